@@ -111,10 +111,10 @@ func chop(inputLineOfText string, closer rune, depth int) (Segment, int, error)
 		return str[start:i]
 	}
 	isHex := func() bool { // is r is a char used in hexadecimal encoding?
-		return runeLength == 1 && HexMap[r] != byte(0xFF)
+		return r < utf8.RuneSelf && HexMap[r] != byte(0xFF)
 	}
 	isB64 := func() bool { // is r is a char used in base64 encoding?
-		return runeLength == 1 && B64DecodeMap[r] != byte(0xFF)
+		return r < utf8.RuneSelf && B64DecodeMap[r] != byte(0xFF)
 	}
 	linktoTail := func(s Segment) {
 		if front == nil {
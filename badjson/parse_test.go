@@ -391,3 +391,24 @@ func tryParseAndUnparse(str string) string {
 	}
 	return result
 }
+
+// FuzzChop is go test -fuzz=FuzzChop ./badjson
+// Chop gets whatever comes in on the text port so it's not allowed to panic.
+func FuzzChop(f *testing.F) {
+	f.Add(`abc "def" ghi`)
+	f.Add(`P sock2channel:bbcc:some_test_hello3`)
+	f.Add(`[P,"% the dest addr","source \"with\" quotes",some_data]`)
+	f.Add(`{"a":[1,2,{"b":'c'}],"d":=AAAA,"e":$414243}`)
+	f.Add(`"unterminated`)
+	f.Fuzz(func(t *testing.T, str string) {
+		segment, err := badjson.Chop(str)
+		if err != nil {
+			return
+		}
+		_ = badjson.ToString(segment)
+		for s := segment; s != nil; s = s.Next() {
+			_ = s.Raw()
+			_ = s.GetQuoted()
+		}
+	})
+}
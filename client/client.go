@@ -0,0 +1,647 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package client is the Go client for the native packet protocol. Instead of everyone
+// writing their own loop around packets.ReadPacket (see monitor_pod/serveThing.go).
+//
+// It sends the Connect with the token and capabilities, pings to keep the contact alive, reconnects with a
+// backoff when the connection breaks and subscribes everything again when it comes back.
+// Subscriptions are a callback or a channel. Call is request/reply and the lookups
+// (like "exists" and "get option") use it. Package rpc is more request/reply on top of this.
+// A big Send goes in fragments and the fragments that come are put back together. See packets/fragment.go
+//
+// Nothing is buffered while disconnected. Publish returns ErrDisconnected and the caller decides.
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/awootton/knotfreeiot/packets"
+)
+
+// Config is how to connect. Only Host and Token are required.
+type Config struct {
+	Host  string // eg. "knotfree.io:8384"
+	Token string
+
+	Timeout    time.Duration // for dialing, subacks and calls without a deadline. Default 5 sec.
+	Keepalive  time.Duration // how often to Ping. The contact expires after 20 min of nothing. Default 5 min.
+	Backoff    time.Duration // the first wait before a reconnect. It doubles to MaxBackoff. Default 1/4 sec.
+	MaxBackoff time.Duration // Default 30 sec.
+	ReplyTopic string        // where the replies to Call come. Default is random.
+
+	Capabilities []string // to ask for. eg. packets.CapSeq. See packets/capabilities.go
+	Compress     string   // packets.CapDeflate or packets.CapZstd to compress what Publish sends. See packets/compress.go
+
+	FragmentSize  int // a bigger Send goes in fragments. Default packets.FragmentSize. See packets/fragment.go
+	MaxReassembly int // bytes of fragments waiting to be put back together. Default packets.MaxMessageSize.
+
+	Debug bool
+}
+
+// Handler gets the publishes to a subscription. It's called from the read loop so a slow
+// one holds up everything. Use a go routine or SubscribeChan.
+type Handler func(p *packets.Send)
+
+// subscription is the handlers of a topic. A "$share/group/filter" is a filter like the others
+// and a pattern gets the publishes that match by their "topic" option.
+type subscription struct {
+	filter   string               // without the $share/group/
+	address  packets.AddressUnion // the hash of the filter
+	handlers []Handler
+}
+
+// Client is a connection to a cluster that stays connected until Close. It's safe for concurrent use.
+type Client struct {
+	config Config
+
+	mux     sync.Mutex
+	conn    net.Conn
+	subs    map[string]*subscription // by the topic as given
+	subacks map[string][]chan bool   // waiting for a suback, by binary address
+	calls   packets.Calls            // the calls waiting for a reply
+	ack     *packets.ConnectAck      // from the last connect
+	closed  bool
+
+	writeMux sync.Mutex
+
+	replyAddress packets.AddressUnion
+	reassembler  packets.Reassembler
+	connects     chan bool  // gets a true after every connect.
+	refused      chan error // gets a *RefusedError when the server says no.
+	done         chan bool
+}
+
+var (
+	// ErrTimeout is when there's no reply in time. The receiver is probably offline.
+	ErrTimeout = errors.New("timed out waiting for reply")
+	// ErrDisconnected is when there's no connection at the moment. It will come back.
+	// For a Call the request may or may not have arrived.
+	ErrDisconnected = errors.New("disconnected")
+	// ErrClosed is after Close.
+	ErrClosed = errors.New("client closed")
+)
+
+// RefusedError is Dial's error when the server refused the connect. Like an expired token.
+type RefusedError struct {
+	Code   packets.ReasonCode
+	Reason string
+}
+
+func (e *RefusedError) Error() string {
+	return "connect refused: " + e.Code.String() + " " + e.Reason
+}
+
+// Dial connects and waits until the Connect and the reply topic subscription are done.
+func Dial(ctx context.Context, config Config) (*Client, error) {
+
+	if config.Timeout <= 0 {
+		config.Timeout = 5 * time.Second
+	}
+	if config.Keepalive <= 0 {
+		config.Keepalive = 5 * 60 * time.Second
+	}
+	if config.Backoff <= 0 {
+		config.Backoff = 250 * time.Millisecond
+	}
+	if config.MaxBackoff <= 0 {
+		config.MaxBackoff = 30 * time.Second
+	}
+	if config.ReplyTopic == "" {
+		config.ReplyTopic = RandomKey()
+	}
+	if config.Compress != "" && !packets.HasCapability(config.Capabilities, config.Compress) {
+		config.Capabilities = append(config.Capabilities, config.Compress)
+	}
+
+	c := &Client{}
+	c.config = config
+	c.subs = make(map[string]*subscription)
+	c.subacks = make(map[string][]chan bool)
+	c.reassembler.MaxBytes = config.MaxReassembly
+	c.replyAddress.FromString(config.ReplyTopic)
+	c.replyAddress.EnsureAddressIsBinary()
+	c.connects = make(chan bool, 1)
+	c.refused = make(chan error, 1)
+	c.done = make(chan bool)
+
+	go c.connectLoop()
+
+	select {
+	case <-c.connects:
+		return c, nil
+	case err := <-c.refused:
+		c.Close()
+		return nil, err
+	case <-ctx.Done():
+		c.Close()
+		return nil, ctx.Err()
+	case <-time.After(config.Timeout):
+		c.Close()
+		return nil, errors.New("timed out connecting to " + config.Host)
+	}
+}
+
+// Config returns the config with the defaults filled in.
+func (c *Client) Config() Config {
+	return c.config
+}
+
+// Capabilities is what the server accepted.
+func (c *Client) Capabilities() []string {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.ack == nil {
+		return nil
+	}
+	caps, _ := c.ack.GetCapabilities()
+	return caps
+}
+
+// Limit is one of the server's limits, like packets.LimitMaxPayload.
+func (c *Client) Limit(name string) (int, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.ack == nil {
+		return 0, false
+	}
+	return c.ack.GetLimit(name)
+}
+
+// Connected is false while it's reconnecting.
+func (c *Client) Connected() bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.conn != nil
+}
+
+// Close sends a Disconnect and stops. The waiting calls get ErrClosed.
+func (c *Client) Close() error {
+	c.mux.Lock()
+	if c.closed {
+		c.mux.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	conn := c.conn
+	c.conn = nil
+	c.mux.Unlock()
+	if conn != nil {
+		c.writePacket(conn, &packets.Disconnect{})
+		conn.Close()
+	}
+	c.calls.FailAll()
+	return nil
+}
+
+// Send writes any packet. A big Send goes in fragments.
+func (c *Client) Send(p packets.Interface) error {
+	c.mux.Lock()
+	closed, conn := c.closed, c.conn
+	c.mux.Unlock()
+	if closed {
+		return ErrClosed
+	}
+	if conn == nil {
+		return ErrDisconnected
+	}
+	send, ok := p.(*packets.Send)
+	if !ok {
+		err := c.writePacket(conn, p)
+		if err != nil {
+			return ErrDisconnected
+		}
+		return nil
+	}
+	for _, frag := range send.Fragment(c.config.FragmentSize) {
+		err := c.writePacket(conn, frag)
+		if err != nil {
+			return ErrDisconnected
+		}
+	}
+	return nil
+}
+
+// Publish sends the payload to the topic. Compressed if the Config says and the server can.
+func (c *Client) Publish(topic string, payload []byte) error {
+	p := &packets.Send{}
+	p.Address.FromString(topic)
+	p.Payload = payload
+	if c.config.Compress != "" && packets.HasCapability(c.Capabilities(), c.config.Compress) {
+		err := p.Compress(c.config.Compress)
+		if err != nil {
+			return err
+		}
+	}
+	return c.Send(p)
+}
+
+// Subscribe calls the handler with every publish to the topic until Unsubscribe.
+// The topic can be a pattern like "home/+/temp" or a "$share/group/topic".
+// It waits for the suback if it's connected. If not it's subscribed when the connection comes back.
+func (c *Client) Subscribe(topic string, handler Handler) error {
+	filter := topic
+	_, shared, ok := packets.SplitSharedName(topic)
+	if ok {
+		filter = shared
+	}
+	address := makeAddress(filter)
+	key := string(address.Bytes)
+
+	suback := make(chan bool, 1)
+	c.mux.Lock()
+	if c.closed {
+		c.mux.Unlock()
+		return ErrClosed
+	}
+	sub, ok := c.subs[topic]
+	if !ok {
+		sub = &subscription{filter: filter, address: address}
+		c.subs[topic] = sub
+	}
+	sub.handlers = append(sub.handlers, handler)
+	conn := c.conn
+	if conn != nil {
+		c.subacks[key] = append(c.subacks[key], suback)
+	}
+	c.mux.Unlock()
+	if conn == nil {
+		return nil
+	}
+
+	err := c.writePacket(conn, subscribeTo(topic))
+	if err != nil {
+		return nil // the reconnect will do it
+	}
+	select {
+	case <-suback:
+		return nil
+	case <-c.done:
+		return ErrClosed
+	case <-time.After(c.config.Timeout):
+		return errors.New("timed out waiting for suback of " + topic)
+	}
+}
+
+// SubscribeChan is Subscribe with a channel. When the channel is full the new ones are dropped.
+func (c *Client) SubscribeChan(topic string, size int) (<-chan *packets.Send, error) {
+	ch := make(chan *packets.Send, size)
+	err := c.Subscribe(topic, func(p *packets.Send) {
+		select {
+		case ch <- p:
+		default:
+			fmt.Println("client subscription channel full", topic)
+		}
+	})
+	return ch, err
+}
+
+// Unsubscribe forgets all the handlers of the topic.
+func (c *Client) Unsubscribe(topic string) error {
+	c.mux.Lock()
+	delete(c.subs, topic)
+	c.mux.Unlock()
+	unsub := &packets.Unsubscribe{}
+	unsub.Address.FromString(topic)
+	return c.Send(unsub)
+}
+
+// Call sends msg, a *packets.Send or a *packets.Lookup, and waits for the reply.
+// The Source and the "sessionKey" and "CorrelationData" options of msg are overwritten.
+// The cluster's replies copy the "sessionKey" and mqtt 5 devices copy the CorrelationData.
+func (c *Client) Call(ctx context.Context, msg packets.Interface) (packets.Interface, error) {
+
+	switch msg.(type) {
+	case *packets.Send, *packets.Lookup:
+	default:
+		return nil, fmt.Errorf("can't call with a %T", msg)
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.config.Timeout)
+		defer cancel()
+	}
+
+	replies := make(chan packets.Interface, 1)
+	key, err := c.calls.Add(msg, c.config.ReplyTopic, replies)
+	if err != nil {
+		return nil, err
+	}
+	defer c.calls.Remove(key)
+
+	err = c.Send(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case reply, ok := <-replies:
+		if !ok {
+			if c.isClosed() {
+				return nil, ErrClosed
+			}
+			return nil, ErrDisconnected
+		}
+		return reply, nil
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, ErrTimeout
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// Lookup runs a lookup command, like "exists" or "get option A", on the name and returns the answer.
+func (c *Client) Lookup(ctx context.Context, name string, command string) (string, error) {
+	lookup := &packets.Lookup{}
+	lookup.Address.FromString(name)
+	lookup.SetOption("cmd", []byte(command))
+	reply, err := c.Call(ctx, lookup)
+	if err != nil {
+		return "", err
+	}
+	send, ok := reply.(*packets.Send)
+	if !ok {
+		return "", fmt.Errorf("got a %T for a lookup reply", reply)
+	}
+	answer := string(send.Payload)
+	if strings.HasPrefix(answer, "error") {
+		return "", errors.New(answer)
+	}
+	return answer, nil
+}
+
+// Exists says if the name is reserved and if something is subscribed to it.
+func (c *Client) Exists(ctx context.Context, name string) (exists bool, online bool, err error) {
+	answer, err := c.Lookup(ctx, name, "exists")
+	if err != nil {
+		return false, false, err
+	}
+	got := struct {
+		Exists bool
+		Online bool
+	}{}
+	err = json.Unmarshal([]byte(answer), &got)
+	return got.Exists, got.Online, err
+}
+
+// GetOption gets an option of a name. eg. "A"
+func (c *Client) GetOption(ctx context.Context, name string, key string) (string, error) {
+	return c.Lookup(ctx, name, "get option "+key)
+}
+
+func (c *Client) connectLoop() {
+
+	backoff := c.config.Backoff
+	for {
+		select {
+		case <-c.done:
+			return
+		default:
+		}
+		conn, err := net.DialTimeout("tcp", c.config.Host, c.config.Timeout)
+		if err == nil {
+			if c.serveConnection(conn) {
+				backoff = c.config.Backoff
+				continue // right away
+			}
+		} else if c.config.Debug {
+			fmt.Println("client dial failed", err)
+		}
+		select {
+		case <-c.done:
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > c.config.MaxBackoff {
+			backoff = c.config.MaxBackoff
+		}
+	}
+}
+
+// serveConnection is one connection from the Connect until it breaks.
+// Returns true if it got as far as the reply topic suback.
+func (c *Client) serveConnection(conn net.Conn) bool {
+
+	defer func() {
+		c.mux.Lock()
+		if c.conn == conn {
+			c.conn = nil
+		}
+		c.mux.Unlock()
+		conn.Close()
+		c.calls.FailAll()
+	}()
+
+	connect := &packets.Connect{}
+	packets.OptToken.Set(connect, c.config.Token)
+	connect.SetCapabilities(c.config.Capabilities...)
+	err := c.writePacket(conn, connect)
+	if err != nil {
+		return false
+	}
+	sub := &packets.Subscribe{}
+	sub.Address = c.replyAddress
+	err = c.writePacket(conn, sub)
+	if err != nil {
+		return false
+	}
+
+	broken := make(chan bool)
+	defer close(broken)
+	go func() { // the keep alive
+		for {
+			select {
+			case <-broken:
+				return
+			case <-c.done:
+				conn.Close()
+				return
+			case <-time.After(c.keepalive()):
+			}
+			c.writePacket(conn, &packets.Ping{})
+		}
+	}()
+
+	connected := false
+	for {
+		conn.SetReadDeadline(time.Now().Add(c.keepalive() * 3))
+		p, err := packets.ReadPacket(conn)
+		if err != nil {
+			if c.config.Debug {
+				fmt.Println("client read failed", err)
+			}
+			return connected
+		}
+		if c.config.Debug {
+			fmt.Println("client got", p.Sig())
+		}
+		switch v := p.(type) {
+		case *packets.Subscribe:
+			v.Address.EnsureAddressIsBinary()
+			key := string(v.Address.Bytes)
+			if !connected && key == string(c.replyAddress.Bytes) {
+				connected = true
+				if !c.connected(conn) {
+					return true
+				}
+				continue
+			}
+			c.mux.Lock()
+			waiting := c.subacks[key]
+			delete(c.subacks, key)
+			c.mux.Unlock()
+			for _, suback := range waiting {
+				suback <- true
+			}
+		case *packets.ConnectAck:
+			code, reason := v.GetReason()
+			if code != packets.ReasonSuccess {
+				select {
+				case c.refused <- &RefusedError{Code: code, Reason: reason}:
+				default:
+				}
+				return false
+			}
+			c.mux.Lock()
+			c.ack = v
+			c.mux.Unlock()
+		case *packets.Disconnect:
+			got, _ := packets.OptError.Get(v)
+			fmt.Println("client disconnected by server", string(got))
+			return connected
+		case *packets.Send:
+			v, err := c.reassembler.Add(v, time.Now())
+			if err != nil {
+				fmt.Println("client can't reassemble", err)
+				continue
+			}
+			if v == nil {
+				continue // there's more fragments coming
+			}
+			err = v.Decompress() // the handlers get plain payloads
+			if err != nil {
+				fmt.Println("client can't decompress", err)
+				continue
+			}
+			v.Address.EnsureAddressIsBinary()
+			if string(v.Address.Bytes) == string(c.replyAddress.Bytes) {
+				c.calls.Reply(v)
+				continue
+			}
+			for _, handler := range c.handlersOf(v) {
+				handler(v)
+			}
+		}
+	}
+}
+
+// connected makes conn the one to use and subscribes everything again.
+func (c *Client) connected(conn net.Conn) bool {
+	c.mux.Lock()
+	if c.closed {
+		c.mux.Unlock()
+		return false
+	}
+	c.conn = conn
+	topics := make([]string, 0, len(c.subs))
+	for topic := range c.subs {
+		topics = append(topics, topic)
+	}
+	c.mux.Unlock()
+	for _, topic := range topics {
+		c.writePacket(conn, subscribeTo(topic))
+	}
+	select {
+	case c.connects <- true:
+	default:
+	}
+	return true
+}
+
+// keepalive is the config's or half the server's, whichever is sooner.
+func (c *Client) keepalive() time.Duration {
+	keepalive := c.config.Keepalive
+	seconds, ok := c.Limit(packets.LimitKeepalive)
+	if ok && seconds > 0 {
+		server := time.Duration(seconds) * time.Second / 2
+		if server < keepalive {
+			keepalive = server
+		}
+	}
+	return keepalive
+}
+
+func (c *Client) isClosed() bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.closed
+}
+
+func (c *Client) writePacket(conn net.Conn, p packets.Interface) error {
+	c.writeMux.Lock()
+	defer c.writeMux.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(c.config.Timeout))
+	return p.Write(conn)
+}
+
+func makeAddress(topic string) packets.AddressUnion {
+	address := packets.AddressUnion{}
+	address.FromString(topic)
+	address.EnsureAddressIsBinary()
+	return address
+}
+
+// subscribeTo is a subscribe with the utf8 name so the server can see a pattern or a $share.
+func subscribeTo(topic string) *packets.Subscribe {
+	sub := &packets.Subscribe{}
+	sub.Address.FromString(topic) // not hashed
+	return sub
+}
+
+// handlersOf is the handlers of the subscriptions that p is for. By the address or, for a pattern,
+// by the "topic" option.
+func (c *Client) handlersOf(p *packets.Send) []Handler {
+	topic, hasTopic := p.GetOption("topic")
+	var handlers []Handler
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for _, sub := range c.subs {
+		if string(sub.address.Bytes) == string(p.Address.Bytes) ||
+			(hasTopic && packets.IsWildcardTopic([]byte(sub.filter)) && packets.MatchTopic(sub.filter, string(topic))) {
+			handlers = append(handlers, sub.handlers...)
+		}
+	}
+	return handlers
+}
+
+// RandomKey is for reply topics and session keys.
+func RandomKey() string {
+	var tmp [18]byte
+	rand.Read(tmp[:])
+	return base64.RawURLEncoding.EncodeToString(tmp[:])
+}
@@ -0,0 +1,277 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/awootton/knotfreeiot/client"
+	"github.com/awootton/knotfreeiot/iot"
+	"github.com/awootton/knotfreeiot/packets"
+	"github.com/awootton/knotfreeiot/tokens"
+)
+
+const starttime = uint32(1577840400) // Wednesday, January 1, 2020 1:00:00 AM
+
+func TestClient(t *testing.T) {
+
+	tokens.LoadPublicKeys()
+	getTime := func() uint32 {
+		return starttime
+	}
+	iot.MakeSimplestCluster(getTime, true, 1, "")
+	token, _ := tokens.GetImpromptuGiantTokenLocal("", "")
+	proxy := startProxy(t, "localhost:8384")
+	config := client.Config{Host: proxy.Addr().String(), Token: token, Timeout: 2 * time.Second}
+	config.Capabilities = []string{packets.CapSeq, "teleport"}
+
+	ctx := context.Background()
+	listener, err := client.Dial(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	talker, err := client.Dial(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer talker.Close()
+
+	caps := listener.Capabilities()
+	if len(caps) != 1 || caps[0] != packets.CapSeq {
+		t.Errorf("got %v, want seq", caps)
+	}
+	keepalive, _ := listener.Limit(packets.LimitKeepalive)
+	if keepalive != 20*60 {
+		t.Errorf("got %v, want 20 min", keepalive)
+	}
+
+	news, err := listener.SubscribeChan("client-news", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mux sync.Mutex
+	weather := []string{}
+	err = listener.Subscribe("client-weather", func(p *packets.Send) {
+		mux.Lock()
+		weather = append(weather, string(p.Payload))
+		mux.Unlock()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	talker.Publish("client-news", []byte("extra"))
+	talker.Publish("client-weather", []byte("rain"))
+	expectNews(t, news, "extra")
+	listener.Unsubscribe("client-weather")
+	time.Sleep(50 * time.Millisecond)
+	talker.Publish("client-weather", []byte("snow"))
+	time.Sleep(50 * time.Millisecond)
+	mux.Lock()
+	if len(weather) != 1 || weather[0] != "rain" {
+		t.Errorf("got %v, want just rain", weather)
+	}
+	mux.Unlock()
+
+	// a pattern and a shared subscription
+	temps, err := listener.SubscribeChan("client/+/temp", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := listener.SubscribeChan("$share/workers/client-jobs", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	talker.Publish("client/kitchen/temp", []byte("72"))
+	talker.Publish("client-jobs", []byte("job 1"))
+	expectNews(t, temps, "72")
+	expectNews(t, jobs, "job 1")
+	listener.Unsubscribe("client/+/temp")
+	time.Sleep(50 * time.Millisecond)
+	talker.Publish("client/kitchen/temp", []byte("73"))
+	time.Sleep(50 * time.Millisecond)
+	if len(temps) != 0 {
+		t.Errorf("got %v, want nothing after the unsubscribe", len(temps))
+	}
+
+	// a compressing talker. The listener didn't ask so the aide decompresses it.
+	squeezed := config
+	squeezed.Compress = packets.CapZstd
+	squeezer, err := client.Dial(ctx, squeezed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer squeezer.Close()
+	squeezer.Publish("client-news", []byte(strings.Repeat("all the news ", 20)))
+	expectNews(t, news, strings.Repeat("all the news ", 20))
+
+	// too big for one packet. It goes in fragments and comes back together.
+	big := strings.Repeat("0123456789", packets.FragmentSize/4)
+	talker.Publish("client-news", []byte(big))
+	select {
+	case p := <-news:
+		if string(p.Payload) != big {
+			t.Errorf("got %v bytes, want %v", len(p.Payload), len(big))
+		}
+	case <-time.After(10 * time.Second): // the sockets have small buffers
+		t.Error("got nothing, want the big one")
+	}
+
+	// a 100KB one that isn't in fragments, like from an old client. The listener still reads it.
+	unsplit := config
+	unsplit.FragmentSize = 1024 * 1024
+	oldie, err := client.Dial(ctx, unsplit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer oldie.Close()
+	big = strings.Repeat("abcdefghij", 10*1024)
+	oldie.Publish("client-news", []byte(big))
+	select {
+	case p := <-news:
+		if string(p.Payload) != big {
+			t.Errorf("got %v bytes, want %v", len(p.Payload), len(big))
+		}
+	case <-time.After(10 * time.Second):
+		t.Error("got nothing, want the 100KB one")
+	}
+	if !listener.Connected() {
+		t.Error("the listener should still be connected")
+	}
+
+	// the lookups
+	exists, online, err := talker.Exists(ctx, "client-news")
+	if err != nil || !exists || !online {
+		t.Errorf("got %v %v %v, want exists and online", exists, online, err)
+	}
+	got, err := talker.GetOption(ctx, "client-news", "A")
+	if err != nil || got != "216.128.128.195" {
+		t.Errorf("got %v %v, want the default A", got, err)
+	}
+	got, err = talker.Lookup(ctx, "client-news", "get time")
+	if _, perr := strconv.Atoi(got); err != nil || perr != nil {
+		t.Errorf("got %v %v, want a time", got, err)
+	}
+
+	// a bad token is refused right away
+	bad := config
+	bad.Token = "not a token"
+	_, err = client.Dial(ctx, bad)
+	refused, ok := err.(*client.RefusedError)
+	if !ok || refused.Code != packets.ReasonBadToken {
+		t.Errorf("got %v, want refused with bad token", err)
+	}
+
+	// break the connections. They come back and resubscribe.
+	proxy.breakAll()
+	for i := 0; i < 40; i++ {
+		err = talker.Publish("client-news", []byte("again"))
+		if err == nil && listener.Connected() {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal("didn't reconnect", err)
+	}
+	time.Sleep(100 * time.Millisecond) // for the resubscribe
+	talker.Publish("client-news", []byte("after"))
+	for i := 0; i < 2; i++ {
+		select {
+		case p := <-news:
+			if string(p.Payload) == "after" {
+				return
+			}
+		case <-time.After(time.Second):
+		}
+	}
+	t.Error("no news after the reconnect")
+}
+
+func TestClientBackoff(t *testing.T) {
+	config := client.Config{Host: "localhost:1", Token: "x", Timeout: 500 * time.Millisecond}
+	start := time.Now()
+	_, err := client.Dial(context.Background(), config)
+	if err == nil {
+		t.Error("got a connection to nowhere")
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Error("took too long", time.Since(start))
+	}
+}
+
+func expectNews(t *testing.T, news <-chan *packets.Send, want string) {
+	t.Helper()
+	select {
+	case p := <-news:
+		if string(p.Payload) != want {
+			t.Errorf("got %v, want %v", string(p.Payload), want)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("got nothing, want %v", want)
+	}
+}
+
+type proxy struct {
+	net.Listener
+	mux   sync.Mutex
+	conns []net.Conn
+}
+
+// startProxy forwards to the host so we can break the connections.
+func startProxy(t *testing.T, host string) *proxy {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	px := &proxy{Listener: listener}
+	go func() {
+		for {
+			down, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			up, err := net.Dial("tcp", host)
+			if err != nil {
+				down.Close()
+				continue
+			}
+			px.mux.Lock()
+			px.conns = append(px.conns, down, up)
+			px.mux.Unlock()
+			go io.Copy(up, down)
+			go io.Copy(down, up)
+		}
+	}()
+	return px
+}
+
+func (px *proxy) breakAll() {
+	px.mux.Lock()
+	defer px.mux.Unlock()
+	for _, conn := range px.conns {
+		conn.Close()
+	}
+	px.conns = nil
+}
@@ -163,8 +163,11 @@ func (cc *tcpContact) WriteDownstream(packet packets.Interface) error {
 	if cc.IsClosed() {
 		return errors.New("tcpContact closed and can't writeDownstream")
 	}
-	got, ok := packet.GetOption("debg")
-	if ok && string(got) == "12345678" {
+	if !cc.config.IsGuru() { // the guru's contacts are aides and they need them.
+		packet = packets.StripInternal(packet) // see packets/options.go
+	}
+	got, ok := packets.OptDebug.Get(packet)
+	if ok && got == "12345678" {
 		fmt.Println("tcpContact WriteDownstream con=", cc.GetKey().Sig(), packet.Sig())
 	}
 	// var goterr error
@@ -294,11 +297,12 @@ func handleConnection(tcpConn *net.TCPConn, ex *Executive) {
 
 		// fmt.Println("KF native contact waiting for packet con=", cc.GetKey().Sig(), ex.Name)
 
-		p, err := packets.ReadPacket(cc)
+		p, err := packets.ServerDecoder.ReadPacket(cc)
 		if err != nil {
 			//connLogThing.Collect("se err " + err.Error())
 			fmt.Println("KF native contact read err", cc.key.Sig(), err, tcpConn.RemoteAddr(), ex.isGuru)
 			TCPServerPacketReadError.Inc()
+			disconnectDecodeError(cc, err)
 			cc.DoClose(err)
 			return
 		}
@@ -82,7 +82,7 @@ func (ex *Executive) DialContactToAnyAide(isTCP bool, ce *ClusterExecutive) {
 				contact.realWriter = &DevNull{} // we don't subscribe or care what they say
 
 				connect := packets.Connect{}
-				connect.SetOption("token", []byte(token)) //SampleSmallToken))
+				packets.OptToken.Set(&connect, token) //SampleSmallToken))
 				err := PushPacketUpFromBottom(contact, &connect)
 				if err != nil {
 					fmt.Println("connect problems test dial conn ", err)
@@ -91,7 +91,7 @@ func (ex *Executive) DialContactToAnyAide(isTCP bool, ce *ClusterExecutive) {
 
 				for p := range ex.channelToAnyAide {
 					// fmt.Println(" got channelToAnyAide aide ", p)
-					err := PushPacketUpFromBottom(contact, p)
+					err := pushServerPacketUp(contact, p) // it's from a guru. It can have the stats.
 					if err != nil {
 						fmt.Println("err PushPacketUpFromBottom ", err)
 					}
@@ -195,7 +195,7 @@ func (ex *Executive) dialAideAndServe() {
 			conn.(*net.TCPConn).SetWriteBuffer(4096)
 
 			connect := &packets.Connect{}
-			connect.SetOption("token", []byte(tokens.GetImpromptuGiantToken()))
+			packets.OptToken.Set(connect, tokens.GetImpromptuGiantToken())
 			connect.SetOption("comment", []byte("dialAideAndServe"+ex.Name))
 			err = connect.Write(conn)
 			if err != nil {
@@ -286,7 +286,7 @@ func (ex *Executive) dialAideAndServe() {
 					fmt.Println("ERROR dialAideAndServe packets.ReadPacket no conn ")
 					break
 				}
-				p, err := packets.ReadPacket(conn)
+				p, err := packets.ServerDecoder.ReadPacket(conn)
 				if err != nil {
 					// if err.Error() == "EOF" { // this is what i'm seeing.
 					// }
@@ -0,0 +1,139 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package iot
+
+import (
+	"github.com/awootton/knotfreeiot/packets"
+)
+
+// Capability negotiation. A Connect with a "version" or "caps" gets a ConnectAck with the
+// caps we have out of the ones it asked for, our limits and the token's limits. The contact remembers the caps.
+// A Connect without them is an old client. It gets nothing back, like always.
+//
+// The caps aren't just advice. A contact that asked gets only what was accepted:
+// no "seq" without CapSeq (see seq.go), no "retain" or retained replays without CapRetain,
+// no "since" or history replays without CapHistory and no "expires" without CapExpiry.
+// The publishes still expire, it just doesn't get to say or see when. An old client gets what it always got.
+// A failed connect gets a ConnectAck with a reason code. See makeErrorAndDisconnect.
+// See packets/capabilities.go and packets/reasons.go
+
+// serverCapabilities is what we can do.
+var serverCapabilities = []string{
+	packets.CapSeq,
+	packets.CapExpiry,
+	packets.CapHistory,
+	packets.CapRetain,
+	packets.CapDeflate,
+	packets.CapZstd,
+}
+
+// contactTimeout is how long a contact lives without a packet. In seconds.
+const contactTimeout = 20 * 60
+
+// acceptCapabilities remembers the caps and returns the ConnectAck. nil for an old client.
+func acceptCapabilities(ss *ContactStruct, ssi ContactInterface, connect *packets.Connect) *packets.ConnectAck {
+
+	offered, ok := connect.GetCapabilities()
+	if !ok {
+		return nil
+	}
+	accepted := packets.Negotiate(offered, serverCapabilities)
+	ss.caps.Store(&accepted)
+
+	ack := &packets.ConnectAck{}
+	ack.SetCapabilities(accepted...)
+	ack.SetReason(packets.ReasonSuccess, "")
+	ack.SetLimit(packets.LimitMaxPayload, packets.MaxPayload)
+	ack.SetLimit(packets.LimitKeepalive, contactTimeout)
+	token := ssi.GetToken()
+	if token != nil {
+		stats := token.KnotFreeContactStats
+		ack.SetLimitFloat(packets.LimitInput, stats.Input)
+		ack.SetLimitFloat(packets.LimitOutput, stats.Output)
+		ack.SetLimitFloat(packets.LimitSubscriptions, stats.Subscriptions-1) // one is ours. See expectToken
+		ack.SetLimitFloat(packets.LimitConnections, stats.Connections)
+	}
+	return ack
+}
+
+// HasCapability is true if the Connect asked for it and we have it.
+func (ss *ContactStruct) HasCapability(name string) bool {
+	caps := ss.caps.Load()
+	if caps == nil {
+		return false
+	}
+	return packets.HasCapability(*caps, name)
+}
+
+// Allows is true if the Connect asked for it and we have it, or if it's an old client that
+// didn't ask for anything. For the things that were there before the caps, like retain.
+func (ss *ContactStruct) Allows(name string) bool {
+	caps := ss.caps.Load()
+	if caps == nil {
+		return true
+	}
+	return packets.HasCapability(*caps, name)
+}
+
+// gateCapabilities is at the aide for a packet from a client. Whatever it didn't ask for is gone.
+func gateCapabilities(ssi ContactInterface, p packets.Interface) {
+	switch v := p.(type) {
+	case *packets.Send:
+		if !ssi.Allows(packets.CapRetain) {
+			v.DeleteOption("retain")
+		}
+		if !ssi.Allows(packets.CapExpiry) {
+			v.DeleteOption("expires")
+		}
+	case *packets.Subscribe:
+		if !ssi.Allows(packets.CapHistory) {
+			v.DeleteOption("since")
+		}
+	}
+}
+
+// capableOf is false for a replay that ci didn't ask for. At the aide on the way down.
+func capableOf(ci ContactInterface, p packets.Interface) bool {
+	send, ok := p.(*packets.Send)
+	if !ok || ci.GetConfig().IsGuru() {
+		return true
+	}
+	retain, _ := send.GetOption("retain")
+	if string(retain) == "replay" && !ci.Allows(packets.CapRetain) {
+		return false
+	}
+	_, isHistory := send.GetOption("history")
+	return !isHistory || ci.Allows(packets.CapHistory)
+}
+
+// withoutExpiry is a copy without the "expires" for a contact that didn't ask for CapExpiry.
+// It's already checked. See outqueue.go
+func withoutExpiry(ci ContactInterface, p packets.Interface) packets.Interface {
+	send, ok := p.(*packets.Send)
+	if !ok || ci.GetConfig().IsGuru() || ci.Allows(packets.CapExpiry) {
+		return p
+	}
+	if _, has := send.GetOption("expires"); !has {
+		return p
+	}
+	cp := &packets.Send{}
+	cp.Address = send.Address
+	cp.Source = send.Source
+	cp.Payload = send.Payload
+	cp.CopyOptions(&send.PacketCommon)
+	cp.DeleteOption("expires")
+	return cp
+}
@@ -0,0 +1,77 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package iot
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/awootton/knotfreeiot/packets"
+)
+
+// Compressed payloads. A Send with an "enc" goes up and across untouched. The aide decompresses
+// it on the way down only for a contact that didn't ask for that compression at Connect,
+// like the mqtt and text contacts and the old clients. The gurus never do, their contacts are aides.
+// The aide checks the "enc" of a client's publish first so a bad one goes nowhere, not just
+// to the contacts that can't take it. See pushPacketUp in contacts.go
+//
+// A fragment is a piece of the compressed payload. For a contact that can't take the compression
+// the aide puts the fragments back together first and the contact gets the whole thing decompressed.
+// See packets/compress.go and packets/fragment.go
+
+// forContact is the packet as ci can take it. A copy if the payload had to be decompressed.
+// nil if it can't be decompressed, or if it's a fragment and the rest of them haven't come yet.
+func forContact(ci ContactInterface, p packets.Interface) packets.Interface {
+	send, ok := p.(*packets.Send)
+	if !ok {
+		return p
+	}
+	enc := send.GetEncoding()
+	if enc == "" || ci.GetConfig().IsGuru() || ci.HasCapability(enc) {
+		return p
+	}
+	if send.IsFragment() {
+		unfrag := &ci.getOutQueue().unfrag
+		if unfrag.MaxBytes == 0 {
+			unfrag.MaxBytes = packets.MaxPacketSize // it's compressed
+		}
+		whole, err := unfrag.Add(send, time.Unix(int64(ci.GetConfig().getTime()), 0))
+		if err != nil {
+			fmt.Println("dropping fragment", enc, err)
+			return nil
+		}
+		if whole == nil {
+			return nil // there's more coming
+		}
+		err = whole.Decompress()
+		if err != nil {
+			fmt.Println("dropping publish with bad payload", enc, err)
+			return nil
+		}
+		return whole
+	}
+	cp := &packets.Send{}
+	cp.Address = send.Address
+	cp.Source = send.Source
+	cp.Payload = send.Payload
+	cp.CopyOptions(&send.PacketCommon)
+	err := cp.Decompress()
+	if err != nil {
+		fmt.Println("dropping publish with bad payload", enc, err)
+		return nil
+	}
+	return cp
+}
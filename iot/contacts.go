@@ -18,12 +18,12 @@ package iot
 
 import (
 	"container/list"
-	"encoding/json"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
 	"reflect"
-	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 
@@ -66,6 +66,10 @@ type ContactStruct struct {
 	realReader io.Reader // usually tcpConn
 	realWriter io.Writer // usually tcpConn
 
+	will atomic.Pointer[packets.Send] // published if we close without a Disconnect. See will.go
+	caps atomic.Pointer[[]string]     // what the Connect asked for that we have. See capabilities.go
+	outq outQueue                     // what the buckets have for WriteDownstream. See outqueue.go
+
 	LogMeVerbose bool // this just a debug thing.
 }
 
@@ -91,6 +95,10 @@ type ContactInterface interface {
 	GetConfig() *ContactStructConfig
 
 	WriteDownstream(cmd packets.Interface) error
+	getOutQueue() *outQueue // see outqueue.go
+
+	HasCapability(name string) bool // see capabilities.go
+	Allows(name string) bool
 
 	WriteUpstream(cmd packets.Interface) error // called by LookupTableStruct.PushUp
 
@@ -136,6 +144,13 @@ type ContactStructConfig struct {
 	defaultTimeoutSeconds uint32 // in seconds
 
 	ce *ClusterExecutive // optional
+
+	OutQueueMax    int            // for each contact. Zero is the default. See outqueue.go
+	OutQueuePolicy OutQueuePolicy // when it's full
+
+	MaxContacts int // more than this and a connect gets packets.ReasonServerFull. Zero is no limit.
+
+	parked sync.Map // the mqtt sessions parked here by their key. See mqtt-session.go
 }
 
 // AccessContactsList so we can disconnect them in test and stuff.
@@ -201,7 +216,7 @@ func AddContactStruct(ss *ContactStruct, ssi ContactInterface, config *ContactSt
 	})
 
 	now := config.GetLookup().getTime()
-	ss.contactExpires = 20*60 + now // stale contacts expire in 20 min. contact timeout
+	ss.contactExpires = contactTimeout + now // stale contacts expire in 20 min. contact timeout
 	// fmt.Println("contactExpires 20 min")
 
 	ss.nextBillingTime = now + 30 // 30 seconds to start with
@@ -262,11 +277,21 @@ func PushPacketUpFromBottom(ssi ContactInterface, p packets.Interface) error {
 // it expects a token before anything else.
 // the packets are sent up to the looker where they are separated into buckets and dealt with.
 func PushPacketUpFromBottom2(ssi ContactInterface, p packets.Interface, doSetExpires bool) error {
+	return pushUpFromBottom(ssi, p, doSetExpires, false)
+}
+
+// pushServerPacketUp is for the packets the contact makes itself. The billing subscribe and the stats.
+// They keep the options that a client can't send. See stripServerOptions
+func pushServerPacketUp(ssi ContactInterface, p packets.Interface) error {
+	return pushUpFromBottom(ssi, p, false, true)
+}
+
+func pushUpFromBottom(ssi ContactInterface, p packets.Interface, doSetExpires bool, trusted bool) error {
 
 	var err error
 	var wg sync.WaitGroup
 	var config *ContactStructConfig
-	var looker *LookupTableStruct
+	var ack *packets.ConnectAck
 	wg.Add(1)
 	ssi.WriteCommand(ContactCommander{
 		who: "PushPacketUpFromBottom2",
@@ -282,18 +307,24 @@ func PushPacketUpFromBottom2(ssi ContactInterface, p packets.Interface, doSetExp
 				fmt.Println("no way there's no config")
 				return
 			}
-			looker = config.GetLookup()
 
 			if doSetExpires {
-				ssi.SetExpires(20*60 + config.lookup.getTime())
+				ssi.SetExpires(contactTimeout + config.lookup.getTime())
 			}
 
 			err := expectToken(ssi, p)
 			if err != nil {
 				return
 			}
-			got, ok := p.GetOption("debg")
-			if ok && string(got) == "12345678" {
+			switch v := p.(type) {
+			case *packets.Connect:
+				ss.will.Store(willFromConnect(v))
+				ack = acceptCapabilities(ss, ssi, v)
+			case *packets.Disconnect:
+				ss.will.Store(nil) // a nice goodbye. No will.
+			}
+			got, ok := packets.OptDebug.Get(p)
+			if ok && got == "12345678" {
 				fmt.Println("Contact PushPacketUpFromBottom con=", ssi.GetConfig().key.Sig(), " ", p.Sig())
 			}
 		},
@@ -308,33 +339,91 @@ func PushPacketUpFromBottom2(ssi ContactInterface, p packets.Interface, doSetExp
 	switch v := p.(type) {
 	case *packets.Connect:
 		// handled the first time by expectToken(ssi, p)
+		if ack != nil {
+			ssi.WriteDownstream(ack)
+		}
 	case *packets.Disconnect:
 		ssi.WriteDownstream(v)
 		fmt.Println("contact closing on disconnect")
 		ssi.DoClose(errors.New("closing on disconnect"))
+	default:
+		return pushPacketUp(ssi, config, p, trusted)
+	}
+	return nil
+}
+
+// pushPacketUp is the rest of PushPacketUpFromBottom2 after the token and the connect.
+// The will comes here too after the contact is closed. See will.go
+func pushPacketUp(ssi ContactInterface, config *ContactStructConfig, p packets.Interface, trusted bool) error {
+
+	looker := config.GetLookup()
+	if !config.IsGuru() && refuseServerOnly(p) {
+		fmt.Println("a client can't use", serverOnlyPrefix, p.Sig())
+		return nil
+	}
+	if !config.IsGuru() && !trusted {
+		stripServerOptions(p)
+		gateCapabilities(ssi, p) // see capabilities.go
+	}
+
+	switch v := p.(type) {
 	case *packets.Subscribe:
+		parseSharedName(&v.PacketCommon, &v.Address)
+		setTopicOption(&v.PacketCommon, &v.Address, config.IsGuru())
+		if !config.IsGuru() && !presenceAddress(ssi, config, &v.PacketCommon, &v.Address) {
+			return nil // see presence.go
+		}
 		v.Address.EnsureAddressIsBinary()
 
 		// every sub gets a jwtid except for the stats subs
-		_, ok := v.GetOption("statsmax")
+		ok := packets.OptStatsMax.Has(v) // only if it's ours. See pushServerPacketUp
 		if !ok && !config.IsGuru() {
 			// it's a non-billing topic.
 			// later, during heartbeat, it will send messages to this address
 			tok := ssi.GetToken()
 			if tok != nil {
 				id := tok.JWTID
-				v.SetOption("jwtid", []byte(id))
+				packets.OptJWTID.Set(v, id)
 			}
+			setPubkOption(ssi, &v.PacketCommon) // see users.go
+		}
+		if !config.IsGuru() {
+			clampTTL(ssi, &v.PacketCommon, looker.getTime()) // see ttl.go
+			stripSeqOptions(&v.PacketCommon)                 // see seq.go
 		}
 		looker.sendSubscriptionMessage(ssi, v)
 	case *packets.Unsubscribe:
+		parseSharedName(&v.PacketCommon, &v.Address)
+		setTopicOption(&v.PacketCommon, &v.Address, config.IsGuru())
+		if !config.IsGuru() && !presenceAddress(ssi, config, &v.PacketCommon, &v.Address) {
+			return nil
+		}
 		v.Address.EnsureAddressIsBinary()
 		looker.sendUnsubscribeMessage(ssi, v)
 	case *packets.Lookup:
 		v.Address.EnsureAddressIsBinary()
 		looker.sendLookupMessage(ssi, v)
 	case *packets.Send:
+		if dropExpired(v, looker.getTime()) {
+			return nil // see expiry.go
+		}
+		if !config.IsGuru() && isPresencePublish(v) {
+			fmt.Println("a client can't publish presence", v.Sig())
+			return nil // see presence.go
+		}
+		if !config.IsGuru() {
+			err := v.CheckEncoding()
+			if err != nil {
+				fmt.Println("dropping publish with bad enc", v.GetEncoding(), err)
+				return nil // see compress.go
+			}
+		}
+		setTopicOption(&v.PacketCommon, &v.Address, config.IsGuru())
 		v.Address.EnsureAddressIsBinary()
+		if !config.IsGuru() {
+			clampTTL(ssi, &v.PacketCommon, looker.getTime()) // see ttl.go
+			stripSeqOptions(&v.PacketCommon)
+		}
 		looker.sendPublishMessage(ssi, v)
 	case *packets.Ping:
 		ssi.WriteDownstream(v)
@@ -352,8 +441,8 @@ func PushPacketUpFromBottom2(ssi ContactInterface, p packets.Interface, doSetExp
 // the dialGuru gadget calls this when it gets a packet from the guru.
 func PushDownFromTop(looker *LookupTableStruct, p packets.Interface) error {
 
-	got, ok := p.GetOption("debg")
-	if ok && string(got) == "12345678" {
+	got, ok := packets.OptDebug.Get(p)
+	if ok && got == "12345678" {
 		fmt.Println("PushDownFromTop ", p.Sig())
 	}
 
@@ -401,8 +490,8 @@ func (ss *ContactStruct) WriteDownstream(p packets.Interface) error {
 	if ss.IsClosed() {
 		return errors.New("closed contact")
 	}
-	got, ok := p.GetOption("debg")
-	if ok && string(got) == "12345678" {
+	got, ok := packets.OptDebug.Get(p)
+	if ok && got == "12345678" {
 		fmt.Println("ContactStruct WriteDownstream con=", ss.GetKey().Sig(), p.Sig())
 	}
 
@@ -414,6 +503,18 @@ func (ss *ContactStruct) WriteDownstream(p packets.Interface) error {
 	return nil
 }
 
+// writeInOrder is the WriteDownstream of a plain ContactStruct for the one draining the
+// outbound queue. It waits so the next one is after it. See outqueue.go
+func (ss *ContactStruct) writeInOrder(p packets.Interface) {
+	if ss.IsClosed() {
+		return
+	}
+	err := p.Write(ss)
+	if err != nil {
+		fmt.Println("ContactStruct writeInOrder", err, ss.GetKey().Sig())
+	}
+}
+
 // GetLookup is a getter
 func (config *ContactStructConfig) GetLookup() *LookupTableStruct {
 	return config.lookup
@@ -458,6 +559,7 @@ func (ss *ContactStruct) DoClosingWork(err error) {
 	// fmt.Println("ContactStruct DoClosingWork con=", ss.GetKey().Sig(), err)
 
 	_ = err
+	ss.publishWill()
 	config := ss.config
 	config.listlock.Lock()
 	if ss.ele != nil {
@@ -622,81 +724,192 @@ func (ss *ContactStruct) ReadByte() (byte, error) {
 	return data[0], err
 }
 
+// serverOnlyPrefix starts the names that only the servers use. eg. the mqtt sessions.
+// A client can't publish, subscribe, or look them up. See serverAddress.
+const serverOnlyPrefix = "$sys/"
+
+// isServerOnly is true if a client can't use the address.
+func isServerOnly(a *packets.AddressUnion) bool {
+	return a.Type == packets.Utf8Address && strings.HasPrefix(string(a.Bytes), serverOnlyPrefix)
+}
+
+// processKey is for serverAddress when there's no ClusterExecutive, in some tests.
+var processKey HashType
+
+func init() {
+	processKey.Random()
+}
+
+// serverAddress is the address of a server only name. The cluster's key is in the hash
+// so a client can't send it as a binary address either.
+func (config *ContactStructConfig) serverAddress(name string) packets.AddressUnion {
+	sh := sha256.New()
+	if config.ce != nil && config.ce.PrivateKeyTemp != nil {
+		sh.Write(config.ce.PrivateKeyTemp[:])
+	} else {
+		sh.Write([]byte(processKey.String()))
+	}
+	sh.Write([]byte(name))
+	a := packets.AddressUnion{}
+	a.Type = packets.BinaryAddress
+	a.Bytes = sh.Sum(nil)[:HashTypeLen]
+	return a
+}
+
+// stripServerOptions is at the aide for what came from a client. A client can't send the Internal
+// options. See packets/options.go. The "pubk" and "jwtid" of a subscribe get set again from the token.
+// A Lookup keeps its "pubk" because the sealed box proves it. See lookmsg.go
+// The packets the servers make themselves go up with pushServerPacketUp and keep them.
+func stripServerOptions(p packets.Interface) {
+	var c *packets.PacketCommon
+	keepPubk := false
+	switch v := p.(type) {
+	case *packets.Subscribe:
+		c = &v.PacketCommon
+	case *packets.Unsubscribe:
+		c = &v.PacketCommon
+	case *packets.Lookup:
+		c = &v.PacketCommon
+		keepPubk = true
+	case *packets.Send:
+		c = &v.PacketCommon
+	default:
+		return
+	}
+	keys, _ := c.GetOptionKeys()
+	for _, key := range keys {
+		if !packets.IsInternalOption(key) {
+			continue
+		}
+		if key != packets.OptPubk.Key || !keepPubk {
+			c.DeleteOption(key)
+		}
+	}
+}
+
+// refuseServerOnly is true if p has an address that's only for the servers.
+func refuseServerOnly(p packets.Interface) bool {
+	switch v := p.(type) {
+	case *packets.Subscribe:
+		return isServerOnly(&v.Address)
+	case *packets.Unsubscribe:
+		return isServerOnly(&v.Address)
+	case *packets.Lookup:
+		return isServerOnly(&v.Address)
+	case *packets.Send:
+		return isServerOnly(&v.Address)
+	}
+	return false
+}
+
 func expectToken(ssi ContactInterface, p packets.Interface) error {
 	if ssi.GetToken() == nil {
 		// we can't do anything if we're not 'checked in'
 		connectPacket, ok := p.(*packets.Connect)
 		if !ok {
-			return makeErrorAndDisconnect(ssi, "expected Connect packet", nil)
+			return makeErrorAndDisconnect(ssi, nil, packets.ReasonProtocolError, "expected Connect packet", nil)
 		}
-		b64Token, ok := connectPacket.GetOption("token")
-		if !ok || b64Token == nil {
-			return makeErrorAndDisconnect(ssi, "expected token", nil)
+		b64Token, ok := packets.OptToken.Get(connectPacket)
+		if !ok {
+			return makeErrorAndDisconnect(ssi, connectPacket, packets.ReasonBadToken, "expected token", nil)
 		}
 		comment, hasComment := connectPacket.GetOption("comment")
 		if hasComment {
 			fmt.Println("comment", string(comment), "from", ssi.GetKey().Sig())
 		}
-		trimmedToken, issuer, err := tokens.GetKnotFreePayload(string(b64Token))
+		trimmedToken, issuer, err := tokens.GetKnotFreePayload(b64Token)
 		if err != nil {
-			return makeErrorAndDisconnect(ssi, "", err)
+			return makeErrorAndDisconnect(ssi, connectPacket, packets.ReasonBadToken, "", err)
 		}
 		// find the public key that matches.
 		publicKeyBytes := tokens.FindPublicKey(issuer)
 		if len(publicKeyBytes) != 32 {
-			return makeErrorAndDisconnect(ssi, "token bad issuer "+issuer, nil)
+			return makeErrorAndDisconnect(ssi, connectPacket, packets.ReasonBadIssuer, "token bad issuer "+issuer, nil)
 		}
 		foundPayload, ok := tokens.VerifyToken([]byte(trimmedToken), []byte(publicKeyBytes))
 		if !ok {
-			return makeErrorAndDisconnect(ssi, "token not verified", nil)
+			return makeErrorAndDisconnect(ssi, connectPacket, packets.ReasonBadToken, "token not verified", nil)
 		}
 		nowsec := ssi.GetConfig().GetCe().timegetter() // uint32(time.Now().Unix())
 		if nowsec > foundPayload.ExpirationTime {
-			return makeErrorAndDisconnect(ssi, "token expired", nil)
+			return makeErrorAndDisconnect(ssi, connectPacket, packets.ReasonTokenExpired, "token expired", nil)
+		}
+		config := ssi.GetConfig()
+		if config.MaxContacts > 0 && config.Len() > config.MaxContacts { // we're in the list already
+			return makeErrorAndDisconnect(ssi, connectPacket, packets.ReasonServerFull, "server full", nil)
 		}
 
 		ssi.SetToken(foundPayload) // we're already in the contact loop thread
 		{                          // subscribe to token for billing
 			foundPayload.KnotFreeContactStats.Subscriptions += 1 // for billing subscription
-			billstr, err := json.Marshal(foundPayload.KnotFreeContactStats)
+			sub := packets.Subscribe{}
+			err := packets.OptStatsMax.Set(&sub, foundPayload.KnotFreeContactStats)
 			if err != nil {
-				return makeErrorAndDisconnect(ssi, "", nil)
+				return makeErrorAndDisconnect(ssi, connectPacket, packets.ReasonUnspecified, "", err)
 			}
-			sub := packets.Subscribe{}
 			id := ssi.GetToken().JWTID
 			sub.Address.FromString(id) // the billing channel real name JWTID
 			// fmt.Println("contact subscribing to ", ssi.GetToken().JWTID)
-			sub.SetOption("statsmax", billstr)
 			sub.SetOption("noack", []byte("1"))
-			go PushPacketUpFromBottom(ssi, &sub)
+			go pushServerPacketUp(ssi, &sub)
 		}
 		return nil
 	}
 	return nil
 }
 
-func makeErrorAndDisconnect(ssi ContactInterface, str string, err error) error {
+// makeErrorAndDisconnect tells them why and closes. A versioned Connect, a text contact and an mqtt
+// contact get a ConnectAck with the reason code first. mqtt doesn't want the Disconnect after a CONNACK.
+// connect can be nil.
+func makeErrorAndDisconnect(ssi ContactInterface, connect *packets.Connect, code packets.ReasonCode, str string, err error) error {
 	if err == nil {
 		err = errors.New(str)
 	}
+	wantsAck := connect != nil && connect.GetVersion() > 0
+	_, isText := ssi.(*textContact)
+	isMqtt := isMqttContact(ssi)
 	go func() { // must not block.
-		dis := &packets.Disconnect{}
-		dis.SetOption("error", []byte(err.Error()))
-		ssi.WriteDownstream(dis)
-		fmt.Println("contacts makeErrorAndDisconnect", str, err)
+		if wantsAck || isText || isMqtt {
+			ack := &packets.ConnectAck{}
+			ack.SetReason(code, err.Error())
+			ssi.WriteDownstream(ack)
+		}
+		if !isMqtt {
+			dis := &packets.Disconnect{}
+			dis.SetReason(code, err.Error())
+			ssi.WriteDownstream(dis)
+		}
+		fmt.Println("contacts makeErrorAndDisconnect", code, str, err)
 		ssi.DoClose(err)
 	}()
 	return err
 }
 
+// disconnectDecodeError writes a reason coded Disconnect if the err is from the decoder
+// and says if it did. The caller still has to DoClose.
+func disconnectDecodeError(ssi ContactInterface, err error) bool {
+	var de *packets.DecodeError
+	if !errors.As(err, &de) {
+		return false
+	}
+	dis := &packets.Disconnect{}
+	dis.SetReason(de.Code(), de.Error())
+	ssi.WriteDownstream(dis)
+	return true
+}
+
 // HasError literally means does this packet have an "error" option
 // returns a Disconnect if the p has an error
 func HasError(p packets.Interface) *packets.Disconnect {
 
-	errmsg, ok := p.GetOption("error")
+	errmsg, ok := packets.OptError.Get(p)
 	if ok {
 		dis := packets.Disconnect{}
-		dis.SetOption("error", errmsg)
+		packets.OptError.Set(&dis, errmsg)
+		code, ok := packets.OptCode.Get(p)
+		if ok {
+			packets.OptCode.Set(&dis, code)
+		}
 		return &dis
 	}
 	return nil
@@ -778,20 +991,18 @@ func (ss *ContactStruct) sendBillingInfo(now uint32) {
 		// fmt.Println("contact publishing to ", ss.token.JWTID)
 		p.Address.FromString(ss.token.JWTID)
 		p.Source.FromString("billing_stats_return_address_contact")
-		str, err := json.Marshal(msg)
+		err := packets.OptAddStats.Set(p, msg)
 		if err != nil {
 			fmt.Println("impossible#3")
 		}
-		p.SetOption("add-stats", str)
-		p.SetOption("stats-deltat", []byte(strconv.FormatInt(int64(deltaTime), 10)))
+		packets.OptStatsDeltaT.Set(p, int64(deltaTime))
 
 		//fmt.Println("contact heartbeat sending stats", p, "from", ss.config.Name)
 
 		// don't bill a billing subscripton for the guru.
 
 		if !config.IsGuru() {
-			doSetExpires := false
-			err = PushPacketUpFromBottom2(ss, p, doSetExpires)
+			err = pushServerPacketUp(ss, p)
 		}
 		if err != nil {
 			fmt.Println("things before")
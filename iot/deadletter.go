@@ -0,0 +1,98 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package iot
+
+import (
+	"fmt"
+
+	"github.com/awootton/knotfreeiot/packets"
+)
+
+// Dead letters. A publish to a name that nobody is subscribed to just disappears.
+// The owner can say "set option DLQ my-dead-letters" on the name and then the guru
+// publishes a copy to my-dead-letters instead. It has a "deadletter" option with the
+// name it was for. Turn on the HISTORY of the dead letter topic to read them later.
+//
+// The guru keeps a name with a DLQ around with nobody watching, until it expires. When it
+// doesn't have the name it gets the DLQ, and the Owner, from the Store first. See store.go
+//
+// The copy goes through channelToAnyAide like the lookup replies because the dead letter
+// topic probably belongs to another guru.
+
+// getDeadLetterTopic is the DLQ option. It can be "DLQ topic name" or just "DLQ name".
+func (wt *WatchedTopic) getDeadLetterTopic() (string, bool) {
+	conf, ok := wt.GetOption("DLQ")
+	if !ok || len(conf) == 0 {
+		return "", false
+	}
+	options := StringToMap(string(conf))
+	name := options["topic"]
+	if name == "" {
+		name = options["@"]
+	}
+	return name, name != ""
+}
+
+// deadLetter is for processPublish at the guru when there's nobody to get it.
+func (me *LookupTableStruct) deadLetter(wt *WatchedTopic, p *packets.Send) {
+	if !me.isGuru || wt.getSize() != 0 {
+		return
+	}
+	name, ok := wt.getDeadLetterTopic()
+	if !ok {
+		return
+	}
+	if _, isDead := p.GetOption("deadletter"); isDead {
+		return // not the dead letters of the dead letters
+	}
+	if _, isRetain := p.GetOption("retain"); isRetain {
+		return // they have it when they come back
+	}
+	cp := &packets.Send{}
+	cp.Address.FromString(name)
+	cp.Source = p.Source
+	cp.Payload = p.Payload
+	cp.CopyOptions(&p.PacketCommon)
+	cp.DeleteOption("seq")
+	cp.DeleteOption("from")
+	cp.DeleteOption("topic")
+	was, ok := p.GetOption("topic")
+	if !ok {
+		was = []byte(p.Address.String())
+	}
+	cp.SetOption("deadletter", was)
+	deadLettered.Inc()
+	me.sendToAnyAide(cp)
+}
+
+// sendToAnyAide is for a guru publishing to a topic that might be on another guru.
+// It doesn't wait if the channel is full.
+func (me *LookupTableStruct) sendToAnyAide(p *packets.Send) {
+	if len(me.ex.channelToAnyAide) >= cap(me.ex.channelToAnyAide) {
+		fmt.Println("ERROR sendToAnyAide channelToAnyAide channel full")
+		return
+	}
+	me.ex.channelToAnyAide <- p
+}
+
+// keepForDeadLetter is true for the topics that the guru keeps with nobody watching.
+func keepForDeadLetter(me *LookupTableStruct, wt *WatchedTopic, now uint32) bool {
+	if !me.isGuru || wt.Expires < now {
+		return false
+	}
+	_, ok := wt.getDeadLetterTopic()
+	return ok
+}
@@ -90,6 +90,8 @@ type ClusterExecutive struct {
 	PrivateKeyTemp *[32]byte //curve25519.PrivateKey
 
 	PacketService *ServiceContact
+
+	Store Store // mongo, or a map in the tests. See store.go
 }
 
 // ExecutiveLimits will be how we tell if the ex is 'full'
@@ -144,6 +146,7 @@ func MakeSimplestCluster(timegetter func() uint32, isTCP bool, aideCount int, su
 		ce.currentPort = 9000
 	}
 	ce.timegetter = timegetter
+	ce.Store = NewMemoryStore()
 
 	secret := tokens.GetPrivateKeyWhole(0) // it's actually binary
 	r := bytes.NewReader([]byte(secret))
@@ -246,6 +249,7 @@ func MakeTCPMain(name string, limits *ExecutiveLimits, token string, isGuru bool
 	ce := &ClusterExecutive{}
 	ce.isTCP = isTCP
 	ce.timegetter = timegetterReal
+	ce.Store = MongoStore{}
 
 	// we should derive this from the current priv jwt ed25519 secret
 	secret := tokens.GetPrivateKeyWhole(0) // it's actually binary
@@ -292,6 +296,7 @@ func NewExecutive(sizeEstimate int, aname string, timegetter func() uint32, isGu
 	look := NewLookupTable(sizeEstimate, aname, isGuru, timegetter)
 	config := NewContactStructConfig(look)
 	config.Name = aname
+	config.ce = ce // for the timegetter. nil in some tests.
 
 	ex := &Executive{}
 	ex.Looker = look
@@ -444,6 +449,31 @@ func CalcExpansionDesired(aides []*ExecutiveStats, gurus []*ExecutiveStats) Expa
 	return result
 }
 
+// AddGuru is the growing part of Operate. The aides remap and subscribe again.
+// Only works in non-tcp mode.
+func (ce *ClusterExecutive) AddGuru() {
+	sample := ce.Gurus[0]
+	n := strconv.FormatInt(int64(len(ce.Gurus)), 10)
+	newName := "guru" + n
+	n1 := NewExecutive(100, newName, sample.getTime, true, ce)
+	ce.Gurus = append(ce.Gurus, n1)
+	GuruNameToConfigMap[newName] = n1 // for test
+	ce.currentGuruList = append(ce.currentGuruList, newName)
+
+	for _, ex := range ce.Gurus {
+		ex.Looker.SetUpstreamNames(ce.currentGuruList, ce.currentGuruList)
+	}
+	for _, aide := range ce.Aides {
+		aide.Looker.SetUpstreamNames(ce.currentGuruList, ce.currentGuruList)
+	}
+	for _, ex := range ce.Gurus {
+		ex.Looker.FlushMarkerAndWait()
+	}
+	for _, ex := range ce.Aides {
+		ex.Looker.FlushMarkerAndWait()
+	}
+}
+
 // Operate where we pretend to be an Operator and resize the cluster.
 // This is really only for test. Only works in non-tcp mode
 // Does not call heartbeat or advance the time.
@@ -520,26 +550,7 @@ func (ce *ClusterExecutive) Operate() {
 
 	// now, same routine for gurus
 	if expansion.ChangeGurus > 0 {
-		sample := ce.Gurus[0]
-		n := strconv.FormatInt(int64(len(ce.Gurus)), 10)
-		newName := "guru" + n
-		n1 := NewExecutive(100, newName, sample.getTime, true, ce)
-		ce.Gurus = append(ce.Gurus, n1)
-		GuruNameToConfigMap[newName] = n1 // for test
-		ce.currentGuruList = append(ce.currentGuruList, newName)
-
-		for _, ex := range ce.Gurus {
-			ex.Looker.SetUpstreamNames(ce.currentGuruList, ce.currentGuruList)
-		}
-		for _, aide := range ce.Aides {
-			aide.Looker.SetUpstreamNames(ce.currentGuruList, ce.currentGuruList)
-		}
-		for _, ex := range ce.Gurus {
-			ex.Looker.FlushMarkerAndWait()
-		}
-		for _, ex := range ce.Aides {
-			ex.Looker.FlushMarkerAndWait()
-		}
+		ce.AddGuru()
 	} else if expansion.ChangeGurus < 0 {
 		// we can only shrink if the result won't just grow again.
 		// with some (10%) margin.
@@ -633,6 +644,10 @@ func (ex *Executive) GetExecutiveStats() *ExecutiveStats {
 	stats.Subscriptions = stats.Subscriptions / ex.Limits.Subscriptions
 
 	stats.Buffers = queuefraction
+	outFraction := ex.Config.getOutQueueFraction() // see outqueue.go
+	if outFraction > stats.Buffers {
+		stats.Buffers = outFraction
+	}
 
 	stats.Limits = ex.Limits
 	stats.Name = ex.Name
@@ -871,8 +886,8 @@ func (ex *Executive) WaitForActions() {
 }
 
 func SpecialPrint(p *packets.PacketCommon, fn func()) {
-	val, ok := p.GetOption("debg")
-	if ok && (string(val) == "[12345678]" || string(val) == "12345678") {
+	val, ok := packets.OptDebug.Get(p)
+	if ok && (val == "[12345678]" || val == "12345678") {
 		fn()
 	}
 }
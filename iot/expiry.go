@@ -0,0 +1,59 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package iot
+
+import (
+	"time"
+
+	"github.com/awootton/knotfreeiot/packets"
+)
+
+// Message expiry. A Send with the "expires" option, in unix seconds, is thrown away
+// wherever it is when that time passes. So a setpoint from five minutes ago doesn't
+// get to a device that just came back.
+//
+// It's checked at the contact, in processPublish and processPublishDown at the aides and
+// the gurus, in the outbound queues, in the upperChannel going up, for the retained
+// value and the history, and in the mqtt qos queues and sessions.
+//
+// mqtt 5 has MessageExpiryInterval. That's seconds from now so the mqtt contact
+// turns it into "expires" and back into what's left when it goes out.
+
+// dropExpired is true if p is a Send that has expired. It counts them.
+func dropExpired(p packets.Interface, now uint32) bool {
+	v, ok := p.(*packets.Send)
+	if !ok || !v.IsExpired(now) {
+		return false
+	}
+	expiredDropped.Inc()
+	return true
+}
+
+// getTime is the time of the lookup, or the real time if there isn't one.
+func (config *ContactStructConfig) getTime() uint32 {
+	if config == nil || config.lookup == nil {
+		return uint32(time.Now().Unix())
+	}
+	return config.lookup.getTime()
+}
+
+// expiryInterval is what's left, for mqtt 5. 0 is no expiry, so it's at least 1.
+func expiryInterval(when uint32, now uint32) uint32 {
+	if when <= now {
+		return 1
+	}
+	return when - now
+}
@@ -115,20 +115,23 @@ func (upc *upperChannel) dialGuru() {
 			}()
 
 			connect := packets.Connect{}
-			connect.SetOption("token", []byte(token))
+			packets.OptToken.Set(&connect, token)
 			err := PushPacketUpFromBottom(contact, &connect)
 			if err != nil {
 				fmt.Println("connect guru test dial conn ", err)
 			}
 			for p := range upc.up {
 
+				if dropExpired(p, upc.ex.getTime()) {
+					continue // see expiry.go
+				}
 				//fmt.Println("UPC pushing to guru ", p)
 				// needs to be cloned because it's still also in aide
 
 				buff := &bytes.Buffer{}
 				p.Write(buff)
 				buff2 := bytes.NewBuffer(buff.Bytes())
-				p2, err := packets.ReadPacket(buff2)
+				p2, err := packets.ServerDecoder.ReadPacket(buff2)
 				if err != nil {
 					_ = err
 				}
@@ -193,7 +196,7 @@ func (m *myPipe) Write(data []byte) (int, error) {
 
 func (upc *upperChannel) readFromPipe(m *myPipe) {
 	for {
-		p, err := packets.ReadPacket(m)
+		p, err := packets.ServerDecoder.ReadPacket(m)
 
 		if err != nil {
 			fmt.Println("readFromPipe ReadPacket err  ", err)
@@ -251,7 +254,7 @@ func (upc *upperChannel) dialGuruAndServe() error {
 
 	tok := tokens.GetImpromptuGiantToken()
 	connect := &packets.Connect{}
-	connect.SetOption("token", []byte(tok))
+	packets.OptToken.Set(connect, tok)
 	mux.Lock()
 	err = connect.Write(upc.conn)
 	mux.Unlock()
@@ -293,15 +296,15 @@ func (upc *upperChannel) dialGuruAndServe() error {
 	// since we have a conn now...
 	go func() {
 		for upc.founderr == nil && upc.isRunning() {
-			p, err := packets.ReadPacket(upc.conn) // guru sent this down to us
+			p, err := packets.ServerDecoder.ReadPacket(upc.conn) // guru sent this down to us
 			if err != nil {
 				fmt.Println("dialGuruAndServe readPacket err", p, err, upc.address, upc.name)
 				upc.founderr = err
 				upc.conn.Close()
 				return
 			}
-			got, ok := p.GetOption("debg")
-			if ok && string(got) == "12345678" {
+			got, ok := packets.OptDebug.Get(p)
+			if ok && got == "12345678" {
 				fmt.Println("dialguru receive", p.Sig())
 			}
 			err = PushDownFromTop(upc.ex.Looker, p)
@@ -319,7 +322,9 @@ func (upc *upperChannel) dialGuruAndServe() error {
 		select {
 		case p := <-upc.up:
 			//fmt.Println("dialGuruAndServe pushing to guru ", p.Sig())
-
+			if dropExpired(p, upc.ex.getTime()) {
+				continue // see expiry.go
+			}
 			err = p.Write(upc.conn)
 
 			//fmt.Println("dialGuruAndServe pushed to guru ", p.Sig())
@@ -0,0 +1,304 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package iot
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/awootton/knotfreeiot/packets"
+)
+
+// Topic history. The last N messages of a topic, so a dashboard can catch up when it reconnects.
+//
+// The owner turns it on with "set option HISTORY size 50" and maybe "set option HISTORY age 3600"
+// (seconds) on the name. Then the guru keeps the publishes in a ring in the WatchedTopic.
+//
+// A subscribe with the "since" option gets the ones after that replayed after the suback.
+// since is the "history" number that's on every replayed message, or a unix time if it's
+// big, or 0 for all of them. The history number is the topic's "seq" so a client with the
+// seq cap can say since the last one it got live. See seq.go
+//
+// The aide puts "sincefor" on the subscribe going up. It's the key of the contact. The guru
+// puts it on the copies coming down and the aide gives them to just that contact.
+//
+// The owner pays. The bytes going into the ring are input and the replays are output, on
+// the token that reserved the name, not the one that subscribed first. See billOwner.
+//
+// The guru has the HISTORY option with nobody watching because it looks in the Store for the
+// names it doesn't have. See store.go
+
+const (
+	historyMax = 1000 // the most a topic can have
+	// since values this big are unix times
+	historySinceTime = 1000000000
+)
+
+type historyItem struct {
+	p    *packets.Send
+	seq  uint64
+	when uint32
+}
+
+type historyRing struct {
+	items []historyItem // a ring
+	start int
+	count int
+	age   uint32 // seconds. 0 is forever
+	seq   uint64 // the last one
+
+	conf string // the HISTORY option we were made with
+
+	inBytes  int // not billed yet
+	outBytes int
+}
+
+// getHistory makes the ring, or changes it, from the HISTORY option. nil is no history.
+func (wt *WatchedTopic) getHistory() *historyRing {
+	conf, ok := wt.GetOption("HISTORY")
+	if !ok || len(conf) == 0 {
+		wt.history = nil
+		return nil
+	}
+	if wt.history != nil && wt.history.conf == string(conf) {
+		return wt.history
+	}
+	options := StringToMap(string(conf))
+	size, _ := strconv.Atoi(options["size"])
+	if size <= 0 {
+		wt.history = nil
+		return nil
+	}
+	if size > historyMax {
+		size = historyMax
+	}
+	age, _ := strconv.Atoi(options["age"])
+	h := &historyRing{items: make([]historyItem, size), conf: string(conf), age: uint32(age)}
+	if wt.history != nil { // keep what we have
+		wt.history.each(0, func(item *historyItem) {
+			h.put(*item)
+		})
+		h.seq = wt.history.seq
+		h.inBytes = wt.history.inBytes
+		h.outBytes = wt.history.outBytes
+	}
+	wt.history = h
+	return h
+}
+
+func (h *historyRing) put(item historyItem) {
+	if h.count == len(h.items) {
+		h.items[h.start] = historyItem{}
+		h.start = (h.start + 1) % len(h.items)
+		h.count--
+	}
+	h.items[(h.start+h.count)%len(h.items)] = item
+	h.count++
+}
+
+// add is for a publish at the guru. It has the seq already.
+func (h *historyRing) add(p *packets.Send, now uint32) {
+	seq, ok := getSeq(&p.PacketCommon)
+	if ok && seq > h.seq {
+		h.seq = seq
+	} else {
+		h.seq++
+	}
+	h.put(historyItem{p: p, seq: h.seq, when: now})
+	h.inBytes += len(p.Payload)
+}
+
+// expire drops the ones that are too old.
+func (h *historyRing) expire(now uint32) {
+	for h.age != 0 && h.count > 0 && h.items[h.start].when+h.age < now {
+		h.items[h.start] = historyItem{}
+		h.start = (h.start + 1) % len(h.items)
+		h.count--
+	}
+}
+
+// each is the ones after since, oldest first.
+func (h *historyRing) each(since uint64, fn func(item *historyItem)) {
+	for i := 0; i < h.count; i++ {
+		item := &h.items[(h.start+i)%len(h.items)]
+		if since >= historySinceTime {
+			if uint64(item.when) < since {
+				continue
+			}
+		} else if item.seq <= since {
+			continue
+		}
+		fn(item)
+	}
+}
+
+// recordHistory is for processPublish at the guru.
+func (me *LookupTableStruct) recordHistory(wt *WatchedTopic, p *packets.Send) {
+	if !me.isGuru {
+		return
+	}
+	h := wt.getHistory()
+	if h == nil {
+		return
+	}
+	now := me.getTime()
+	h.expire(now)
+	h.add(p, now)
+}
+
+// replayHistory is for processSubscribe at the guru.
+func (me *LookupTableStruct) replayHistory(wt *WatchedTopic, submsg *subscriptionMessage) {
+	val, ok := submsg.p.GetOption("since")
+	if !ok || !me.isGuru {
+		return
+	}
+	h := wt.getHistory()
+	if h == nil {
+		return
+	}
+	since, _ := strconv.ParseUint(string(val), 10, 64)
+	sincefor, hasFor := submsg.p.GetOption("sincefor")
+	h.replay(submsg.ss, since, me.getTime(), func(cp *packets.Send, item *historyItem) {
+		cp.SetOption("history", []byte(strconv.FormatUint(item.seq, 10)))
+		if hasFor {
+			cp.SetOption("sincefor", sincefor)
+		}
+	})
+}
+
+// replay queues copies of the ones after since, oldest first. The inbox uses it too.
+// mark is for the options of the copy.
+func (h *historyRing) replay(ss ContactInterface, since uint64, now uint32, mark func(cp *packets.Send, item *historyItem)) {
+	h.expire(now)
+	h.each(since, func(item *historyItem) {
+		if dropExpired(item.p, now) {
+			return // see expiry.go
+		}
+		cp := &packets.Send{}
+		cp.Address = item.p.Address
+		cp.Source = item.p.Source
+		cp.Payload = item.p.Payload
+		cp.CopyOptions(&item.p.PacketCommon)
+		if mark != nil {
+			mark(cp, item)
+		}
+		h.outBytes += len(cp.Payload)
+		queueDownstream(ss, cp) // after the suback and before the ones after this
+		sentMessages.Inc()
+	})
+}
+
+// clear empties the ring.
+func (h *historyRing) clear() {
+	for h.count > 0 {
+		h.items[h.start] = historyItem{}
+		h.start = (h.start + 1) % len(h.items)
+		h.count--
+	}
+}
+
+// markSince is at the aide so the guru's copies come back to this contact.
+// A new wildcard subscriber gets the retained values that way too. See retained.go
+func markSince(p *packets.Subscribe, ss ContactInterface, isNew bool) {
+	_, hasSince := p.GetOption("since")
+	_, isWild := getWildcardPattern(p)
+	if !hasSince && !(isNew && isWild && getShareGroup(p) == "") {
+		return
+	}
+	key := uint64(ss.GetKey())
+	p.SetOption("sincefor", []byte(strconv.FormatUint(key, 10)))
+}
+
+// isHistoryCopy is true for the replays coming down.
+func isHistoryCopy(p *packets.Send) bool {
+	_, ok := p.GetOption("sincefor")
+	return ok
+}
+
+// deliverHistory is at the aide. Just the one contact gets it.
+func deliverHistory(me *LookupTableStruct, bucket *subscribeBucket, pubmsg *publishMessageDown) {
+	wt, ok := getWatcher(bucket, &pubmsg.h)
+	if !ok {
+		return // they left
+	}
+	val, _ := pubmsg.p.GetOption("sincefor")
+	key, err := strconv.ParseUint(string(val), 10, 64)
+	if err != nil {
+		return
+	}
+	item, ok := wt.get(HalfHash(key))
+	if !ok || me.checkForBadContact(item.contactInterface, wt) {
+		return
+	}
+	cp := &packets.Send{}
+	cp.Address = pubmsg.p.Address
+	cp.Source = pubmsg.p.Source
+	cp.Payload = pubmsg.p.Payload
+	cp.CopyOptions(&pubmsg.p.PacketCommon)
+	cp.DeleteOption("sincefor")
+	queueDownstream(item.contactInterface, cp)
+	sentMessages.Inc()
+}
+
+// keepForHistory is true for the topics that the guru keeps with nobody watching.
+func keepForHistory(me *LookupTableStruct, wt *WatchedTopic, now uint32) bool {
+	return me.isGuru && wt.history != nil && wt.history.count > 0 && wt.Expires >= now
+}
+
+// billOwner is for the heartbeat at the guru. The history and the inbox bytes go to the
+// billing topic of the Owner's token, like the stats from a contact.
+func (me *LookupTableStruct) billOwner(wt *WatchedTopic, in, out int, now uint32) {
+	if in+out == 0 || wt.ownerJwtid == "" {
+		return
+	}
+	deltat := now - wt.lastBillingTime
+	if deltat == 0 {
+		deltat = 1
+	}
+	msg := &Stats{}
+	msg.Input = float64(in)
+	msg.Output = float64(out)
+	p := &packets.Send{}
+	p.Address.FromString(wt.ownerJwtid)
+	p.Source.FromString("billing_stats_return_address_history")
+	err := packets.OptAddStats.Set(p, msg)
+	if err != nil {
+		fmt.Println("billOwner", err)
+		return
+	}
+	packets.OptStatsDeltaT.Set(p, int64(deltat))
+	me.sendToAnyAide(p)
+	me.ex.Billing.AddUsage(&msg.KnotFreeContactStats, now, int(deltat))
+}
+
+// billKept is for a topic at the guru that nobody is watching. It's kept for the history or the
+// inbox and those bytes don't wait for a subscriber. It's for the one going away too.
+func (me *LookupTableStruct) billKept(wt *WatchedTopic, now uint32) {
+	historyIn, historyOut := wt.takeHistoryBytes()
+	inboxIn, inboxOut := wt.takeInboxBytes() // see inbox.go
+	me.billOwner(wt, historyIn+inboxIn, historyOut+inboxOut, now)
+}
+
+// takeHistoryBytes is for the billing. It returns the bytes in and out since last time.
+func (wt *WatchedTopic) takeHistoryBytes() (int, int) {
+	h := wt.history
+	if h == nil {
+		return 0, 0
+	}
+	in, out := h.inBytes, h.outBytes
+	h.inBytes, h.outBytes = 0, 0
+	return in, out
+}
@@ -0,0 +1,133 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package iot
+
+import (
+	"strconv"
+
+	"github.com/awootton/knotfreeiot/packets"
+)
+
+// The inbox. For the sleepy devices. A publish to a reserved name, one with an Owner,
+// when nobody is subscribed is kept at the guru. The next subscribe gets them all,
+// in order, right after the suback and then the inbox is empty.
+//
+// The owner turns it on with "set option INBOX size 20" and maybe "set option INBOX age 600"
+// (seconds). "set option INBOX on" is the defaults. Size 0 turns it off.
+// The owner's token pays for the bytes in and out like the history. See history.go
+//
+// The guru gets the option from the Store when nobody is watching. See store.go
+// It keeps the name while there's something in the inbox. The inbox is only in memory at
+// the guru. If the gurus are remapped it's gone.
+
+const (
+	inboxSize = 100          // the default
+	inboxAge  = 24 * 60 * 60 // the default, seconds
+)
+
+// getInbox makes the inbox, or changes it, from the INBOX option. nil is no inbox.
+// It's the same ring as the history.
+func (wt *WatchedTopic) getInbox() *historyRing {
+	if wt.Owner == "" {
+		wt.inbox = nil
+		return nil
+	}
+	conf, ok := wt.GetOption("INBOX")
+	if !ok || len(conf) == 0 {
+		wt.inbox = nil
+		return nil
+	}
+	if wt.inbox != nil && wt.inbox.conf == string(conf) {
+		return wt.inbox
+	}
+	options := StringToMap(string(conf))
+	size := inboxSize
+	if val, ok := options["size"]; ok {
+		size, _ = strconv.Atoi(val)
+	}
+	if size <= 0 {
+		wt.inbox = nil
+		return nil
+	}
+	if size > historyMax {
+		size = historyMax
+	}
+	age := inboxAge
+	if val, ok := options["age"]; ok {
+		age, _ = strconv.Atoi(val)
+	}
+	if age <= 0 || age > inboxAge {
+		age = inboxAge
+	}
+	h := &historyRing{items: make([]historyItem, size), conf: string(conf), age: uint32(age)}
+	if wt.inbox != nil { // keep what we have
+		wt.inbox.each(0, func(item *historyItem) {
+			h.put(*item)
+		})
+		h.seq = wt.inbox.seq
+		h.inBytes = wt.inbox.inBytes
+		h.outBytes = wt.inbox.outBytes
+	}
+	wt.inbox = h
+	return h
+}
+
+// storeInbox is for processPublish at the guru when there's nobody to get it.
+func (me *LookupTableStruct) storeInbox(wt *WatchedTopic, p *packets.Send) {
+	if !me.isGuru || wt.getSize() != 0 {
+		return
+	}
+	if _, isRetain := p.GetOption("retain"); isRetain {
+		return // they get that anyway
+	}
+	h := wt.getInbox()
+	if h == nil {
+		return
+	}
+	now := me.getTime()
+	h.expire(now)
+	h.add(p, now)
+}
+
+// deliverInbox is for processSubscribe at the guru. All of it goes to the new one.
+func (me *LookupTableStruct) deliverInbox(wt *WatchedTopic, submsg *subscriptionMessage) {
+	h := wt.inbox
+	if !me.isGuru || h == nil || h.count == 0 {
+		return
+	}
+	h.replay(submsg.ss, 0, me.getTime(), nil) // see history.go
+	h.clear()
+}
+
+// keepForInbox is true for the topics that the guru keeps with nobody watching.
+func keepForInbox(me *LookupTableStruct, wt *WatchedTopic, now uint32) bool {
+	if !me.isGuru || wt.inbox == nil {
+		return false
+	}
+	wt.inbox.expire(now)
+	return wt.inbox.count > 0
+}
+
+// takeInboxBytes is for the billing. It returns the bytes in and out since last time.
+func (wt *WatchedTopic) takeInboxBytes() (int, int) {
+	h := wt.inbox
+	if h == nil {
+		return 0, 0
+	}
+	in, out := h.inBytes, h.outBytes
+	h.inBytes, h.outBytes = 0, 0
+	return in, out
+}
@@ -31,6 +31,41 @@ var (
 		Help: "The total number of messages sent down",
 	})
 
+	outQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "look_out_queue_depth",
+		Help: "The number of messages waiting in the contact outbound queues",
+	})
+
+	outQueueDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "look_out_queue_dropped",
+		Help: "The total number of times an outbound queue was full",
+	})
+
+	ownedDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "look_owned_dropped",
+		Help: "The total number of publishes to owned topics that weren't signed by the owner",
+	})
+
+	subscribeRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "look_subscribe_rejected",
+		Help: "The total number of subscribes by someone not in the Users of the name",
+	})
+
+	expiredDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "look_expired_dropped",
+		Help: "The total number of messages thrown away because they expired",
+	})
+
+	deadLettered = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "look_dead_lettered",
+		Help: "The total number of publishes to nobody that went to a DLQ topic",
+	})
+
+	presenceEvents = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "look_presence_events",
+		Help: "The total number of times a topic got its first subscriber or lost its last",
+	})
+
 	fatalMessups = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "look_fatal_messages",
 		Help: "The total number garbage messages",
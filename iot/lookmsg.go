@@ -57,7 +57,7 @@ type lookupCallContext struct {
 // If we do this when we'll have to re-q to get accress again. See callBackCommand
 func processLookup(me *LookupTableStruct, bucket *subscribeBucket, lookmsg *lookupMessage) {
 
-	if !me.isGuru {
+	if !me.isTop() {
 		fmt.Println("processLookup PushUp", me.ex.Name)
 		err := bucket.looker.PushUp(lookmsg.p, lookmsg.topicHash)
 		if err != nil {
@@ -199,13 +199,13 @@ func getAndSetWatcher(callContext interface{},
 	str := lookMsg.topicHash.ToBase64()
 	go func() {
 		// checkMongo
-		gotwatchedTopic, ok := GetSubscription(str)
+		gotwatchedTopic, ok := me.config.GetStore().GetTopic(lookMsg.topicHash)
 		if !ok {
 			if makeName != nil {
 				// make a new one
 				makeName(callContext, str)
 				// keep going
-				gotwatchedTopic, ok = GetSubscription(str)
+				gotwatchedTopic, ok = me.config.GetStore().GetTopic(lookMsg.topicHash)
 				if !ok {
 					sendReply(me, lookMsg, "error: topic failed to make")
 					return
@@ -222,6 +222,7 @@ func getAndSetWatcher(callContext interface{},
 			callContext: callContext,
 			callback: func(me *LookupTableStruct, bucket *subscribeBucket, cmd *callBackCommand) {
 				// remember it
+				fromStore(gotwatchedTopic, lookMsg.topicHash, me.getTime()) // see store.go
 				setWatcher(bucket, &lookMsg.topicHash, gotwatchedTopic)
 
 				finish(callContext, watchedTopic)
@@ -369,7 +370,7 @@ func setupCommands(c *lookupContext) {
 				newMapAsStr := MapToString(optionMap)
 				watchedTopic.SetOption(key, newMapAsStr)
 				// save to mongo !
-				SaveSubscription(watchedTopic)
+				me.config.GetStore().SaveTopic(watchedTopic)
 
 				sendReply(me, lookMsg, "ok")
 			}, nil)
@@ -414,7 +415,7 @@ func setupCommands(c *lookupContext) {
 				newMapAsStr := MapToString(optionMap)
 				watchedTopic.SetOption(key, newMapAsStr)
 				// save to mongo !
-				SaveSubscription(watchedTopic)
+				me.config.GetStore().SaveTopic(watchedTopic)
 
 				sendReply(me, lookMsg, "ok")
 			}, nil)
@@ -458,7 +459,120 @@ func setupCommands(c *lookupContext) {
 				watchedTopic.ReplaceOptions(aMap)
 
 				// save to mongo !
-				SaveSubscription(watchedTopic)
+				me.config.GetStore().SaveTopic(watchedTopic)
+
+				sendReply(me, lookMsg, "ok")
+			}, nil)
+			return ""
+
+		}, c.CommandMap)
+
+	monitor_pod.MakeCommand("add user",
+		"add a public key that can subscribe. See users.go", 0,
+		func(msg string, args []string, callContext interface{}) string {
+			me, _, lookMsg, _ := getCallContext(callContext)
+			if len(args) < 1 {
+				sendReply(me, lookMsg, "error: not enough arguments")
+				return ""
+			}
+			user := args[0]
+
+			getAndSetWatcher(callContext, func(callContext interface{}, watchedTopic *WatchedTopic) {
+				me, _, lookMsg, pubk := getCallContext(callContext)
+				if pubk != watchedTopic.Owner {
+					sendReply(me, lookMsg, "error: not owner")
+					return
+				}
+				watchedTopic.addUser(user)
+				// save to mongo !
+				me.config.GetStore().SaveTopic(watchedTopic)
+
+				sendReply(me, lookMsg, "ok")
+			}, nil)
+			return ""
+
+		}, c.CommandMap)
+
+	monitor_pod.MakeCommand("remove user",
+		"remove a public key from the users", 0,
+		func(msg string, args []string, callContext interface{}) string {
+			me, _, lookMsg, _ := getCallContext(callContext)
+			if len(args) < 1 {
+				sendReply(me, lookMsg, "error: not enough arguments")
+				return ""
+			}
+			user := args[0]
+
+			getAndSetWatcher(callContext, func(callContext interface{}, watchedTopic *WatchedTopic) {
+				me, _, lookMsg, pubk := getCallContext(callContext)
+				if pubk != watchedTopic.Owner {
+					sendReply(me, lookMsg, "error: not owner")
+					return
+				}
+				watchedTopic.removeUser(user)
+				// save to mongo !
+				me.config.GetStore().SaveTopic(watchedTopic)
+
+				sendReply(me, lookMsg, "ok")
+			}, nil)
+			return ""
+
+		}, c.CommandMap)
+
+	monitor_pod.MakeCommand("list users",
+		"the public keys that can subscribe. json. Empty means anyone", 0,
+		func(msg string, args []string, callContext interface{}) string {
+
+			getAndSetWatcher(callContext, func(callContext interface{}, watchedTopic *WatchedTopic) {
+				me, _, lookMsg, pubk := getCallContext(callContext)
+				if pubk != watchedTopic.Owner {
+					sendReply(me, lookMsg, "error: not owner")
+					return
+				}
+				users := watchedTopic.Users
+				if users == nil {
+					users = []string{}
+				}
+				json, err := json.Marshal(users)
+				if err != nil {
+					sendReply(me, lookMsg, "json error: "+err.Error())
+					return
+				}
+				sendReply(me, lookMsg, string(json))
+			}, nil)
+			return ""
+
+		}, c.CommandMap)
+
+	monitor_pod.MakeCommand("set owned",
+		"true or false. Only the owner can publish, signed. See owned.go", 0,
+		func(msg string, args []string, callContext interface{}) string {
+			me, _, lookMsg, _ := getCallContext(callContext)
+
+			if len(args) < 1 {
+				sendReply(me, lookMsg, "error: not enough arguments")
+				return ""
+			}
+			owned, err := strconv.ParseBool(args[0])
+			if err != nil {
+				sendReply(me, lookMsg, "set owned error: "+err.Error())
+				return ""
+			}
+
+			getAndSetWatcher(callContext, func(callContext interface{}, watchedTopic *WatchedTopic) {
+				me, _, lookMsg, pubk := getCallContext(callContext)
+				if pubk != watchedTopic.Owner {
+					sendReply(me, lookMsg, "error: not owner")
+					return
+				}
+				if _, ok := watchedTopic.ownerPublicKey(); !ok && owned {
+					sendReply(me, lookMsg, "error: owner is not an ed25519 key")
+					return
+				}
+				watchedTopic.OwnedBroadcast = owned
+				me.tellOwned(watchedTopic)
+				// save to mongo !
+				me.config.GetStore().SaveTopic(watchedTopic)
 
 				sendReply(me, lookMsg, "ok")
 			}, nil)
@@ -524,13 +638,12 @@ func setupCommands(c *lookupContext) {
 				return ""
 			}
 			// it wasn't loaded. We have try to load it.
-			str := lookMsg.topicHash.ToBase64()
 			// we have to do this in a go routine because we have to release the bucket
 			// we will lose exclusive access to the bucket now.
 			go func() {
 				// checkMongo
 				fmt.Println("exists check mongo")
-				gotwatchedTopic, ok := GetSubscription(str)
+				gotwatchedTopic, ok := me.config.GetStore().GetTopic(lookMsg.topicHash)
 				fmt.Println("exists got mongo", ok)
 				if !ok {
 					exists.Exists = false
@@ -545,6 +658,7 @@ func setupCommands(c *lookupContext) {
 					callContext: callContext,
 					callback: func(me *LookupTableStruct, bucket *subscribeBucket, cmd *callBackCommand) {
 						// remember it
+						fromStore(gotwatchedTopic, lookMsg.topicHash, me.getTime())
 						setWatcher(bucket, &lookMsg.topicHash, gotwatchedTopic)
 						exists.Exists = true
 						exists.Online = false
@@ -632,7 +746,7 @@ func decryptCommand(me *LookupTableStruct, p *packets.Lookup, command string) bo
 	if !ok {
 		return false
 	}
-	nonce, ok := p.GetOption("nonc")
+	nonce, ok := packets.OptNonce.Get(p)
 	if !ok {
 		return false
 	}
@@ -870,7 +984,7 @@ func MapToString(m map[string]string) string {
 // 			if !ok {
 // 				// checkMongo
 // 				str := lookMsg.topicHash.ToBase64()
-// 				watchedTopic, ok = GetSubscription(str)
+// 				watchedTopic, ok = me.config.GetStore().GetTopic(lookMsg.topicHash)
 // 				if !ok {
 // 					changed = true
 // 					watchedTopic = &WatchedTopic{}
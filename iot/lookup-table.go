@@ -53,6 +53,11 @@ type LookupTableStruct struct {
 	// Becomes a 'thread' count. The count of the queues.
 	theBucketsSize     int // = uint(16)
 	theBucketsSizeLog2 int // = 4
+
+	// the mqtt style + and # subscriptions. See wildcards.go
+	wildcards *wildcardIndex
+
+	loads *sync.WaitGroup // the Store lookups. See store.go
 }
 
 type MyRedblacktree struct {
@@ -86,6 +91,7 @@ type WatchedTopic struct {
 	nextBillingTime uint32
 	lastBillingTime uint32
 	Jwtid           string `bson:"jwtid,omitempty" json:"jwtid,omitempty"` // aka billkey is the id fronm the auth token
+	ownerJwtid      string // the token of the Owner. It pays for the history and the inbox. See store.go
 
 	// presense of Pubk implies this Permanent bool `bson:"perm,omitempty"`   // keep it around always, until it expires.
 	// presense of Users enforces this Single    bool `bson:"simgle,omitempty"` // just the one subscriber
@@ -96,6 +102,25 @@ type WatchedTopic struct {
 	// Owners []string `bson:"own,omitempty"`   // the public key of the owners who have permission to make changes.
 	Owner string   `bson:"own" json:"own"`                         // the public key of the owners who have permission to make changes.
 	Users []string `bson:"users,omitempty" json:"users,omitempty"` // the public key of things that can subscribe to this topic. None means anyone.
+
+	retained      *packets.Send // the last Send with "retain". See retained.go
+	retainedUntil uint32        // the guru keeps it with nobody watching until then.
+
+	ttl     uint32 // seconds. The longest one of the watchers, 0 is the defaults. See ttl.go
+	touched uint32 // the last subscribe or publish
+
+	history *historyRing // the last messages. See history.go
+
+	inbox *historyRing // kept for the next subscriber. See inbox.go
+
+	quiet bool // no presence events. See presence.go
+
+	seq   uint64 // the last sequence number. See seq.go
+	epoch uint32 // when the seq started
+
+	shareNext map[string]int // round robin for the $share groups. See shared.go
+
+	signed map[string]uint32 // the "signonce"s lately and until when. See owned.go
 }
 
 type watcherItem struct {
@@ -105,6 +130,14 @@ type watcherItem struct {
 	// if they want this they have to explicitly ask for it.
 	// it creates multiple replies.
 	pub2self bool // if true then publish back to caller if subscribed. The default is false everywhere else.
+
+	shares     []string // the $share groups. See shared.go
+	onlyShared bool     // and not a plain subscriber
+
+	ttl   uint32 // seconds, from its subscribe. 0 is the topic's. See ttl.go
+	since uint32 // its last subscribe
+
+	back bool // an aide that wants its own publishes back. See seq.go
 }
 
 // PushUp is to send msg up to guruness. has a q per contact.
@@ -148,6 +181,26 @@ func (me *LookupTableStruct) PushUp(p packets.Interface, h HashType) error {
 	return nil
 }
 
+// PushUpAll is PushUp but to every upper channel.
+// Wildcard subscriptions don't map to any one guru so they all get a copy.
+func (me *LookupTableStruct) PushUpAll(p packets.Interface) error {
+
+	router := me.upstreamRouter
+	if router.maglev == nil {
+		return errors.New("no upstreamRouter")
+	}
+	if len(router.channels) == 0 {
+		return errors.New("no upstream channels")
+	}
+	for _, upc := range router.channels {
+		if len(upc.up) >= cap(upc.up) {
+			fmt.Println("PushUpAll channel full", upc.name)
+		}
+		upc.up <- p
+	}
+	return nil
+}
+
 // NewLookupTable makes a LookupTableStruct, usually a singleton.
 // In the tests we call here and then use the result to init a server.
 // Starts 16 go routines that are hung on their 32 deep q's
@@ -173,6 +226,8 @@ func NewLookupTable(projectedTopicCount int, aname string, isGuru bool, getTime
 	if portion != portion2 {
 		fmt.Println("EPIC FAIL me.theBucketsSizeLog2 != uint(math.Log2(float64(me.theBucketsSize)))")
 	}
+	me.wildcards = &wildcardIndex{}
+	me.loads = &sync.WaitGroup{}
 	me.allTheSubscriptions = make([]subscribeBucket, me.theBucketsSize)
 	for i := 0; i < me.theBucketsSize; i++ {
 		// mySubscriptions is not an array of 64 maps
@@ -184,6 +239,8 @@ func NewLookupTable(projectedTopicCount int, aname string, isGuru bool, getTime
 		me.allTheSubscriptions[i].incoming = tmp
 		me.allTheSubscriptions[i].looker = me
 		me.allTheSubscriptions[i].index = i
+		me.allTheSubscriptions[i].loading = make(map[HashType][]interface{})
+		me.allTheSubscriptions[i].notStored = make(map[HashType]uint32)
 		go me.allTheSubscriptions[i].processMessages(me)
 	}
 	me.upstreamRouter = new(upstreamRouterStruct)
@@ -395,6 +452,8 @@ func (bucket *subscribeBucket) processMessages(me *LookupTableStruct) {
 			processPublish(me, bucket, v)
 		case *publishMessageDown:
 			processPublishDown(me, bucket, v)
+		case *wildcardPublishMessage:
+			processWildcardPublish(me, bucket, v)
 
 		case *unsubscribeMessage:
 			processUnsubscribe(me, bucket, v)
@@ -470,6 +529,9 @@ type subscribeBucket struct {
 	incoming        chan interface{}
 	looker          *LookupTableStruct
 	index           int
+
+	loading   map[HashType][]interface{} // the messages waiting for the Store. See store.go
+	notStored map[HashType]uint32        // the names that weren't there, until when
 }
 
 // NewWithInt64Comparator for HalfHash
@@ -497,7 +559,12 @@ func setWatcher(bucket *subscribeBucket, h *HashType, watcher *WatchedTopic) {
 			watcher.thetree = NewWithInt64Comparator()
 		}
 		hashtable[*h] = watcher
+		delete(bucket.notStored, *h)
 	} else {
+		old, ok := hashtable[*h]
+		if ok && old.isWildcard() {
+			bucket.looker.wildcards.remove(old.NameStr)
+		}
 		delete(hashtable, *h)
 	}
 }
@@ -766,7 +833,12 @@ func (wt *WatchedTopic) SetOption(key string, val string) {
 // FlushMarkerAndWait puts a command into the head of *all* the q's
 // and waits for *all* of them to arrive. This way we can wait. for testing.
 func (me *LookupTableStruct) FlushMarkerAndWait() {
+	me.flushMarkers()
+	me.loads.Wait() // and then what they started. See store.go
+	me.flushMarkers()
+}
 
+func (me *LookupTableStruct) flushMarkers() {
 	command := callBackCommand{}
 	command.name = "FlushMarkerAndWait"
 	command.callback = flushMarkerCallback
@@ -809,6 +881,9 @@ func guruDeleteRemappedAndGoneTopics(me *LookupTableStruct, bucket *subscribeBuc
 	//for _, s := range bucket.mySubscriptions {
 	s := bucket.mySubscriptions
 	for h, WatchedTopic := range s { //s {
+		if WatchedTopic.isWildcard() {
+			continue // every guru has these
+		}
 		index := me.upstreamRouter.maglev.Lookup(h.GetUint64())
 		// if the index is not me then delete the topic and tell upstream.
 		if index != cmd.index {
@@ -817,6 +892,7 @@ func guruDeleteRemappedAndGoneTopics(me *LookupTableStruct, bucket *subscribeBuc
 			unsub.Address.Bytes = make([]byte, 24)
 			h.GetBytes(unsub.Address.Bytes)
 			me.PushUp(&unsub, h)
+			me.billKept(WatchedTopic, me.getTime()) // the new guru doesn't know. See history.go
 			delete(s, h)
 		}
 		_ = WatchedTopic
@@ -825,6 +901,36 @@ func guruDeleteRemappedAndGoneTopics(me *LookupTableStruct, bucket *subscribeBuc
 	cmd.wg.Done()
 }
 
+// resubscribes are what an aide sends to a guru that doesn't have the topic.
+// One for the plain subscribers and one for each $share group. See shared.go
+func resubscribes(wt *WatchedTopic, h HashType) []*packets.Subscribe {
+	var groups []string
+	if wt.hasMember("") {
+		groups = append(groups, "")
+	}
+	groups = append(groups, wt.sharedGroups()...)
+	subs := make([]*packets.Subscribe, 0, len(groups))
+	for _, group := range groups {
+		sub := &packets.Subscribe{}
+		sub.SetOption("noack", []byte("y"))
+		if wt.isWildcard() {
+			sub.SetOption("topic", []byte(wt.NameStr))
+		} else {
+			setSeqOption(wt, &sub.PacketCommon) // see seq.go
+		}
+		setTTLOption(wt, &sub.PacketCommon) // see ttl.go
+		markBack(wt, &sub.PacketCommon)     // see seq.go
+		if group != "" {
+			sub.SetOption("share", []byte(group))
+		}
+		sub.Address.Type = packets.BinaryAddress
+		sub.Address.Bytes = make([]byte, 24)
+		h.GetBytes(sub.Address.Bytes)
+		subs = append(subs, sub)
+	}
+	return subs
+}
+
 func reSubscribeRemappedTopics(me *LookupTableStruct, bucket *subscribeBucket, cmd *callBackCommand) {
 
 	defer func() {
@@ -833,6 +939,13 @@ func reSubscribeRemappedTopics(me *LookupTableStruct, bucket *subscribeBucket, c
 	}()
 	s := bucket.mySubscriptions
 	for h, watchedTopic := range s {
+		if watchedTopic.isWildcard() {
+			// we don't know which gurus are new so tell them all again.
+			for _, sub := range resubscribes(watchedTopic, h) {
+				me.PushUpAll(sub)
+			}
+			continue
+		}
 		indexNew := me.upstreamRouter.maglev.Lookup(h.GetUint64())
 		indexOld := -1
 		if me.upstreamRouter.previousmaglev != nil {
@@ -840,11 +953,10 @@ func reSubscribeRemappedTopics(me *LookupTableStruct, bucket *subscribeBucket, c
 		}
 		// if the index has changed then push up a subscribe
 		if indexNew != indexOld {
-			sub := packets.Subscribe{}
-			sub.Address.Type = packets.BinaryAddress
-			sub.Address.Bytes = make([]byte, 24)
-			h.GetBytes(sub.Address.Bytes)
-			me.PushUp(&sub, h)
+			for _, sub := range resubscribes(watchedTopic, h) {
+				me.PushUp(sub, h)
+			}
+			pushUpRetained(me, watchedTopic, h) // the new guru doesn't have it.
 		}
 		_ = watchedTopic
 	}
@@ -867,16 +979,22 @@ func reSubscribeMyTopics(me *LookupTableStruct, bucket *subscribeBucket, cmd *ca
 		}
 
 		indexNew := me.upstreamRouter.maglev.Lookup(h.GetUint64())
-		if indexNew != cmd.index {
+		if indexNew != cmd.index && !watchedTopic.isWildcard() {
 			continue
 		}
-		sub := packets.Subscribe{}
 		// messy sub.SetOption("debg", []byte("12345678"))
-		sub.SetOption("noack", []byte("y"))
-		sub.Address.Type = packets.BinaryAddress
-		sub.Address.Bytes = make([]byte, 24)
-		h.GetBytes(sub.Address.Bytes)
-		me.PushUp(&sub, h)
-		_ = watchedTopic
+		if watchedTopic.isWildcard() {
+			// all the gurus have the wildcards. This one must be new.
+			if cmd.index < len(me.upstreamRouter.channels) {
+				for _, sub := range resubscribes(watchedTopic, h) {
+					me.upstreamRouter.channels[cmd.index].up <- sub
+				}
+			}
+			continue
+		}
+		for _, sub := range resubscribes(watchedTopic, h) {
+			me.PushUp(sub, h)
+		}
+		pushUpRetained(me, watchedTopic, h)
 	}
 }
@@ -163,6 +163,35 @@ func GetSubscriptionListCount(ownerPubk string) (int, error) {
 	return len(names), nil
 }
 
+// GetSubscriptionNames is all the names in the subscriptions collection. Just the names.
+func GetSubscriptionNames() ([]string, error) {
+
+	client, err := GetMongoClient()
+	if err != nil {
+		fmt.Println("mongo.Connect err", err)
+		return nil, err
+	}
+	subscriptions := client.Database("iot").Collection("subscriptions")
+
+	opts := options.Find().SetProjection(bson.D{{Key: "name", Value: 1}})
+	cursor, err := subscriptions.Find(context.TODO(), bson.D{}, opts)
+	if err != nil {
+		fmt.Println("mongo find names err", err)
+		return nil, err
+	}
+	var found []struct {
+		Name string `bson:"name"`
+	}
+	if err = cursor.All(context.TODO(), &found); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(found))
+	for _, f := range found {
+		names = append(names, f.Name)
+	}
+	return names, nil
+}
+
 func GetSubscription(hashedTopicStr string) (*WatchedTopic, bool) {
 
 	startTime := time.Now()
@@ -394,5 +423,84 @@ func InitIotTables() error {
 	_ = name
 	// fmt.Println("Name of tokens Index Created: " + name)
 
+	// the mqtt sessions. Mongo deletes them when they expire.
+	sessions := client.Database("iot").Collection("sessions")
+	indexModel = mongo.IndexModel{
+		Keys:    bson.D{{Key: "key", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}
+	_, err = sessions.Indexes().CreateOne(context.TODO(), indexModel)
+	if err != nil {
+		return err
+	}
+	indexModel = mongo.IndexModel{
+		Keys:    bson.D{{Key: "exp", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	}
+	_, err = sessions.Indexes().CreateOne(context.TODO(), indexModel)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
+
+// mongoTimeout is for the calls made while a client waits.
+const mongoTimeout = 2 * time.Second
+
+// savedSession is a row in the sessions. See mqtt-session.go
+type savedSession struct {
+	Key     string    `bson:"key"`
+	Val     []byte    `bson:"val"`
+	Expires time.Time `bson:"exp"` // there's a ttl index on this.
+}
+
+// GetSession returns what SaveSession saved.
+func GetSession(key string) ([]byte, bool) {
+	client, err := GetMongoClient()
+	if err != nil {
+		fmt.Println("mongo.Connect err", err)
+		return nil, false
+	}
+	ctx, cancel := context.WithTimeout(context.TODO(), mongoTimeout)
+	defer cancel()
+	sessions := client.Database("iot").Collection("sessions")
+	filter := bson.D{{Key: "key", Value: key}}
+	found := savedSession{}
+	err = sessions.FindOne(ctx, filter).Decode(&found)
+	if err != nil {
+		return nil, false
+	}
+	return found.Val, true
+}
+
+// SaveSession saves the session under the key until expires, unix seconds.
+func SaveSession(key string, val []byte, expires uint32) error {
+	client, err := GetMongoClient()
+	if err != nil {
+		fmt.Println("mongo.Connect err", err)
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.TODO(), mongoTimeout)
+	defer cancel()
+	sessions := client.Database("iot").Collection("sessions")
+	filter := bson.D{{Key: "key", Value: key}}
+	row := savedSession{key, val, time.Unix(int64(expires), 0)}
+	_, err = sessions.ReplaceOne(ctx, filter, row, options.Replace().SetUpsert(true))
+	return err
+}
+
+// DeleteSession deletes the session under the key.
+func DeleteSession(key string) error {
+	client, err := GetMongoClient()
+	if err != nil {
+		fmt.Println("mongo.Connect err", err)
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.TODO(), mongoTimeout)
+	defer cancel()
+	sessions := client.Database("iot").Collection("sessions")
+	filter := bson.D{{Key: "key", Value: key}}
+	_, err = sessions.DeleteOne(ctx, filter)
+	return err
+}
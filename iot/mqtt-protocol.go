@@ -22,7 +22,9 @@ import (
 	"net"
 	"reflect"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 
 	"time"
 
@@ -37,6 +39,11 @@ type mqttContact struct {
 	protoVersion   libmqtt.ProtoVersion
 	writeLibPacket func(libPacket libmqtt.Packet, cc *mqttContact) error
 	subscriptions  map[string]bool
+	qos            *mqttQos // see mqtt-qos.go
+	clientID       string
+	cleanSession   bool
+	sessionSeconds uint32 // how long to keep the session. See mqtt-session.go
+	handOver       atomic.Pointer[sessionHandOver]
 }
 
 // mqttWsContact is used with the react mqtt client that uses websockets from a browser.
@@ -73,7 +80,7 @@ func (cc *mqttWsContact) DoClosingWorkClose(err error) {
 	fmt.Println("mqttWsContact DoClosingWork con=", cc.GetKey().Sig(), err)
 
 	dis := packets.Disconnect{}
-	dis.SetOption("error", []byte(err.Error()))
+	packets.OptError.Set(&dis, []byte(err.Error()))
 	cc.WriteDownstream(&dis)
 	cc.mqttContact.DoClosingWork(err)
 }
@@ -119,6 +126,7 @@ func mqttConnection(tcpConn *net.TCPConn, ex *Executive) {
 	defer func() {
 		fmt.Println("mqtt mqttConnection close", cc.GetKey().Sig())
 		cc.DoClose(nil)
+		cc.parkSession()
 	}()
 
 	fmt.Println("new mqttConnection ", cc.GetKey().Sig())
@@ -190,11 +198,21 @@ func MQTTHandlePacket(cc *mqttContact, control libmqtt.Packet) {
 
 		p := &packets.Connect{}
 		if len(mq.Password) == 0 {
-			p.SetOption("token", []byte(mq.Username))
+			packets.OptToken.Set(p, mq.Username)
 		} else {
-			p.SetOption("token", []byte(mq.Password))
+			packets.OptToken.Set(p, mq.Password)
 		}
 		// = mq.Username
+		if mq.IsWill { // see will.go
+			p.SetOption("will", []byte(mq.WillTopic))
+			p.SetOption("willmsg", mq.WillMessage)
+			if mq.WillRetain {
+				p.SetOption("willretain", []byte("1"))
+			}
+			if mq.WillQos > libmqtt.Qos0 {
+				p.SetOption("willqos", []byte{'0' + byte(mq.WillQos)})
+			}
+		}
 		cc.protoVersion = mq.Version()
 		err := PushPacketUpFromBottom(cc, p)
 		if err != nil {
@@ -204,6 +222,19 @@ func MQTTHandlePacket(cc *mqttContact, control libmqtt.Packet) {
 			cc.DoClose(err)
 			return
 		}
+		if cc.GetToken() == nil {
+			return // refused. The CONNACK with the reason is on the way. See makeErrorAndDisconnect
+		}
+		cc.clientID = mq.ClientID
+		cc.cleanSession = mq.CleanSession
+		cc.sessionSeconds = sessionSeconds(mq)
+		if mq.Props != nil {
+			cc.qos.setWindow(mq.Props.MaxRecv)
+		}
+		if cc.clientID != "" {
+			go cc.connectSession() // it writes the ack. See mqtt-session.go
+			return
+		}
 		// write an ack
 		conack := &libmqtt.ConnAckPacket{}
 		err = cc.writeLibPacket(conack, cc)
@@ -213,17 +244,35 @@ func MQTTHandlePacket(cc *mqttContact, control libmqtt.Packet) {
 
 	case *libmqtt.PublishPacket: // handle upstream publish
 
+		if mq.Qos == libmqtt.Qos2 && !cc.qos.receive(mq.PacketID) {
+			cc.ackPublish(mq) // a resend. We already have it.
+			return
+		}
+		defer cc.ackPublish(mq)
+
 		// translate it to a Send
 		p := &packets.Send{}
 		p.Address.FromString(mq.TopicName)
 		p.Payload = mq.Payload
+		if mq.IsRetain {
+			p.SetOption("retain", []byte("1"))
+		}
+		if mq.Qos > libmqtt.Qos0 {
+			p.SetOption("qos", []byte{'0' + byte(mq.Qos)})
+		}
 		if mq.Props != nil { // copy the props
 			p.Source.FromString(mq.Props.RespTopic)
 			for k, v := range mq.Props.UserProps {
+				if packets.IsInternalOption(k) {
+					continue // see packets/options.go
+				}
 				p.SetOption(k, []byte(fmt.Sprint(v)))
 			}
 			if len(mq.Props.CorrelationData) > 0 {
-				p.SetOption("CorrelationData", mq.Props.CorrelationData)
+				p.SetOption(packets.OptCorrelationData, mq.Props.CorrelationData)
+			}
+			if mq.Props.MessageExpiryInterval != 0 {
+				p.SetExpires(cc.config.getTime() + mq.Props.MessageExpiryInterval) // see expiry.go
 			}
 		}
 		//fmt.Println("mqtt client publish ", p)
@@ -238,7 +287,7 @@ func MQTTHandlePacket(cc *mqttContact, control libmqtt.Packet) {
 				respAddres := mq.Props.RespTopic
 				p.Address.FromString(respAddres) // change the address
 				// leave the payload. Anon doesn't have a pubk so leave it
-				replyApiNumber, ok := p.GetOption("nonc")
+				replyApiNumber, ok := packets.OptNonce.Get(p)
 				if ok {
 					p.SetOption("api1", replyApiNumber)
 					_ = PushPacketUpFromBottom(cc, p)
@@ -268,15 +317,29 @@ func MQTTHandlePacket(cc *mqttContact, control libmqtt.Packet) {
 
 	case *libmqtt.SubscribePacket:
 
+		codes := make([]byte, 0, len(mq.Topics))
 		for _, topic := range mq.Topics {
 
 			// fmt.Println("mqtt client subscribes to", topic)
+			if strings.HasPrefix(topic.Name, serverOnlyPrefix) {
+				codes = append(codes, libmqtt.SubFail) // refused. See contacts.go
+				continue
+			}
 			cc.subscriptions[topic.Name] = true
+			granted := topic.Qos
+			if granted > libmqtt.Qos2 {
+				granted = libmqtt.Qos2
+			}
+			cc.qos.grant(topic.Name, granted)
+			codes = append(codes, granted)
 
 			p := &packets.Subscribe{}
 			p.Address.FromString(topic.Name)
 			if mq.Props != nil { // copy the props
 				for k, v := range mq.Props.UserProps {
+					if packets.IsInternalOption(k) {
+						continue
+					}
 					p.SetOption(k, []byte(fmt.Sprint(v)))
 				}
 			}
@@ -288,6 +351,8 @@ func MQTTHandlePacket(cc *mqttContact, control libmqtt.Packet) {
 		timeStr := strconv.Itoa(int(time.Now().Unix()))
 		// write an ack. TODO: make the suback actuall come from the subs coming down from the cluster
 		suback := &libmqtt.SubAckPacket{
+			PacketID: mq.PacketID,
+			Codes:    codes,
 			Props: &libmqtt.SubAckProps{
 				Reason:    "",
 				UserProps: libmqtt.UserProps{"unix-time": []string{timeStr}},
@@ -300,11 +365,19 @@ func MQTTHandlePacket(cc *mqttContact, control libmqtt.Packet) {
 			fmt.Println("mqtt conn fail", err) // needs prom counter
 		}
 
+	case *libmqtt.DisconnPacket:
+		// no will unless it's mqtt 5 and they asked for it with 0x04
+		if mq.Code != 0x04 {
+			cc.will.Store(nil)
+		}
+		cc.DoClose(nil)
+
 	case *libmqtt.UnsubPacket:
 		for _, topic := range mq.TopicNames {
 
 			fmt.Println("mqtt client unsubscribes to", topic)
 			delete(cc.subscriptions, topic)
+			cc.qos.ungrant(topic)
 
 			p := &packets.Unsubscribe{}
 			p.Address.FromString(topic)
@@ -316,6 +389,9 @@ func MQTTHandlePacket(cc *mqttContact, control libmqtt.Packet) {
 			_ = PushPacketUpFromBottom(cc, p)
 		}
 	default:
+		if cc.handleQosAck(control) {
+			return // puback etc.
+		}
 		if mq.Type() == libmqtt.PingReqPacket.Type() {
 			cc.writeLibPacket(libmqtt.PingRespPacket, cc)
 			fmt.Println("mqtt ping")
@@ -336,6 +412,10 @@ func MQTTHandlePacket(cc *mqttContact, control libmqtt.Packet) {
 // WriteDownstream translates the packets to mqtt and sends them down via TCP to the thing..
 func (cc *mqttContact) WriteDownstream(p packets.Interface) error {
 
+	if cc.handedOver(p) {
+		return nil // see mqtt-session.go
+	}
+
 	cc.commands <- ContactCommander{
 		who: "mqttContact WriteDownstream",
 		fn: func(dummy *ContactStruct) {
@@ -343,12 +423,23 @@ func (cc *mqttContact) WriteDownstream(p packets.Interface) error {
 			switch v := p.(type) {
 			case *packets.Connect:
 				fmt.Println("cant happen")
+			case *packets.ConnectAck:
+				// only the refusals come here. We write the good CONNACK ourselves.
+				code, reason := v.GetReason()
+				mq := &libmqtt.ConnAckPacket{}
+				mq.Code = mqttConnAckCode(code, cc.protoVersion)
+				if cc.protoVersion == 5 {
+					mq.Props = &libmqtt.ConnAckProps{}
+					mq.Props.Reason = reason
+				}
+				cc.writeLibPacket(mq, cc)
+				return
 			case *packets.Disconnect:
 
 				mq := &libmqtt.DisconnPacket{}
 				mq.Props = &libmqtt.DisconnProps{}
 				//	mq.MessageType = mqttpackets.Disconnect
-				estr, ok := v.GetOption("error")
+				estr, ok := packets.OptError.Get(v)
 				if ok {
 					mq.Props.Reason = string(estr)
 				}
@@ -389,7 +480,9 @@ func (cc *mqttContact) WriteDownstream(p packets.Interface) error {
 
 					keys, values := v.GetOptionKeys()
 					for i, key := range keys {
-						mq.Props.UserProps.Add(key, string(values[i]))
+						if !packets.IsInternalOption(key) {
+							mq.Props.UserProps.Add(key, string(values[i]))
+						}
 					}
 					mq.Props.UserProps.Add("atw", "test1")
 					mq.Props.UserProps.Add("lookup", "lookup")
@@ -400,38 +493,10 @@ func (cc *mqttContact) WriteDownstream(p packets.Interface) error {
 
 			case *packets.Send:
 
-				mq := &libmqtt.PublishPacket{}
-				mq.Payload = v.Payload
-				mq.TopicName = v.Address.String()
-				if len(mq.TopicName) == 0 {
-					mq.TopicName = "fixme_need_topic" // fixme:
-				}
-
-				if cc.protoVersion == 5 {
-					mq.Props = &libmqtt.PublishProps{}
-
-					mq.Props.UserProps = make(map[string][]string)
-					// if v.SourceAlias != nil { // fixme: must always be something.
-					// 	mq.Props.RespTopic = string(v.SourceAlias)
-					// } else {
-					// 	mq.Props.RespTopic = "xxTEST/TIMEefghijk"
-					// }
-					mq.Props.RespTopic = v.Source.String()
-					corrData, ok := v.GetOption("CorrelationData")
-					if ok {
-						mq.Props.CorrelationData = corrData
-					}
-					keys, values := v.GetOptionKeys()
-					for i, key := range keys {
-						if key != "CorrelationData" {
-							mq.Props.UserProps.Add(key, string(values[i]))
-						}
-					}
-					//mq.Props.UserProps.Add("atw", "test1")
-				}
+				mq := sendToPublish(v, cc.protoVersion)
 
 				//fmt.Println("mqtt WriteDownstream send topic = ", string(mq.TopicName))
-				err := cc.writeLibPacket(mq, cc) // mq.WriteTo(cc)
+				err := cc.writePublish(v, mq) // mq.WriteTo(cc)
 				_ = err
 
 				// since there's no message in mqtt disconnect, send the pub first.
@@ -457,6 +522,50 @@ func (cc *mqttContact) WriteDownstream(p packets.Interface) error {
 	return nil
 }
 
+// sendToPublish translates a Send to an mqtt publish. The qos is up to the caller.
+func sendToPublish(v *packets.Send, protoVersion libmqtt.ProtoVersion) *libmqtt.PublishPacket {
+
+	mq := &libmqtt.PublishPacket{}
+	mq.Payload = v.Payload
+	mq.TopicName = v.Address.String()
+	topic, hasTopic := v.GetOption("topic") // the real name. Wildcard subscribers need it.
+	if hasTopic {
+		mq.TopicName = string(topic)
+	}
+	retain, _ := v.GetOption("retain")
+	mq.IsRetain = string(retain) == "replay" // only the ones from the subscribe. See retained.go
+	if len(mq.TopicName) == 0 {
+		mq.TopicName = "fixme_need_topic" // fixme:
+	}
+
+	if protoVersion == 5 {
+		mq.Props = &libmqtt.PublishProps{}
+
+		mq.Props.UserProps = make(map[string][]string)
+		// if v.SourceAlias != nil { // fixme: must always be something.
+		// 	mq.Props.RespTopic = string(v.SourceAlias)
+		// } else {
+		// 	mq.Props.RespTopic = "xxTEST/TIMEefghijk"
+		// }
+		mq.Props.RespTopic = v.Source.String()
+		corrData, ok := v.GetOption(packets.OptCorrelationData)
+		if ok {
+			mq.Props.CorrelationData = corrData
+		}
+		keys, values := v.GetOptionKeys()
+		for i, key := range keys {
+			if packets.IsInternalOption(key) {
+				continue // see packets/options.go
+			}
+			if key != packets.OptCorrelationData && key != "topic" && key != "retain" && key != "qos" && key != "expires" {
+				mq.Props.UserProps.Add(key, string(values[i]))
+			}
+		}
+		//mq.Props.UserProps.Add("atw", "test1")
+	}
+	return mq
+}
+
 // localMakeMqttContact is a factory
 func localMakeMqttContact(config *ContactStructConfig, tcpConn *net.TCPConn) *mqttContact {
 	contact1 := &mqttContact{}
@@ -465,6 +574,7 @@ func localMakeMqttContact(config *ContactStructConfig, tcpConn *net.TCPConn) *mq
 	contact1.realReader = tcpConn
 	contact1.realWriter = tcpConn
 	contact1.subscriptions = make(map[string]bool)
+	contact1.qos = newMqttQos(config.getTime)
 
 	writer := func(mq libmqtt.Packet, cc *mqttContact) error {
 		mq.SetVersion(cc.protoVersion)
@@ -476,6 +586,31 @@ func localMakeMqttContact(config *ContactStructConfig, tcpConn *net.TCPConn) *mq
 	return contact1
 }
 
+// mqttConnAckCode is the CONNACK code for the reason. Our codes are the mqtt 5 ones.
+// mqtt 3 only has a few.
+func mqttConnAckCode(code packets.ReasonCode, protoVersion libmqtt.ProtoVersion) byte {
+	if protoVersion == 5 {
+		return byte(code)
+	}
+	switch code {
+	case packets.ReasonSuccess:
+		return libmqtt.CodeSuccess
+	case packets.ReasonBadToken, packets.ReasonBadIssuer:
+		return libmqtt.CodeBadUsernameOrPassword
+	case packets.ReasonServerFull:
+		return libmqtt.CodeServerUnavailable
+	}
+	return libmqtt.CodeUnauthorized
+}
+
+func isMqttContact(ssi ContactInterface) bool {
+	switch ssi.(type) {
+	case *mqttContact, *mqttWsContact:
+		return true
+	}
+	return false
+}
+
 // WebSocketLoop loops reading mqtt packets
 func WebSocketLoop(wsConn *websocket.Conn, config *ContactStructConfig) {
 
@@ -485,6 +620,8 @@ func WebSocketLoop(wsConn *websocket.Conn, config *ContactStructConfig) {
 	cc.netDotTCPConn = nil
 	cc.realReader = nil // set below.
 	cc.realWriter = &cc.writebuff
+	cc.subscriptions = make(map[string]bool)
+	cc.qos = newMqttQos(config.getTime)
 	// todo out-line this
 	cc.writeLibPacket = func(mq libmqtt.Packet, ccx *mqttContact) error {
 
@@ -581,6 +718,7 @@ func WebSocketLoop(wsConn *websocket.Conn, config *ContactStructConfig) {
 		MQTTHandlePacket(&cc.mqttContact, control)
 	}
 	fmt.Println("returned from ReadMessage loop ")
+	cc.parkSession()
 }
 
 // IsWholeMqttPacket returns true if the data is an mqtt packet and returns the length used.
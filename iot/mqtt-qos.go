@@ -0,0 +1,449 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package iot
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/awootton/knotfreeiot/packets"
+	"github.com/awootton/libmqtt"
+)
+
+// QoS 1 and 2 for the mqtt contacts. Like the spec.
+//
+// Incoming publishes get a puback, or a pubrec. The qos 2 ones are remembered by packet id
+// until the pubrel so that a resend isn't published twice.
+//
+// Outgoing publishes are delivered at the lower of the publisher's qos, which travels
+// in the "qos" option, and the qos the subscription was granted. They stay in flight until acked.
+// At most MqttInflightWindow are in flight at once and the rest wait their turn.
+//
+// Nothing is resent while connected. When a client with a session goes away its mqttQos
+// keeps what's in flight, and what arrives after that waits in pending, see park.
+// toState and fromState turn that into the saved form and back. When the client
+// reconnects fromState says what to write: a pubrel for the ones that got a pubrec and
+// everything else still in flight again with the dup flag, then pending as the window allows.
+// Where the session is kept is in mqtt-session.go
+//
+// The ones with an "expires" are thrown away if they're still pending when it passes.
+// See expiry.go
+
+// MqttInflightWindow is how many qos 1 and 2 publishes can be unacked at once, per contact.
+// A client can ask for less with receive maximum.
+var MqttInflightWindow = 32
+
+// mqttPendingMax is how many can wait for room in the window before we start dropping the oldest.
+const mqttPendingMax = 1024
+
+// mqttQos is the qos state of one mqtt contact.
+// The reader and the contact's command loop both use it so it has a lock.
+type mqttQos struct {
+	mux sync.Mutex
+
+	nextID   uint16
+	window   int
+	inflight map[uint16]*libmqtt.PublishPacket // sent and not done yet
+	order    []uint16                          // the inflight ids in the order they were sent
+	released map[uint16]bool                   // qos 2 that got a pubrec. We sent a pubrel and wait for the pubcomp
+	pending  []*libmqtt.PublishPacket          // waiting for room in the window
+	received map[uint16]bool                   // incoming qos 2 that we published. Waiting for the pubrel.
+
+	granted map[string]libmqtt.QosLevel // from the subscription name, and the hashed name, to the qos
+
+	expires map[*libmqtt.PublishPacket]uint32 // the pending and inflight that have an "expires"
+	now     func() uint32
+}
+
+func newMqttQos(now func() uint32) *mqttQos {
+	q := &mqttQos{}
+	q.now = now
+	q.expires = make(map[*libmqtt.PublishPacket]uint32)
+	q.window = MqttInflightWindow
+	q.inflight = make(map[uint16]*libmqtt.PublishPacket)
+	q.released = make(map[uint16]bool)
+	q.received = make(map[uint16]bool)
+	q.granted = make(map[string]libmqtt.QosLevel)
+	return q
+}
+
+// setWindow is for the receive maximum from the client. Zero means they didn't say.
+func (q *mqttQos) setWindow(max uint16) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	q.window = MqttInflightWindow
+	if max != 0 && int(max) < q.window {
+		q.window = int(max)
+	}
+}
+
+// grant remembers the qos of a subscription by name and by the hash of the name
+// because the publishes that come down might only have the hash.
+func (q *mqttQos) grant(name string, qos libmqtt.QosLevel) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	name = sharedFilter(name) // see shared.go
+	q.granted[name] = qos
+	q.granted[hashedTopicName(name)] = qos
+}
+
+func (q *mqttQos) ungrant(name string) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	name = sharedFilter(name)
+	delete(q.granted, name)
+	delete(q.granted, hashedTopicName(name))
+}
+
+// grantedQos is the highest qos of the subscriptions that match the topic.
+func (q *mqttQos) grantedQos(topic string) libmqtt.QosLevel {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	qos, ok := q.granted[topic]
+	if ok {
+		return qos
+	}
+	qos = libmqtt.Qos0
+	for name, g := range q.granted {
+		if g > qos && IsWildcardTopic([]byte(name)) && MatchTopic(name, topic) {
+			qos = g
+		}
+	}
+	return qos
+}
+
+func hashedTopicName(name string) string {
+	a := packets.AddressUnion{}
+	a.FromString(name)
+	a.EnsureAddressIsBinary()
+	return a.String()
+}
+
+// publish returns the packet, with an id, if it can go now.
+// Otherwise it waits in pending and we return nil.
+func (q *mqttQos) publish(mq *libmqtt.PublishPacket) *libmqtt.PublishPacket {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	if len(q.inflight) < q.window && len(q.pending) == 0 {
+		q.startLocked(mq)
+		return mq
+	}
+	if len(q.pending) >= mqttPendingMax {
+		fmt.Println("mqtt qos pending full. dropping", q.pending[0].TopicName)
+		delete(q.expires, q.pending[0])
+		q.pending = q.pending[1:]
+	}
+	q.pending = append(q.pending, mq)
+	return nil
+}
+
+// setExpires remembers when mq expires, if v has an "expires".
+func (q *mqttQos) setExpires(v *packets.Send, mq *libmqtt.PublishPacket) {
+	when, ok := v.GetExpires()
+	if !ok {
+		return
+	}
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	q.expires[mq] = when
+}
+
+// nextPendingLocked is the next one from pending that hasn't expired, or nil.
+func (q *mqttQos) nextPendingLocked() *libmqtt.PublishPacket {
+	for len(q.pending) > 0 {
+		mq := q.pending[0]
+		q.pending = q.pending[1:]
+		when, ok := q.expires[mq]
+		if ok && q.now() > when {
+			delete(q.expires, mq)
+			expiredDropped.Inc()
+			continue
+		}
+		return mq
+	}
+	return nil
+}
+
+func (q *mqttQos) startLocked(mq *libmqtt.PublishPacket) {
+	for {
+		q.nextID++
+		if q.nextID == 0 {
+			continue
+		}
+		if _, used := q.inflight[q.nextID]; !used {
+			break
+		}
+	}
+	mq.PacketID = q.nextID
+	q.inflight[mq.PacketID] = mq
+	q.order = append(q.order, mq.PacketID)
+	when, ok := q.expires[mq]
+	if ok && mq.Props != nil {
+		mq.Props.MessageExpiryInterval = expiryInterval(when, q.now()) // what's left
+	}
+}
+
+// done is for the puback or the pubcomp. Returns the ones that can go now.
+func (q *mqttQos) done(id uint16) []*libmqtt.PublishPacket {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	mq, ok := q.inflight[id]
+	if !ok {
+		return nil // a dup, or junk.
+	}
+	delete(q.expires, mq)
+	delete(q.inflight, id)
+	delete(q.released, id)
+	for i, o := range q.order {
+		if o == id {
+			q.order = append(q.order[:i], q.order[i+1:]...)
+			break
+		}
+	}
+	var ready []*libmqtt.PublishPacket
+	for len(q.inflight) < q.window {
+		mq := q.nextPendingLocked()
+		if mq == nil {
+			break
+		}
+		q.startLocked(mq)
+		ready = append(ready, mq)
+	}
+	return ready
+}
+
+// rec is for the pubrec. Returns false if we don't know about it.
+func (q *mqttQos) rec(id uint16) bool {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	mq, ok := q.inflight[id]
+	if !ok || mq.Qos != libmqtt.Qos2 {
+		return false
+	}
+	q.released[id] = true
+	return true
+}
+
+// receive is for an incoming qos 2 publish. Returns false if we already published it.
+func (q *mqttQos) receive(id uint16) bool {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	if q.received[id] {
+		return false
+	}
+	q.received[id] = true
+	return true
+}
+
+// release is for the pubrel from the client.
+func (q *mqttQos) release(id uint16) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	delete(q.received, id)
+}
+
+// toState is for saving. The caller adds the subscriptions.
+func (q *mqttQos) toState(version libmqtt.ProtoVersion) *mqttSessionState {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	st := &mqttSessionState{}
+	st.NextID = q.nextID
+	st.Version = version
+	for _, id := range q.order {
+		mq := q.inflight[id]
+		mq.SetVersion(version)
+		st.Inflight = append(st.Inflight, mqttSessionPublish{Released: q.released[id], Packet: mq.Bytes(), Expires: q.expires[mq]})
+	}
+	for _, mq := range q.pending {
+		mq.SetVersion(version)
+		st.Pending = append(st.Pending, mqttSessionPublish{Packet: mq.Bytes(), Expires: q.expires[mq]})
+	}
+	for id := range q.received {
+		st.Received = append(st.Received, id)
+	}
+	return st
+}
+
+// fromState is after a reconnect. It returns what to write now: a pubrel for the ones
+// that got a pubrec, the publish again, with dup set, for the rest,
+// and then whatever fits from pending. The ones that expired while we waited are gone.
+func (q *mqttQos) fromState(st *mqttSessionState) []libmqtt.Packet {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	q.nextID = st.NextID
+	now := q.now()
+	var result []libmqtt.Packet
+	for _, sp := range st.Inflight {
+		mq, err := decodeSessionPublish(sp.Packet, st.Version)
+		if err != nil {
+			fmt.Println("mqtt session bad inflight", err)
+			continue
+		}
+		if sp.Expires != 0 && !sp.Released {
+			if now > sp.Expires {
+				expiredDropped.Inc()
+				continue
+			}
+			q.expires[mq] = sp.Expires
+			if mq.Props != nil {
+				mq.Props.MessageExpiryInterval = expiryInterval(sp.Expires, now)
+			}
+		}
+		q.inflight[mq.PacketID] = mq
+		q.order = append(q.order, mq.PacketID)
+		if sp.Released {
+			q.released[mq.PacketID] = true
+			result = append(result, &libmqtt.PubRelPacket{PacketID: mq.PacketID})
+			continue
+		}
+		mq.IsDup = true
+		result = append(result, mq)
+	}
+	for _, sp := range st.Pending {
+		mq, err := decodeSessionPublish(sp.Packet, st.Version)
+		if err != nil {
+			fmt.Println("mqtt session bad pending", err)
+			continue
+		}
+		if sp.Expires != 0 {
+			q.expires[mq] = sp.Expires
+		}
+		q.pending = append(q.pending, mq)
+	}
+	for _, id := range st.Received {
+		q.received[id] = true
+	}
+	for len(q.inflight) < q.window {
+		mq := q.nextPendingLocked()
+		if mq == nil {
+			break
+		}
+		q.startLocked(mq)
+		result = append(result, mq)
+	}
+	return result
+}
+
+func decodeSessionPublish(data []byte, version libmqtt.ProtoVersion) (*libmqtt.PublishPacket, error) {
+	p, err := libmqtt.Decode(version, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	mq, ok := p.(*libmqtt.PublishPacket)
+	if !ok {
+		return nil, errors.New("not a publish")
+	}
+	return mq, nil
+}
+
+// park keeps a publish for a client that's away. The oldest go first when it's full.
+func (q *mqttQos) park(mq *libmqtt.PublishPacket, maxBytes int) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	size := len(mq.Payload)
+	for _, p := range q.pending {
+		size += len(p.Payload)
+	}
+	for len(q.pending) > 0 && (size > maxBytes || len(q.pending) >= mqttPendingMax) {
+		fmt.Println("mqtt session full. dropping", q.pending[0].TopicName)
+		size -= len(q.pending[0].Payload)
+		delete(q.expires, q.pending[0])
+		q.pending = q.pending[1:]
+	}
+	if size > maxBytes {
+		fmt.Println("mqtt session publish too big", mq.TopicName)
+		delete(q.expires, mq)
+		return
+	}
+	q.pending = append(q.pending, mq)
+}
+
+// writePublish is WriteDownstream for a publish. The qos gets worked out here.
+func (cc *mqttContact) writePublish(v *packets.Send, mq *libmqtt.PublishPacket) error {
+
+	mq.Qos = deliveryQos(v, cc.qos.grantedQos(mq.TopicName))
+	if mq.Qos == libmqtt.Qos0 {
+		when, ok := v.GetExpires()
+		if ok && mq.Props != nil {
+			mq.Props.MessageExpiryInterval = expiryInterval(when, cc.config.getTime())
+		}
+		return cc.writeLibPacket(mq, cc)
+	}
+	cc.qos.setExpires(v, mq)
+	mq = cc.qos.publish(mq)
+	if mq == nil {
+		return nil // it waits
+	}
+	return cc.writeLibPacket(mq, cc)
+}
+
+// deliveryQos is the lower of the publisher's qos and the subscription's.
+func deliveryQos(v *packets.Send, granted libmqtt.QosLevel) libmqtt.QosLevel {
+	qos := libmqtt.Qos0
+	pubQos, ok := v.GetOption("qos")
+	if ok && len(pubQos) == 1 && pubQos[0] >= '1' && pubQos[0] <= '2' {
+		qos = libmqtt.QosLevel(pubQos[0] - '0')
+	}
+	if granted < qos {
+		qos = granted
+	}
+	return qos
+}
+
+// handleQosAck deals with the puback, pubrec, pubrel and pubcomp. Returns false if it's something else.
+func (cc *mqttContact) handleQosAck(control libmqtt.Packet) bool {
+
+	var ready []*libmqtt.PublishPacket
+	switch mq := control.(type) {
+	case *libmqtt.PubAckPacket:
+		ready = cc.qos.done(mq.PacketID)
+	case *libmqtt.PubRecvPacket:
+		if cc.qos.rec(mq.PacketID) {
+			cc.writeLibPacket(&libmqtt.PubRelPacket{PacketID: mq.PacketID}, cc)
+		}
+	case *libmqtt.PubCompPacket:
+		ready = cc.qos.done(mq.PacketID)
+	case *libmqtt.PubRelPacket:
+		// always answer. Some clients send a pubrel after a pubcomp.
+		cc.qos.release(mq.PacketID)
+		cc.writeLibPacket(&libmqtt.PubCompPacket{PacketID: mq.PacketID}, cc)
+	default:
+		return false
+	}
+	for _, p := range ready {
+		err := cc.writeLibPacket(p, cc)
+		if err != nil {
+			fmt.Println("mqtt qos write fail", err)
+		}
+	}
+	return true
+}
+
+// ackPublish sends the puback or the pubrec after an incoming publish.
+func (cc *mqttContact) ackPublish(mq *libmqtt.PublishPacket) {
+	var err error
+	switch mq.Qos {
+	case libmqtt.Qos1:
+		err = cc.writeLibPacket(&libmqtt.PubAckPacket{PacketID: mq.PacketID}, cc)
+	case libmqtt.Qos2:
+		err = cc.writeLibPacket(&libmqtt.PubRecvPacket{PacketID: mq.PacketID}, cc)
+	}
+	if err != nil {
+		fmt.Println("mqtt publish ack fail", err)
+	}
+}
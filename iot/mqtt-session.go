@@ -0,0 +1,433 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package iot
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/awootton/knotfreeiot/packets"
+	"github.com/awootton/knotfreeiot/tokens"
+	"github.com/awootton/libmqtt"
+)
+
+// Persistent mqtt sessions. That's a client id and clean session false in mqtt 3
+// or a session expiry interval in mqtt 5.
+//
+// When a client with a session goes away an mqttParkedSession takes its place on the aide.
+// It subscribes to everything the client was subscribed to and keeps the qos 1 and 2
+// publishes until the client comes back or the session expires. The qos 0 ones are dropped.
+//
+// The session is saved in the Store (see store.go) under the owner of the token and the client id.
+// So the client can come back to any aide, with a new token, and the session isn't lost if the aide
+// goes away. Only what was saved is there then. The parked session saves when it's made and then on
+// the heartbeat when there's something new. It's not a topic so no client can read or clear it.
+//
+// A connection with a client id takes the session, in the background so the connect doesn't wait.
+// From the parked session if it's on the same aide. Else, if the Store has one, it sends a publish
+// to the session's server only address (see serverAddress in contacts.go) and the parked session,
+// wherever it is, saves what it has and says so. Then it reads the Store. If nobody says, for
+// storeWait, the aide is gone and the Store has what there is. Then it deletes it.
+// A clean session connect just closes the parked session and deletes it.
+//
+// It's all bounded by the session expiry, by MqttSessionExpiryMax, by when the token expires,
+// and the bytes kept are limited to what the token could have sent in that time.
+// The parked session is a contact so it's billed like one.
+
+// MqttSessionExpiryMax is the longest we keep a session, in seconds.
+// mqtt 3 doesn't have a session expiry so they all get this.
+var MqttSessionExpiryMax uint32 = 24 * 60 * 60
+
+// mqttSessionSaveSeconds is how often a parked session saves even if nothing happened.
+// So the Store has something recent if the aide goes away.
+const mqttSessionSaveSeconds = 5 * 60
+
+// mqttSessionState is what gets saved.
+type mqttSessionState struct {
+	Subscriptions map[string]libmqtt.QosLevel `json:"subs"`
+	Inflight      []mqttSessionPublish        `json:"inflight,omitempty"`
+	Pending       []mqttSessionPublish        `json:"pending,omitempty"`
+	Received      []uint16                    `json:"rcvd,omitempty"` // incoming qos 2 waiting for a pubrel
+	NextID        uint16                      `json:"next"`
+	Version       libmqtt.ProtoVersion        `json:"v"`
+	Expires       uint32                      `json:"exp"` // unix seconds
+}
+
+// mqttSessionPublish is a publish as it goes on the wire.
+type mqttSessionPublish struct {
+	Released bool   `json:"rel,omitempty"` // got the pubrec so only the pubrel is left
+	Packet   []byte `json:"p"`
+	Expires  uint32 `json:"exp,omitempty"` // unix seconds. See expiry.go
+}
+
+// sessionSeconds is how long the client wants the session kept after it goes away.
+func sessionSeconds(mq *libmqtt.ConnPacket) uint32 {
+	seconds := uint32(0)
+	if mq.Version() == libmqtt.V5 {
+		if mq.Props != nil {
+			seconds = mq.Props.SessionExpiryInterval
+		}
+	} else if !mq.CleanSession {
+		seconds = MqttSessionExpiryMax
+	}
+	if seconds > MqttSessionExpiryMax {
+		seconds = MqttSessionExpiryMax
+	}
+	return seconds
+}
+
+// sessionKey is where the session is kept in the Store. It's per owner, the pubk in the token,
+// so a renewed token still has it and someone else can't take it just by knowing the client id.
+// A token without a pubk only has its JWTID.
+func sessionKey(token *tokens.KnotFreeTokenPayload, clientID string) string {
+	owner := token.Pubk
+	if owner == "" {
+		owner = token.JWTID
+	}
+	return owner + "/" + clientID
+}
+
+// takeSession tells the parked session, on any aide, that it's over.
+// With a reply it saves first and says so there. See handOver
+func takeSession(ci ContactInterface, key string, reply *packets.AddressUnion) {
+	p := &packets.Send{}
+	p.Address = ci.GetConfig().serverAddress(serverOnlyPrefix + "session/" + key)
+	p.Source.FromString("mqtt_session")
+	if reply != nil {
+		p.Source = *reply
+	}
+	err := PushPacketUpFromBottom(ci, p)
+	if err != nil {
+		fmt.Println("mqtt takeSession fail", err)
+	}
+}
+
+// sessionHandOver is the new aide waiting for the parked session to save. See handOverSession
+type sessionHandOver struct {
+	address packets.AddressUnion
+	done    chan struct{}
+}
+
+// connectSession is after the connect, in the background, so the reading doesn't wait
+// on the Store or on the other aide. It writes the CONNACK.
+func (cc *mqttContact) connectSession() {
+	session := cc.fetchSession()
+	conack := &libmqtt.ConnAckPacket{}
+	conack.Present = session != nil
+	err := cc.writeLibPacket(conack, cc)
+	if err != nil {
+		fmt.Println("mqtt connack fail", err) // needs prom counter
+	}
+	if session != nil {
+		cc.resumeSession(session)
+	}
+}
+
+// fetchSession returns nil if there's no session.
+// A clean session clears the old one.
+func (cc *mqttContact) fetchSession() *mqttSessionState {
+
+	key := sessionKey(cc.GetToken(), cc.clientID)
+	var st *mqttSessionState
+	if !cc.cleanSession {
+		if v, ok := cc.config.parked.Load(key); ok {
+			st = v.(*mqttParkedSession).take()
+		} else {
+			st = cc.handOverSession(key)
+		}
+	}
+	err := cc.config.GetStore().DeleteSession(key)
+	if err != nil {
+		fmt.Println("mqtt fetchSession delete fail", err)
+	}
+	takeSession(cc, key, nil)
+	if st == nil || st.Expires <= cc.config.getTime() {
+		return nil
+	}
+	return st
+}
+
+// handOverSession is when it's not parked here. The parked session, wherever it is,
+// saves what came since its last save so nothing parked there is lost.
+func (cc *mqttContact) handOverSession(key string) *mqttSessionState {
+
+	store := cc.config.GetStore()
+	payload, ok := store.GetSession(key)
+	if !ok {
+		return nil // it was never parked
+	}
+	ho := &sessionHandOver{done: make(chan struct{}, 1)}
+	ho.address = cc.config.serverAddress(serverOnlyPrefix + "session/" + key + "/" + cc.GetKey().String())
+	cc.handOver.Store(ho) // see WriteDownstream in mqtt-protocol.go
+	sub := &packets.Subscribe{}
+	sub.Address = ho.address
+	sub.SetOption("noack", []byte("y"))
+	_ = PushPacketUpFromBottom(cc, sub)
+	takeSession(cc, key, &ho.address)
+	select {
+	case <-ho.done:
+		payload, ok = store.GetSession(key)
+	case <-time.After(storeWait): // see store.go
+		fmt.Println("mqtt session hand over timeout", cc.clientID)
+	}
+	unsub := &packets.Unsubscribe{}
+	unsub.Address = ho.address
+	_ = PushPacketUpFromBottom(cc, unsub)
+	if !ok {
+		return nil
+	}
+	st := &mqttSessionState{}
+	err := json.Unmarshal(payload, st)
+	if err != nil {
+		fmt.Println("mqtt fetchSession bad session", err)
+		return nil
+	}
+	return st
+}
+
+// handedOver is true for the parked session saying it saved.
+func (cc *mqttContact) handedOver(p packets.Interface) bool {
+	ho := cc.handOver.Load()
+	v, ok := p.(*packets.Send)
+	if ho == nil || !ok || !bytes.Equal(v.Address.Bytes, ho.address.Bytes) {
+		return false
+	}
+	select {
+	case ho.done <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// resumeSession is after the connack. Subscribe again, tell the parked session to go,
+// and send what's still in flight.
+func (cc *mqttContact) resumeSession(st *mqttSessionState) {
+
+	maxSubs := int(cc.GetToken().Subscriptions)
+	for name, qos := range st.Subscriptions {
+		if len(cc.subscriptions) >= maxSubs {
+			fmt.Println("mqtt resumeSession too many subscriptions", cc.clientID)
+			break
+		}
+		cc.subscriptions[name] = true
+		cc.qos.grant(name, qos)
+		sub := &packets.Subscribe{}
+		sub.Address.FromString(name)
+		sub.SetOption("noack", []byte("y"))
+		err := PushPacketUpFromBottom(cc, sub)
+		if err != nil {
+			fmt.Println("mqtt resumeSession sub fail", err)
+		}
+	}
+	for _, p := range cc.qos.fromState(st) {
+		err := cc.writeLibPacket(p, cc)
+		if err != nil {
+			fmt.Println("mqtt resend fail", err)
+			return
+		}
+	}
+}
+
+// parkSession is when the connection is gone. If the client has a session
+// an mqttParkedSession takes over.
+func (cc *mqttContact) parkSession() {
+
+	token := cc.GetToken()
+	if cc.clientID == "" || cc.sessionSeconds == 0 || token == nil {
+		return
+	}
+	now := cc.config.GetLookup().getTime()
+	expires := now + cc.sessionSeconds
+	if token.ExpirationTime < expires {
+		expires = token.ExpirationTime
+	}
+	if expires <= now {
+		return
+	}
+
+	ps := &mqttParkedSession{}
+	AddContactStruct(&ps.ContactStruct, ps, cc.config)
+	ps.token = token
+	ps.clientID = cc.clientID
+	ps.key = sessionKey(token, cc.clientID)
+	ps.version = cc.protoVersion
+	ps.expires = expires
+	ps.qos = cc.qos
+	ps.maxBytes = int(token.Output * float64(expires-now))
+	ps.subs = make(map[string]libmqtt.QosLevel)
+	for name := range cc.subscriptions {
+		ps.subs[name] = cc.qos.grantedQos(sharedFilter(name))
+	}
+	ps.SetExpires(expires)
+
+	fmt.Println("mqtt parking session", cc.clientID, len(ps.subs))
+	for name := range ps.subs {
+		sub := &packets.Subscribe{}
+		sub.Address.FromString(name)
+		sub.SetOption("noack", []byte("y"))
+		_ = PushPacketUpFromBottom(ps, sub)
+	}
+	ps.address = cc.config.serverAddress(serverOnlyPrefix + "session/" + ps.key)
+	sub := &packets.Subscribe{}
+	sub.Address = ps.address
+	sub.SetOption("noack", []byte("y"))
+	_ = PushPacketUpFromBottom(ps, sub)
+
+	cc.config.parked.Store(ps.key, ps)
+	ps.save(now)
+}
+
+// mqttParkedSession stands in for an mqtt client that has a session and went away.
+type mqttParkedSession struct {
+	ContactStruct
+
+	clientID string
+	key      string               // see sessionKey
+	address  packets.AddressUnion // where the client says it's back. See takeSession
+	version  libmqtt.ProtoVersion
+	expires  uint32
+	subs     map[string]libmqtt.QosLevel
+	qos      *mqttQos
+	maxBytes int
+
+	dirty    atomic.Bool
+	saveMux  sync.Mutex
+	nextSave uint32
+	closed   bool // taken or expired. Under the saveMux.
+}
+
+// WriteDownstream keeps the qos 1 and 2 publishes for later.
+func (ps *mqttParkedSession) WriteDownstream(p packets.Interface) error {
+
+	v, ok := p.(*packets.Send)
+	if !ok || ps.IsClosed() {
+		return nil
+	}
+	if bytes.Equal(v.Address.Bytes, ps.address.Bytes) {
+		// the client is back, maybe on another aide, or it wants a clean session. See takeSession
+		go ps.handOver(v.Source)
+		return nil
+	}
+	if dropExpired(v, ps.config.getTime()) {
+		return nil // see expiry.go
+	}
+	mq := sendToPublish(v, ps.version)
+	mq.Qos = deliveryQos(v, ps.qos.grantedQos(mq.TopicName))
+	if mq.Qos == libmqtt.Qos0 {
+		return nil
+	}
+	ps.qos.setExpires(v, mq)
+	ps.qos.park(mq, ps.maxBytes)
+	ps.dirty.Store(true)
+	return nil
+}
+
+// take is when the client is back on this aide. It gets the state without going to the Store.
+func (ps *mqttParkedSession) take() *mqttSessionState {
+	ps.close(errors.New("mqtt session taken"))
+	ps.saveMux.Lock()
+	defer ps.saveMux.Unlock()
+	st := ps.qos.toState(ps.version)
+	st.Subscriptions = ps.subs
+	st.Expires = ps.expires
+	return st
+}
+
+// handOver saves and then tells the new aide at reply, if there's a reply.
+// Not for a clean session, that would put it back.
+func (ps *mqttParkedSession) handOver(reply packets.AddressUnion) {
+	saving := reply.Type == packets.BinaryAddress
+	ps.saveMux.Lock()
+	if ps.closed {
+		ps.saveMux.Unlock()
+		return
+	}
+	if saving {
+		ps.saveLocked(ps.config.getTime())
+	}
+	ps.closed = true
+	ps.saveMux.Unlock()
+	if saving {
+		p := &packets.Send{}
+		p.Address = reply
+		p.Source.FromString("mqtt_session")
+		err := PushPacketUpFromBottom(ps, p)
+		if err != nil {
+			fmt.Println("mqtt session hand over fail", err)
+		}
+	}
+	ps.close(errors.New("mqtt session taken"))
+}
+
+// close stops the saves and unsubscribes.
+func (ps *mqttParkedSession) close(err error) {
+	ps.saveMux.Lock()
+	ps.closed = true
+	ps.saveMux.Unlock()
+	ps.config.parked.CompareAndDelete(ps.key, ps)
+	go ps.DoClose(err)
+}
+
+// Heartbeat saves the session if it changed and closes it when it expires.
+func (ps *mqttParkedSession) Heartbeat(now uint32) {
+
+	if ps.IsClosed() {
+		return
+	}
+	if now > ps.expires {
+		fmt.Println("mqtt session expired", ps.clientID)
+		ps.close(errors.New("mqtt session expired"))
+		err := ps.config.GetStore().DeleteSession(ps.key)
+		if err != nil {
+			fmt.Println("mqtt session delete fail", err)
+		}
+		return
+	}
+	ps.ContactStruct.Heartbeat(now)
+	if ps.dirty.Swap(false) || now >= ps.nextSave {
+		ps.save(now)
+	}
+}
+
+func (ps *mqttParkedSession) save(now uint32) {
+	ps.saveMux.Lock()
+	defer ps.saveMux.Unlock()
+	if ps.closed {
+		return // it was taken. Don't put it back.
+	}
+	ps.saveLocked(now)
+}
+
+func (ps *mqttParkedSession) saveLocked(now uint32) {
+	st := ps.qos.toState(ps.version)
+	st.Subscriptions = ps.subs
+	st.Expires = ps.expires
+	payload, err := json.Marshal(st)
+	if err != nil {
+		fmt.Println("mqtt session save fail", err)
+		return
+	}
+	ps.nextSave = now + mqttSessionSaveSeconds
+	err = ps.config.GetStore().SaveSession(ps.key, payload, ps.expires)
+	if err != nil {
+		fmt.Println("mqtt session save fail", err)
+	}
+}
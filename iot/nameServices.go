@@ -37,7 +37,7 @@ func (api ApiHandler) NameService(w http.ResponseWriter, req *http.Request) {
 	look.Address.FromString(aName)
 	look.SetOption("cmd", []byte(command))
 	look.SetOption("pubk", []byte(theirPubk))
-	look.SetOption("nonc", []byte(nonceStr)) // raw nonce
+	packets.OptNonce.Set(&look, []byte(nonceStr)) // raw nonce
 
 	binSealed, err := base64.RawURLEncoding.DecodeString(sealed)
 	if err != nil {
@@ -131,14 +131,15 @@ func createNameFunc(msg string, args []string, callContext interface{}) string {
 			fmt.Println("add name: name already exists", name)
 			watchedTopic.Expires = payload.ExpirationTime
 			watchedTopic.Jwtid = payload.JWTID
+			watchedTopic.ownerJwtid = payload.JWTID
 			watchedTopic.Owner = payload.Pubk
-			err = SaveSubscription(watchedTopic)
+			err = me.config.GetStore().SaveTopic(watchedTopic)
 			if err != nil {
 				fmt.Println("add name: save subscription err", err)
 			}
 		} else {
 			// try to pull it first
-			gotwatchedTopic, ok := GetSubscription(lookMsg.topicHash.ToBase64())
+			gotwatchedTopic, ok := me.config.GetStore().GetTopic(lookMsg.topicHash)
 			if ok {
 				if gotwatchedTopic.Owner != pubk {
 					fmt.Println("add name error: not owner", name)
@@ -148,7 +149,8 @@ func createNameFunc(msg string, args []string, callContext interface{}) string {
 				fmt.Println("add name: name already exists")
 				gotwatchedTopic.Expires = payload.ExpirationTime
 				gotwatchedTopic.Jwtid = payload.JWTID
-				err = SaveSubscription(gotwatchedTopic)
+				gotwatchedTopic.ownerJwtid = payload.JWTID
+				err = me.config.GetStore().SaveTopic(gotwatchedTopic)
 				if err != nil {
 					fmt.Println("add name: save subscription err", err)
 				}
@@ -163,9 +165,10 @@ func createNameFunc(msg string, args []string, callContext interface{}) string {
 					OptionalKeyValues: nil,
 					Bill:              nil,
 					Jwtid:             payload.JWTID,
+					ownerJwtid:        payload.JWTID,
 					Owner:             payload.Pubk,
 				}
-				err = SaveSubscription(&newWatchedTopic)
+				err = me.config.GetStore().SaveTopic(&newWatchedTopic)
 				if err != nil {
 					fmt.Println("add name error: save subscription2", err)
 				}
@@ -214,17 +217,16 @@ func deleteNameFunc(msg string, args []string, callContext interface{}) string {
 			}
 			var hashed HashType
 			hashed.HashString(name)
-			hashedStr := hashed.ToBase64() // should we check this more often?
 			if hashed != lookMsg.topicHash || hashed != watchedTopic.Name {
 				sendReply(me, lookMsg, "delete name error: hash mismatch")
 				return
 			}
-			err := DeleteSubscription(hashedStr)
+			err := me.config.GetStore().DeleteTopic(hashed)
 			if err != nil {
 				fmt.Println("add name error: save subscription", err)
 			}
 		} else {
-			gotwatchedTopic, ok := GetSubscription(lookMsg.topicHash.ToBase64())
+			gotwatchedTopic, ok := me.config.GetStore().GetTopic(lookMsg.topicHash)
 			if !ok {
 				// is this really an error?
 				fmt.Println("delete name error: not found", name)
@@ -238,12 +240,11 @@ func deleteNameFunc(msg string, args []string, callContext interface{}) string {
 			}
 			var hashed HashType
 			hashed.HashString(name)
-			hashedStr := hashed.ToBase64() // should we check this more often?
 			if hashed != lookMsg.topicHash || hashed != gotwatchedTopic.Name {
 				sendReply(me, lookMsg, "delete name error: hash mismatch")
 				return
 			}
-			err := DeleteSubscription(hashedStr)
+			err := me.config.GetStore().DeleteTopic(hashed)
 			if err != nil {
 				fmt.Println("add name error: save subscription", err)
 			}
@@ -335,7 +336,7 @@ func deleteNameFunc(msg string, args []string, callContext interface{}) string {
 // 		Jwtid:             payload.JWTID,
 // 		Owner:             payload.Pubk,
 // 	}
-// 	err = SaveSubscription(&watchedTopic)
+// 	err = me.config.GetStore().SaveTopic(&watchedTopic)
 // 	// did it work?
 // 	if err != nil {
 // 		fmt.Println("add name error: save subscription", err)
@@ -0,0 +1,171 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package iot
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/awootton/knotfreeiot/packets"
+)
+
+// The outbound queues. The buckets don't call WriteDownstream because a slow contact
+// would hold up the whole bucket. They put it in the contact's queue, the publishes and the
+// subacks and the replays, so they stay in order. A goroutine, one per contact and only while
+// there's something to do, does the WriteDownstream.
+//
+// The queue has a max and when it's full the OutQueuePolicy says what happens.
+
+// OutQueuePolicy is what to do when a contact's outbound queue is full.
+type OutQueuePolicy int
+
+const (
+	// OutQueueDropOldest throws away the oldest to make room. The default.
+	OutQueueDropOldest OutQueuePolicy = iota
+	// OutQueueDropNewest throws away the new one.
+	OutQueueDropNewest
+	// OutQueueDisconnect sends a Disconnect with an "error" and closes the contact.
+	OutQueueDisconnect
+)
+
+// the defaults if the config doesn't say. The gurus have the aides for contacts so theirs are bigger.
+const (
+	defaultOutQueueMax     = 256
+	defaultGuruOutQueueMax = 4096
+)
+
+type outQueue struct {
+	mux      sync.Mutex
+	packets  []packets.Interface
+	draining bool // there's a goroutine doing the WriteDownstream
+	closed   bool // we disconnected it
+
+	unfrag packets.Reassembler // the compressed fragments for a contact that can't take them. See compress.go
+}
+
+func (q *outQueue) depth() int {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	return len(q.packets)
+}
+
+// getOutQueueMax is the max for the contacts of this config.
+func (config *ContactStructConfig) getOutQueueMax() int {
+	if config.OutQueueMax > 0 {
+		return config.OutQueueMax
+	}
+	if config.IsGuru() {
+		return defaultGuruOutQueueMax
+	}
+	return defaultOutQueueMax
+}
+
+// queueDownstream is WriteDownstream that doesn't wait.
+func queueDownstream(ci ContactInterface, p packets.Interface) {
+
+	q := ci.getOutQueue()
+	config := ci.GetConfig()
+	limit := config.getOutQueueMax()
+
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	if q.closed {
+		return
+	}
+	if len(q.packets) >= limit {
+		outQueueDropped.Inc()
+		switch config.OutQueuePolicy {
+		case OutQueueDropNewest:
+			return
+		case OutQueueDisconnect:
+			q.closed = true
+			outQueueDepth.Sub(float64(len(q.packets)))
+			q.packets = nil
+			fmt.Println("outbound queue full. disconnecting", ci.GetKey().Sig())
+			go func() {
+				dis := &packets.Disconnect{}
+				packets.OptError.Set(dis, []byte("outbound queue full"))
+				ci.WriteDownstream(dis)
+				ci.DoClose(errors.New("outbound queue full"))
+			}()
+			return
+		default:
+			q.packets[0] = nil
+			q.packets = q.packets[1:]
+			outQueueDepth.Dec()
+		}
+	}
+	q.packets = append(q.packets, p)
+	outQueueDepth.Inc()
+	if !q.draining {
+		q.draining = true
+		go q.drain(ci)
+	}
+}
+
+func (q *outQueue) drain(ci ContactInterface) {
+	for {
+		q.mux.Lock()
+		if len(q.packets) == 0 || q.closed {
+			q.draining = false
+			q.mux.Unlock()
+			return
+		}
+		p := q.packets[0]
+		q.packets[0] = nil
+		q.packets = q.packets[1:]
+		outQueueDepth.Dec()
+		q.mux.Unlock()
+
+		if ci.IsClosed() {
+			continue // throw them away
+		}
+		if dropExpired(p, ci.GetConfig().getTime()) {
+			continue // it waited too long. See expiry.go
+		}
+		if !capableOf(ci, p) {
+			continue // see capabilities.go
+		}
+		p = withoutExpiry(ci, p)
+		p = forContact(ci, p) // see compress.go
+		if p == nil {
+			continue
+		}
+		if ss, ok := ci.(*ContactStruct); ok {
+			ss.writeInOrder(p) // its WriteDownstream doesn't wait so they'd pass each other
+			continue
+		}
+		ci.WriteDownstream(p)
+	}
+}
+
+// getOutQueue is for queueDownstream.
+func (ss *ContactStruct) getOutQueue() *outQueue {
+	return &ss.outq
+}
+
+// getOutQueueFraction is how full the fullest queue is. 0 to 1.
+func (config *ContactStructConfig) getOutQueueFraction() float64 {
+	fullest := 0
+	for _, ci := range config.GetContactsListCopy() {
+		d := ci.getOutQueue().depth()
+		if d > fullest {
+			fullest = d
+		}
+	}
+	return float64(fullest) / float64(config.getOutQueueMax())
+}
@@ -0,0 +1,154 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package iot
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/awootton/knotfreeiot/packets"
+)
+
+// Owned broadcast topics. Only the owner can publish to them. Like firmware updates.
+//
+// The owner turns it on with the "set owned true" lookup command. After that every publish
+// to the topic has to be signed (see packets/signed.go) by the ed25519 key that's the Owner
+// of the name, and not too old. The rest get dropped.
+//
+// The guru knows the Owner. It puts the "owned" option on the subacks so the aides know too,
+// because an aide gives a publish to its own subscribers before the guru sees it.
+// When the flag changes the guru tells the aides it has with a suback that has "noack".
+//
+// A signed publish has a random "signonce" and the topic remembers the ones it saw for a while,
+// so the same publish sent again is dropped too. The aides remember the ones coming down from
+// the guru so a copy sent to another aide doesn't get to the subscribers there first.
+//
+// The check is in the bucket of the name before anyone gets it, the wildcard subscribers too.
+// So the guru keeps an owned name even when nobody is subscribed, or a forged publish would find
+// no name to check and go straight to the patterns. See keepForOwned and wildcards.go
+
+// ownedMaxAge is how old, or how far in the future, the "sigtime" can be.
+const ownedMaxAge = 10 * 60
+
+// signedSeenMax is how many nonces a topic has before it looks for old ones to throw out.
+const signedSeenMax = 64
+
+// ownerPublicKey is the Owner as an ed25519 key.
+func (wt *WatchedTopic) ownerPublicKey() (ed25519.PublicKey, bool) {
+	bytes, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(wt.Owner, "="))
+	if err != nil || len(bytes) != ed25519.PublicKeySize {
+		return nil, false
+	}
+	return ed25519.PublicKey(bytes), true
+}
+
+// ownerSigned is true if the owner signed it lately.
+func (wt *WatchedTopic) ownerSigned(p *packets.Send, now uint32) bool {
+	pubk, ok := wt.ownerPublicKey()
+	if !ok {
+		return false
+	}
+	when, ok := p.VerifySignature(pubk)
+	if !ok {
+		return false
+	}
+	if when+ownedMaxAge < now || when > now+ownedMaxAge {
+		return false
+	}
+	return wt.sawSigned(p, now)
+}
+
+// sawSigned remembers the "signonce". It's false if it was there already.
+// A sigtime in the future is good for 2 ownedMaxAge so that's how long we keep them.
+func (wt *WatchedTopic) sawSigned(p *packets.Send, now uint32) bool {
+	nonce, ok := p.GetOption("signonce")
+	if !ok {
+		return false
+	}
+	if wt.signed == nil {
+		wt.signed = make(map[string]uint32)
+	}
+	if len(wt.signed) >= signedSeenMax {
+		for k, until := range wt.signed {
+			if until < now {
+				delete(wt.signed, k)
+			}
+		}
+	}
+	if _, seen := wt.signed[string(nonce)]; seen {
+		return false
+	}
+	wt.signed[string(nonce)] = now + 2*ownedMaxAge
+	return true
+}
+
+// checkOwned is false if the topic is owned and the publish isn't good.
+func (me *LookupTableStruct) checkOwned(wt *WatchedTopic, p *packets.Send) bool {
+	if !wt.OwnedBroadcast {
+		return true
+	}
+	if wt.ownerSigned(p, me.getTime()) {
+		return true
+	}
+	ownedDropped.Inc()
+	fmt.Println(me.ex.Name, "dropping publish to owned topic that's not signed by the owner", p.Sig())
+	return false
+}
+
+// keepForOwned is true if the top needs the name to check the publishes.
+func keepForOwned(me *LookupTableStruct, wt *WatchedTopic) bool {
+	return me.isTop() && wt.OwnedBroadcast
+}
+
+// setOwnedOption is for the suback at the guru. The guru decides.
+func setOwnedOption(wt *WatchedTopic, p *packets.PacketCommon) {
+	if wt.OwnedBroadcast {
+		p.SetOption("owned", []byte(wt.Owner))
+	} else {
+		p.DeleteOption("owned")
+	}
+}
+
+// gotOwnedOption is for the suback at the aide.
+func gotOwnedOption(wt *WatchedTopic, p *packets.PacketCommon) {
+	owner, ok := p.GetOption("owned")
+	wt.OwnedBroadcast = ok
+	if ok {
+		wt.Owner = string(owner)
+	}
+}
+
+// tellOwned sends the flag down to the aides that are watching.
+func (me *LookupTableStruct) tellOwned(wt *WatchedTopic) {
+	if !me.isGuru {
+		return // there's nobody below that doesn't already know
+	}
+	sub := &packets.Subscribe{}
+	sub.Address.Type = packets.BinaryAddress
+	sub.Address.Bytes = make([]byte, 24)
+	wt.Name.GetBytes(sub.Address.Bytes)
+	sub.SetOption("noack", []byte("y"))
+	setOwnedOption(wt, &sub.PacketCommon)
+	it := wt.Iterator()
+	for it.Next() {
+		_, item := it.KeyValue()
+		if !me.checkForBadContact(item.contactInterface, wt) {
+			queueDownstream(item.contactInterface, sub)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package iot
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/awootton/knotfreeiot/packets"
+)
+
+// Presence. Instead of polling "exists" subscribe to PresenceTopic(pubk, name) and get
+// a Presence when the name gets its first subscriber or loses its last one.
+// It's retained so a new subscriber gets the latest right away.
+//
+// The owner can subscribe to OwnerPresenceTopic(pubk) for all of their names at once.
+// Those aren't retained.
+//
+// Only the owner can watch. The pubk in the topic has to be the one of the token, and the
+// names without an Owner don't have presence. The aide gives the subscribes a server address
+// (see serverAddress in contacts.go) so a client can't publish to them, not even with the
+// hash. A wildcard doesn't get them.
+//
+// It's the guru that knows because the aides only know their own contacts.
+// The events go through channelToAnyAide like the lookup replies because the presence
+// topic probably belongs to another guru.
+// The wildcards, the billing topics and the presence topics don't have presence.
+
+const presencePrefix = "presence/"
+
+// Presence is the payload of a presence event.
+type Presence struct {
+	Topic  string `json:"topic"`          // the hash, in base64
+	Name   string `json:"name,omitempty"` // if the guru knows it
+	Online bool   `json:"online"`
+	When   uint32 `json:"when"` // unix seconds
+}
+
+// PresenceTopic is where the presence of name goes. pubk is the owner.
+func PresenceTopic(pubk string, name string) string {
+	a := packets.AddressUnion{}
+	a.FromString(name)
+	a.EnsureAddressIsBinary()
+	h := HashType{}
+	h.InitFromBytes(a.Bytes)
+	return OwnerPresenceTopic(pubk) + "/" + h.ToBase64()
+}
+
+// OwnerPresenceTopic is where the presence of all the names of the owner goes.
+func OwnerPresenceTopic(pubk string) string {
+	return presencePrefix + pubk
+}
+
+// presenceAddress is at the aide for a subscribe or an unsubscribe from a client. It returns
+// false if it's somebody else's. The address becomes the server address.
+func presenceAddress(ssi ContactInterface, config *ContactStructConfig, p *packets.PacketCommon, address *packets.AddressUnion) bool {
+	if address.Type != packets.Utf8Address || !strings.HasPrefix(string(address.Bytes), presencePrefix) {
+		return true
+	}
+	topic := string(address.Bytes)
+	pubk, _, _ := strings.Cut(strings.TrimPrefix(topic, presencePrefix), "/")
+	tok := ssi.GetToken()
+	if tok == nil || tok.Pubk == "" || pubk != tok.Pubk {
+		fmt.Println("presence is for the owner", topic)
+		return false
+	}
+	*address = config.serverAddress(topic)
+	p.SetOption("topic", []byte(topic))
+	return true
+}
+
+// isPresencePublish is true for a client publishing to a presence topic. See pushPacketUp
+func isPresencePublish(p *packets.Send) bool {
+	return p.Address.Type == packets.Utf8Address && strings.HasPrefix(string(p.Address.Bytes), presencePrefix)
+}
+
+// markQuiet is for the first subscribe. Some topics don't have presence.
+func markQuiet(wt *WatchedTopic, p *packets.PacketCommon) {
+	topic, _ := p.GetOption("topic")
+	isBilling := packets.OptStatsMax.Has(p)
+	if wt.isWildcard() || isBilling || strings.HasPrefix(string(topic), presencePrefix) {
+		wt.quiet = true
+	}
+}
+
+// announcePresence is at the guru when a topic gets its first subscriber or loses its last.
+func (me *LookupTableStruct) announcePresence(wt *WatchedTopic, online bool) {
+	if !me.isGuru || wt.quiet || wt.Owner == "" {
+		return
+	}
+	event := &Presence{Topic: wt.Name.ToBase64(), Name: wt.NameStr, Online: online, When: me.getTime()}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	topic := OwnerPresenceTopic(wt.Owner) + "/" + event.Topic
+	p := me.presenceSend(topic, payload)
+	p.SetOption("retain", []byte("1"))
+	me.sendToAnyAide(p)
+	me.sendToAnyAide(me.presenceSend(OwnerPresenceTopic(wt.Owner), payload))
+	presenceEvents.Inc()
+}
+
+// presenceSend is an event to the server address of topic.
+func (me *LookupTableStruct) presenceSend(topic string, payload []byte) *packets.Send {
+	p := &packets.Send{}
+	p.Address = me.config.serverAddress(topic)
+	p.Source.FromString("presence")
+	p.Payload = payload
+	p.SetOption("topic", []byte(topic))
+	packets.OptNoWild.Set(p) // see wildcards.go
+	return p
+}
@@ -16,9 +16,8 @@
 package iot
 
 import (
-	"encoding/json"
 	"fmt"
-	"strconv"
+	"sync"
 
 	"github.com/awootton/knotfreeiot/packets"
 )
@@ -34,23 +33,51 @@ func processPublish(me *LookupTableStruct, bucket *subscribeBucket, pubmsg *publ
 		fmt.Println(me.ex.Name, "processPublish top con=", pubmsg.ss.GetKey().Sig(), " to:", pubmsg.p.Sig())
 	}
 
+	if dropExpired(pubmsg.p, me.getTime()) {
+		return // see expiry.go
+	}
+	if isRetainRemap(pubmsg.p) {
+		processRetainRemap(me, bucket, pubmsg)
+		return
+	}
+	_, isRetain := pubmsg.p.GetOption("retain")
+
 	watchedTopic, ok := getWatcher(bucket, &pubmsg.topicHash)
+	if !ok && me.loadStored(bucket, pubmsg.topicHash, pubmsg) {
+		return // it might have a DLQ or a HISTORY. See store.go
+	}
+	if !ok && isRetain && me.isGuru {
+		// nobody is watching but we keep it for whoever comes next.
+		watchedTopic = newRetainedTopic(me, bucket, &pubmsg.topicHash)
+		ok = true
+	}
 	if !ok {
 
 		// nobody local is subscribing to this.
 		// push it up to the next level
+		// at a guru it's gone. It wasn't in the Store so it has no DLQ. See deadletter.go
 		missedPushes.Inc()
 		// send upstream publish
-		if !me.isGuru {
-			err := bucket.looker.PushUp(pubmsg.p, pubmsg.topicHash)
+		if !me.isTop() {
+			// with the "from" in case it comes back for a wildcard. See seq.go
+			// the wildcards here wait for it to come back. We don't know if it's owned. See owned.go
+			err := bucket.looker.PushUp(markFrom(pubmsg.p, pubmsg.ss.GetKey(), false), pubmsg.topicHash)
 			if err != nil {
 				// what? sad? todo: man up
 				// we should die and reconnect
 				fmt.Println(me.ex.Name, "when a q push fails", string(pubmsg.p.Payload))
 			}
+			return
 		}
+		// but maybe a pattern is. See wildcards.go
+		p, from, hasFrom, sent := takeFrom(pubmsg.p)
+		me.sendWildcardPublishMessages(newFanOut(p, pubmsg.ss, from, hasFrom, sent))
 	} else {
 
+		if !me.checkOwned(watchedTopic, pubmsg.p) {
+			return // see owned.go
+		}
+
 		// use isGuru instead of haveUpstream := len(me.upstreamRouter.channels) != 0
 
 		// it has which holds the billingAccumulator
@@ -66,27 +93,22 @@ func processPublish(me *LookupTableStruct, bucket *subscribeBucket, pubmsg *publ
 			// todo: make this a m5n commmand.
 			// this should really be msg == "add stats {...stats...}"
 			// todo: implement "get stats"
-			billstr, hasStats := pubmsg.p.GetOption("add-stats")
+			hasStats := packets.OptAddStats.Has(pubmsg.p)
 
 			// fmt.Println("isBilling ", haveUpstream, hasStats, string(pubmsg.p.Payload))
 
 			if hasStats && !me.isGuru { //!haveUpstream {
 
 				deltat := 10
-				deltatStr, ok := pubmsg.p.GetOption("stats-deltat")
+				tmp, ok := packets.OptStatsDeltaT.Get(pubmsg.p)
 				if ok {
-					tmp, err := strconv.ParseInt(string(deltatStr), 10, 32)
-					if err == nil {
-						deltat = int(tmp)
-					} else {
-						fmt.Println(me.ex.Name, "ERROR FAIL to parse "+string(deltatStr))
-					}
+					deltat = int(tmp)
 				} else {
 					fmt.Println(me.ex.Name, "ERROR FAIL to find  stats-deltat")
 				}
 
 				msg := &Stats{}
-				err := json.Unmarshal(billstr, msg)
+				_, err := packets.OptAddStats.Get(pubmsg.p, msg)
 				if err == nil {
 
 					// if billingAccumulator.max.Subscriptions == 1 { // the test in billing_test
@@ -113,70 +135,42 @@ func processPublish(me *LookupTableStruct, bucket *subscribeBucket, pubmsg *publ
 			watchedTopic.Expires = 60*60 + me.getTime() // one hour
 
 		} else {
-			badContacts := make([]ContactInterface, 0)
 			// do the WriteDownstream
-			watchedTopic.Expires = 25*60 + me.getTime() //20 min
+			watchedTopic.touch(me.getTime(), 25*60) // see ttl.go
+			watchedTopic.publishedTTL(&pubmsg.p.PacketCommon, me.getTime())
+			if !me.isTop() {
+				if isRetain {
+					watchedTopic.setRetained(pubmsg.p, me.getTime())
+				}
+				// the ones here get it now, unless they want the seq. See seq.go
+				f := &fanOut{p: pubmsg.p, sender: pubmsg.ss.GetKey(), hasSender: true, noSeq: true, sent: &sentTo{}}
+				me.deliver(watchedTopic, f)
+				err := bucket.looker.PushUp(markFrom(pubmsg.p, pubmsg.ss.GetKey(), true), pubmsg.topicHash)
+				if err != nil {
+					fmt.Println("ERROR PushUp in processPublish ", err, pubmsg.p.Sig(), " in ", me.ex.Name)
+					// then they all get it now, without a seq.
+					me.deliver(watchedTopic, &fanOut{p: pubmsg.p, sender: f.sender, hasSender: true, sent: f.sent})
+				}
+				return
+			}
+			p, from, hasFrom, sent := takeFrom(pubmsg.p)
+			pubmsg.p = watchedTopic.stampSeq(p, me.getTime())
+			if len(watchedTopic.Users) != 0 {
+				packets.OptNoWild.Set(pubmsg.p) // see wildcards.go
+			}
+			f := newFanOut(pubmsg.p, pubmsg.ss, from, hasFrom, sent)
+			if isRetain {
+				watchedTopic.setRetained(pubmsg.p, me.getTime())
+			}
+			me.recordHistory(watchedTopic, pubmsg.p)
+			me.deadLetter(watchedTopic, pubmsg.p) // if nobody gets it. See deadletter.go
+			me.storeInbox(watchedTopic, pubmsg.p) // and see inbox.go
 			// this is where the typical packet comes
-			// fmt.Println("pub down", string(pubmsg.p.Payload))
 			if wereSpecial && watchedTopic.thetree.Size() == 0 {
 				fmt.Println(me.ex.Name, "processPublish getWatcher found topic but no subs con=", pubmsg.ss.GetKey().Sig(), " p:", pubmsg.p.Sig())
 			}
-			pubMsgKey := pubmsg.ss.GetKey()
-			it := watchedTopic.Iterator()
-			for it.Next() {
-
-				key, item := it.KeyValue()
-				ci := item.contactInterface
-
-				if item.pub2self { // this is dumb. we should just not add it to the watchedTopic
-					// it's for people who want to publich to their own address and get it back
-					// which is not a usual case.
-					// everybody here gets the message right now
-					// if key != pubMsgKey {
-					if !me.checkForBadContact(ci, watchedTopic) {
-						ci.WriteDownstream(pubmsg.p)
-						sentMessages.Inc()
-						if wereSpecial {
-							fmt.Println(me.ex.Name, "WriteDownstream con=", ci.GetKey().Sig(), " ", pubmsg.p.Sig())
-						}
-					} else {
-						if wereSpecial {
-							fmt.Println(me.ex.Name, "haveBadContact ", ci.GetKey().Sig(), " ", pubmsg.p.Sig())
-						}
-					}
-					// }
-				} else {
-					// we don't sent right back to ourselves. this is the typical case
-					// if me.isGuru {
-					// 	fmt.Println("k1 k2 k3 k4 ", key.Sig(), pubMsgKey.Sig(), ci.GetKey().Sig(), pubmsg.ss.GetKey().Sig())
-					// }
-					if key != pubMsgKey {
-						if !me.checkForBadContact(ci, watchedTopic) {
-							if wereSpecial {
-								fmt.Println(me.ex.Name, "WriteDownstream2 ", ci.GetKey().Sig(), " ", pubmsg.p.Sig())
-							}
-							ci.WriteDownstream(pubmsg.p)
-							sentMessages.Inc()
-						} else {
-							// can't we just delete it right now?
-							// we're in the interator so no: watchedTopic.remove(ci.GetKey())
-
-							if wereSpecial {
-								fmt.Println(me.ex.Name, "haveBadContact2", ci.GetKey().Sig(), " ", pubmsg.p.Sig())
-							}
-							// what if we don't ??
-							badContacts = append(badContacts, ci)
-							// ci.WriteDownstream(pubmsg.p)
-						}
-					}
-				}
-			}
-			for _, ci := range badContacts {
-				if wereSpecial {
-					fmt.Println(me.ex.Name, "Publish removing bad contact", ci.GetKey().Sig(), " sub:", pubmsg.ss.GetKey().Sig())
-				}
-				watchedTopic.remove(ci.GetKey())
-			}
+			me.deliver(watchedTopic, f)
+			me.sendWildcardPublishMessages(f)
 		}
 
 		if wereSpecial {
@@ -195,23 +189,37 @@ func processPublish(me *LookupTableStruct, bucket *subscribeBucket, pubmsg *publ
 
 func processPublishDown(me *LookupTableStruct, bucket *subscribeBucket, pubmsg *publishMessageDown) {
 
+	if dropExpired(pubmsg.p, me.getTime()) {
+		return // see expiry.go
+	}
+	if isHistoryCopy(pubmsg.p) {
+		deliverHistory(me, bucket, pubmsg) // see history.go
+		return
+	}
+
 	wereSpecial := false
 	SpecialPrint(&pubmsg.p.PacketCommon, func() {
 		fmt.Println(me.ex.Name, "processPublishDown ", pubmsg.p.Sig())
 		wereSpecial = true
 	})
 
+	p, from, hasFrom, sent := takeFrom(pubmsg.p) // see seq.go
+	f := &fanOut{p: p, sender: from, hasSender: hasFrom, down: true, sent: &sentTo{}}
 	watcheditem, ok := getWatcher(bucket, &pubmsg.h) //bucket.mySubscriptions[pubmsg.h]
-	if !ok {
+	if ok && sent {
+		alreadySent(watcheditem, f) // see seq.go
+	}
+	wild := me.sendWildcardPublishMessages(f) // see wildcards.go
 
-		// SpecialPrint(&pubmsg.p.PacketCommon, func() {
-		// 	//fmt.Println("special no publish possible this should not happen going down?", pubmsg.p.Address.String())
-		// })
-		// fmt.Println("Publish no publish possible this should not happen going down?", pubmsg.p.Address.String(), " in ", me.ex.Name)
+	if !ok {
 
 		// there was an unsub but our parent doesnt know we should not be subscribing.
 		// we should send an unsub to our parent
 
+		if wild {
+			return // it came down for a wildcard subscription. See wildcards.go
+		}
+
 		if wereSpecial {
 			fmt.Println(me.ex.Name, "processPublishDown no watcher, unsub in parent", pubmsg.p.Address.Sig())
 		}
@@ -229,33 +237,108 @@ func processPublishDown(me *LookupTableStruct, bucket *subscribeBucket, pubmsg *
 		missedPushes.Inc()
 
 	} else {
-		watcheditem.Expires = 25*60 + me.getTime() // 25 min
+		watcheditem.touch(me.getTime(), 25*60) // 25 min or the ttl
+		watcheditem.publishedTTL(&p.PacketCommon, me.getTime())
+		watcheditem.sawSeq(&p.PacketCommon)
+		if watcheditem.OwnedBroadcast {
+			watcheditem.sawSigned(p, me.getTime()) // see owned.go
+		}
+		_, isRetain := p.GetOption("retain")
+		if isRetain {
+			watcheditem.setRetained(p, me.getTime()) // so we can replay it here
+		}
 		if wereSpecial && watcheditem.thetree.Size() == 0 {
-			fmt.Println(me.ex.Name, "processPublishDown getWatcher found topic but no subs ", " p:", pubmsg.p.Sig())
+			fmt.Println(me.ex.Name, "processPublishDown getWatcher found topic but no subs ", " p:", p.Sig())
 		}
-		it := watcheditem.Iterator()
-		for it.Next() {
-
-			key, item := it.KeyValue()
-			ci := item.contactInterface
-			_ = key
-			// key is a watched item key which is a Contact key
-			// pubmsg.h is a HashType. 24 bytes, of the topic
-			// comparing them makes no sense
-			//if key != pubmsg.h.GetHalfHash() {// why would these EVER not be ==
-			// always send to everyone
-			// need: system test watching for duplicates.
-			if !me.checkForBadContact(ci, watcheditem) {
-				if wereSpecial {
-					fmt.Println(me.ex.Name, "    processPublishDown WriteDownstream3 to con:", ci.GetKey().Sig(), " pub:", pubmsg.p.Sig())
-				}
-				ci.WriteDownstream(pubmsg.p)
-				sentMessages.Inc()
-			} else {
-				if wereSpecial {
-					fmt.Println(me.ex.Name, "    processPublishDown haveBadContact to con:", ci.GetKey().Sig(), " pub:", pubmsg.p.Sig())
+		me.deliver(watcheditem, f)
+	}
+}
+
+// sentTo is the contacts that already have a publish. The bucket of the name and the buckets
+// of the patterns it matched share one so nobody gets it twice. See wildcards.go
+type sentTo struct {
+	mux  sync.Mutex
+	keys map[HalfHash]bool
+}
+
+// first is true the first time for a contact.
+func (st *sentTo) first(key HalfHash) bool {
+	st.mux.Lock()
+	defer st.mux.Unlock()
+	if st.keys == nil {
+		st.keys = make(map[HalfHash]bool)
+	}
+	if st.keys[key] {
+		return false
+	}
+	st.keys[key] = true
+	return true
+}
+
+// fanOut is one publish on its way to the subscribers here.
+// The sender doesn't get it unless pub2self, or it's the aide of the publisher and asked for back.
+type fanOut struct {
+	p         *packets.Send
+	back      *packets.Send // with the "from". See seq.go
+	sender    HalfHash
+	hasSender bool
+	down      bool // it came from a guru
+	noSeq     bool // just the ones here without the seq cap. See seq.go
+	sent      *sentTo
+}
+
+// newFanOut is for a publish at the top. from is the publisher if ss is its aide.
+func newFanOut(p *packets.Send, ss ContactInterface, from HalfHash, hasFrom bool, sent bool) *fanOut {
+	f := &fanOut{p: p, sender: ss.GetKey(), hasSender: true, sent: &sentTo{}}
+	if hasFrom {
+		f.back = markFrom(p, from, sent) // see seq.go
+	}
+	return f
+}
+
+// deliver queues the publish to everyone watching wt that doesn't have it yet.
+func (me *LookupTableStruct) deliver(wt *WatchedTopic, f *fanOut) {
+
+	if !f.noSeq { // the groups wait for the guru
+		// at a guru the sender is an aide and the others there are in the groups too.
+		plain := me.publishShared(wt, f.p, f.down, f.sender, f.hasSender && (f.down || !me.isGuru))
+		if !plain {
+			return // see shared.go
+		}
+	}
+	badContacts := make([]ContactInterface, 0)
+	it := wt.Iterator()
+	for it.Next() {
+		key, item := it.KeyValue()
+		ci := item.contactInterface
+		if item.onlyShared {
+			continue // see shared.go
+		}
+		if f.noSeq && wantsSeq(ci) {
+			continue // it waits for the copy with the seq
+		}
+		p := f.p
+		if f.hasSender && key == f.sender {
+			if f.back != nil {
+				if !item.back {
+					continue // the aide did them all. See seq.go
 				}
+				p = f.back
+			} else if !item.pub2self {
+				continue // we don't send right back to ourselves. this is the typical case
 			}
 		}
+		if me.checkForBadContact(ci, wt) {
+			badContacts = append(badContacts, ci)
+			continue
+		}
+		if !f.sent.first(key) {
+			continue // it has it from another subscription
+		}
+		queueDownstream(ci, p) // see outqueue.go
+		sentMessages.Inc()
+	}
+	for _, ci := range badContacts {
+		wt.remove(ci.GetKey())
 	}
 }
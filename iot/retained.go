@@ -0,0 +1,180 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package iot
+
+import (
+	"fmt"
+
+	"github.com/awootton/knotfreeiot/packets"
+)
+
+// Retained messages. Like mqtt.
+// A Send with the "retain" option is kept in the WatchedTopic as the last value
+// and a new subscriber gets a copy right after the suback.
+// An empty payload with "retain" clears it.
+//
+// The values of the "retain" option:
+//   anything: deliver as usual and keep it.
+//   "replay": this is the copy a new subscriber gets. mqtt sets the retain flag for these.
+//   "remap": an aide is carrying the value to a new guru. Store it but don't deliver it.
+//
+// The guru is where they really live. The guru keeps a topic with nobody watching it
+// around if it has a retained value, for retainedKeep after the last one, or until the
+// "expires" of the value. It's only in memory so a guru that restarts loses them.
+// The aides keep a copy as it goes by so they can replay it to their own contacts,
+// and the guru only replays to an aide that is new to the topic.
+// When the gurus are remapped the aides send their copy up with "remap" so it's not lost.
+//
+// A new wildcard subscriber gets the retained values of all the names it matches. The aides
+// don't have those so every guru looks in all its buckets. The copies have the address of the
+// pattern, the real name is in "topic", and "sincefor" so the aide gives them to just the new
+// one, like the history. See wildcards.go and history.go
+
+// retainedKeep is how long the guru keeps a retained value that nobody is watching. A week.
+const retainedKeep = 7 * 24 * 60 * 60
+
+// setRetained remembers the value or forgets it if the payload is empty.
+func (wt *WatchedTopic) setRetained(p *packets.Send, now uint32) {
+	if len(p.Payload) == 0 {
+		wt.retained = nil
+		return
+	}
+	wt.retained = p
+	wt.retainedUntil = now + retainedKeep
+}
+
+// retainedCopy makes a new Send from the retained one with "retain" set to how.
+func retainedCopy(p *packets.Send, how string) *packets.Send {
+	cp := &packets.Send{}
+	cp.Address = p.Address
+	cp.Source = p.Source
+	cp.Payload = p.Payload
+	cp.CopyOptions(&p.PacketCommon)
+	cp.SetOption("retain", []byte(how))
+	return cp
+}
+
+// isRetainRemap is true when the Send is a retained value moving to a new guru.
+func isRetainRemap(p *packets.Send) bool {
+	got, ok := p.GetOption("retain")
+	return ok && string(got) == "remap"
+}
+
+// keepForRetained is true for the topics that the guru keeps with nobody watching.
+func keepForRetained(me *LookupTableStruct, wt *WatchedTopic, now uint32) bool {
+	if !me.isGuru || wt.retained == nil || wt.retainedUntil < now {
+		return false
+	}
+	if dropExpired(wt.retained, now) {
+		wt.retained = nil // see expiry.go
+		return false
+	}
+	return true
+}
+
+// processRetainRemap is at the guru. A value coming from an aide after a remap doesn't
+// replace the one we have because ours is newer.
+func processRetainRemap(me *LookupTableStruct, bucket *subscribeBucket, pubmsg *publishMessage) {
+
+	if !me.isGuru {
+		_ = bucket.looker.PushUp(pubmsg.p, pubmsg.topicHash)
+		return
+	}
+	watchedTopic, ok := getWatcher(bucket, &pubmsg.topicHash)
+	if !ok {
+		watchedTopic = newRetainedTopic(me, bucket, &pubmsg.topicHash)
+	}
+	if watchedTopic.retained == nil {
+		pubmsg.p.SetOption("retain", []byte("1"))
+		watchedTopic.setRetained(pubmsg.p, me.getTime())
+	}
+}
+
+// newRetainedTopic is when there's a publish with retain and nobody is watching.
+func newRetainedTopic(me *LookupTableStruct, bucket *subscribeBucket, h *HashType) *WatchedTopic {
+	watchedTopic := &WatchedTopic{}
+	watchedTopic.Name = *h
+	watchedTopic.thetree = NewWithInt64Comparator()
+	watchedTopic.Expires = 25*60 + me.getTime()
+	now := me.getTime()
+	watchedTopic.nextBillingTime = now + 30
+	watchedTopic.lastBillingTime = now
+	setWatcher(bucket, h, watchedTopic)
+	TopicsAdded.Inc()
+	return watchedTopic
+}
+
+// pushUpRetained sends the retained value after a subscribe on a remap.
+func pushUpRetained(me *LookupTableStruct, watchedTopic *WatchedTopic, h HashType) {
+	if watchedTopic.retained == nil {
+		return
+	}
+	cp := retainedCopy(watchedTopic.retained, "remap")
+	me.PushUp(cp, h)
+}
+
+// retainedMatchCmd looks in one bucket for the retained values a new wildcard subscription matches.
+type retainedMatchCmd struct {
+	pattern  string
+	address  packets.AddressUnion // of the pattern
+	sincefor []byte
+	ss       ContactInterface
+}
+
+func (cmd *retainedMatchCmd) Run(me *LookupTableStruct, bucket *subscribeBucket) {
+	now := me.getTime()
+	for _, wt := range bucket.mySubscriptions {
+		if wt.retained == nil || len(wt.Users) != 0 || dropExpired(wt.retained, now) {
+			continue
+		}
+		topic, ok := wt.retained.GetOption("topic")
+		if !ok || !MatchTopic(cmd.pattern, string(topic)) {
+			continue
+		}
+		cp := retainedCopy(wt.retained, "replay")
+		cp.Address = cmd.address
+		if cmd.sincefor != nil {
+			cp.SetOption("sincefor", cmd.sincefor) // see history.go
+		}
+		queueDownstream(cmd.ss, cp)
+		sentMessages.Inc()
+	}
+}
+
+// replayRetainedMatches is for a new wildcard subscriber at the top.
+// At a guru it's the aide that asked, with "sincefor".
+func (me *LookupTableStruct) replayRetainedMatches(wt *WatchedTopic, submsg *subscriptionMessage, isNewWatcher bool) {
+	if !wt.isWildcard() || getShareGroup(submsg.p) != "" || !me.isTop() {
+		return
+	}
+	sincefor, hasFor := submsg.p.GetOption("sincefor")
+	if me.isGuru && !hasFor {
+		return // it's not a new one at the aide
+	}
+	if !me.isGuru && !isNewWatcher {
+		return
+	}
+	cmd := &retainedMatchCmd{pattern: wt.NameStr, address: submsg.p.Address, ss: submsg.ss}
+	if hasFor {
+		cmd.sincefor = sincefor
+	}
+	for _, b := range me.allTheSubscriptions {
+		if len(b.incoming) >= cap(b.incoming) {
+			fmt.Println("replayRetainedMatches channel full")
+		}
+		b.incoming <- cmd
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package iot
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/awootton/knotfreeiot/packets"
+)
+
+// Topic sequence numbers. The guru that has the topic puts a "seq" option on every publish
+// before it goes down, 1, 2, 3 ... so a subscriber can see when it missed one or got one
+// out of order. See packets.SeqTracker.
+//
+// The aide of the publisher still gives it right away to the contacts there that didn't ask
+// for the seq cap (see capabilities.go). It puts "from", the key of the publisher, on it and
+// pushes it up. The guru sends it back with the "from" and the aide gives it to the ones that
+// did ask, with the seq. "from" has " sent" after the key when the others have it already.
+// If the push up fails they all get it right away, without a seq.
+// The guru only sends it back when the aide put "back" on its subscribe, because a contact
+// there has the seq cap or it's a wildcard. Otherwise the aide already did them all.
+//
+// The aides remember the last seq they saw and put it on the subscribes they send to a new
+// guru after a remap so the new one keeps counting from there.
+//
+// When the guru forgets a topic, nobody watching for a while, it starts at 1 again. The
+// "seqepoch" is when it started counting so a client can tell. See packets.SeqTracker
+//
+// The wildcard subscribers get the seq of the name they matched. The ones in a $share group
+// don't get them in order.
+
+// getSeq returns the "seq" option.
+func getSeq(p *packets.PacketCommon) (uint64, bool) {
+	val, ok := p.GetOption("seq")
+	if !ok {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(string(val), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return seq, true
+}
+
+// stampSeq is at the guru. It returns a copy with the next seq and without the "from".
+// It's a copy because the wildcard buckets have the same packet.
+func (wt *WatchedTopic) stampSeq(p *packets.Send, now uint32) *packets.Send {
+	if wt.epoch == 0 {
+		wt.epoch = now
+	}
+	wt.seq++
+	cp := &packets.Send{}
+	cp.Address = p.Address
+	cp.Source = p.Source
+	cp.Payload = p.Payload
+	cp.CopyOptions(&p.PacketCommon)
+	cp.DeleteOption("from")
+	cp.SetOption("seq", []byte(strconv.FormatUint(wt.seq, 10)))
+	cp.SetOption("seqepoch", []byte(strconv.FormatUint(uint64(wt.epoch), 10)))
+	return cp
+}
+
+// withFrom is the copy that goes back to the aide of the publisher.
+func withFrom(p *packets.Send, from []byte) *packets.Send {
+	cp := &packets.Send{}
+	cp.Address = p.Address
+	cp.Source = p.Source
+	cp.Payload = p.Payload
+	cp.CopyOptions(&p.PacketCommon)
+	cp.SetOption("from", from)
+	return cp
+}
+
+// markFrom is at the aide. The copy goes up and the local subscribers with the seq cap wait
+// for it to come back. sent is true if the others have it already.
+func markFrom(p *packets.Send, key HalfHash, sent bool) *packets.Send {
+	from := strconv.FormatUint(uint64(key), 10)
+	if sent {
+		from += " sent"
+	}
+	return withFrom(p, []byte(from))
+}
+
+// takeFrom is at the aide for the ones coming back. It returns the publisher, if the ones
+// without the seq cap have it already, and a copy without the "from".
+func takeFrom(p *packets.Send) (*packets.Send, HalfHash, bool, bool) {
+	val, ok := p.GetOption("from")
+	if !ok {
+		return p, 0, false, false
+	}
+	str, sent := strings.CutSuffix(string(val), " sent")
+	key, _ := strconv.ParseUint(str, 10, 64)
+	cp := &packets.Send{}
+	cp.Address = p.Address
+	cp.Source = p.Source
+	cp.Payload = p.Payload
+	cp.CopyOptions(&p.PacketCommon)
+	cp.DeleteOption("from")
+	return cp, HalfHash(key), true, sent
+}
+
+// getEpoch returns the "seqepoch" option or 0.
+func getEpoch(p *packets.PacketCommon) uint32 {
+	val, ok := p.GetOption("seqepoch")
+	if !ok {
+		return 0
+	}
+	epoch, _ := strconv.ParseUint(string(val), 10, 32)
+	return uint32(epoch)
+}
+
+// sawSeq is at the aide so it can tell the next guru. And at the guru when an aide does.
+// An older epoch than ours is from before we started again.
+func (wt *WatchedTopic) sawSeq(p *packets.PacketCommon) {
+	seq, ok := getSeq(p)
+	if !ok {
+		return
+	}
+	epoch := getEpoch(p)
+	if epoch != wt.epoch {
+		if epoch < wt.epoch {
+			return
+		}
+		wt.epoch = epoch
+		wt.seq = seq
+		return
+	}
+	if seq > wt.seq {
+		wt.seq = seq
+	}
+}
+
+// setSeqOption is for the subscribes the aide sends after a remap.
+func setSeqOption(wt *WatchedTopic, p *packets.PacketCommon) {
+	if wt.seq != 0 {
+		p.SetOption("seq", []byte(strconv.FormatUint(wt.seq, 10)))
+		p.SetOption("seqepoch", []byte(strconv.FormatUint(uint64(wt.epoch), 10)))
+	}
+}
+
+// stripSeqOptions is at the contact. The clients don't get to set these.
+func stripSeqOptions(p *packets.PacketCommon) {
+	p.DeleteOption("seq")
+	p.DeleteOption("seqepoch")
+	p.DeleteOption("from")
+}
+
+// alreadySent is at the aide of the publisher when its copy comes back. The ones that
+// don't want the seq had it.
+func alreadySent(wt *WatchedTopic, f *fanOut) {
+	it := wt.Iterator()
+	for it.Next() {
+		key, item := it.KeyValue()
+		if !item.onlyShared && !wantsSeq(item.contactInterface) {
+			f.sent.first(key)
+		}
+	}
+}
+
+// markBack is at the aide on the subscribes going up. See above.
+// It stays until the next subscribe after the seq ones leave. That's just one more copy.
+func markBack(wt *WatchedTopic, p *packets.PacketCommon) {
+	if wt.isWildcard() || anyWantsSeq(wt) {
+		packets.OptBack.Set(p)
+	} else {
+		p.DeleteOption("back")
+	}
+}
+
+func anyWantsSeq(wt *WatchedTopic) bool {
+	it := wt.Iterator()
+	for it.Next() {
+		_, item := it.KeyValue()
+		if !item.onlyShared && wantsSeq(item.contactInterface) {
+			return true
+		}
+	}
+	return false
+}
+
+// wantsSeq is true if the contact waits for the copy from the guru.
+func wantsSeq(ci ContactInterface) bool {
+	return ci.HasCapability(packets.CapSeq)
+}
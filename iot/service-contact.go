@@ -3,7 +3,6 @@ package iot
 import (
 	"fmt"
 	"io"
-	"sync"
 
 	"time"
 
@@ -38,9 +37,8 @@ type ServiceContact struct {
 	// this is 0our return address
 	mySubscriptionName string
 
-	// a map of which call to SendPacket sent the message
-	key2channel     map[string]chan packets.Interface
-	key2channelLock sync.Mutex
+	// which call to SendPacket sent the message. See packets/calls.go
+	calls packets.Calls
 
 	packetsChan chan packets.Interface
 	closed      chan bool
@@ -57,7 +55,7 @@ func (sc *ServiceContact) GetPacketReply(msg packets.Interface) (packets.Interfa
 }
 
 func (sc *ServiceContact) GetPacketReplyLonger(msg packets.Interface, timeout time.Duration) (packets.Interface, error) {
-	returnChannel := make(chan packets.Interface)
+	returnChannel := make(chan packets.Interface, 1)
 	done := make(chan bool)
 	// this termnates when we close done.
 	// it might close done if error
@@ -80,33 +78,17 @@ func (sc *ServiceContact) GetPacketReplyLonger(msg packets.Interface, timeout ti
 // caller should select on the returnChannel and timeout if needed. See Get() above.
 func (sc *ServiceContact) SendPacket(msg packets.Interface, returnChannel chan packets.Interface, done chan bool) {
 
-	key := GetRandomB64String()
-	// case  on the type of msg and set the sessionKey and reply address
-	switch v := msg.(type) {
-	case *packets.Send:
-		v.SetOption("sessionKey", []byte(key))
-		v.Source.FromString(sc.mySubscriptionName)
-	case *packets.Lookup:
-		v.SetOption("sessionKey", []byte(key))
-		v.Source.FromString(sc.mySubscriptionName)
-	default:
-		fmt.Printf("ERROR I don't know about type %T!\n", v)
+	key, err := sc.calls.Add(msg, sc.mySubscriptionName, returnChannel)
+	if err != nil {
+		fmt.Printf("ERROR I don't know about type %T!\n", msg)
 		close(done)
 		return
 	}
+	defer sc.calls.Remove(key)
 
 	fmt.Println("ServiceContact SendPacket ", msg.Sig())
 
-	sc.key2channelLock.Lock()
-	sc.key2channel[key] = returnChannel
-	sc.key2channelLock.Unlock()
-	defer func() {
-		sc.key2channelLock.Lock()
-		delete(sc.key2channel, key)
-		sc.key2channelLock.Unlock()
-	}()
-
-	err := PushPacketUpFromBottom(sc.contact, msg)
+	err = PushPacketUpFromBottom(sc.contact, msg)
 	if err != nil {
 		fmt.Println("ServiceContact SendPacket PushPacketUpFromBottom failed ", err)
 		return
@@ -150,7 +132,6 @@ func StartNewServiceContact(ex *Executive) (*ServiceContact, error) {
 // Starts listening for packets on the pipe.
 func InitNewServiceContact(sc *ServiceContact) error {
 
-	sc.key2channel = make(map[string]chan packets.Interface)
 	sc.mySubscriptionName = GetRandomB64String()
 	sc.closed = make(chan bool)
 
@@ -173,7 +154,7 @@ func InitNewServiceContact(sc *ServiceContact) error {
 	AddContactStruct(contact, contact, sc.ex.Config)
 
 	connect := packets.Connect{}
-	connect.SetOption("token", []byte(tokens.GetImpromptuGiantToken()))
+	packets.OptToken.Set(&connect, tokens.GetImpromptuGiantToken())
 	err := PushPacketUpFromBottom(contact, &connect)
 	_ = err
 
@@ -246,19 +227,7 @@ func InitNewServiceContact(sc *ServiceContact) error {
 				return // we're dead as a doornail
 			case p := <-packetsChan:
 				{
-					sessionKey, got := p.GetOption("sessionKey")
-					if !got {
-						// this happens. fmt.Println("ERROR no sessionKey in packet ", p.Sig())
-						continue
-					}
-					sc.key2channelLock.Lock()
-					destChan, ok := sc.key2channel[string(sessionKey)]
-					sc.key2channelLock.Unlock()
-					if !ok {
-						// fmt.Println("ERROR no channel for key ", string(sessionKey))
-					} else {
-						destChan <- p
-					}
+					sc.calls.Reply(p)
 				}
 			}
 		}
@@ -277,7 +246,7 @@ func (sc *ServiceContact) startReadTheWriterPipe() {
 				return
 			default:
 
-				packet, err := packets.ReadPacket(sc.myWriter)
+				packet, err := packets.ServerDecoder.ReadPacket(sc.myWriter)
 				if err != nil || packet == nil {
 					// the buffer only had a partial packet
 					fmt.Println("ERROR packet read fail ", err)
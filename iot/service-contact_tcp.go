@@ -3,7 +3,6 @@ package iot
 import (
 	"fmt"
 	"net"
-	"sync"
 
 	"time"
 
@@ -28,6 +27,7 @@ import (
 // This is similar to the ServiceContact struct in iot/service-contact.go
 // except it's over TCP instead of a pipe.
 // TODO: make this share most of the code with ServiceContact
+// The public version, for any request/reply and not just lookups, is package rpc.
 
 type ServiceContactTcp struct {
 
@@ -48,9 +48,8 @@ type ServiceContactTcp struct {
 	// this is our return address
 	mySubscriptionName string
 
-	// a map of which call to SendPacket sent the message
-	key2channel     map[string]chan packets.Interface
-	key2channelLock sync.Mutex
+	// which call to SendPacket sent the message. See packets/calls.go
+	calls packets.Calls
 
 	packetsChan chan packets.Interface
 	closed      chan bool
@@ -62,7 +61,7 @@ type ServiceContactTcp struct {
 // it blocks waiting for an answer. Has a smaller timeout than SendPacket
 // This is an example of client code.
 func (sc *ServiceContactTcp) Get(msg packets.Interface) (packets.Interface, error) {
-	returnChannel := make(chan packets.Interface)
+	returnChannel := make(chan packets.Interface, 1)
 	done := make(chan bool)
 	// this termnates when we close done.
 	// it might close done if error
@@ -85,33 +84,13 @@ func (sc *ServiceContactTcp) Get(msg packets.Interface) (packets.Interface, erro
 // caller should select on the returnChannel and timeout if needed. See Get() above.
 func (sc *ServiceContactTcp) SendPacket(msg packets.Interface, returnChannel chan packets.Interface, done chan bool) {
 
-	key := GetRandomB64String()
-	// fmt.Println("ServiceContact_tcp sessionKey ", key)
-
-	// case  on the type of msg and set the sessionKey and reply address
-	switch v := msg.(type) {
-	case *packets.Send:
-		v.SetOption("sessionKey", []byte(key))
-		v.Source.FromString(sc.mySubscriptionName)
-	case *packets.Lookup:
-		v.SetOption("sessionKey", []byte(key))
-		v.Source.FromString(sc.mySubscriptionName)
-	default:
-		fmt.Printf("ERROR ServiceContact_tcp I don't know about type %T!\n", v)
+	key, err := sc.calls.Add(msg, sc.mySubscriptionName, returnChannel)
+	if err != nil {
+		fmt.Printf("ERROR ServiceContact_tcp I don't know about type %T!\n", msg)
 		close(done)
 		return
 	}
-
-	// fmt.Println("ServiceContact_tcp send packet ", msg.Sig())
-
-	sc.key2channelLock.Lock()
-	sc.key2channel[key] = returnChannel
-	sc.key2channelLock.Unlock()
-	defer func() {
-		sc.key2channelLock.Lock()
-		delete(sc.key2channel, key)
-		sc.key2channelLock.Unlock()
-	}()
+	defer sc.calls.Remove(key)
 
 	sc.outgoing <- msg
 
@@ -148,7 +127,6 @@ func StartNewServiceContactTcp(address string, token string) (*ServiceContactTcp
 // Starts listening for packets on the pipe.
 func InitNewServiceContactTcp(sc *ServiceContactTcp) error {
 
-	sc.key2channel = make(map[string]chan packets.Interface)
 	sc.mySubscriptionName = GetRandomB64String()
 	// sc.ex = ex
 	sc.closed = make(chan bool)
@@ -221,21 +199,7 @@ func InitNewServiceContactTcp(sc *ServiceContactTcp) error {
 				return
 			case p := <-sc.packetsChan:
 				{
-					sessionKey, got := p.GetOption("sessionKey")
-					if !got {
-						// this happens fmt.Println("ERROR no sessionKey in packet tcp ", p.Sig())
-						continue
-					}
-
-					sc.key2channelLock.Lock()
-					destChan, ok := sc.key2channel[string(sessionKey)]
-					sc.key2channelLock.Unlock()
-					if !ok {
-						fmt.Println("ERROR no match for sessionKey ", string(sessionKey), p.Sig())
-					} else {
-						// fmt.Println("found sessionKey match", string(sessionKey), p.Sig())
-						destChan <- p
-					}
+					sc.calls.Reply(p)
 				}
 			}
 		}
@@ -269,7 +233,7 @@ func (sc *ServiceContactTcp) ConnectLoopForever() {
 				continue // to connect loop forever
 			}
 			connect := &packets.Connect{}
-			connect.SetOption("token", []byte(sc.token))
+			packets.OptToken.Set(connect, sc.token)
 			// if c.LogMeVerbose {
 			// 	connect.SetOption("debg", []byte("12345678"))
 			// }
@@ -325,7 +289,7 @@ func (sc *ServiceContactTcp) ConnectLoopForever() {
 					done = true
 					break // from read loop
 				}
-				p, err := packets.ReadPacket(sc.conn) // blocks
+				p, err := packets.ServerDecoder.ReadPacket(sc.conn) // blocks
 				if err != nil {
 					println("ReadPacket client err:", err.Error())
 					sc.conn.Close()
@@ -0,0 +1,255 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package iot
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+
+	"github.com/awootton/knotfreeiot/packets"
+)
+
+// Shared subscriptions. Like $share/group/topic in mqtt 5.
+//
+// A subscribe to "$share/group/topic" is a subscribe to "topic" with the "share" option set to the group.
+// The watcherItem remembers the groups it's in. A publish goes to all the plain subscribers like always
+// and to just one member of each group, round robin.
+//
+// Only the top picks. That's the guru, or an aide with no upstream, because the members of a group
+// can be on different aides. The guru sends a copy to the aide it picked with "share" set to the group,
+// and "sharefilter" set to the pattern if it's a wildcard subscription. The aide gives that to one of its
+// own members of the group and to nobody else. An aide never picks by itself.
+//
+// A Send can come with "share" already set. Then it only goes to one member of that group.
+// "*" means any one of the subscribers. The http subdomain requests do that so that a subdomain
+// can be served by several replicas. See sub-domain-server.go
+
+// shareAny is the group of everybody.
+const shareAny = "*"
+
+// sharedFilter returns the topic of a $share/group/topic name, or the name.
+func sharedFilter(name string) string {
+	_, filter, ok := splitSharedName(name)
+	if !ok {
+		return name
+	}
+	return filter
+}
+
+func splitSharedName(name string) (string, string, bool) {
+	group, filter, ok := packets.SplitSharedName(name)
+	if !ok && strings.HasPrefix(name, "$share/") {
+		fmt.Println("bad shared subscription", name)
+	}
+	return group, filter, ok
+}
+
+// parseSharedName changes $share/group/topic into topic with the "share" option.
+// For subscribe and unsubscribe before the address is hashed.
+func parseSharedName(p *packets.PacketCommon, address *packets.AddressUnion) {
+	if address.Type != packets.Utf8Address {
+		return
+	}
+	group, filter, ok := splitSharedName(string(address.Bytes))
+	if !ok {
+		return
+	}
+	p.SetOption("share", []byte(group))
+	address.FromString(filter)
+}
+
+func getShareGroup(p packets.Interface) string {
+	group, _ := p.GetOption("share")
+	return string(group)
+}
+
+func (wi *watcherItem) inGroup(group string) bool {
+	if group == shareAny {
+		return true
+	}
+	for _, g := range wi.shares {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// subscribed is for a subscribe, new or again. An empty group is a plain subscription.
+func (wi *watcherItem) subscribed(group string, isNew bool) {
+	if group == "" {
+		wi.onlyShared = false
+		return
+	}
+	if isNew {
+		wi.onlyShared = true
+	}
+	if !wi.inGroup(group) {
+		wi.shares = append(wi.shares, group)
+	}
+}
+
+// unsubscribed returns true if there's nothing left and it should be removed.
+// The group "*" is everything. An aide sends that up when it has nobody left.
+func (wi *watcherItem) unsubscribed(group string) bool {
+	switch group {
+	case shareAny:
+		return true
+	case "":
+		wi.onlyShared = true
+	default:
+		for i, g := range wi.shares {
+			if g == group {
+				wi.shares = append(wi.shares[:i:i], wi.shares[i+1:]...)
+				break
+			}
+		}
+	}
+	return wi.onlyShared && len(wi.shares) == 0
+}
+
+// unsubscribe removes the contact from the group, or from being a plain subscriber.
+func (wt *WatchedTopic) unsubscribe(key HalfHash, group string) {
+	item, ok := wt.get(key)
+	if ok && item.unsubscribed(group) {
+		wt.remove(key)
+	}
+}
+
+// hasMember is true if anyone is in the group. An empty group is the plain subscribers.
+func (wt *WatchedTopic) hasMember(group string) bool {
+	it := wt.Iterator()
+	for it.Next() {
+		_, item := it.KeyValue()
+		if group == "" && !item.onlyShared {
+			return true
+		}
+		if group != "" && item.inGroup(group) {
+			return true
+		}
+	}
+	return false
+}
+
+// sharedGroups returns all the groups, in the order of the watchers.
+func (wt *WatchedTopic) sharedGroups() []string {
+	var groups []string
+	seen := make(map[string]bool)
+	it := wt.Iterator()
+	for it.Next() {
+		_, item := it.KeyValue()
+		for _, g := range item.shares {
+			if !seen[g] {
+				seen[g] = true
+				groups = append(groups, g)
+			}
+		}
+	}
+	return groups
+}
+
+// pickShared is the next member of the group, round robin. Returns nil if nobody.
+// At an aide the sender doesn't get its own publish unless it asked with pub2self.
+// The fragments of a Send all go to the same member. See packets/fragment.go
+func (me *LookupTableStruct) pickShared(wt *WatchedTopic, group string, p *packets.Send, sender HalfHash, hasSender bool) ContactInterface {
+	var members []ContactInterface
+	it := wt.Iterator()
+	for it.Next() {
+		key, item := it.KeyValue()
+		if !item.inGroup(group) || me.checkForBadContact(item.contactInterface, wt) {
+			continue
+		}
+		if hasSender && key == sender && !item.pub2self {
+			continue
+		}
+		members = append(members, item.contactInterface)
+	}
+	if len(members) == 0 {
+		return nil
+	}
+	fragid, isFragment := p.GetOption("frag")
+	if isFragment {
+		h := fnv.New32a()
+		h.Write(fragid)
+		return members[h.Sum32()%uint32(len(members))]
+	}
+	if wt.shareNext == nil {
+		wt.shareNext = make(map[string]int)
+	}
+	i := wt.shareNext[group] % len(members)
+	wt.shareNext[group] = i + 1
+	return members[i]
+}
+
+// sharedCopy is what the picked one gets. The gurus mark it for the aide.
+// Everyone else gets it without the marks.
+func (me *LookupTableStruct) sharedCopy(p *packets.Send, group string, filter string) *packets.Send {
+	cp := &packets.Send{}
+	cp.Address = p.Address
+	cp.Source = p.Source
+	cp.Payload = p.Payload
+	cp.CopyOptions(&p.PacketCommon)
+	cp.DeleteOption("share")
+	cp.DeleteOption("sharefilter")
+	if me.isGuru {
+		cp.SetOption("share", []byte(group))
+		if filter != "" {
+			cp.SetOption("sharefilter", []byte(filter))
+		}
+	}
+	return cp
+}
+
+// isTop is true if we're the one that picks for the groups.
+func (me *LookupTableStruct) isTop() bool {
+	return me.isGuru || len(me.upstreamRouter.channels) == 0
+}
+
+// publishShared does the groups for a publish and returns true if the plain subscribers get it too.
+// down is for publishes that came from a guru.
+func (me *LookupTableStruct) publishShared(wt *WatchedTopic, p *packets.Send, down bool, sender HalfHash, hasSender bool) bool {
+
+	pattern := ""
+	if wt.isWildcard() {
+		pattern = wt.NameStr
+	}
+	group, marked := p.GetOption("share")
+	if marked {
+		filter, _ := p.GetOption("sharefilter")
+		if string(filter) != pattern {
+			return false // it's for another subscription
+		}
+		if down || me.isTop() {
+			ci := me.pickShared(wt, string(group), p, sender, hasSender)
+			if ci != nil {
+				queueDownstream(ci, me.sharedCopy(p, string(group), pattern))
+				sentMessages.Inc()
+			}
+		}
+		return false
+	}
+	if !down && me.isTop() {
+		for _, g := range wt.sharedGroups() {
+			ci := me.pickShared(wt, g, p, sender, hasSender)
+			if ci != nil {
+				queueDownstream(ci, me.sharedCopy(p, g, pattern))
+				sentMessages.Inc()
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,347 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package iot
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// The Store is for what has to outlive a contact, an aide and a guru. eg. the mqtt sessions,
+// and the names that have an Owner with their options and users.
+// It's mongo in production. See mongo.go
+// MakeSimplestCluster uses a map so the tests don't need a database.
+//
+// When a publish or a subscribe comes to the top for a name it doesn't have it looks in the
+// Store first. That's async. The messages for the name wait in the bucket until it's back and
+// then they run again. A name that's not there isn't looked for again for a while.
+//
+// It only looks for the names the Store might have. MayHaveTopic answers from memory, so a
+// client publishing to random names doesn't make a query for each one. A bucket only waits
+// for maxLoading names at a time and only for storeWait. After that the messages run like
+// the name isn't stored and the Store's answer, when it comes, is for the next ones.
+
+// Store is where we keep things that aren't in memory.
+type Store interface {
+	GetSession(key string) ([]byte, bool)
+	SaveSession(key string, val []byte, expires uint32) error
+	DeleteSession(key string) error
+
+	GetTopic(name HashType) (*WatchedTopic, bool)
+	SaveTopic(wt *WatchedTopic) error
+	DeleteTopic(name HashType) error
+	MayHaveTopic(name HashType) bool // quick, from memory. false means don't bother.
+}
+
+// MongoStore is the Store in production.
+type MongoStore struct{}
+
+// mongoNames are the names in mongo. They're all loaded again every namesRefresh.
+// Until the first load is back every name might be there.
+var mongoNames = &nameIndex{}
+
+const namesRefresh = 60 // seconds
+
+type nameIndex struct {
+	mux       sync.Mutex
+	names     map[HashType]bool
+	loadedAt  time.Time
+	isLoading bool
+}
+
+func (ni *nameIndex) has(name HashType) bool {
+	ni.mux.Lock()
+	defer ni.mux.Unlock()
+	if !ni.isLoading && time.Since(ni.loadedAt) > namesRefresh*time.Second {
+		ni.isLoading = true
+		go ni.load()
+	}
+	if ni.names == nil {
+		return true
+	}
+	return ni.names[name]
+}
+
+func (ni *nameIndex) load() {
+	got, err := GetSubscriptionNames()
+	names := make(map[HashType]bool, len(got))
+	for _, str := range got {
+		bytes, err := base64.RawURLEncoding.DecodeString(str)
+		if err != nil || len(bytes) != HashTypeLen {
+			continue
+		}
+		var h HashType
+		h.InitFromBytes(bytes)
+		names[h] = true
+	}
+	ni.mux.Lock()
+	defer ni.mux.Unlock()
+	ni.isLoading = false
+	ni.loadedAt = time.Now()
+	if err != nil {
+		fmt.Println("nameIndex load", err)
+		return // try again next time
+	}
+	ni.names = names
+}
+
+func (ni *nameIndex) set(name HashType, have bool) {
+	ni.mux.Lock()
+	defer ni.mux.Unlock()
+	if ni.names == nil {
+		return
+	}
+	if have {
+		ni.names[name] = true
+	} else {
+		delete(ni.names, name)
+	}
+}
+
+func (MongoStore) GetSession(key string) ([]byte, bool) {
+	return GetSession(key)
+}
+
+func (MongoStore) SaveSession(key string, val []byte, expires uint32) error {
+	return SaveSession(key, val, expires)
+}
+
+func (MongoStore) DeleteSession(key string) error {
+	return DeleteSession(key)
+}
+
+func (MongoStore) GetTopic(name HashType) (*WatchedTopic, bool) {
+	return GetSubscription(name.ToBase64())
+}
+
+func (MongoStore) SaveTopic(wt *WatchedTopic) error {
+	mongoNames.set(wt.Name, true)
+	return SaveSubscription(wt)
+}
+
+func (MongoStore) DeleteTopic(name HashType) error {
+	mongoNames.set(name, false)
+	return DeleteSubscription(name.ToBase64())
+}
+
+func (MongoStore) MayHaveTopic(name HashType) bool {
+	return mongoNames.has(name)
+}
+
+// memoryStore is the Store for the tests.
+type memoryStore struct {
+	mux      sync.Mutex
+	sessions map[string]memoryItem
+	topics   map[HashType][]byte // bson, like mongo
+}
+
+type memoryItem struct {
+	val     []byte
+	expires uint32 // unix seconds. Mongo uses it to throw them away.
+}
+
+// NewMemoryStore is a Store that's just a map.
+func NewMemoryStore() Store {
+	return &memoryStore{sessions: make(map[string]memoryItem), topics: make(map[HashType][]byte)}
+}
+
+func (ms *memoryStore) GetSession(key string) ([]byte, bool) {
+	ms.mux.Lock()
+	defer ms.mux.Unlock()
+	item, ok := ms.sessions[key]
+	return item.val, ok // the caller looks at the expires
+}
+
+func (ms *memoryStore) SaveSession(key string, val []byte, expires uint32) error {
+	ms.mux.Lock()
+	defer ms.mux.Unlock()
+	ms.sessions[key] = memoryItem{val, expires}
+	return nil
+}
+
+func (ms *memoryStore) DeleteSession(key string) error {
+	ms.mux.Lock()
+	defer ms.mux.Unlock()
+	delete(ms.sessions, key)
+	return nil
+}
+
+func (ms *memoryStore) GetTopic(name HashType) (*WatchedTopic, bool) {
+	ms.mux.Lock()
+	bytes, ok := ms.topics[name]
+	ms.mux.Unlock()
+	if !ok {
+		return nil, false
+	}
+	wt := &WatchedTopic{}
+	err := bson.Unmarshal(bytes, wt)
+	if err != nil {
+		fmt.Println("memoryStore GetTopic", err)
+		return nil, false
+	}
+	return wt, true
+}
+
+func (ms *memoryStore) MayHaveTopic(name HashType) bool {
+	ms.mux.Lock()
+	defer ms.mux.Unlock()
+	_, ok := ms.topics[name]
+	return ok
+}
+
+func (ms *memoryStore) SaveTopic(wt *WatchedTopic) error {
+	bytes, err := bson.Marshal(wt)
+	if err != nil {
+		return err
+	}
+	ms.mux.Lock()
+	defer ms.mux.Unlock()
+	ms.topics[wt.Name] = bytes
+	return nil
+}
+
+func (ms *memoryStore) DeleteTopic(name HashType) error {
+	ms.mux.Lock()
+	defer ms.mux.Unlock()
+	delete(ms.topics, name)
+	return nil
+}
+
+// the one for when there's no ClusterExecutive.
+var defaultStore = NewMemoryStore()
+
+// GetStore returns the Store of the cluster.
+func (config *ContactStructConfig) GetStore() Store {
+	if config.ce == nil || config.ce.Store == nil {
+		return defaultStore
+	}
+	return config.ce.Store
+}
+
+// notStoredFor is how long we don't look in the Store again for a name that wasn't there.
+const notStoredFor = 5 * 60
+
+// maxLoading is how many names a bucket waits for at a time.
+const maxLoading = 8
+
+// storeWait is how long the messages wait for the Store.
+var storeWait = 2 * time.Second
+
+// loadStored is at the top for a publish or a subscribe to a name we don't have.
+// It returns true if msg is waiting for the Store.
+func (me *LookupTableStruct) loadStored(bucket *subscribeBucket, h HashType, msg interface{}) bool {
+	if !me.isTop() {
+		return false
+	}
+	until, ok := bucket.notStored[h]
+	if ok && until >= me.getTime() {
+		return false
+	}
+	waiting, ok := bucket.loading[h]
+	if ok {
+		bucket.loading[h] = append(waiting, msg)
+		return true
+	}
+	store := me.config.GetStore()
+	if len(bucket.loading) >= maxLoading || !store.MayHaveTopic(h) {
+		return false
+	}
+	bucket.loading[h] = []interface{}{msg}
+	me.loads.Add(1)
+	go func() {
+		result := make(chan *WatchedTopic, 1)
+		go func() {
+			wt, found := store.GetTopic(h)
+			if !found {
+				wt = nil
+			}
+			result <- wt
+		}()
+		select {
+		case wt := <-result:
+			backFromStore(bucket, h, wt)
+			me.loads.Done()
+		case <-time.After(storeWait):
+			fmt.Println("loadStored slow store", h.Sig())
+			bucket.incoming <- &lookBackCommand{
+				callback: func(me *LookupTableStruct, bucket *subscribeBucket, cmd *callBackCommand) {
+					bucket.notStored[h] = me.getTime() + notStoredFor // until it answers
+					runWaiting(me, bucket, h)
+				},
+			}
+			me.loads.Done() // nobody waits for the rest
+			backFromStore(bucket, h, <-result)
+		}
+	}()
+	return true
+}
+
+func backFromStore(bucket *subscribeBucket, h HashType, wt *WatchedTopic) {
+	bucket.incoming <- &lookBackCommand{
+		callback: func(me *LookupTableStruct, bucket *subscribeBucket, cmd *callBackCommand) {
+			gotStored(me, bucket, h, wt)
+		},
+	}
+}
+
+// gotStored is back in the bucket. wt is nil if it's not there. The ones that were waiting run again.
+func gotStored(me *LookupTableStruct, bucket *subscribeBucket, h HashType, wt *WatchedTopic) {
+	now := me.getTime()
+	_, have := getWatcher(bucket, &h)
+	if wt != nil && wt.Expires >= now && !have {
+		fromStore(wt, h, now)
+		setWatcher(bucket, &h, wt)
+		TopicsAdded.Inc()
+	} else if !have {
+		bucket.notStored[h] = now + notStoredFor
+	}
+	runWaiting(me, bucket, h)
+}
+
+// runWaiting runs the messages that were waiting for the Store.
+func runWaiting(me *LookupTableStruct, bucket *subscribeBucket, h HashType) {
+	waiting := bucket.loading[h]
+	delete(bucket.loading, h)
+	for _, msg := range waiting {
+		switch v := msg.(type) {
+		case *publishMessage:
+			processPublish(me, bucket, v)
+		case *subscriptionMessage:
+			processSubscribe(me, bucket, v)
+		}
+	}
+}
+
+// fromStore is for a WatchedTopic that came out of the Store.
+func fromStore(wt *WatchedTopic, h HashType, now uint32) {
+	wt.Name = h
+	wt.ownerJwtid = wt.Jwtid // it was the Owner's token that saved it. See nameServices.go
+	wt.nextBillingTime = now + 30
+	wt.lastBillingTime = now
+}
+
+// expireNotStored is for the heartbeat.
+func (bucket *subscribeBucket) expireNotStored(now uint32) {
+	for h, until := range bucket.notStored {
+		if until < now {
+			delete(bucket.notStored, h)
+		}
+	}
+}
@@ -136,21 +136,17 @@ func HandleHttpSubdomainRequest(w http.ResponseWriter, r *http.Request, ex *Exec
 		return
 	}
 
+	// the body isn't read here. It goes straight from the request into the fragments. See packets/fragment.go
 	clen := r.ContentLength
-	if clen > 63*1024 {
+	if clen < 0 {
+		http.Error(w, "http needs a Content-Length ", http.StatusLengthRequired)
+		return
+	}
+	if clen > packets.MaxMessageSize {
 		fmt.Println("http packet too long ")
 		http.Error(w, "http packet too long ", 500)
 		return
 	}
-	theBody := make([]byte, clen)
-	if clen > 0 {
-		n, err := r.Body.Read(theBody)
-		if err != nil || (n != int(clen)) {
-
-			http.Error(w, "http content read fail ", 500)
-			return
-		}
-	}
 	isDebg := false
 
 	//fmt.Println("http header ", r.Header) // it's a map with Cookie
@@ -186,11 +182,6 @@ func HandleHttpSubdomainRequest(w http.ResponseWriter, r *http.Request, ex *Exec
 		}
 	}
 	buf.WriteString("\r\n")
-	// write the body to a buffer
-	n, err := buf.Write(theBody)
-	if err != nil || (n != len(theBody)) {
-		http.Error(w, "http theBody write ", 500)
-	}
 
 	fmt.Println("http is request ", firstLine[0:len(firstLine)-2])
 
@@ -230,7 +221,7 @@ func HandleHttpSubdomainRequest(w http.ResponseWriter, r *http.Request, ex *Exec
 				return
 			default:
 
-				packet, err := packets.ReadPacket(myWriter)
+				packet, err := packets.ServerDecoder.ReadPacket(myWriter)
 				if err != nil || packet == nil {
 					// the buffer only had a partial packet
 					fmt.Println("ERROR packet read fail ", err)
@@ -266,9 +257,9 @@ func HandleHttpSubdomainRequest(w http.ResponseWriter, r *http.Request, ex *Exec
 	// and dispense with the billing?
 
 	connect := packets.Connect{}
-	connect.SetOption("token", []byte(tokens.GetImpromptuGiantToken()))
+	packets.OptToken.Set(&connect, tokens.GetImpromptuGiantToken())
 	if isDebg {
-		connect.SetOption("debg", []byte("12345678"))
+		packets.OptDebug.Set(&connect, "12345678")
 	}
 	err = PushPacketUpFromBottom(contact, &connect)
 	if err != nil {
@@ -284,7 +275,7 @@ func HandleHttpSubdomainRequest(w http.ResponseWriter, r *http.Request, ex *Exec
 	subs.Address.EnsureAddressIsBinary()
 	//
 	if isDebg {
-		subs.SetOption("debg", []byte("12345678"))
+		packets.OptDebug.Set(&subs, "12345678")
 		fmt.Println(" our address will be ", subs.Address.String())
 	}
 	err = PushPacketUpFromBottom(contact, &subs)
@@ -321,12 +312,8 @@ func HandleHttpSubdomainRequest(w http.ResponseWriter, r *http.Request, ex *Exec
 		}
 	}
 
-	if buf.Len() > 60*1024 {
-		// stream it
-		fmt.Println("ERROR fixme: implement this streaming thing")
-	} else {
-
-		// just send it all at once in one Send
+	{
+		// send it all at once in one Send, or in fragments if it's big.
 		pub := packets.Send{}
 
 		// copy the options over
@@ -336,13 +323,13 @@ func HandleHttpSubdomainRequest(w http.ResponseWriter, r *http.Request, ex *Exec
 			parts = strings.Split(parts[0], "&")
 			for _, part := range parts {
 				kv := strings.Split(part, "=")
-				if len(kv) == 2 {
+				if len(kv) == 2 && !packets.IsInternalOption(kv[0]) {
 					pub.SetOption(kv[0], []byte(kv[1]))
 				}
 			}
 		}
-		got, ok := pub.GetOption("debg")
-		if ok && string(got) == "12345678" {
+		got, ok := packets.OptDebug.Get(&pub)
+		if ok && got == "12345678" {
 			isDebg = true
 		}
 
@@ -352,14 +339,24 @@ func HandleHttpSubdomainRequest(w http.ResponseWriter, r *http.Request, ex *Exec
 		pub.Address.EnsureAddressIsBinary()
 		// fmt.Println(" our send addr is ", pub.Address.String())  // atw delete
 		// fmt.Println(" our return addr is ", pub.Source.String()) // atw delete
-		pub.Payload = []byte("GET " + r.URL.String() + " HTTP/1.1\n\n")
-		pub.Payload = buf.Bytes()
+		// just one of the subscribers gets the request so there can be replicas. See shared.go
+		// "*" isn't a group that anyone subscribes with. It matches every subscriber, plain or in a group,
+		// so the guru picks one aide and that aide picks one of its own. The fragments all go to the same one
+		// and the answer comes back to the Source.
+		pub.SetOption("share", []byte(shareAny))
 
 		if isDebg {
 			fmt.Println("publish PushPacketUpFromBottom", pub.Sig())
 		}
-		err = PushPacketUpFromBottom(contact, &pub)
-		_ = err
+		// the header and then the body, a fragment at a time.
+		err = pub.FragmentReader(buf.Bytes(), r.Body, clen, 0, func(frag *packets.Send) error {
+			return pushUpFromBottom(contact, frag, true, true) // trusted. It has the "share". See stripServerOptions
+		})
+		if err != nil {
+			fmt.Println("http request send fail", err)
+			http.Error(w, "http content read fail ", 500)
+			return
+		}
 	}
 
 	hj, ok := w.(http.Hijacker)
@@ -388,6 +385,7 @@ func HandleHttpSubdomainRequest(w http.ResponseWriter, r *http.Request, ex *Exec
 
 	{ // The Receive-a-packet loop
 		running := true
+		reassembler := &packets.Reassembler{} // for a reply in fragments
 		//hadHeader := false
 		theLengthWeNeed := 0
 		theAmountWeGot := 0
@@ -407,7 +405,16 @@ func HandleHttpSubdomainRequest(w http.ResponseWriter, r *http.Request, ex *Exec
 				}
 				switch v := packet.(type) {
 				case *packets.Send:
-					snd := v
+					snd, err := reassembler.Add(v, time.Now())
+					if err != nil {
+						fmt.Println("http reply reassembly fail", err)
+						responseBuffer.Write([]byte("error reassembling the reply"))
+						running = false
+						break
+					}
+					if snd == nil {
+						continue // waiting for the rest of the fragments
+					}
 					packetCountStr, ok := snd.GetOption("of")
 					if ok {
 						_ = packetCountStr
@@ -565,7 +572,7 @@ func HandleHttpSubdomainRequest(w http.ResponseWriter, r *http.Request, ex *Exec
 		unsub := packets.Unsubscribe{}
 		unsub.Address.FromString(myRandomName)
 		if isDebg {
-			unsub.SetOption("debg", []byte("12345678"))
+			packets.OptDebug.Set(&unsub, "12345678")
 		}
 		err = PushPacketUpFromBottom(contact, &unsub)
 		_ = err
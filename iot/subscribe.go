@@ -18,9 +18,7 @@ package iot
 import (
 	"bytes"
 	"encoding/base64"
-	"encoding/json"
 	"fmt"
-	"strconv"
 	"time"
 
 	"github.com/awootton/knotfreeiot/packets"
@@ -40,6 +38,10 @@ func processSubscribe(me *LookupTableStruct, bucket *subscribeBucket, submsg *su
 
 	// weAreTheFirst := false // if we're not the first then we don't need to propogate upwards
 	watchedTopic, ok := getWatcher(bucket, &submsg.topicHash)
+	_, isWild := getWildcardPattern(submsg.p)
+	if !ok && !isWild && !packets.OptStatsMax.Has(submsg.p) && me.loadStored(bucket, submsg.topicHash, submsg) {
+		return // it might have an Owner. See store.go
+	}
 	if !ok {
 		// weAreTheFirst = true
 		// make a new one as necessary
@@ -48,13 +50,18 @@ func processSubscribe(me *LookupTableStruct, bucket *subscribeBucket, submsg *su
 		watchedTopic.thetree = NewWithInt64Comparator()
 		watchedTopic.Expires = 20*60 + me.getTime()
 
-		t, _ := submsg.p.GetOption("jwtid") // don't they ALL have this?, except billing topics
-		if len(t) != 0 {                    // it's always 64 bytes binary
-			watchedTopic.Jwtid = string(t)
+		t, _ := packets.OptJWTID.Get(submsg.p) // don't they ALL have this?, except billing topics
+		if len(t) != 0 {                       // it's always 64 bytes binary
+			watchedTopic.Jwtid = t
 		}
 		// if watchedTopic.jwtid == "123456" {
 		// 	fmt.Println("have 123456 in new watcher", me.myname)
 		// }
+		pattern, isWild := getWildcardPattern(submsg.p)
+		if isWild {
+			watchedTopic.NameStr = pattern
+			me.wildcards.add(pattern, submsg.topicHash)
+		}
 		setWatcher(bucket, &submsg.topicHash, watchedTopic)
 		TopicsAdded.Inc()
 
@@ -63,15 +70,29 @@ func processSubscribe(me *LookupTableStruct, bucket *subscribeBucket, submsg *su
 		watchedTopic.lastBillingTime = now
 	}
 
+	if me.isTop() {
+		pubk, _ := submsg.p.GetOption("pubk")
+		if !watchedTopic.userAllowed(string(pubk)) {
+			rejectSubscribe(me, submsg) // see users.go
+			return
+		}
+	}
+	if me.isGuru {
+		watchedTopic.sawSeq(&submsg.p.PacketCommon) // an aide after a remap. See seq.go
+	}
+
 	wi := &watcherItem{}
 	wi.contactInterface = submsg.ss
+	isNewWatcher := false
+	wasEmpty := watchedTopic.getSize() == 0
+	markQuiet(watchedTopic, &submsg.p.PacketCommon)
+	group := getShareGroup(submsg.p)
 
 	// is this right?
-	opt, ok := submsg.p.GetOption("pub2self")
-	if ok {
-		_ = opt // ignore the value
+	if packets.OptPub2Self.Is(submsg.p) { // ignore the value
 		wi.pub2self = true
 	}
+	wi.back = me.isGuru && packets.OptBack.Has(submsg.p) // see seq.go
 
 	// if ok { // TODO: tear this out. Who uses pub2self ?
 	// 	_ = opt // assume it's 0 which means false
@@ -84,8 +105,7 @@ func processSubscribe(me *LookupTableStruct, bucket *subscribeBucket, submsg *su
 	// }
 
 	// The contact is going to send up this subscribe to the billing channel
-	val, ok := submsg.p.GetOption("statsmax")
-	if ok {
+	if packets.OptStatsMax.Has(submsg.p) {
 
 		// we need to make a note that we're a billing sub even if this is an aide
 		// just add the bill ?
@@ -96,7 +116,7 @@ func processSubscribe(me *LookupTableStruct, bucket *subscribeBucket, submsg *su
 		if !haveBilling {
 			//fmt.Println("new BillingAccumulator", watchedTopic.name)
 			stats := &tokens.KnotFreeContactStats{}
-			err := json.Unmarshal(val, stats)
+			_, err := packets.OptStatsMax.Get(submsg.p, stats)
 			if err == nil {
 				ba := &BillingAccumulator{}
 				ba.Name = submsg.topicHash.String()[0:4]
@@ -110,7 +130,8 @@ func processSubscribe(me *LookupTableStruct, bucket *subscribeBucket, submsg *su
 		watchedTopic.Expires = 60*60 + me.getTime()
 	}
 
-	watchedTopic.Expires = 26*60 + me.getTime()
+	watchedTopic.subscribedTTL(wi, &submsg.p.PacketCommon, me.getTime()) // see ttl.go
+	watchedTopic.touch(me.getTime(), 26*60)
 
 	// use ghe lookmsg  api for this
 	// // only the first subscriber can set the IPv6 address that lookup can return.
@@ -207,15 +228,23 @@ func processSubscribe(me *LookupTableStruct, bucket *subscribeBucket, submsg *su
 			if wereSpecial {
 				fmt.Println(me.ex.Name, "Subscribe already exists", contactKey.Sig(), " for ", submsg.p.Sig())
 			}
-			_ = foundWi
+			foundWi.subscribed(group, false)
+			foundWi.ttl, foundWi.since = wi.ttl, wi.since // the new one's. See ttl.go
+			foundWi.back = wi.back
 		} else {
 			if wereSpecial {
 				fmt.Println(me.ex.Name, "Subscribe adding new contact:", contactKey.Sig(), " for", submsg.p.Sig())
 			}
+			wi.subscribed(group, true)
 			watchedTopic.put(contactKey, wi)
+			isNewWatcher = true
 		}
 	}
 
+	if wasEmpty && watchedTopic.getSize() > 0 {
+		me.announcePresence(watchedTopic, true) // see presence.go
+	}
+
 	// the common case is that we are the first subscriber.
 	// are we the top or a guru ?
 
@@ -225,13 +254,16 @@ func processSubscribe(me *LookupTableStruct, bucket *subscribeBucket, submsg *su
 			if wereSpecial {
 				fmt.Println(me.ex.Name, "Subscribe writing down:", submsg.ss.GetKey().Sig(), " for", submsg.p.Sig())
 			}
-			submsg.ss.WriteDownstream(submsg.p) // subs going down are suback's
+			// the aides need to know if it's owned. See owned.go
+			setOwnedOption(watchedTopic, &submsg.p.PacketCommon)
+			queueDownstream(submsg.ss, submsg.p) // subs going down are suback's
 		}
 	} else {
 		// we're an aide
 		noUpstream := len(me.upstreamRouter.channels) == 0
 		// there's a case when we are local and just running an aide.
-		if noUpstream {
+		// Every guru gets the wildcards so we do the suback here or there'd be one from each.
+		if noUpstream || watchedTopic.isWildcard() {
 			if wereSpecial {
 				fmt.Println(me.ex.Name, "Subscribe noUpstream writing down:", submsg.ss.GetKey().Sig(), " for", submsg.p.Sig())
 			}
@@ -239,7 +271,7 @@ func processSubscribe(me *LookupTableStruct, bucket *subscribeBucket, submsg *su
 			// 	fmt.Println("subscribe noUpstream writing down TOP for bucket 49")
 			// }
 
-			submsg.ss.WriteDownstream(submsg.p) // subs going down are suback's
+			queueDownstream(submsg.ss, submsg.p) // subs going down are suback's
 
 			// if bucket.index == 49 {
 			// 	fmt.Println("subscribe noUpstream writing down DONE for bucket 49")
@@ -247,8 +279,37 @@ func processSubscribe(me *LookupTableStruct, bucket *subscribeBucket, submsg *su
 		}
 	}
 
+	// after the suback. Only the new ones get the retained value. Not the shared ones.
+	if isNewWatcher && watchedTopic.retained != nil && group == "" {
+		if dropExpired(watchedTopic.retained, me.getTime()) {
+			watchedTopic.retained = nil // see expiry.go
+		} else {
+			queueDownstream(submsg.ss, retainedCopy(watchedTopic.retained, "replay"))
+		}
+	}
+	// the wildcards get them from all the names they match.
+	me.replayRetainedMatches(watchedTopic, submsg, isNewWatcher)
+	// and then the history, if they asked.
+	me.replayHistory(watchedTopic, submsg)
+	// and what came while nobody was here.
+	me.deliverInbox(watchedTopic, submsg)
+
 	namesAdded.Inc()
-	if !me.isGuru {
+	if !me.isGuru && watchedTopic.isWildcard() {
+		// a copy because the one above is still on the way down.
+		sub := &packets.Subscribe{}
+		sub.Address = submsg.p.Address
+		sub.CopyOptions(&submsg.p.PacketCommon)
+		sub.SetOption("noack", []byte("y"))
+		markSince(sub, submsg.ss, isNewWatcher) // see history.go
+		markBack(watchedTopic, &sub.PacketCommon)
+		err := bucket.looker.PushUpAll(sub)
+		if err != nil {
+			fmt.Println("ERROR pushup all", err, submsg.p.Sig(), me.ex.Name)
+		}
+	} else if !me.isGuru {
+		markSince(submsg.p, submsg.ss, isNewWatcher)
+		markBack(watchedTopic, &submsg.p.PacketCommon) // see seq.go
 		err := bucket.looker.PushUp(submsg.p, submsg.topicHash)
 		if err != nil {
 			// what? we're sad? todo: man up
@@ -269,6 +330,16 @@ func processSubscribeDown(me *LookupTableStruct, bucket *subscribeBucket, submsg
 	if !ok {
 		// this is weird but is it wrong? fmt.Println("processSubscribeDown ERROR no watcher for suback", submsg.p.Sig())
 	} else {
+		rejected := packets.OptError.Has(submsg.p)
+		if rejected {
+			me.gotRejected(watcheditem, submsg.p) // see users.go
+			return
+		}
+		gotOwnedOption(watcheditem, &submsg.p.PacketCommon) // see owned.go
+		_, noack := submsg.p.GetOption("noack")
+		if noack {
+			return // it was just the owned flag
+		}
 		// what if there's more than one? Who get's the suback?
 		// we'll do them all
 		it := watcheditem.Iterator()
@@ -283,7 +354,7 @@ func processSubscribeDown(me *LookupTableStruct, bucket *subscribeBucket, submsg
 			}
 
 			if !me.checkForBadContact(ci, watcheditem) {
-				ci.WriteDownstream(submsg.p)
+				queueDownstream(ci, submsg.p)
 			}
 		}
 	}
@@ -307,6 +378,7 @@ func heartBeatCallBack(me *LookupTableStruct, bucket *subscribeBucket, cmd *call
 	// }
 
 	s := bucket.mySubscriptions
+	bucket.expireNotStored(cmd.now) // see store.go
 
 	emptyTopics := make([]*WatchedTopic, 0, 10)
 
@@ -315,12 +387,18 @@ func heartBeatCallBack(me *LookupTableStruct, bucket *subscribeBucket, cmd *call
 	for h, watchedItem := range s {
 
 		if watchedItem.getSize() == 0 {
+			if keepForRetained(me, watchedItem, cmd.now) || keepForHistory(me, watchedItem, cmd.now) || keepForDeadLetter(me, watchedItem, cmd.now) || keepForInbox(me, watchedItem, cmd.now) || keepForOwned(me, watchedItem) {
+				if !haveUpstream {
+					me.billKept(watchedItem, cmd.now) // see history.go
+				}
+				continue
+			}
 			// fmt.Println("Subscribe heartbeat expiring whole bucket", watchedItem.name.Sig())
 			emptyTopics = append(emptyTopics, watchedItem)
 			continue
 		}
 
-		expireAll := watchedItem.Expires < cmd.now
+		expireAll := watchedItem.Expires < cmd.now // the ttl is in Expires. See ttl.go
 
 		// FIRST, scan all the contact references and schedule the stale ones for deleteion.
 		// if expireAll {
@@ -334,7 +412,7 @@ func heartBeatCallBack(me *LookupTableStruct, bucket *subscribeBucket, cmd *call
 		for it.Next() {
 			key, item := it.KeyValue()
 			// also clean up the closed ones.
-			if expireAll || item.contactInterface.IsClosed() {
+			if expireAll || item.contactInterface.IsClosed() || (!me.isGuru && item.expired(watchedItem, cmd.now)) {
 
 				// if expireAll {
 				// 	fmt.Println("Subscribe heartbeat expiring all sub=", watchedItem.name.Sig(), " con=", item.contactInterface.GetKey().Sig())
@@ -354,6 +432,9 @@ func heartBeatCallBack(me *LookupTableStruct, bucket *subscribeBucket, cmd *call
 			watchedItem.remove(contact.GetKey())
 		}
 		//}()
+		if len(unsubsNeeded) != 0 && watchedItem.getSize() == 0 {
+			me.announcePresence(watchedItem, false) // see presence.go
+		}
 
 		// SECOND, check if this is a billing topic
 		// if it's billing and it's over limits then write 'error Send' down.
@@ -376,7 +457,8 @@ func heartBeatCallBack(me *LookupTableStruct, bucket *subscribeBucket, cmd *call
 					h.GetBytes(p.Address.Bytes)
 					p.Source.FromString("ping") // ie none
 					p.Payload = []byte(msg)
-					p.SetOption("error", p.Payload)
+					packets.OptError.Set(p, p.Payload)
+					packets.OptCode.Set(p, int64(packets.ReasonOverLimit))
 					// just like a publish down.
 					it = watchedItem.Iterator()
 					for it.Next() {
@@ -384,7 +466,7 @@ func heartBeatCallBack(me *LookupTableStruct, bucket *subscribeBucket, cmd *call
 						_ = key
 						ci := item.contactInterface
 						if !me.checkForBadContact(ci, watchedItem) {
-							ci.WriteDownstream(p)
+							queueDownstream(ci, p)
 						}
 					}
 				}
@@ -394,6 +476,9 @@ func heartBeatCallBack(me *LookupTableStruct, bucket *subscribeBucket, cmd *call
 		// from the guru only. For all topics that are not billing
 		if len(watchedItem.Jwtid) > 0 && !haveUpstream {
 			if watchedItem.nextBillingTime < cmd.now {
+				historyIn, historyOut := watchedItem.takeHistoryBytes() // the owner pays. See history.go
+				inboxIn, inboxOut := watchedItem.takeInboxBytes()       // and inbox.go
+				me.billOwner(watchedItem, historyIn+inboxIn, historyOut+inboxOut, cmd.now)
 				// again, we can't do this right now.
 				go func(watchedItem *WatchedTopic) {
 					deltaTime := watchedItem.nextBillingTime - watchedItem.lastBillingTime
@@ -409,12 +494,11 @@ func heartBeatCallBack(me *LookupTableStruct, bucket *subscribeBucket, cmd *call
 					p := &packets.Send{}
 					p.Address.FromString(watchedItem.Jwtid)
 					p.Source.FromString("billing_stats_return_address_subscribe") // doesn't exist. use "ping" ?
-					str, err := json.Marshal(msg)
+					err := packets.OptAddStats.Set(p, msg)
 					if err != nil {
 						fmt.Println(" break fast ")
 					}
-					p.SetOption("add-stats", str)
-					p.SetOption("stats-deltat", []byte(strconv.FormatInt(int64(deltaTime), 10)))
+					packets.OptStatsDeltaT.Set(p, int64(deltaTime))
 					// publish a "add-stats" command to billing topicget					me.ex.channelToAnyAide <- p
 					// channelToAnyAideMessages = append(channelToAnyAideMessages, p)
 
@@ -423,7 +507,7 @@ func heartBeatCallBack(me *LookupTableStruct, bucket *subscribeBucket, cmd *call
 			}
 		}
 		// they may have lost some items above
-		if watchedItem.getSize() == 0 {
+		if watchedItem.getSize() == 0 && !keepForRetained(me, watchedItem, cmd.now) && !keepForHistory(me, watchedItem, cmd.now) && !keepForDeadLetter(me, watchedItem, cmd.now) && !keepForInbox(me, watchedItem, cmd.now) && !keepForOwned(me, watchedItem) {
 			emptyTopics = append(emptyTopics, watchedItem)
 		}
 	}
@@ -436,7 +520,10 @@ func heartBeatCallBack(me *LookupTableStruct, bucket *subscribeBucket, cmd *call
 	// we have to do this async
 	for _, emptyBucket := range emptyTopics {
 		// fmt.Println("Subscribe deleting entire empty bucket", emptyBucket.name)
-		delete(bucket.mySubscriptions, emptyBucket.Name) // the name is the hash
+		if !haveUpstream {
+			me.billKept(emptyBucket, cmd.now) // what's left
+		}
+		setWatcher(bucket, &emptyBucket.Name, nil) // the name is the hash
 	}
 
 	// if bucket.index == 49 {
@@ -464,7 +551,13 @@ func heartBeatCallBack(me *LookupTableStruct, bucket *subscribeBucket, cmd *call
 			if len(b.incoming)*4 > cap(b.incoming)*3 {
 				time.Sleep(time.Millisecond) // low priority
 			}
-			if !me.isGuru {
+			if !me.isGuru && emptyBucket.isWildcard() {
+				unmsg.SetOption("topic", []byte(emptyBucket.NameStr))
+				err := bucket.looker.PushUpAll(unmsg)
+				if err != nil {
+					fmt.Println("Subscribe heartbeat unsub  PushUpAll error", err)
+				}
+			} else if !me.isGuru {
 				err := bucket.looker.PushUp(unmsg, emptyBucket.Name)
 				if err != nil {
 					fmt.Println("Subscribe heartbeat unsub  PushUp error", err)
@@ -501,6 +594,12 @@ func processUnsubscribe(me *LookupTableStruct, bucket *subscribeBucket, unmsg *u
 
 	watchedTopic, ok := getWatcher(bucket, &unmsg.topicHash)
 	if ok {
+		wasEmpty := watchedTopic.getSize() == 0
+		defer func() {
+			if !wasEmpty && watchedTopic.getSize() == 0 {
+				me.announcePresence(watchedTopic, false) // see presence.go
+			}
+		}()
 		isPermanent := len(watchedTopic.Owner) > 0
 		if isPermanent {
 			watchedTopic.remove(unmsg.ss.GetKey())
@@ -513,18 +612,38 @@ func processUnsubscribe(me *LookupTableStruct, bucket *subscribeBucket, unmsg *u
 			}
 
 		} else {
-			watchedTopic.remove(unmsg.ss.GetKey())
+			group := getShareGroup(unmsg.p)
+			watchedTopic.unsubscribe(unmsg.ss.GetKey(), group)
 			_, isBilling := watchedTopic.IsBilling()
-			if watchedTopic.getSize() == 0 && !isBilling {
+			if watchedTopic.getSize() == 0 && !isBilling && !keepForRetained(me, watchedTopic, me.getTime()) {
 				// if nobody here is subscribing anymore then delete the entry in the hash
 				setWatcher(bucket, &unmsg.topicHash, nil)
+				if group != "" {
+					unmsg.p.SetOption("share", []byte(shareAny)) // all of it. See shared.go
+				}
 				// and also tell upstream that we're not interested anymore.
-				if !me.isGuru {
+				if !me.isGuru && watchedTopic.isWildcard() {
+					err := bucket.looker.PushUpAll(unmsg.p)
+					if err != nil {
+						fmt.Println("ERROR processUnsubscribe PushUpAll", err, me.ex.Name)
+					}
+				} else if !me.isGuru {
 					err := bucket.looker.PushUp(unmsg.p, unmsg.topicHash)
 					if err != nil {
 						fmt.Println("ERROR processUnsubscribe PushUp", err, me.ex.Name)
 					}
 				}
+			} else if !me.isGuru && watchedTopic.getSize() != 0 && !watchedTopic.hasMember(group) {
+				// the last one of a $share group, or the last plain one. See shared.go
+				var err error
+				if watchedTopic.isWildcard() {
+					err = bucket.looker.PushUpAll(unmsg.p)
+				} else {
+					err = bucket.looker.PushUp(unmsg.p, unmsg.topicHash)
+				}
+				if err != nil {
+					fmt.Println("ERROR processUnsubscribe PushUp", err, me.ex.Name)
+				}
 			}
 			topicsRemoved.Inc()
 		}
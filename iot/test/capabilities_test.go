@@ -0,0 +1,137 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package iot_test
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awootton/knotfreeiot/iot"
+	"github.com/awootton/knotfreeiot/packets"
+	"github.com/awootton/knotfreeiot/tokens"
+)
+
+func TestCapabilities(t *testing.T) {
+
+	tokens.LoadPublicKeys()
+
+	localtime := starttime
+	getTime := func() uint32 {
+		return localtime
+	}
+	ce := iot.MakeSimplestCluster(getTime, false, 1, "")
+	globalClusterExec = ce
+
+	// an old client. No ConnectAck.
+	old := getNewContactFromAide(ce.Aides[0], "")
+	ce.WaitForActions()
+	if ack := popConnectAck(old); ack != nil {
+		t.Error("old client got", ack)
+	}
+
+	cc := getNewContactFromAide(ce.Aides[0], "")
+	ce.WaitForActions()
+	connect := &packets.Connect{}
+	connect.SetOption("token", []byte(tokens.Get32xTokenLocal()))
+	connect.SetCapabilities(packets.CapSeq, "teleport", packets.CapHistory)
+	iot.PushPacketUpFromBottom(cc, connect)
+	ce.WaitForActions()
+
+	ack := popConnectAck(cc)
+	if ack == nil {
+		t.Fatal("no ConnectAck")
+	}
+	caps, _ := ack.GetCapabilities()
+	if strings.Join(caps, ",") != "history,seq" {
+		t.Error("got", caps, "want history,seq")
+	}
+	if ack.GetVersion() != packets.ProtocolVersion {
+		t.Error("got version", ack.GetVersion())
+	}
+	if got, _ := ack.GetLimit(packets.LimitMaxPayload); got != packets.MaxPayload {
+		t.Error("got maxpayload", got)
+	}
+	if got, _ := ack.GetLimit(packets.LimitKeepalive); got != 20*60 {
+		t.Error("got keepalive", got)
+	}
+	contact := &cc.(*testContact).ContactStruct
+	if !contact.HasCapability(packets.CapSeq) || contact.HasCapability("teleport") {
+		t.Error("the contact has the wrong caps")
+	}
+
+	// cc didn't ask for retain. It doesn't get the replay and it can't retain.
+	SendText(old, "P gauge old full retain 1")
+	ce.WaitForActions()
+	SendText(cc, "S gauge")
+	ce.WaitForActions()
+	if got := popAll(cc); strings.Contains(got, "replay") {
+		t.Error("got", got, "want no replay")
+	}
+	watcher := getNewContactFromAide(ce.Aides[0], "")
+	ce.WaitForActions()
+	SendText(watcher, "S gauge")
+	ce.WaitForActions()
+	popAll(watcher)
+	SendText(cc, "P gauge cc empty retain 1")
+	ce.WaitForActions()
+	if got := popAll(watcher); !strings.Contains(got, "cc,empty") || strings.Contains(got, "retain") {
+		t.Error("got", got, "want it without retain")
+	}
+	late := getNewContactFromAide(ce.Aides[0], "")
+	ce.WaitForActions()
+	SendText(late, "S gauge")
+	ce.WaitForActions()
+	if got := popAll(late); !strings.Contains(got, "old,full,retain,replay") {
+		t.Error("got", got, "want the old one replayed")
+	}
+
+	// and it didn't ask for expiry. It can't set it and it doesn't see it.
+	expires := strconv.FormatUint(uint64(starttime+600), 10)
+	SendText(cc, "S meter")
+	SendText(watcher, "S meter")
+	ce.WaitForActions()
+	popAll(cc)
+	popAll(watcher)
+	SendText(cc, "P meter cc soon expires "+expires)
+	ce.WaitForActions()
+	if got := popAll(watcher); !strings.Contains(got, "cc,soon") || strings.Contains(got, "expires") {
+		t.Error("got", got, "want it without expires")
+	}
+	SendText(old, "P meter old soon expires "+expires)
+	ce.WaitForActions()
+	if got := popAll(cc); !strings.Contains(got, "old,soon") || strings.Contains(got, "expires") {
+		t.Error("got", got, "want it without expires")
+	}
+	if got := popAll(watcher); !strings.Contains(got, "expires,"+expires) {
+		t.Error("got", got, "want the old client to see it")
+	}
+}
+
+func popConnectAck(cc iot.ContactInterface) *packets.ConnectAck {
+	for {
+		select {
+		case p := <-cc.(*testContact).mostRecent:
+			ack, ok := p.(*packets.ConnectAck)
+			if ok {
+				return ack
+			}
+		case <-time.After(100 * time.Millisecond):
+			return nil
+		}
+	}
+}
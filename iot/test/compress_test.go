@@ -0,0 +1,118 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package iot_test
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/awootton/knotfreeiot/iot"
+	"github.com/awootton/knotfreeiot/packets"
+	"github.com/awootton/knotfreeiot/tokens"
+)
+
+func TestCompressedPayloads(t *testing.T) {
+
+	tokens.LoadPublicKeys()
+
+	localtime := starttime
+	getTime := func() uint32 {
+		return localtime
+	}
+	ce := iot.MakeSimplestCluster(getTime, false, 2, "")
+	globalClusterExec = ce
+
+	squeezer := getNewContactFromAide(ce.Aides[1], "") // asks for deflate
+	plain := getNewContactFromAide(ce.Aides[1], "")    // an old client
+	pub := getNewContactFromAide(ce.Aides[0], "")
+	ce.WaitForActions()
+	connect := &packets.Connect{}
+	connect.SetOption("token", []byte(tokens.Get32xTokenLocal()))
+	connect.SetCapabilities(packets.CapDeflate)
+	iot.PushPacketUpFromBottom(squeezer, connect)
+	SendText(squeezer, "S squeezed")
+	SendText(plain, "S squeezed")
+	ce.WaitForActions()
+	popAll(squeezer)
+	popAll(plain)
+
+	verbose := []byte(strings.Repeat(`{"temp":21.5,"humidity":40}`, 20))
+	p := &packets.Send{}
+	p.Address.FromString("squeezed")
+	p.Source.FromString("pub")
+	p.Payload = verbose
+	err := p.Compress(packets.CapDeflate)
+	if err != nil || p.GetEncoding() != packets.CapDeflate {
+		t.Fatal("didn't compress", err)
+	}
+	compressed := p.Payload
+	iot.PushPacketUpFromBottom(pub, p)
+	ce.WaitForActions()
+
+	got := popSends(squeezer)
+	if len(got) != 1 || got[0].GetEncoding() != packets.CapDeflate || !bytes.Equal(got[0].Payload, compressed) {
+		t.Fatalf("got %v, want it untouched", got)
+	}
+	got = popSends(plain)
+	if len(got) != 1 || got[0].GetEncoding() != "" || !bytes.Equal(got[0].Payload, verbose) {
+		t.Fatalf("got %v, want it decompressed", got)
+	}
+	if !bytes.Equal(p.Payload, compressed) {
+		t.Error("the original changed")
+	}
+
+	// one that won't decompress is dropped at the aide. Nobody gets it.
+	bad := &packets.Send{}
+	bad.Address.FromString("squeezed")
+	bad.Source.FromString("pub")
+	bad.Payload = []byte("not deflate at all")
+	bad.SetOption("enc", []byte(packets.CapDeflate))
+	iot.PushPacketUpFromBottom(pub, bad)
+	ce.WaitForActions()
+	if got := popSends(plain); len(got) != 0 {
+		t.Errorf("got %v, want nothing", got)
+	}
+	if got := popSends(squeezer); len(got) != 0 {
+		t.Errorf("got %v, want nothing", got)
+	}
+
+	// the fragments go to the squeezer as is and to the old client whole and decompressed.
+	big := &packets.Send{}
+	big.Address.FromString("squeezed")
+	big.Source.FromString("pub")
+	for i := 0; len(big.Payload) < 3000; i++ {
+		big.Payload = append(big.Payload, []byte(fmt.Sprintf(`{"reading":%v}`, i*i))...)
+	}
+	whole := big.Payload
+	err = big.Compress(packets.CapDeflate)
+	if err != nil || big.GetEncoding() != packets.CapDeflate {
+		t.Fatal("didn't compress", err)
+	}
+	frags := big.Fragment(len(big.Payload)/3 + 1)
+	for _, frag := range frags {
+		iot.PushPacketUpFromBottom(pub, frag)
+	}
+	ce.WaitForActions()
+	if got := popSends(squeezer); len(got) != len(frags) {
+		t.Errorf("got %v, want %v fragments", len(got), len(frags))
+	}
+	got = popSends(plain)
+	if len(got) != 1 || got[0].IsFragment() || got[0].GetEncoding() != "" || !bytes.Equal(got[0].Payload, whole) {
+		t.Errorf("got %v, want it whole", got)
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package iot_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/awootton/knotfreeiot/iot"
+	"github.com/awootton/knotfreeiot/packets"
+	"github.com/awootton/knotfreeiot/tokens"
+)
+
+func TestConnectAckReasons(t *testing.T) {
+
+	tokens.LoadPublicKeys()
+
+	localtime := starttime
+	getTime := func() uint32 {
+		return localtime
+	}
+	ce := iot.MakeSimplestCluster(getTime, false, 1, "")
+	globalClusterExec = ce
+	token := tokens.Get32xTokenLocal()
+
+	connect := func(token []byte) iot.ContactInterface {
+		cc := makeUnconnectedContact(ce.Aides[0].Config)
+		connect := &packets.Connect{}
+		connect.SetOption("token", token)
+		connect.SetCapabilities(packets.CapSeq)
+		iot.PushPacketUpFromBottom(cc, connect)
+		ce.WaitForActions()
+		return cc
+	}
+
+	// the good one has the token's limits
+	cc := connect(token)
+	ack := popConnectAck(cc)
+	if ack == nil {
+		t.Fatal("no ConnectAck")
+	}
+	if code, _ := ack.GetReason(); code != packets.ReasonSuccess {
+		t.Error("got", code, "want success")
+	}
+	stats := cc.GetToken().KnotFreeContactStats
+	if got, ok := ack.GetLimitFloat(packets.LimitConnections); !ok || got != stats.Connections {
+		t.Error("got connections", got, "want", stats.Connections)
+	}
+	if got, _ := ack.GetLimitFloat(packets.LimitSubscriptions); got != stats.Subscriptions-1 {
+		t.Error("got subscriptions", got, "want", stats.Subscriptions-1)
+	}
+
+	wantRefused := func(cc iot.ContactInterface, want packets.ReasonCode) {
+		t.Helper()
+		ack := popConnectAck(cc)
+		if ack == nil {
+			t.Fatal("no ConnectAck for", want)
+		}
+		code, reason := ack.GetReason()
+		if code != want || reason == "" {
+			t.Error("got", code, reason, "want", want)
+		}
+		_, hasError := ack.GetOption("error")
+		if hasError {
+			t.Error("a ConnectAck with an error option")
+		}
+		time.Sleep(10 * time.Millisecond) // the close is async
+		if cc.GetToken() != nil || !cc.IsClosed() {
+			t.Error("still open after", want)
+		}
+	}
+
+	wantRefused(connect([]byte("not a token")), packets.ReasonBadToken)
+	wantRefused(connect(nil), packets.ReasonBadToken)
+
+	localtime = uint32(time.Now().Unix()) + 10*365*24*60*60
+	wantRefused(connect(token), packets.ReasonTokenExpired)
+	localtime = starttime
+
+	ce.Aides[0].Config.MaxContacts = ce.Aides[0].Config.Len()
+	wantRefused(connect(token), packets.ReasonServerFull)
+	ce.Aides[0].Config.MaxContacts = 0
+
+	// an old client gets a Disconnect with the code
+	old := makeUnconnectedContact(ce.Aides[0].Config)
+	bad := &packets.Connect{}
+	bad.SetOption("token", []byte("not a token"))
+	iot.PushPacketUpFromBottom(old, bad)
+	ce.WaitForActions()
+	var dis *packets.Disconnect
+	for dis == nil {
+		select {
+		case p := <-old.(*testContact).mostRecent:
+			if _, ok := p.(*packets.ConnectAck); ok {
+				t.Error("an old client got a ConnectAck")
+			}
+			dis, _ = p.(*packets.Disconnect)
+		case <-time.After(100 * time.Millisecond):
+			t.Fatal("no Disconnect")
+		}
+	}
+	if code, reason := dis.GetReason(); code != packets.ReasonBadToken || reason == "" {
+		t.Error("got", code, reason)
+	}
+}
+
+// makeUnconnectedContact is makeTestContact without the Connect.
+func makeUnconnectedContact(config *iot.ContactStructConfig) iot.ContactInterface {
+	acontact := &testContact{}
+	acontact.mostRecent = make(chan (packets.Interface), 1000)
+	acontact.SetReader(&iot.DevNull{})
+	acontact.SetWriter(&iot.DevNull{})
+	iot.AddContactStruct(&acontact.ContactStruct, acontact, config)
+	return acontact
+}
@@ -0,0 +1,62 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package iot_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/awootton/knotfreeiot/iot"
+	"github.com/awootton/knotfreeiot/tokens"
+)
+
+func TestDeadLetterFromStore(t *testing.T) {
+
+	tokens.LoadPublicKeys()
+
+	localtime := starttime
+	getTime := func() uint32 {
+		return localtime
+	}
+	ce := iot.MakeSimplestCluster(getTime, false, 1, "")
+	globalClusterExec = ce
+	aide := ce.Aides[0]
+
+	// the owner said "set option DLQ my-dead-letters" and then everyone left.
+	wt := &iot.WatchedTopic{}
+	wt.Name.HashString("sleepy-device")
+	wt.Owner = "the-owner"
+	wt.Jwtid = "the-owners-token"
+	wt.Expires = starttime + 60*60
+	wt.SetOption("DLQ", "my-dead-letters")
+	ce.Store.SaveTopic(wt)
+
+	dead := getNewContactFromAide(aide, "")
+	pub := getNewContactFromAide(aide, "")
+	ce.WaitForActions()
+	SendText(dead, "S my-dead-letters")
+	ce.WaitForActions()
+	popAll(dead)
+
+	SendText(pub, "P sleepy-device pub wake-up")
+	ce.WaitForActions()
+	ce.WaitForActions()
+
+	got := popAll(dead)
+	if !strings.Contains(got, "wake-up") || !strings.Contains(got, "deadletter") {
+		t.Errorf("got %v, want the dead letter", got)
+	}
+}
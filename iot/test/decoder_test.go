@@ -0,0 +1,94 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package iot_test
+
+import (
+	"bufio"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awootton/knotfreeiot/iot"
+	"github.com/awootton/knotfreeiot/packets"
+	"github.com/awootton/knotfreeiot/tokens"
+)
+
+// a bad packet gets a reason coded Disconnect before the socket closes.
+func TestDecoderDisconnects(t *testing.T) {
+
+	tokens.LoadPublicKeys()
+	localtime := starttime
+	getTime := func() uint32 {
+		return localtime
+	}
+	ce := iot.MakeSimplestCluster(getTime, false, 1, "")
+	aide := ce.Aides[0]
+	// a whole tcp cluster starts the public servers and there can only be one of those.
+	iot.MakeTCPExecutive(aide, "localhost:8095")
+	iot.MakeTextExecutive(aide, "localhost:7476")
+	time.Sleep(10 * time.Millisecond)
+
+	// native. A Send that says it has a 100MB arg.
+	sock := openConnectedSocket("localhost:8095", t, "")
+	sock.Write([]byte{'P', 1, 0xB0, 0x80, 0x80, 0x00})
+	var code packets.ReasonCode
+	for i := 0; i < 100; i++ {
+		p := readSocket(sock)
+		dis, ok := p.(*packets.Disconnect)
+		_, hasCode := p.GetOption("code") // readSocket says Disconnect on timeouts
+		if ok && hasCode {
+			code, _ = dis.GetReason()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if code != packets.ReasonPacketTooLarge {
+		t.Errorf("got %v, want %v", code, packets.ReasonPacketTooLarge)
+	}
+	sock.Close()
+
+	// text. Too many args.
+	sock = openPlainSocket("localhost:7476", t)
+	sock.Write([]byte("C token '" + string(tokens.Get32xTokenLocal()) + "'\n"))
+	sock.Write([]byte("P" + strings.Repeat(" a", 200) + "\n"))
+	code = packets.ReasonSuccess
+	sock.SetDeadline(time.Now().Add(2 * time.Second))
+	lineReader := bufio.NewReader(sock) // readLine loses the rest of the buffer
+	for {
+		line, err := lineReader.ReadString('\n')
+		if err != nil {
+			break
+		}
+		if strings.HasPrefix(line, "[D") {
+			p, err := iot.Text2Packet(line[1 : len(line)-2])
+			if err != nil {
+				t.Fatal(err)
+			}
+			code, _ = p.(*packets.Disconnect).GetReason()
+			break
+		}
+	}
+	if code != packets.ReasonMalformed {
+		t.Errorf("got %v, want %v", code, packets.ReasonMalformed)
+	}
+	sock.Close()
+
+	_, err := iot.Text2Packet("P" + strings.Repeat(" a", 200))
+	if !errors.Is(err, packets.ErrTooManyArgs) {
+		t.Errorf("got %v, want %v", err, packets.ErrTooManyArgs)
+	}
+}
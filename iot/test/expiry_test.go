@@ -0,0 +1,76 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package iot_test
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/awootton/knotfreeiot/iot"
+	"github.com/awootton/knotfreeiot/tokens"
+)
+
+func TestMessageExpiry(t *testing.T) {
+
+	tokens.LoadPublicKeys()
+
+	localtime := starttime
+	getTime := func() uint32 {
+		return localtime
+	}
+	ce := iot.MakeSimplestCluster(getTime, false, 2, "")
+	globalClusterExec = ce
+
+	sub := getNewContactFromAide(ce.Aides[1], "")
+	pub := getNewContactFromAide(ce.Aides[0], "")
+	ce.WaitForActions()
+	SendText(sub, "S setpoint")
+	ce.WaitForActions()
+	popAll(sub)
+
+	past := strconv.FormatUint(uint64(localtime-1), 10)
+	soon := strconv.FormatUint(uint64(localtime+60), 10)
+	SendText(pub, "P setpoint pub stale expires "+past)
+	SendText(pub, "P setpoint pub fresh expires "+soon)
+	ce.WaitForActions()
+	got := popAll(sub)
+	if strings.Contains(got, "stale") || !strings.Contains(got, "fresh") {
+		t.Errorf("got %v, want just fresh", got)
+	}
+
+	// a retained one that expires isn't replayed.
+	SendText(pub, "P thermostat pub 68 retain 1 expires "+soon)
+	ce.WaitForActions()
+	late := getNewContactFromAide(ce.Aides[1], "")
+	ce.WaitForActions()
+	SendText(late, "S thermostat")
+	ce.WaitForActions()
+	got = popAll(late)
+	if !strings.Contains(got, ",68,") {
+		t.Errorf("got %v, want the replay", got)
+	}
+
+	localtime += 120
+	later := getNewContactFromAide(ce.Aides[0], "")
+	ce.WaitForActions()
+	SendText(later, "S thermostat")
+	ce.WaitForActions()
+	got = popAll(later)
+	if strings.Contains(got, ",68,") {
+		t.Errorf("got %v, want no replay after it expired", got)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package iot_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/awootton/knotfreeiot/iot"
+	"github.com/awootton/knotfreeiot/packets"
+	"github.com/awootton/knotfreeiot/tokens"
+)
+
+func TestFragments(t *testing.T) {
+
+	tokens.LoadPublicKeys()
+
+	localtime := starttime
+	getTime := func() uint32 {
+		return localtime
+	}
+	ce := iot.MakeSimplestCluster(getTime, false, 2, "")
+	globalClusterExec = ce
+
+	w1 := getNewContactFromAide(ce.Aides[0], "")
+	w2 := getNewContactFromAide(ce.Aides[1], "")
+	w3 := getNewContactFromAide(ce.Aides[1], "")
+	pub := getNewContactFromAide(ce.Aides[0], "")
+	ce.WaitForActions()
+	workers := []iot.ContactInterface{w1, w2, w3}
+	for _, w := range workers {
+		subscribe(w, "$share/workers/snapshots")
+	}
+	ce.WaitForActions()
+	for _, w := range workers {
+		popAll(w)
+	}
+
+	snapshot := make([]byte, 3*packets.FragmentSize+100)
+	for i := range snapshot {
+		snapshot[i] = byte(i * 7)
+	}
+	for round := 0; round < 3; round++ {
+		p := &packets.Send{}
+		p.Address.FromString("snapshots")
+		p.Source.FromString("camera")
+		p.Payload = snapshot
+		for _, frag := range p.Fragment(0) {
+			iot.PushPacketUpFromBottom(pub, frag)
+		}
+		ce.WaitForActions()
+
+		// one worker gets all four
+		var got []*packets.Send
+		for _, w := range workers {
+			sends := popSends(w)
+			if len(sends) != 0 && len(got) != 0 {
+				t.Fatalf("the fragments went to more than one worker")
+			}
+			if len(sends) != 0 {
+				got = sends
+			}
+		}
+		if len(got) != 4 {
+			t.Fatalf("got %v fragments, want 4", len(got))
+		}
+		reassembler := &packets.Reassembler{}
+		var whole *packets.Send
+		for _, frag := range got {
+			whole, _ = reassembler.Add(frag, time.Now())
+		}
+		if whole == nil || !bytes.Equal(whole.Payload, snapshot) {
+			t.Fatal("didn't reassemble")
+		}
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package iot_test
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/awootton/knotfreeiot/iot"
+	"github.com/awootton/knotfreeiot/packets"
+	"github.com/awootton/knotfreeiot/tokens"
+)
+
+func TestHistoryReplayAtAide(t *testing.T) {
+
+	tokens.LoadPublicKeys()
+
+	localtime := starttime
+	getTime := func() uint32 {
+		return localtime
+	}
+	ce := iot.MakeSimplestCluster(getTime, false, 1, "")
+	globalClusterExec = ce
+	aide := ce.Aides[0]
+
+	dashboard := getNewContactFromAide(aide, "")
+	other := getNewContactFromAide(aide, "")
+	ce.WaitForActions()
+	SendText(other, "S sensor-readings")
+	SendText(dashboard, "S sensor-readings since 0")
+	ce.WaitForActions()
+	popAll(dashboard)
+	popAll(other)
+
+	// we don't have mongo so we can't set the HISTORY option. Be the guru replaying.
+	for i := 1; i <= 3; i++ {
+		p := &packets.Send{}
+		p.Address.FromString("sensor-readings")
+		p.Source.FromString("sensor")
+		p.Payload = []byte("reading" + strconv.Itoa(i))
+		p.SetOption("history", []byte(strconv.Itoa(i)))
+		p.SetOption("sincefor", []byte(strconv.FormatUint(uint64(dashboard.GetKey()), 10)))
+		iot.PushDownFromTop(aide.Looker, p)
+	}
+	ce.WaitForActions()
+
+	got := popAll(dashboard)
+	if strings.Count(got, "[P,") != 3 || strings.Index(got, "reading1") > strings.Index(got, "reading3") {
+		t.Errorf("got %v, want the 3 in order", got)
+	}
+	if strings.Contains(got, "sincefor") {
+		t.Errorf("got %v, want sincefor gone", got)
+	}
+	got = popAll(other)
+	if got != "" {
+		t.Errorf("got %v, want nothing for the other one", got)
+	}
+}
+
+func TestHistoryFromStore(t *testing.T) {
+
+	tokens.LoadPublicKeys()
+
+	localtime := starttime
+	getTime := func() uint32 {
+		return localtime
+	}
+	ce := iot.MakeSimplestCluster(getTime, false, 1, "")
+	globalClusterExec = ce
+	aide := ce.Aides[0]
+
+	// the owner said "set option HISTORY size 10" a while ago. The guru doesn't have it.
+	wt := &iot.WatchedTopic{}
+	wt.Name.HashString("sensor-log")
+	wt.Owner = "the-owner"
+	wt.Jwtid = "the-owners-token"
+	wt.Expires = starttime + 60*60
+	wt.SetOption("HISTORY", "size 10")
+	ce.Store.SaveTopic(wt)
+
+	pub := getNewContactFromAide(aide, "")
+	ce.WaitForActions()
+	SendText(pub, "P sensor-log sensor reading1")
+	SendText(pub, "P sensor-log sensor reading2")
+	ce.WaitForActions()
+
+	dashboard := getNewContactFromAide(aide, "")
+	ce.WaitForActions()
+	SendText(dashboard, "S sensor-log since 0")
+	ce.WaitForActions()
+	ce.WaitForActions()
+
+	got := popAll(dashboard)
+	if strings.Count(got, "history,") != 2 || strings.Index(got, "reading1") > strings.Index(got, "reading2") {
+		t.Errorf("got %v, want the 2 from before anyone was watching", got)
+	}
+
+	// a client can't say who a history copy is for.
+	other := getNewContactFromAide(aide, "")
+	ce.WaitForActions()
+	SendText(other, "S sensor-log")
+	ce.WaitForActions()
+	popAll(other)
+	key := strconv.FormatUint(uint64(dashboard.GetKey()), 10)
+	SendText(pub, "P sensor-log sensor forged sincefor "+key)
+	ce.WaitForActions()
+	ce.WaitForActions()
+	got = popAll(other)
+	if !strings.Contains(got, "forged") {
+		t.Errorf("got %v, want the other one to get it too", got)
+	}
+}
+
+func TestHistoryResumeFromSeq(t *testing.T) {
+
+	tokens.LoadPublicKeys()
+
+	localtime := starttime
+	getTime := func() uint32 {
+		return localtime
+	}
+	ce := iot.MakeSimplestCluster(getTime, false, 1, "")
+	globalClusterExec = ce
+	aide := ce.Aides[0]
+
+	wt := &iot.WatchedTopic{}
+	wt.Name.HashString("sensor-resume")
+	wt.Owner = "the-owner"
+	wt.Jwtid = "the-owners-token"
+	wt.Expires = starttime + 60*60
+	wt.SetOption("HISTORY", "size 10")
+	ce.Store.SaveTopic(wt)
+
+	withCaps := func() iot.ContactInterface {
+		cc := getNewContactFromAide(aide, "")
+		connect := &packets.Connect{}
+		connect.SetOption("token", []byte(tokens.Get32xTokenLocal()))
+		connect.SetCapabilities(packets.CapSeq, packets.CapHistory)
+		iot.PushPacketUpFromBottom(cc, connect)
+		ce.WaitForActions()
+		popAll(cc)
+		return cc
+	}
+	// an aide that had it from an older guru counted to 41 already. See seq.go
+	remapped := getNewContactFromAide(ce.Gurus[0], "")
+	ce.WaitForActions()
+	SendText(remapped, "S sensor-resume seq 41 seqepoch "+strconv.FormatUint(uint64(starttime), 10))
+	ce.WaitForActions()
+
+	pub := getNewContactFromAide(aide, "")
+	dashboard := withCaps()
+	SendText(dashboard, "S sensor-resume")
+	ce.WaitForActions()
+	popAll(dashboard)
+
+	for i := 1; i <= 3; i++ {
+		SendText(pub, "P sensor-resume sensor live"+strconv.Itoa(i))
+		ce.WaitForActions()
+	}
+	got := popSends(dashboard)
+	if len(got) != 3 {
+		t.Fatalf("got %v, want 3", got)
+	}
+	last, ok := got[2].GetSeq()
+	if !ok || last != 44 {
+		t.Fatalf("got %v, want seq 44", got[2])
+	}
+
+	// it goes away and comes back. It missed 2.
+	SendText(dashboard, "U sensor-resume")
+	ce.WaitForActions()
+	SendText(pub, "P sensor-resume sensor missed1")
+	SendText(pub, "P sensor-resume sensor missed2")
+	ce.WaitForActions()
+	again := withCaps()
+	SendText(again, "S sensor-resume since "+strconv.FormatUint(last, 10))
+	ce.WaitForActions()
+	ce.WaitForActions()
+	got = popSends(again)
+	if len(got) != 2 || string(got[0].Payload) != "missed1" || string(got[1].Payload) != "missed2" {
+		t.Errorf("got %v, want the 2 it missed", got)
+	}
+}
+
+func TestHistoryBilledWithNobodyWatching(t *testing.T) {
+
+	tokens.LoadPublicKeys()
+
+	localtime := starttime
+	getTime := func() uint32 {
+		return localtime
+	}
+	ce := iot.MakeSimplestCluster(getTime, false, 1, "")
+	globalClusterExec = ce
+
+	wt := &iot.WatchedTopic{}
+	wt.Name.HashString("sensor-unwatched")
+	wt.Owner = "the-owner"
+	wt.Jwtid = "the-owners-token"
+	wt.Expires = starttime + 60*60
+	wt.SetOption("HISTORY", "size 10")
+	ce.Store.SaveTopic(wt)
+
+	pub := getNewContactFromAide(ce.Aides[0], "")
+	ce.WaitForActions()
+	SendText(pub, "P sensor-unwatched sensor reading1")
+	SendText(pub, "P sensor-unwatched sensor reading2")
+	ce.WaitForActions()
+
+	// the owner pays for the ring now, not when somebody subscribes.
+	guru := ce.Gurus[0]
+	if got := guru.Billing.GetInput(localtime); got != 0 {
+		t.Errorf("got %v, want nothing before the heartbeat", got)
+	}
+	localtime += 10
+	guru.Looker.Heartbeat(localtime)
+	ce.WaitForActions()
+	if got := guru.Billing.GetInput(localtime); got == 0 {
+		t.Error("got nothing, want the history bytes billed")
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package iot_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/awootton/knotfreeiot/iot"
+	"github.com/awootton/knotfreeiot/tokens"
+)
+
+func TestInbox(t *testing.T) {
+
+	tokens.LoadPublicKeys()
+
+	localtime := starttime
+	getTime := func() uint32 {
+		return localtime
+	}
+	ce := iot.MakeSimplestCluster(getTime, false, 1, "")
+	globalClusterExec = ce
+	aide := ce.Aides[0]
+
+	// both are reserved. Only one has the INBOX option.
+	for _, name := range []string{"sleepy-lamp", "sleepy-fan"} {
+		wt := &iot.WatchedTopic{}
+		wt.Name.HashString(name)
+		wt.Owner = "the-owner"
+		wt.Jwtid = "the-owners-token"
+		wt.Expires = starttime + 60*60
+		if name == "sleepy-lamp" {
+			wt.SetOption("INBOX", "size 5")
+		}
+		ce.Store.SaveTopic(wt)
+	}
+
+	pub := getNewContactFromAide(aide, "")
+	ce.WaitForActions()
+	SendText(pub, "P sleepy-lamp pub lamp-on")
+	SendText(pub, "P sleepy-fan pub fan-on")
+	ce.WaitForActions()
+
+	lamp := getNewContactFromAide(aide, "")
+	fan := getNewContactFromAide(aide, "")
+	ce.WaitForActions()
+	SendText(lamp, "S sleepy-lamp")
+	SendText(fan, "S sleepy-fan")
+	ce.WaitForActions()
+	ce.WaitForActions()
+
+	got := popAll(lamp)
+	if !strings.Contains(got, "lamp-on") {
+		t.Errorf("got %v, want the one from the inbox", got)
+	}
+	got = popAll(fan)
+	if strings.Contains(got, "fan-on") {
+		t.Errorf("got %v, want no inbox without the option", got)
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package iot_test
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/awootton/knotfreeiot/iot"
+	"github.com/awootton/knotfreeiot/tokens"
+	"github.com/awootton/libmqtt"
+)
+
+func TestMqttQos(t *testing.T) {
+
+	tokens.LoadPublicKeys()
+
+	localtime := starttime
+	getTime := func() uint32 {
+		return localtime
+	}
+	ce := iot.MakeSimplestCluster(getTime, false, 1, "")
+	globalClusterExec = ce
+	iot.MakeMqttExecutive(ce.Aides[0], "localhost:7471")
+	time.Sleep(10 * time.Millisecond)
+
+	sub := dialMqtt(t, "localhost:7471", "subber", true)
+	sub.subscribe(t, "qos/test", libmqtt.Qos1)
+
+	// the publisher is the libmqtt client.
+	connected := make(chan byte, 1)
+	published := make(chan error, 2)
+	client, err := libmqtt.NewClient(
+		libmqtt.WithLog(libmqtt.Silent),
+		libmqtt.WithAutoReconnect(false),
+		libmqtt.WithConnHandleFunc(func(client libmqtt.Client, server string, code byte, err error) {
+			connected <- code
+		}),
+		libmqtt.WithPubHandleFunc(func(client libmqtt.Client, topic string, err error) {
+			published <- err
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy(true)
+	err = client.ConnectServer("localhost:7471",
+		libmqtt.WithVersion(libmqtt.V311, false),
+		libmqtt.WithClientID("pubber"),
+		libmqtt.WithIdentity(string(tokens.Get32xTokenLocal()), ""),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case code := <-connected:
+		if code != libmqtt.CodeSuccess {
+			t.Fatalf("got connect code %v", code)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no connack")
+	}
+
+	client.Publish(
+		&libmqtt.PublishPacket{TopicName: "qos/test", Qos: libmqtt.Qos1, Payload: []byte("one")},
+		&libmqtt.PublishPacket{TopicName: "qos/test", Qos: libmqtt.Qos2, Payload: []byte("two")},
+	)
+	// the client only calls back after the puback, and after the pubcomp for qos 2.
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-published:
+			if err != nil {
+				t.Errorf("publish %v got %v", i, err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("publish %v never acked", i)
+		}
+	}
+
+	// the subscription is qos 1 so both come at qos 1.
+	for _, want := range []string{"one", "two"} {
+		pub := sub.expectPublish(t, want)
+		if pub.Qos != libmqtt.Qos1 || pub.PacketID == 0 {
+			t.Errorf("got qos %v id %v, want qos 1", pub.Qos, pub.PacketID)
+		}
+		sub.write(&libmqtt.PubAckPacket{PacketID: pub.PacketID})
+	}
+	sub.conn.Close()
+}
+
+func TestMqttQosWindowAndResend(t *testing.T) {
+
+	tokens.LoadPublicKeys()
+
+	saved := iot.MqttInflightWindow
+	iot.MqttInflightWindow = 2
+	defer func() {
+		iot.MqttInflightWindow = saved
+	}()
+
+	localtime := starttime
+	getTime := func() uint32 {
+		return localtime
+	}
+	ce := iot.MakeSimplestCluster(getTime, false, 1, "")
+	globalClusterExec = ce
+	iot.MakeMqttExecutive(ce.Aides[0], "localhost:7472")
+	time.Sleep(10 * time.Millisecond)
+
+	sub := dialMqtt(t, "localhost:7472", "sleepy", false)
+	sub.subscribe(t, "qos/window", libmqtt.Qos2)
+	pub := dialMqtt(t, "localhost:7472", "", true)
+
+	// a qos 2 publish sent twice is only published once.
+	p := &libmqtt.PublishPacket{TopicName: "qos/window", Qos: libmqtt.Qos2, PacketID: 7, Payload: []byte("dup-test")}
+	pub.write(p)
+	pub.expect(t, &libmqtt.PubRecvPacket{PacketID: 7})
+	p.IsDup = true
+	pub.write(p)
+	pub.expect(t, &libmqtt.PubRecvPacket{PacketID: 7})
+	pub.write(&libmqtt.PubRelPacket{PacketID: 7})
+	pub.expect(t, &libmqtt.PubCompPacket{PacketID: 7})
+
+	got := sub.expectPublish(t, "dup-test")
+	if got.Qos != libmqtt.Qos2 {
+		t.Errorf("got qos %v want 2", got.Qos)
+	}
+	sub.write(&libmqtt.PubRecvPacket{PacketID: got.PacketID})
+	sub.expect(t, &libmqtt.PubRelPacket{PacketID: got.PacketID})
+	sub.write(&libmqtt.PubCompPacket{PacketID: got.PacketID})
+
+	// the window is 2 so c has to wait.
+	for i, payload := range []string{"a", "b", "c"} {
+		pub.write(&libmqtt.PublishPacket{TopicName: "qos/window", Qos: libmqtt.Qos1, PacketID: uint16(10 + i), Payload: []byte(payload)})
+		pub.expect(t, &libmqtt.PubAckPacket{PacketID: uint16(10 + i)})
+	}
+	sub.expectPublish(t, "a")
+	sub.expectPublish(t, "b")
+	if extra := sub.read(300 * time.Millisecond); extra != nil {
+		t.Errorf("got %v, want nothing until an ack", extra)
+	}
+
+	// go away without acking and come back.
+	sub.conn.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	sub = dialMqttPresent(t, "localhost:7472", "sleepy", false, true)
+	a := sub.expectPublish(t, "a")
+	b := sub.expectPublish(t, "b")
+	if !a.IsDup || !b.IsDup {
+		t.Errorf("want the dup flag on the resends")
+	}
+	sub.write(&libmqtt.PubAckPacket{PacketID: a.PacketID})
+	sub.expectPublish(t, "c")
+	sub.conn.Close()
+	pub.conn.Close()
+}
+
+// mqttTestConn is a raw socket speaking mqtt 3.1.1 with the libmqtt packets.
+type mqttTestConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialMqtt(t *testing.T, address string, clientID string, clean bool) *mqttTestConn {
+	return dialMqttPresent(t, address, clientID, clean, false)
+}
+
+func dialMqttPresent(t *testing.T, address string, clientID string, clean bool, present bool) *mqttTestConn {
+	return dialMqttToken(t, address, clientID, clean, present, string(tokens.Get32xTokenLocal()))
+}
+
+func dialMqttToken(t *testing.T, address string, clientID string, clean bool, present bool, token string) *mqttTestConn {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc := &mqttTestConn{conn: conn, reader: bufio.NewReader(conn)}
+	mc.write(&libmqtt.ConnPacket{
+		ProtoName:    "MQTT",
+		ClientID:     clientID,
+		CleanSession: clean,
+		Username:     token,
+		Keepalive:    60,
+	})
+	got := mc.read(2 * time.Second)
+	ack, ok := got.(*libmqtt.ConnAckPacket)
+	if !ok {
+		t.Fatalf("got %v, want connack", got)
+	}
+	if ack.Present != present {
+		t.Errorf("got session present %v, want %v", ack.Present, present)
+	}
+	return mc
+}
+
+func (mc *mqttTestConn) write(p libmqtt.Packet) {
+	p.SetVersion(libmqtt.V311)
+	mc.conn.Write(p.Bytes())
+}
+
+// read returns nil on a timeout.
+func (mc *mqttTestConn) read(timeout time.Duration) libmqtt.Packet {
+	mc.conn.SetReadDeadline(time.Now().Add(timeout))
+	p, err := libmqtt.Decode(libmqtt.V311, mc.reader)
+	if err != nil {
+		return nil
+	}
+	return p
+}
+
+func (mc *mqttTestConn) subscribe(t *testing.T, topic string, qos libmqtt.QosLevel) {
+	mc.write(&libmqtt.SubscribePacket{PacketID: 1, Topics: []*libmqtt.Topic{{Name: topic, Qos: qos}}})
+	got := mc.read(2 * time.Second)
+	ack, ok := got.(*libmqtt.SubAckPacket)
+	if !ok || len(ack.Codes) != 1 || ack.Codes[0] != qos {
+		t.Fatalf("got %v, want suback with qos %v", got, qos)
+	}
+}
+
+func (mc *mqttTestConn) expect(t *testing.T, want libmqtt.Packet) {
+	t.Helper()
+	got := mc.read(2 * time.Second)
+	if got == nil || got.Type() != want.Type() || string(got.Bytes()) != string(want.Bytes()) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func (mc *mqttTestConn) expectPublish(t *testing.T, payload string) *libmqtt.PublishPacket {
+	t.Helper()
+	got := mc.read(2 * time.Second)
+	pub, ok := got.(*libmqtt.PublishPacket)
+	if !ok {
+		t.Fatalf("got %v, want publish %v", got, payload)
+	}
+	if string(pub.Payload) != payload {
+		t.Errorf("got %v, want %v", string(pub.Payload), payload)
+	}
+	return pub
+}
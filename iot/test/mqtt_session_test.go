@@ -0,0 +1,139 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package iot_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/awootton/knotfreeiot/iot"
+	"github.com/awootton/knotfreeiot/tokens"
+	"github.com/awootton/libmqtt"
+)
+
+func TestMqttSession(t *testing.T) {
+
+	tokens.LoadPublicKeys()
+
+	localtime := starttime
+	getTime := func() uint32 {
+		return localtime
+	}
+	ce := iot.MakeSimplestCluster(getTime, false, 2, "")
+	globalClusterExec = ce
+	iot.MakeMqttExecutive(ce.Aides[0], "localhost:7473")
+	iot.MakeMqttExecutive(ce.Aides[1], "localhost:7474")
+	time.Sleep(10 * time.Millisecond)
+
+	// a device with a session subscribes on one aide and goes to sleep.
+	device := dialMqtt(t, "localhost:7473", "battery", false)
+	device.subscribe(t, "sleep/cmd", libmqtt.Qos1)
+	device.conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	// while it's away.
+	pub := dialMqtt(t, "localhost:7474", "", true)
+	pub.subscribe(t, "$sys/session/#", libmqtt.SubFail) // the sessions are only for the servers.
+	pub.write(&libmqtt.PublishPacket{TopicName: "sleep/cmd", Qos: libmqtt.Qos1, PacketID: 1, Payload: []byte("wake up")})
+	pub.expect(t, &libmqtt.PubAckPacket{PacketID: 1})
+	pub.write(&libmqtt.PublishPacket{TopicName: "sleep/cmd", Payload: []byte("lost")})
+	time.Sleep(100 * time.Millisecond)
+
+	localtime += 30
+	ce.Heartbeat(localtime) // the parked session saves
+	time.Sleep(200 * time.Millisecond)
+
+	// it wakes up on the other aide. The qos 0 one is gone.
+	device = dialMqttPresent(t, "localhost:7474", "battery", false, true)
+	got := device.expectPublish(t, "wake up")
+	if got.Qos != libmqtt.Qos1 {
+		t.Errorf("got qos %v want 1", got.Qos)
+	}
+	device.write(&libmqtt.PubAckPacket{PacketID: got.PacketID})
+	if extra := device.read(300 * time.Millisecond); extra != nil {
+		t.Errorf("got %v, want nothing", extra)
+	}
+
+	// and it's still subscribed.
+	pub.write(&libmqtt.PublishPacket{TopicName: "sleep/cmd", Qos: libmqtt.Qos1, PacketID: 2, Payload: []byte("again")})
+	pub.expect(t, &libmqtt.PubAckPacket{PacketID: 2})
+	got = device.expectPublish(t, "again")
+	device.write(&libmqtt.PubAckPacket{PacketID: got.PacketID})
+	device.conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	// a clean session throws it away.
+	device = dialMqttPresent(t, "localhost:7473", "battery", true, false)
+	device.conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	pub.write(&libmqtt.PublishPacket{TopicName: "sleep/cmd", Qos: libmqtt.Qos1, PacketID: 3, Payload: []byte("nobody")})
+	pub.expect(t, &libmqtt.PubAckPacket{PacketID: 3})
+	time.Sleep(100 * time.Millisecond)
+
+	device = dialMqttPresent(t, "localhost:7473", "battery", false, false)
+	if extra := device.read(300 * time.Millisecond); extra != nil {
+		t.Errorf("got %v, want nothing", extra)
+	}
+	device.conn.Close()
+	pub.conn.Close()
+}
+
+func TestMqttSessionHandOver(t *testing.T) {
+
+	tokens.LoadPublicKeys()
+
+	localtime := starttime
+	getTime := func() uint32 {
+		return localtime
+	}
+	ce := iot.MakeSimplestCluster(getTime, false, 2, "")
+	globalClusterExec = ce
+	iot.MakeMqttExecutive(ce.Aides[0], "localhost:7477")
+	iot.MakeMqttExecutive(ce.Aides[1], "localhost:7478")
+	time.Sleep(10 * time.Millisecond)
+
+	// the same owner, a new token every time.
+	ownerToken := func() string {
+		payload := tokens.GetSampleTokenFromStats(uint32(time.Now().Unix()), "knotfree.dog:8085/mqtt", tokens.GetTokenStatsAndPrice(tokens.Medium).Stats)
+		payload.Pubk = "the-session-owner"
+		tok, err := tokens.MakeToken(payload, []byte(tokens.GetPrivateKeyWhole(0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(tok)
+	}
+
+	device := dialMqttToken(t, "localhost:7477", "sleepy", false, false, ownerToken())
+	device.subscribe(t, "nap/cmd", libmqtt.Qos1)
+	device.conn.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	pub := dialMqtt(t, "localhost:7478", "", true)
+	pub.write(&libmqtt.PublishPacket{TopicName: "nap/cmd", Qos: libmqtt.Qos1, PacketID: 1, Payload: []byte("wake up")})
+	pub.expect(t, &libmqtt.PubAckPacket{PacketID: 1})
+	time.Sleep(100 * time.Millisecond)
+
+	// no heartbeat so the Store doesn't have it yet. The old aide saves it when asked.
+	device = dialMqttToken(t, "localhost:7478", "sleepy", false, true, ownerToken())
+	got := device.expectPublish(t, "wake up")
+	device.write(&libmqtt.PubAckPacket{PacketID: got.PacketID})
+	if extra := device.read(300 * time.Millisecond); extra != nil {
+		t.Errorf("got %v, want nothing", extra)
+	}
+	device.conn.Close()
+	pub.conn.Close()
+}
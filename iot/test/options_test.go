@@ -0,0 +1,66 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package iot_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/awootton/knotfreeiot/iot"
+	"github.com/awootton/knotfreeiot/packets"
+	"github.com/awootton/knotfreeiot/tokens"
+)
+
+// the aide puts a jwtid on every subscribe but the suback that goes back down doesn't have it.
+func TestInternalOptions(t *testing.T) {
+
+	tokens.LoadPublicKeys()
+	localtime := starttime
+	getTime := func() uint32 {
+		return localtime
+	}
+	ce := iot.MakeSimplestCluster(getTime, false, 1, "")
+	aide := ce.Aides[0]
+	iot.MakeTCPExecutive(aide, "localhost:8097") // see decoder_test.go
+	time.Sleep(10 * time.Millisecond)
+
+	sock := openConnectedSocket("localhost:8097", t, "")
+	sub := &packets.Subscribe{}
+	sub.Address.FromString("internalOptionsChan")
+	packets.OptDebug.Set(sub, "abc")
+	sub.Write(sock)
+
+	var suback packets.Interface
+	for i := 0; i < 100 && suback == nil; i++ {
+		p := readSocket(sock)
+		if _, ok := p.(*packets.Subscribe); ok {
+			suback = p
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if suback == nil {
+		t.Fatal("no suback")
+	}
+	if packets.OptJWTID.Has(suback) {
+		t.Errorf("got a jwtid %v", suback)
+	}
+	got, _ := packets.OptDebug.Get(suback)
+	want := "abc"
+	if got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	sock.Close()
+}
@@ -0,0 +1,186 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package iot_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awootton/knotfreeiot/iot"
+	"github.com/awootton/knotfreeiot/packets"
+	"github.com/awootton/knotfreeiot/tokens"
+)
+
+// stuckContact doesn't return from WriteDownstream for a Send until it's released.
+type stuckContact struct {
+	testContact
+	release chan bool
+}
+
+func (cc *stuckContact) WriteDownstream(packet packets.Interface) error {
+	if _, ok := packet.(*packets.Send); ok {
+		<-cc.release
+	}
+	return cc.testContact.WriteDownstream(packet)
+}
+
+func makeStuckContact(config *iot.ContactStructConfig) *stuckContact {
+	cc := &stuckContact{}
+	cc.release = make(chan bool)
+	cc.mostRecent = make(chan packets.Interface, 1000)
+	cc.SetReader(&iot.DevNull{})
+	cc.SetWriter(&iot.DevNull{})
+	iot.AddContactStruct(&cc.ContactStruct, cc, config)
+	connect := packets.Connect{}
+	connect.SetOption("token", []byte(tokens.Get32xTokenLocal()))
+	iot.PushPacketUpFromBottom(cc, &connect)
+	return cc
+}
+
+func TestOutQueue(t *testing.T) {
+
+	tokens.LoadPublicKeys()
+
+	tests := []struct {
+		policy iot.OutQueuePolicy
+		want   string
+	}{
+		{iot.OutQueueDropOldest, "m0 m6 m7 m8 m9"},
+		{iot.OutQueueDropNewest, "m0 m1 m2 m3 m4"},
+		{iot.OutQueueDisconnect, "outbound queue full"},
+	}
+	for _, tt := range tests {
+
+		localtime := starttime
+		getTime := func() uint32 {
+			return localtime
+		}
+		ce := iot.MakeSimplestCluster(getTime, false, 1, "")
+		globalClusterExec = ce
+		aide := ce.Aides[0]
+		aide.Config.OutQueueMax = 4
+		aide.Config.OutQueuePolicy = tt.policy
+
+		stuck := makeStuckContact(aide.Config)
+		fast := getNewContactFromAide(aide, "")
+		pub := getNewContactFromAide(aide, "")
+		ce.WaitForActions()
+		SendText(stuck, "S slowtopic")
+		SendText(fast, "S slowtopic")
+		ce.WaitForActions()
+		popAll(fast)
+		drainStuck(stuck)
+
+		// the first one gets stuck in WriteDownstream and then the queue fills up.
+		SendText(pub, "P slowtopic pub m0")
+		ce.WaitForActions()
+		time.Sleep(10 * time.Millisecond)
+		for i := 1; i < 10; i++ {
+			SendText(pub, fmt.Sprintf("P slowtopic pub m%v", i))
+			ce.WaitForActions()
+			time.Sleep(time.Millisecond) // so the fast one keeps up
+		}
+
+		// the fast one doesn't wait for the slow one.
+		got := popAll(fast)
+		if strings.Count(got, "[P,") != 10 {
+			t.Errorf("%v got %v, want all 10", tt.policy, got)
+		}
+		if tt.policy == iot.OutQueueDisconnect {
+			time.Sleep(10 * time.Millisecond)
+			if !stuck.IsClosed() {
+				t.Errorf("want the slow one closed")
+			}
+		}
+
+		close(stuck.release)
+		time.Sleep(10 * time.Millisecond)
+		got = drainStuck(stuck)
+		if got != tt.want {
+			t.Errorf("%v got %v, want %v", tt.policy, got, tt.want)
+		}
+	}
+}
+
+func TestOutQueueOrder(t *testing.T) {
+
+	tokens.LoadPublicKeys()
+
+	localtime := starttime
+	getTime := func() uint32 {
+		return localtime
+	}
+	ce := iot.MakeSimplestCluster(getTime, false, 1, "")
+	globalClusterExec = ce
+	aide := ce.Aides[0]
+
+	stuck := makeStuckContact(aide.Config)
+	pub := getNewContactFromAide(aide, "")
+	ce.WaitForActions()
+	SendText(stuck, "S slowtopic")
+	ce.WaitForActions()
+	drainStuck(stuck)
+
+	// the suback waits in the same queue as the publishes.
+	SendText(pub, "P slowtopic pub m0")
+	ce.WaitForActions()
+	time.Sleep(10 * time.Millisecond)
+	SendText(stuck, "S othertopic")
+	ce.WaitForActions()
+	SendText(pub, "P slowtopic pub m1")
+	ce.WaitForActions()
+
+	close(stuck.release)
+	time.Sleep(10 * time.Millisecond)
+	var got []string
+	for len(got) < 3 {
+		select {
+		case p := <-stuck.mostRecent:
+			switch v := p.(type) {
+			case *packets.Send:
+				got = append(got, string(v.Payload))
+			case *packets.Subscribe:
+				got = append(got, "suback")
+			}
+		case <-time.After(100 * time.Millisecond):
+			got = append(got, "timeout")
+		}
+	}
+	if strings.Join(got, " ") != "m0 suback m1" {
+		t.Errorf("got %v, want m0 suback m1", got)
+	}
+}
+
+// drainStuck returns the payloads, or the error of the Disconnect.
+func drainStuck(cc *stuckContact) string {
+	var got []string
+	for {
+		select {
+		case p := <-cc.mostRecent:
+			switch v := p.(type) {
+			case *packets.Send:
+				got = append(got, string(v.Payload))
+			case *packets.Disconnect:
+				e, _ := v.GetOption("error")
+				return string(e) // and that's the end
+			}
+		case <-time.After(100 * time.Millisecond):
+			return strings.Join(got, " ")
+		}
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package iot_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/awootton/knotfreeiot/iot"
+	"github.com/awootton/knotfreeiot/packets"
+	"github.com/awootton/knotfreeiot/tokens"
+)
+
+func TestOwnedBroadcast(t *testing.T) {
+
+	tokens.LoadPublicKeys()
+
+	localtime := starttime
+	getTime := func() uint32 {
+		return localtime
+	}
+	ce := iot.MakeSimplestCluster(getTime, false, 1, "")
+	globalClusterExec = ce
+	aide := ce.Aides[0]
+
+	pubk, privk, _ := ed25519.GenerateKey(nil)
+	_, forger, _ := ed25519.GenerateKey(nil)
+
+	device := getNewContactFromAide(aide, "")
+	someone := getNewContactFromAide(aide, "")
+	ce.WaitForActions()
+	SendText(device, "S firmware")
+	ce.WaitForActions()
+	popAll(device)
+
+	// we don't have mongo here so be the guru and tell the aide it's owned.
+	setOwned := func(owned bool) {
+		sub := &packets.Subscribe{}
+		sub.Address.FromString("firmware")
+		sub.SetOption("noack", []byte("y"))
+		if owned {
+			sub.SetOption("owned", []byte(base64.RawURLEncoding.EncodeToString(pubk)))
+		}
+		iot.PushDownFromTop(aide.Looker, sub)
+		ce.WaitForActions()
+	}
+	publish := func(payload string, key ed25519.PrivateKey, when uint32) {
+		p := &packets.Send{}
+		p.Address.FromString("firmware")
+		p.Source.FromString("someone")
+		p.Payload = []byte(payload)
+		if key != nil {
+			p.Sign(key, when)
+		}
+		iot.PushPacketUpFromBottom(someone, p)
+		ce.WaitForActions()
+	}
+
+	setOwned(true)
+	got := popAll(device)
+	if got != "" {
+		t.Errorf("got %v, want nothing for the notice", got)
+	}
+
+	publish("unsigned", nil, 0)
+	publish("forged", forger, localtime)
+	publish("stale", privk, localtime-60*60)
+	publish("v1.2.3", privk, localtime)
+	got = popAll(device)
+	if strings.Count(got, "[P,") != 1 || !strings.Contains(got, "v1.2.3") {
+		t.Errorf("got %v, want just the signed one", got)
+	}
+
+	setOwned(false)
+	publish("anybody", nil, 0)
+	got = popAll(device)
+	if !strings.Contains(got, "anybody") {
+		t.Errorf("got %v, want anybody", got)
+	}
+}
+
+func TestOwnedWildcard(t *testing.T) {
+
+	tokens.LoadPublicKeys()
+
+	localtime := starttime
+	getTime := func() uint32 {
+		return localtime
+	}
+	ce := iot.MakeSimplestCluster(getTime, false, 2, "")
+	globalClusterExec = ce
+
+	pubk, privk, _ := ed25519.GenerateKey(nil)
+	_, forger, _ := ed25519.GenerateKey(nil)
+
+	device := getNewContactFromAide(ce.Aides[0], "")
+	watcher := getNewContactFromAide(ce.Aides[1], "")
+	someone := getNewContactFromAide(ce.Aides[1], "")
+	ce.WaitForActions()
+	SendText(device, "S fw/update")
+	SendText(watcher, "S fw/#")
+	ce.WaitForActions()
+
+	// we don't have mongo here so tell the guru it's owned like it was the one that knew.
+	sub := &packets.Subscribe{}
+	sub.Address.FromString("fw/update")
+	sub.SetOption("noack", []byte("y"))
+	sub.SetOption("owned", []byte(base64.RawURLEncoding.EncodeToString(pubk)))
+	iot.PushDownFromTop(ce.Gurus[0].Looker, sub)
+	ce.WaitForActions()
+
+	// the device goes and the guru has nobody on the name but it keeps it.
+	SendText(device, "U fw/update")
+	ce.WaitForActions()
+	ce.Gurus[0].Looker.Heartbeat(localtime)
+	ce.WaitForActions()
+	popAll(watcher)
+
+	publish := func(payload string, key ed25519.PrivateKey) {
+		p := &packets.Send{}
+		p.Address.FromString("fw/update")
+		p.Source.FromString("someone")
+		p.Payload = []byte(payload)
+		if key != nil {
+			p.Sign(key, localtime)
+		}
+		iot.PushPacketUpFromBottom(someone, p)
+		ce.WaitForActions()
+	}
+	publish("forged", forger)
+	publish("unsigned", nil)
+	publish("v2.0.0", privk)
+	got := popAll(watcher)
+	if strings.Count(got, "[P,") != 1 || !strings.Contains(got, "v2.0.0") {
+		t.Errorf("got %v, want just the signed one", got)
+	}
+}
+
+func TestOwnedReplay(t *testing.T) {
+
+	tokens.LoadPublicKeys()
+
+	localtime := starttime
+	getTime := func() uint32 {
+		return localtime
+	}
+	ce := iot.MakeSimplestCluster(getTime, false, 2, "")
+	globalClusterExec = ce
+
+	pubk, privk, _ := ed25519.GenerateKey(nil)
+
+	near := getNewContactFromAide(ce.Aides[0], "")
+	far := getNewContactFromAide(ce.Aides[1], "")
+	someone := getNewContactFromAide(ce.Aides[0], "")
+	replayer := getNewContactFromAide(ce.Aides[1], "")
+	ce.WaitForActions()
+	SendText(near, "S firmware")
+	SendText(far, "S firmware")
+	ce.WaitForActions()
+
+	// we don't have mongo here so be the guru and tell everyone it's owned.
+	for _, ex := range []*iot.Executive{ce.Gurus[0], ce.Aides[0], ce.Aides[1]} {
+		sub := &packets.Subscribe{}
+		sub.Address.FromString("firmware")
+		sub.SetOption("noack", []byte("y"))
+		sub.SetOption("owned", []byte(base64.RawURLEncoding.EncodeToString(pubk)))
+		iot.PushDownFromTop(ex.Looker, sub)
+	}
+	ce.WaitForActions()
+	popAll(near)
+	popAll(far)
+
+	signed := &packets.Send{}
+	signed.Address.FromString("firmware")
+	signed.Source.FromString("someone")
+	signed.Payload = []byte("v1.2.3")
+	signed.Sign(privk, localtime)
+	var buff bytes.Buffer
+	signed.Write(&buff)
+	wire := buff.Bytes()
+	send := func(cc iot.ContactInterface) {
+		p, err := packets.ReadPacket(bytes.NewReader(wire))
+		if err != nil {
+			t.Fatal(err)
+		}
+		iot.PushPacketUpFromBottom(cc, p)
+		ce.WaitForActions()
+	}
+
+	send(someone)
+	for _, cc := range []iot.ContactInterface{near, far} {
+		if got := popAll(cc); strings.Count(got, "v1.2.3") != 1 {
+			t.Errorf("got %v, want the signed one", got)
+		}
+	}
+	// the same bytes again, at the same aide and at the other one.
+	send(someone)
+	send(replayer)
+	for _, cc := range []iot.ContactInterface{near, far} {
+		if got := popAll(cc); got != "" {
+			t.Errorf("got %v, want no replay", got)
+		}
+	}
+	// a new one is fine.
+	again := &packets.Send{}
+	again.Address.FromString("firmware")
+	again.Source.FromString("someone")
+	again.Payload = []byte("v1.2.4")
+	again.Sign(privk, localtime)
+	iot.PushPacketUpFromBottom(someone, again)
+	ce.WaitForActions()
+	if got := popAll(far); !strings.Contains(got, "v1.2.4") {
+		t.Errorf("got %v, want the new one", got)
+	}
+}
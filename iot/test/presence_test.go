@@ -0,0 +1,119 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package iot_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/awootton/knotfreeiot/iot"
+	"github.com/awootton/knotfreeiot/tokens"
+)
+
+func TestPresence(t *testing.T) {
+
+	tokens.LoadPublicKeys()
+
+	localtime := starttime
+	getTime := func() uint32 {
+		return localtime
+	}
+	ce := iot.MakeSimplestCluster(getTime, false, 2, "")
+	globalClusterExec = ce
+
+	tokenWithPubk := func(pubk string) string {
+		payload := tokens.GetSampleTokenFromStats(uint32(time.Now().Unix()), "knotfree.dog:8085/mqtt", tokens.GetTokenStatsAndPrice(tokens.Medium).Stats)
+		payload.Pubk = pubk
+		tok, err := tokens.MakeToken(payload, []byte(tokens.GetPrivateKeyWhole(0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(tok)
+	}
+
+	// only an owned name has presence.
+	wt := &iot.WatchedTopic{}
+	wt.Name.HashString("thermostat-42")
+	wt.Owner = "owner-pubk"
+	wt.Jwtid = "the-owners-token"
+	wt.Expires = starttime + 60*60
+	ce.Store.SaveTopic(wt)
+
+	watcher := getNewContactFromAide(ce.Aides[1], tokenWithPubk("owner-pubk"))
+	stranger := getNewContactFromAide(ce.Aides[1], tokenWithPubk("stranger-pubk"))
+	device := getNewContactFromAide(ce.Aides[0], "")
+	other := getNewContactFromAide(ce.Aides[0], "")
+	ce.WaitForActions()
+	SendText(watcher, "S "+iot.PresenceTopic("owner-pubk", "thermostat-42"))
+	SendText(stranger, "S "+iot.PresenceTopic("owner-pubk", "thermostat-42"))
+	SendText(stranger, "S presence/#")
+	ce.WaitForActions()
+	popAll(watcher)
+	popAll(stranger)
+
+	expect := func(want bool) {
+		t.Helper()
+		time.Sleep(50 * time.Millisecond) // it goes through channelToAnyAide
+		ce.WaitForActions()
+		got := popSends(watcher)
+		if len(got) != 1 {
+			t.Fatalf("got %v, want one event", got)
+		}
+		event := &iot.Presence{}
+		err := json.Unmarshal(got[0].Payload, event)
+		if err != nil || event.Online != want {
+			t.Errorf("got %v %v, want online %v", string(got[0].Payload), err, want)
+		}
+	}
+
+	SendText(device, "S thermostat-42")
+	expect(true)
+	if got := popSends(stranger); len(got) != 0 {
+		t.Errorf("got %v, want nothing for the stranger", got)
+	}
+
+	// a client can't fake one.
+	SendText(other, "P "+iot.PresenceTopic("owner-pubk", "thermostat-42")+" pub fake")
+	ce.WaitForActions()
+	if got := popSends(watcher); len(got) != 0 {
+		t.Errorf("got %v, want nothing", got)
+	}
+
+	// the second one isn't news.
+	SendText(other, "S thermostat-42")
+	ce.WaitForActions()
+	SendText(other, "U thermostat-42")
+	ce.WaitForActions()
+	if got := popSends(watcher); len(got) != 0 {
+		t.Errorf("got %v, want nothing", got)
+	}
+
+	SendText(device, "U thermostat-42")
+	expect(false)
+
+	SendText(device, "S thermostat-42")
+	expect(true)
+
+	// and when it just goes away.
+	device.DoClose(errors.New("gone"))
+	localtime += 30
+	ce.Heartbeat(localtime)
+	ce.WaitForActions()
+	ce.Heartbeat(localtime)
+	expect(false)
+}
@@ -0,0 +1,212 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package iot_test
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/awootton/knotfreeiot/iot"
+	"github.com/awootton/knotfreeiot/packets"
+	"github.com/awootton/knotfreeiot/tokens"
+)
+
+func TestRetained(t *testing.T) {
+
+	tokens.LoadPublicKeys()
+
+	got := ""
+	want := ""
+	localtime := starttime
+	getTime := func() uint32 {
+		return localtime
+	}
+
+	ce := iot.MakeSimplestCluster(getTime, false, 2, "")
+	globalClusterExec = ce
+
+	c1 := getNewContactFromAide(ce.Aides[0], "")
+	c2 := getNewContactFromAide(ce.Aides[0], "")
+	c3 := getNewContactFromAide(ce.Aides[1], "")
+	ce.WaitForActions()
+
+	// nobody is subscribed yet.
+	SendText(c3, "P dashboard c3 lights_on retain 1")
+	ce.WaitForActions()
+
+	SendText(c1, "S dashboard")
+	ce.WaitForActions()
+
+	// the suback and the replay might come in either order.
+	want = ",c3,lights_on,retain,replay," // then the seq
+	got = popAll(c1)
+	if !strings.Contains(got, "[S,") || strings.Count(got, want) != 1 {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// the aide has a copy now. c1 doesn't get another.
+	SendText(c2, "S dashboard")
+	ce.WaitForActions()
+
+	got = popAll(c2)
+	if strings.Count(got, want) != 1 {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	got = popAll(c1)
+	if strings.Contains(got, want) {
+		t.Errorf("got %v, want no replay", got)
+	}
+
+	// an empty payload clears it.
+	clear := packets.Send{}
+	clear.Address.FromString("dashboard")
+	clear.Source.FromString("c3")
+	clear.SetOption("retain", []byte("1"))
+	iot.PushPacketUpFromBottom(c3, &clear)
+	ce.WaitForActions()
+	c1.(*testContact).popResultAsString()
+	c2.(*testContact).popResultAsString()
+
+	c4 := getNewContactFromAide(ce.Aides[1], "")
+	ce.WaitForActions()
+	SendText(c4, "S dashboard")
+	ce.WaitForActions()
+	got = popAll(c4)
+	if strings.Contains(got, "[P,") {
+		t.Errorf("got %v, want no replay", got)
+	}
+}
+
+// popAll returns all the messages so far, in one string.
+func popAll(cc iot.ContactInterface) string {
+	all := ""
+	for {
+		got, ok := cc.(*testContact).popResultAsString()
+		if !ok {
+			return all
+		}
+		all += got
+	}
+}
+
+func TestRetainedRemap(t *testing.T) {
+
+	tokens.LoadPublicKeys()
+
+	got := ""
+	localtime := starttime
+	getTime := func() uint32 {
+		return localtime
+	}
+
+	ce := iot.MakeSimplestCluster(getTime, false, 2, "")
+	globalClusterExec = ce
+
+	c1 := getNewContactFromAide(ce.Aides[0], "")
+	c2 := getNewContactFromAide(ce.Aides[1], "")
+	c3 := getNewContactFromAide(ce.Aides[1], "")
+	ce.WaitForActions()
+
+	const topicCount = 16
+	for i := 0; i < topicCount; i++ {
+		SendText(c1, "S remapped"+strconv.Itoa(i))
+	}
+	ce.WaitForActions()
+	for i := 0; i < topicCount; i++ {
+		SendText(c3, "P remapped"+strconv.Itoa(i)+" c3 value"+strconv.Itoa(i)+" retain 1")
+	}
+	ce.WaitForActions()
+
+	// add a guru. About half the topics move to it.
+	guru1 := iot.NewExecutive(100, "guru1", getTime, true, ce)
+	iot.GuruNameToConfigMap["guru1"] = guru1
+	ce.Gurus = append(ce.Gurus, guru1)
+	names := []string{"guru0", "guru1"}
+	for _, ex := range ce.Gurus {
+		ex.Looker.SetUpstreamNames(names, names)
+	}
+	for _, ex := range ce.Aides {
+		ex.Looker.SetUpstreamNames(names, names)
+	}
+	ce.WaitForActions()
+
+	// c2 is on the other aide so it has to come from a guru.
+	for i := 0; i < topicCount; i++ {
+		SendText(c2, "S remapped"+strconv.Itoa(i))
+	}
+	ce.WaitForActions()
+
+	got = popAll(c2)
+	for i := 0; i < topicCount; i++ {
+		want := ",c3,value" + strconv.Itoa(i) + ",retain,replay,"
+		if !strings.Contains(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestRetainedWildcard(t *testing.T) {
+
+	tokens.LoadPublicKeys()
+
+	got := ""
+	localtime := starttime
+	getTime := func() uint32 {
+		return localtime
+	}
+
+	ce := iot.MakeSimplestCluster(getTime, false, 2, "")
+	globalClusterExec = ce
+
+	c1 := getNewContactFromAide(ce.Aides[0], "")
+	c2 := getNewContactFromAide(ce.Aides[0], "")
+	c3 := getNewContactFromAide(ce.Aides[1], "")
+	ce.WaitForActions()
+
+	SendText(c3, "P plant7/line1/temp c3 hot retain 1")
+	SendText(c3, "P plant7/line2/temp c3 cold retain 1")
+	SendText(c3, "P plant8/line1/temp c3 other retain 1")
+	ce.WaitForActions()
+
+	// an hour later, with nobody watching, the guru still has them.
+	localtime += 60 * 60
+	ce.Gurus[0].Looker.Heartbeat(localtime)
+	localtime -= 60 * 60 // so the contacts don't time out.
+	ce.WaitForActions()
+
+	SendText(c1, "S plant7/#")
+	ce.WaitForActions()
+	got = popAll(c1)
+	if !strings.Contains(got, "hot,retain,replay,") || !strings.Contains(got, "cold,retain,replay,") {
+		t.Errorf("got %v, want both", got)
+	}
+	if !strings.Contains(got, "topic,plant7/line1/temp") || strings.Contains(got, "other") {
+		t.Errorf("got %v, want just plant7", got)
+	}
+
+	// the next one at the same aide gets them and c1 doesn't get them again.
+	SendText(c2, "S plant7/+/temp")
+	ce.WaitForActions()
+	got = popAll(c2)
+	if strings.Count(got, ",retain,replay,") != 2 {
+		t.Errorf("got %v, want 2 replays", got)
+	}
+	got = popAll(c1)
+	if strings.Contains(got, "replay") {
+		t.Errorf("got %v, want no replay", got)
+	}
+}
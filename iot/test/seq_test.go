@@ -0,0 +1,205 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package iot_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/awootton/knotfreeiot/iot"
+	"github.com/awootton/knotfreeiot/packets"
+	"github.com/awootton/knotfreeiot/tokens"
+)
+
+func TestSequenceNumbers(t *testing.T) {
+
+	tokens.LoadPublicKeys()
+
+	localtime := starttime
+	getTime := func() uint32 {
+		return localtime
+	}
+	ce := iot.MakeSimplestCluster(getTime, false, 2, "")
+	globalClusterExec = ce
+
+	near := getNewContactFromAide(ce.Aides[0], "") // the same aide as the publisher
+	far := getNewContactFromAide(ce.Aides[1], "")
+	pub := getNewContactFromAide(ce.Aides[0], "")
+	old := getNewContactFromAide(ce.Aides[0], "") // doesn't ask for the seq
+	ce.WaitForActions()
+	askForSeq(near)
+	askForSeq(far)
+	ce.WaitForActions()
+	SendText(near, "S counted")
+	SendText(far, "S counted")
+	SendText(pub, "S counted") // it doesn't get its own
+	SendText(old, "S counted")
+	ce.WaitForActions()
+	popAll(near)
+	popAll(far)
+	popAll(pub)
+	popAll(old)
+
+	for i := 0; i < 3; i++ {
+		SendText(pub, "P counted pub hello")
+		ce.WaitForActions()
+	}
+	got := popSends(old)
+	if len(got) != 3 {
+		t.Errorf("got %v, want 3 for the one at the same aide", got)
+	}
+	for _, p := range got {
+		if _, ok := p.GetSeq(); ok {
+			t.Errorf("got %v, want it before the guru", p)
+		}
+	}
+	for _, cc := range []iot.ContactInterface{near, far} {
+		got := popSends(cc)
+		if len(got) != 3 {
+			t.Fatalf("got %v, want 3", got)
+		}
+		for i, p := range got {
+			seq, ok := p.GetSeq()
+			if !ok || seq != uint64(i+1) {
+				t.Errorf("got %v %v, want %v", seq, ok, i+1)
+			}
+			if _, ok := p.GetOption("from"); ok {
+				t.Errorf("got %v, want no from", p)
+			}
+		}
+	}
+	if got := popSends(pub); len(got) != 0 {
+		t.Errorf("got %v, want nothing for the publisher", got)
+	}
+
+	// a client can see the gap. Be the guru and skip one.
+	tracker := &packets.SeqTracker{}
+	for _, seq := range []string{"1", "2", "4", "3"} {
+		p := &packets.Send{}
+		p.Address.FromString("counted")
+		p.Payload = []byte("seq " + seq)
+		p.SetOption("seq", []byte(seq))
+		iot.PushDownFromTop(ce.Aides[1].Looker, p)
+		ce.WaitForActions()
+	}
+	var missed uint64
+	var olds int
+	for _, p := range popSends(far) {
+		m, old := tracker.Check(p)
+		missed += m
+		if old {
+			olds++
+		}
+	}
+	if missed != 1 || olds != 1 {
+		t.Errorf("got %v missed %v old, want 1 and 1", missed, olds)
+	}
+
+	// the guru forgets it when nobody is watching and starts again.
+	tracker = &packets.SeqTracker{}
+	SendText(pub, "P counted pub before")
+	ce.WaitForActions()
+	for _, p := range popSends(far) {
+		tracker.Check(p)
+	}
+	for _, cc := range []iot.ContactInterface{near, far, pub, old} {
+		SendText(cc, "U counted")
+	}
+	ce.WaitForActions()
+	localtime += 60
+	ce.Gurus[0].Looker.Heartbeat(localtime)
+	ce.WaitForActions()
+	SendText(far, "S counted")
+	ce.WaitForActions()
+	popAll(far)
+	SendText(pub, "P counted pub after")
+	ce.WaitForActions()
+	got = popSends(far)
+	if len(got) != 1 {
+		t.Fatalf("got %v, want 1", got)
+	}
+	if seq, _ := got[0].GetSeq(); seq != 1 {
+		t.Errorf("got %v, want it to start again", got[0])
+	}
+	if _, old := tracker.Check(got[0]); old {
+		t.Errorf("got %v, want the new epoch to not be old", got[0])
+	}
+}
+
+func TestSeqBackOnlyWhenAsked(t *testing.T) {
+
+	tokens.LoadPublicKeys()
+
+	localtime := starttime
+	getTime := func() uint32 {
+		return localtime
+	}
+	ce := iot.MakeSimplestCluster(getTime, false, 1, "")
+	globalClusterExec = ce
+
+	// be an aide at the guru. See seq.go
+	aide := getNewContactFromAide(ce.Gurus[0], "")
+	ce.WaitForActions()
+	SendText(aide, "S nobody-counts")
+	ce.WaitForActions()
+	popAll(aide)
+	SendText(aide, "P nobody-counts pub hello from 77")
+	ce.WaitForActions()
+	if got := popSends(aide); len(got) != 0 {
+		t.Errorf("got %v, want no round trip without back", got)
+	}
+
+	// now one of its contacts has the seq cap.
+	SendText(aide, "S nobody-counts back 1")
+	ce.WaitForActions()
+	popAll(aide)
+	SendText(aide, "P nobody-counts pub hello from 77")
+	ce.WaitForActions()
+	got := popSends(aide)
+	if len(got) != 1 {
+		t.Fatalf("got %v, want it back", got)
+	}
+	if from, _ := got[0].GetOption("from"); string(from) != "77" {
+		t.Errorf("got %v, want the from", got[0])
+	}
+	if _, ok := got[0].GetSeq(); !ok {
+		t.Errorf("got %v, want a seq", got[0])
+	}
+}
+
+// askForSeq is a Connect with the seq cap. See capabilities.go
+func askForSeq(cc iot.ContactInterface) {
+	connect := &packets.Connect{}
+	connect.SetOption("token", []byte(tokens.Get32xTokenLocal()))
+	connect.SetCapabilities(packets.CapSeq)
+	iot.PushPacketUpFromBottom(cc, connect)
+}
+
+// popSends is all the publishes so far.
+func popSends(cc iot.ContactInterface) []*packets.Send {
+	var sends []*packets.Send
+	for {
+		select {
+		case p := <-cc.(*testContact).mostRecent:
+			send, ok := p.(*packets.Send)
+			if ok {
+				sends = append(sends, send)
+			}
+		case <-time.After(100 * time.Millisecond):
+			return sends
+		}
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package iot_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/awootton/knotfreeiot/iot"
+	"github.com/awootton/knotfreeiot/packets"
+	"github.com/awootton/knotfreeiot/tokens"
+)
+
+func TestSharedSubscription(t *testing.T) {
+
+	tokens.LoadPublicKeys()
+
+	localtime := starttime
+	getTime := func() uint32 {
+		return localtime
+	}
+	ce := iot.MakeSimplestCluster(getTime, false, 2, "")
+	globalClusterExec = ce
+
+	// the workers are on both aides.
+	w1 := getNewContactFromAide(ce.Aides[0], "")
+	w2 := getNewContactFromAide(ce.Aides[0], "")
+	w3 := getNewContactFromAide(ce.Aides[1], "")
+	plain := getNewContactFromAide(ce.Aides[1], "")
+	pub := getNewContactFromAide(ce.Aides[0], "")
+	ce.WaitForActions()
+
+	workers := []iot.ContactInterface{w1, w2, w3}
+	for _, w := range workers {
+		subscribe(w, "$share/workers/jobs")
+	}
+	SendText(plain, "S jobs")
+	ce.WaitForActions()
+	for _, cc := range []iot.ContactInterface{w1, w2, w3, plain} {
+		popAll(cc)
+	}
+
+	for i := 0; i < 6; i++ {
+		SendText(pub, fmt.Sprintf("P jobs pub job%v", i))
+		ce.WaitForActions()
+	}
+	counts, total := countJobs(workers)
+	if total != 6 {
+		t.Errorf("got %v jobs %v, want 6, once each", total, counts)
+	}
+	for i, count := range counts {
+		if count == 0 {
+			t.Errorf("worker %v got no jobs %v", i, counts)
+		}
+	}
+	got := popAll(plain)
+	if strings.Count(got, "[P,") != 6 {
+		t.Errorf("got %v, want all 6 for the plain subscriber", got)
+	}
+
+	// w3 leaves. Now the other aide has them all.
+	unsub := &packets.Unsubscribe{}
+	unsub.Address.FromString("$share/workers/jobs")
+	iot.PushPacketUpFromBottom(w3, unsub)
+	ce.WaitForActions()
+	for i := 0; i < 4; i++ {
+		SendText(pub, fmt.Sprintf("P jobs pub job%v", i))
+		ce.WaitForActions()
+	}
+	counts, total = countJobs(workers)
+	if total != 4 || counts[2] != 0 || counts[0] == 0 || counts[1] == 0 {
+		t.Errorf("got %v, want w1 and w2 to share 4", counts)
+	}
+	got = popAll(plain)
+	if strings.Count(got, "[P,") != 4 {
+		t.Errorf("got %v, want all 4 for the plain subscriber", got)
+	}
+
+	// a client can't ask for just one of anybody. The aide takes the "share" out.
+	anyJob := func(cc iot.ContactInterface) {
+		p := &packets.Send{}
+		p.Address.FromString("jobs")
+		p.Source.FromString("pub")
+		p.Payload = []byte("job-any")
+		p.SetOption("share", []byte("*"))
+		iot.PushPacketUpFromBottom(cc, p)
+		ce.WaitForActions()
+	}
+	for i := 0; i < 2; i++ {
+		anyJob(pub)
+	}
+	_, total = countJobs([]iot.ContactInterface{w1, w2, w3, plain})
+	if total != 4 {
+		t.Errorf("got %v, want 4. The workers and plain", total)
+	}
+
+	// the servers can. Like the subdomain requests. See sub-domain-server.go
+	server := getNewContactFromAide(ce.Gurus[0], "")
+	ce.WaitForActions()
+	for i := 0; i < 2; i++ {
+		anyJob(server)
+	}
+	_, total = countJobs([]iot.ContactInterface{w1, w2, w3, plain})
+	if total != 2 {
+		t.Errorf("got %v, want 2", total)
+	}
+}
+
+func TestSharedWildcardSubscription(t *testing.T) {
+
+	tokens.LoadPublicKeys()
+
+	localtime := starttime
+	getTime := func() uint32 {
+		return localtime
+	}
+	ce := iot.MakeSimplestCluster(getTime, false, 2, "")
+	globalClusterExec = ce
+
+	w1 := getNewContactFromAide(ce.Aides[0], "")
+	w2 := getNewContactFromAide(ce.Aides[1], "")
+	pub := getNewContactFromAide(ce.Aides[1], "")
+	ce.WaitForActions()
+
+	workers := []iot.ContactInterface{w1, w2}
+	for _, w := range workers {
+		subscribe(w, "$share/workers/jobs/+")
+	}
+	ce.WaitForActions()
+	for _, w := range workers {
+		popAll(w)
+	}
+
+	for i := 0; i < 4; i++ {
+		SendText(pub, fmt.Sprintf("P jobs/%v pub job%v", i, i))
+		ce.WaitForActions()
+	}
+	counts, total := countJobs(workers)
+	if total != 4 || counts[0] == 0 || counts[1] == 0 {
+		t.Errorf("got %v, want 4 shared", counts)
+	}
+}
+
+func TestSharedRemap(t *testing.T) {
+
+	tokens.LoadPublicKeys()
+
+	localtime := starttime
+	getTime := func() uint32 {
+		return localtime
+	}
+	ce := iot.MakeSimplestCluster(getTime, false, 2, "")
+	globalClusterExec = ce
+
+	worker := getNewContactFromAide(ce.Aides[0], "")
+	plain := getNewContactFromAide(ce.Aides[0], "")
+	pub := getNewContactFromAide(ce.Aides[1], "")
+	ce.WaitForActions()
+
+	// enough names that some of them move to the new guru.
+	for i := 0; i < 8; i++ {
+		subscribe(worker, fmt.Sprintf("$share/workers/jobs%v", i))
+		SendText(plain, fmt.Sprintf("S jobs%v", i))
+	}
+	subscribe(worker, "$share/workers/tasks/+")
+	ce.WaitForActions()
+	popAll(worker)
+	popAll(plain)
+
+	ce.AddGuru()
+	ce.WaitForActions()
+
+	for i := 0; i < 8; i++ {
+		SendText(pub, fmt.Sprintf("P jobs%v pub job%v", i, i))
+		ce.WaitForActions()
+	}
+	SendText(pub, "P tasks/a pub task")
+	ce.WaitForActions()
+
+	got := popAll(worker)
+	if strings.Count(got, "[P,") != 9 {
+		t.Errorf("got %v, want all 8 jobs and the task in the group", got)
+	}
+	got = popAll(plain)
+	if strings.Count(got, "[P,") != 8 {
+		t.Errorf("got %v, want all 8 jobs for the plain subscriber", got)
+	}
+}
+
+// subscribe is because the text packets don't do names with a '$'.
+func subscribe(cc iot.ContactInterface, name string) {
+	sub := &packets.Subscribe{}
+	sub.Address.FromString(name)
+	iot.PushPacketUpFromBottom(cc, sub)
+}
+
+// countJobs counts the publishes each one got.
+func countJobs(contacts []iot.ContactInterface) ([]int, int) {
+	counts := make([]int, len(contacts))
+	total := 0
+	for i, cc := range contacts {
+		got := popAll(cc)
+		counts[i] = strings.Count(got, "[P,")
+		total += counts[i]
+	}
+	return counts, total
+}
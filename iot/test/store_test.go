@@ -0,0 +1,111 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package iot_test
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/awootton/knotfreeiot/iot"
+	"github.com/awootton/knotfreeiot/tokens"
+)
+
+// countingStore counts the GetTopic and can hold them up.
+type countingStore struct {
+	iot.Store
+	mux  sync.Mutex
+	gets int
+	hold chan bool
+}
+
+func (cs *countingStore) GetTopic(name iot.HashType) (*iot.WatchedTopic, bool) {
+	cs.mux.Lock()
+	cs.gets++
+	hold := cs.hold
+	cs.mux.Unlock()
+	if hold != nil {
+		<-hold
+	}
+	return cs.Store.GetTopic(name)
+}
+
+func (cs *countingStore) getCount() int {
+	cs.mux.Lock()
+	defer cs.mux.Unlock()
+	return cs.gets
+}
+
+func TestStoreLookups(t *testing.T) {
+
+	tokens.LoadPublicKeys()
+
+	localtime := starttime
+	getTime := func() uint32 {
+		return localtime
+	}
+	ce := iot.MakeSimplestCluster(getTime, false, 2, "")
+	globalClusterExec = ce
+	store := &countingStore{Store: ce.Store}
+	ce.Store = store
+
+	for _, name := range []string{"stored-name", "slow-name"} {
+		wt := &iot.WatchedTopic{}
+		wt.Name.HashString(name)
+		wt.Owner = "the-owner"
+		wt.Jwtid = "the-owners-token"
+		wt.Expires = starttime + 60*60
+		ce.Store.SaveTopic(wt)
+	}
+
+	pub := getNewContactFromAide(ce.Aides[0], "")
+	sub := getNewContactFromAide(ce.Aides[1], "")
+	ce.WaitForActions()
+
+	// random names don't go to the Store.
+	for i := 0; i < 50; i++ {
+		SendText(pub, "P random-name-"+strconv.Itoa(i)+" pub hello")
+	}
+	ce.WaitForActions()
+	if got := store.getCount(); got != 0 {
+		t.Errorf("got %v, want no lookups", got)
+	}
+	SendText(pub, "P stored-name pub hello")
+	ce.WaitForActions()
+	if got := store.getCount(); got != 1 {
+		t.Errorf("got %v, want 1 lookup", got)
+	}
+
+	// a slow Store. The messages wait a while and then go like it's not stored.
+	store.mux.Lock()
+	store.hold = make(chan bool)
+	store.mux.Unlock()
+	SendText(sub, "S slow-name")
+	time.Sleep(100 * time.Millisecond)
+	SendText(pub, "P slow-name pub waited")
+	time.Sleep(300 * time.Millisecond)
+	if got := popAll(sub); strings.Contains(got, "waited") {
+		t.Errorf("got %v, want it waiting for the Store", got)
+	}
+	time.Sleep(3 * time.Second)
+	if got := popAll(sub); !strings.Contains(got, "waited") {
+		t.Errorf("got %v, want it after the Store was slow", got)
+	}
+	close(store.hold)
+	ce.WaitForActions()
+}
@@ -0,0 +1,142 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package iot_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awootton/knotfreeiot/iot"
+	"github.com/awootton/knotfreeiot/packets"
+	"github.com/awootton/knotfreeiot/tokens"
+)
+
+func TestTopicTTL(t *testing.T) {
+
+	tokens.LoadPublicKeys()
+
+	localtime := starttime
+	getTime := func() uint32 {
+		return localtime
+	}
+	ce := iot.MakeSimplestCluster(getTime, false, 1, "")
+	globalClusterExec = ce
+
+	sub := getNewContactFromAide(ce.Aides[0], "")
+	other := getNewContactFromAide(ce.Aides[0], "")
+	pub := getNewContactFromAide(ce.Aides[0], "")
+	ce.WaitForActions()
+
+	SendText(sub, "S short-lived ttl 30")
+	SendText(sub, "S tiny ttl 1") // that's too small. It becomes 10.
+	SendText(sub, "S long-lived")
+	SendText(other, "S short-lived") // the ttl is just for sub.
+	ce.WaitForActions()
+	popAll(sub)
+	popAll(other)
+
+	// and a publish can't make it shorter for everybody.
+	SendText(pub, "P long-lived pub short ttl 10")
+	ce.WaitForActions()
+	popAll(sub)
+
+	localtime += 5
+	ce.Heartbeat(localtime)
+	ce.WaitForActions()
+	SendText(pub, "P tiny pub still-here")
+	ce.WaitForActions()
+	got := popAll(sub)
+	if !strings.Contains(got, "still-here") {
+		t.Errorf("got %v, want still-here", got)
+	}
+
+	localtime += 60
+	ce.Heartbeat(localtime)
+	ce.WaitForActions()
+	SendText(pub, "P short-lived pub gone")
+	SendText(pub, "P long-lived pub the-default")
+	ce.WaitForActions()
+	got = popAll(sub)
+	if strings.Contains(got, "gone") {
+		t.Errorf("got %v, want the short one expired", got)
+	}
+	if !strings.Contains(got, "the-default") {
+		t.Errorf("got %v, want the long one", got)
+	}
+	got = popAll(other)
+	if !strings.Contains(got, "gone") {
+		t.Errorf("got %v, want the one without a ttl to still have it", got)
+	}
+}
+
+func TestTopicTTLPublishAndToken(t *testing.T) {
+
+	tokens.LoadPublicKeys()
+
+	localtime := starttime
+	getTime := func() uint32 {
+		return localtime
+	}
+	ce := iot.MakeSimplestCluster(getTime, false, 1, "")
+	globalClusterExec = ce
+
+	payload := tokens.GetSampleTokenFromStats(uint32(time.Now().Unix()), "knotfree.dog:8085/mqtt", tokens.GetTokenStatsAndPrice(tokens.Tiny).Stats)
+	tinyToken, err := tokens.MakeToken(payload, []byte(tokens.GetPrivateKeyWhole(0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tiny := getNewContactFromAide(ce.Aides[0], string(tinyToken))
+	big := getNewContactFromAide(ce.Aides[0], "")
+	keeper := getNewContactFromAide(ce.Aides[0], "")
+	pub := getNewContactFromAide(ce.Aides[0], "")
+	ce.WaitForActions()
+
+	// a tiny token has 3 subscriptions so it gets 3 hours, not a day.
+	SendText(tiny, "S tiny-topic ttl 86400")
+	SendText(big, "S big-topic ttl 86400")
+	SendText(keeper, "S kept-topic")
+	ce.WaitForActions()
+	// a publish with a ttl keeps the topic past the usual 25 minutes.
+	SendText(pub, "P kept-topic pub hello ttl 86400")
+	ce.WaitForActions()
+	popAll(tiny)
+	popAll(big)
+	popAll(keeper)
+
+	// 4 hours. The contacts ping so they don't time out.
+	for i := 0; i < 24; i++ {
+		localtime += 10 * 60
+		for _, cc := range []iot.ContactInterface{tiny, big, keeper, pub} {
+			iot.PushPacketUpFromBottom(cc, &packets.Ping{})
+		}
+		ce.Heartbeat(localtime)
+		ce.WaitForActions()
+	}
+	SendText(pub, "P tiny-topic pub tiny-gone")
+	SendText(pub, "P big-topic pub big-here")
+	SendText(pub, "P kept-topic pub kept-here")
+	ce.WaitForActions()
+	if got := popAll(tiny); strings.Contains(got, "tiny-gone") {
+		t.Errorf("got %v, want the tiny token's ttl clamped", got)
+	}
+	if got := popAll(big); !strings.Contains(got, "big-here") {
+		t.Errorf("got %v, want big-here", got)
+	}
+	if got := popAll(keeper); !strings.Contains(got, "kept-here") {
+		t.Errorf("got %v, want the publish ttl to keep it", got)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package iot_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awootton/knotfreeiot/iot"
+	"github.com/awootton/knotfreeiot/packets"
+	"github.com/awootton/knotfreeiot/tokens"
+)
+
+func TestUsersRejected(t *testing.T) {
+
+	tokens.LoadPublicKeys()
+	tokens.Get32xTokenLocal() // loads the private keys
+
+	localtime := starttime
+	getTime := func() uint32 {
+		return localtime
+	}
+	ce := iot.MakeSimplestCluster(getTime, false, 1, "")
+	globalClusterExec = ce
+	aide := ce.Aides[0]
+
+	tokenWithPubk := func(pubk string) string {
+		payload := tokens.GetSampleTokenFromStats(uint32(time.Now().Unix()), "knotfree.dog:8085/mqtt", tokens.GetTokenStatsAndPrice(tokens.Medium).Stats)
+		payload.Pubk = pubk
+		tok, err := tokens.MakeToken(payload, []byte(tokens.GetPrivateKeyWhole(0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(tok)
+	}
+	alice := getNewContactFromAide(aide, tokenWithPubk("alice-pubk"))
+	bob := getNewContactFromAide(aide, tokenWithPubk("bob-pubk"))
+	pub := getNewContactFromAide(aide, "")
+	ce.WaitForActions()
+	SendText(alice, "S alices-name")
+	SendText(bob, "S alices-name")
+	ce.WaitForActions()
+	popAll(alice)
+	popAll(bob)
+
+	// we don't have mongo here so be the guru and say no to bob.
+	suback := &packets.Subscribe{}
+	suback.Address.FromString("alices-name")
+	suback.SetOption("error", []byte("subscribe rejected: not a user of this name"))
+	suback.SetOption("pubk", []byte("bob-pubk"))
+	iot.PushDownFromTop(aide.Looker, suback)
+	ce.WaitForActions()
+
+	got := popAll(bob)
+	if !strings.Contains(got, "not a user") {
+		t.Errorf("got %v, want an error for bob", got)
+	}
+	got = popAll(alice)
+	if got != "" {
+		t.Errorf("got %v, want nothing for alice", got)
+	}
+
+	SendText(pub, "P alices-name pub hello")
+	ce.WaitForActions()
+	got = popAll(alice)
+	if !strings.Contains(got, "hello") {
+		t.Errorf("got %v, want hello for alice", got)
+	}
+	got = popAll(bob)
+	if strings.Contains(got, "hello") {
+		t.Errorf("got %v, want nothing for bob", got)
+	}
+}
+
+func TestServerOptionsStripped(t *testing.T) {
+
+	tokens.LoadPublicKeys()
+
+	localtime := starttime
+	getTime := func() uint32 {
+		return localtime
+	}
+	ce := iot.MakeSimplestCluster(getTime, false, 1, "")
+	globalClusterExec = ce
+	aide := ce.Aides[0]
+
+	evil := getNewContactFromAide(aide, "")
+	good := getNewContactFromAide(aide, "")
+	pub := getNewContactFromAide(aide, "")
+	ce.WaitForActions()
+
+	// a client that says it's a billing subscribe, and somebody else.
+	sub := &packets.Subscribe{}
+	sub.Address.FromString("victim")
+	sub.SetOption("statsmax", []byte(`{"in":1,"su":1}`))
+	sub.SetOption("pubk", []byte("the-owners-pubk"))
+	sub.SetOption("jwtid", []byte("someone-elses-jwtid"))
+	iot.PushPacketUpFromBottom(evil, sub)
+	ce.WaitForActions()
+	SendText(good, "S victim")
+	ce.WaitForActions()
+	popAll(evil)
+	popAll(good)
+
+	// it's just a name and the publishes go through.
+	SendText(pub, "P victim pub hello")
+	ce.WaitForActions()
+	got := popAll(good)
+	if !strings.Contains(got, "hello") {
+		t.Errorf("got %v, want hello", got)
+	}
+	got = popAll(evil)
+	if !strings.Contains(got, "hello") {
+		t.Errorf("got %v, want hello", got)
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package iot_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/awootton/knotfreeiot/iot"
+	"github.com/awootton/knotfreeiot/packets"
+	"github.com/awootton/knotfreeiot/tokens"
+)
+
+func TestMatchTopic(t *testing.T) {
+
+	tests := []struct {
+		pattern string
+		topic   string
+		want    bool
+	}{
+		{"home/+/temp", "home/kitchen/temp", true},
+		{"home/+/temp", "home/kitchen/humid", false},
+		{"home/+/temp", "home/kitchen/oven/temp", false},
+		{"home/#", "home/kitchen/temp", true},
+		{"home/#", "home", true},
+		{"home/#", "homer/kitchen", false},
+		{"+/+", "a/b", true},
+		{"+/+", "a/b/c", false},
+		{"#", "a/b/c", true},
+		{"#", "$SYS/a", false},
+		{"$SYS/#", "$SYS/a", true},
+	}
+	for _, tt := range tests {
+		got := iot.MatchTopic(tt.pattern, tt.topic)
+		if got != tt.want {
+			t.Errorf("MatchTopic(%v, %v) got %v, want %v", tt.pattern, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestWildcardSubscribe(t *testing.T) {
+
+	tokens.LoadPublicKeys()
+
+	got := ""
+	want := ""
+	localtime := starttime
+	getTime := func() uint32 {
+		return localtime
+	}
+
+	// 1 guru and 2 aides so the publish has to go through the guru.
+	ce := iot.MakeSimplestCluster(getTime, false, 2, "")
+	globalClusterExec = ce
+
+	c1 := getNewContactFromAide(ce.Aides[0], "")
+	c2 := getNewContactFromAide(ce.Aides[1], "")
+	c3 := getNewContactFromAide(ce.Aides[1], "")
+	ce.WaitForActions()
+
+	SendText(c1, "S home/+/temp")
+	ce.WaitForActions()
+	SendText(c2, "S home/#")
+	ce.WaitForActions()
+
+	// the subacks
+	got, _ = c1.(*testContact).popResultAsString()
+	if !strings.HasPrefix(got, "[S,") {
+		t.Errorf("got %v, want suback", got)
+	}
+	got, _ = c2.(*testContact).popResultAsString()
+	if !strings.HasPrefix(got, "[S,") {
+		t.Errorf("got %v, want suback", got)
+	}
+
+	SendText(c3, "P home/kitchen/temp c3 hot")
+	ce.WaitForActions()
+
+	got, _ = c1.(*testContact).popResultAsString()
+	want = "hot"
+	if !strings.Contains(got, want) || !strings.Contains(got, "topic,home/kitchen/temp") {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	got, _ = c2.(*testContact).popResultAsString()
+	if !strings.Contains(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// only the # gets this one
+	SendText(c3, "P home/kitchen/humid c3 damp")
+	ce.WaitForActions()
+
+	got, _ = c2.(*testContact).popResultAsString()
+	want = "damp"
+	if !strings.Contains(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	got, _ = c1.(*testContact).popResultAsString()
+	want = "no message received"
+	if !strings.HasPrefix(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// and names without a '/' never match
+	SendText(c3, "P kitchen c3 private")
+	ce.WaitForActions()
+	got, _ = c2.(*testContact).popResultAsString()
+	if !strings.HasPrefix(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// native packets work too, after an unsubscribe
+	unsub := packets.Unsubscribe{}
+	unsub.Address.FromString("home/#")
+	iot.PushPacketUpFromBottom(c2, &unsub)
+	ce.WaitForActions()
+
+	SendText(c3, "P home/kitchen/temp c3 cold")
+	ce.WaitForActions()
+
+	got, _ = c1.(*testContact).popResultAsString()
+	if !strings.Contains(got, "cold") {
+		t.Errorf("got %v, want %v", got, "cold")
+	}
+	got, _ = c2.(*testContact).popResultAsString()
+	if !strings.HasPrefix(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestWildcardNoDuplicates(t *testing.T) {
+
+	tokens.LoadPublicKeys()
+
+	got := ""
+	none := "no message received"
+	localtime := starttime
+	getTime := func() uint32 {
+		return localtime
+	}
+
+	ce := iot.MakeSimplestCluster(getTime, false, 2, "")
+	globalClusterExec = ce
+
+	// c1 has the name and two patterns. c2 is at the same aide as the publisher.
+	c1 := getNewContactFromAide(ce.Aides[0], "")
+	c2 := getNewContactFromAide(ce.Aides[1], "")
+	c3 := getNewContactFromAide(ce.Aides[1], "")
+	ce.WaitForActions()
+
+	for _, name := range []string{"home/kitchen/temp", "home/+/temp", "home/#"} {
+		SendText(c1, "S "+name)
+		ce.WaitForActions()
+		c1.(*testContact).popResultAsString() // the suback
+	}
+	for _, name := range []string{"home/kitchen/temp", "home/#"} {
+		SendText(c2, "S "+name)
+		ce.WaitForActions()
+		c2.(*testContact).popResultAsString()
+	}
+
+	SendText(c3, "P home/kitchen/temp c3 hot")
+	ce.WaitForActions()
+
+	for _, c := range []iot.ContactInterface{c1, c2} {
+		got, _ = c.(*testContact).popResultAsString()
+		if !strings.Contains(got, "hot") {
+			t.Errorf("got %v, want %v", got, "hot")
+		}
+		got, _ = c.(*testContact).popResultAsString()
+		if !strings.HasPrefix(got, none) {
+			t.Errorf("got %v, want only one", got)
+		}
+	}
+	got, _ = c3.(*testContact).popResultAsString()
+	if !strings.HasPrefix(got, none) {
+		t.Errorf("got %v, want %v", got, none)
+	}
+
+	// a "topic" from the client doesn't make it go to a pattern.
+	send := packets.Send{}
+	send.Address.FromString("kitchen")
+	send.Source.FromString("c3")
+	send.Payload = []byte("spoof")
+	send.SetOption("topic", []byte("home/kitchen/temp"))
+	iot.PushPacketUpFromBottom(c3, &send)
+	ce.WaitForActions()
+
+	got, _ = c1.(*testContact).popResultAsString()
+	if !strings.HasPrefix(got, none) {
+		t.Errorf("got %v, want %v", got, none)
+	}
+
+	// and a bare # is just a name.
+	SendText(c2, "S #")
+	ce.WaitForActions()
+	c2.(*testContact).popResultAsString()
+	SendText(c3, "P other/thing c3 nope")
+	ce.WaitForActions()
+	got, _ = c2.(*testContact).popResultAsString()
+	if !strings.HasPrefix(got, none) {
+		t.Errorf("got %v, want %v", got, none)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package iot_test
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awootton/knotfreeiot/iot"
+	"github.com/awootton/knotfreeiot/packets"
+	"github.com/awootton/knotfreeiot/tokens"
+	"github.com/awootton/libmqtt"
+)
+
+func TestWill(t *testing.T) {
+
+	tokens.LoadPublicKeys()
+
+	localtime := starttime
+	getTime := func() uint32 {
+		return localtime
+	}
+	ce := iot.MakeSimplestCluster(getTime, false, 2, "")
+	globalClusterExec = ce
+
+	watcher := getNewContactFromAide(ce.Aides[1], "")
+	device := getNewContactFromAide(ce.Aides[0], "")
+	polite := getNewContactFromAide(ce.Aides[0], "")
+	ce.WaitForActions()
+
+	SendText(watcher, "S device/status")
+	ce.WaitForActions()
+	popAll(watcher)
+
+	for _, cc := range []iot.ContactInterface{device, polite} {
+		connect := &packets.Connect{}
+		connect.SetOption("will", []byte("device/status"))
+		connect.SetOption("willmsg", []byte("offline"))
+		iot.PushPacketUpFromBottom(cc, connect)
+	}
+	ce.WaitForActions()
+
+	// a Disconnect means no will.
+	iot.PushPacketUpFromBottom(polite, &packets.Disconnect{})
+	ce.WaitForActions()
+	got := popAll(watcher)
+	if strings.Contains(got, "offline") {
+		t.Errorf("got %v, want no will", got)
+	}
+
+	// the connection dies.
+	device.DoClose(errors.New("tcp went away"))
+	ce.WaitForActions()
+	got = popAll(watcher)
+	if strings.Count(got, "offline") != 1 {
+		t.Errorf("got %v, want the will", got)
+	}
+}
+
+func TestMqttWill(t *testing.T) {
+
+	tokens.LoadPublicKeys()
+
+	localtime := starttime
+	getTime := func() uint32 {
+		return localtime
+	}
+	ce := iot.MakeSimplestCluster(getTime, false, 1, "")
+	globalClusterExec = ce
+	iot.MakeMqttExecutive(ce.Aides[0], "localhost:7475")
+	time.Sleep(10 * time.Millisecond)
+
+	sub := dialMqtt(t, "localhost:7475", "dashboard", true)
+	sub.subscribe(t, "sensor/status", libmqtt.Qos1)
+
+	dialWill := func(clientID string) *mqttTestConn {
+		conn, err := net.Dial("tcp", "localhost:7475")
+		if err != nil {
+			t.Fatal(err)
+		}
+		mc := &mqttTestConn{conn: conn, reader: bufio.NewReader(conn)}
+		mc.write(&libmqtt.ConnPacket{
+			ProtoName:    "MQTT",
+			ClientID:     clientID,
+			CleanSession: true,
+			Username:     string(tokens.Get32xTokenLocal()),
+			Keepalive:    60,
+			IsWill:       true,
+			WillTopic:    "sensor/status",
+			WillMessage:  []byte(clientID + " offline"),
+			WillQos:      libmqtt.Qos1,
+		})
+		if _, ok := mc.read(2 * time.Second).(*libmqtt.ConnAckPacket); !ok {
+			t.Fatal("no connack")
+		}
+		return mc
+	}
+
+	// a proper disconnect. No will.
+	polite := dialWill("polite")
+	polite.write(&libmqtt.DisconnPacket{})
+	if extra := sub.read(300 * time.Millisecond); extra != nil {
+		t.Errorf("got %v, want no will", extra)
+	}
+
+	// the socket just dies.
+	rude := dialWill("rude")
+	rude.conn.Close()
+	got := sub.expectPublish(t, "rude offline")
+	if got.Qos != libmqtt.Qos1 {
+		t.Errorf("got qos %v want 1", got.Qos)
+	}
+	sub.write(&libmqtt.PubAckPacket{PacketID: got.PacketID})
+	sub.conn.Close()
+}
@@ -17,7 +17,6 @@ package iot
 
 import (
 	"bufio"
-	"errors"
 	"fmt"
 	"net"
 	"time"
@@ -39,6 +38,7 @@ func MakeTextExecutive(ex *Executive, serverName string) *Executive {
 }
 
 // Text2Packet turns badjson into a packet
+// The limits are packets.ServerDecoder and the errors are *packets.DecodeError
 func Text2Packet(text string) (packets.Interface, error) {
 
 	// fmt.Println("Text2Packet converting ", text)
@@ -46,28 +46,28 @@ func Text2Packet(text string) (packets.Interface, error) {
 	segment, err := badjson.Chop(text)
 	if err != nil {
 		fmt.Println("SendText badjson err", err)
-		return nil, err
+		return nil, &packets.DecodeError{Kind: packets.ErrMalformed, Detail: err.Error()}
 	}
 	rawFirstSegment := segment.Raw()
 	if len(rawFirstSegment) == 0 {
-		return nil, errors.New("too little data")
+		return nil, &packets.DecodeError{Kind: packets.ErrMalformed, Detail: "too little data"}
 	}
 	uni := packets.Universal{}
-	uni.Args = make([][]byte, 64) // much too big
 	// will not be quoted
 	uni.Cmd = packets.CommandType(rawFirstSegment[0])
 	segment = segment.Next()
 
 	// traverse the result
 	// put raw bytes into the uni.
-	i := 0
 	for s := segment; s != nil; s = s.Next() {
-		stmp := s.Raw()
-		uni.Args[i] = []byte(stmp)
-		i++
-		if i > 10 {
-			break
+		if len(uni.Args) >= packets.ServerDecoder.MaxArgs {
+			return nil, &packets.DecodeError{Kind: packets.ErrTooManyArgs}
 		}
+		uni.Args = append(uni.Args, []byte(s.Raw()))
+	}
+	err = packets.ServerDecoder.CheckArgs(uni.Args)
+	if err != nil {
+		return nil, err
 	}
 	p, err := packets.FillPacket(&uni)
 	if err != nil {
@@ -76,10 +76,27 @@ func Text2Packet(text string) (packets.Interface, error) {
 	return p, err
 }
 
+// readLine is ReadString('\n') that gives up when the line gets too long.
+func readLine(reader *bufio.Reader, max int) (string, error) {
+	var line []byte
+	for {
+		got, err := reader.ReadSlice('\n')
+		if len(line)+len(got) > max {
+			return "", &packets.DecodeError{Kind: packets.ErrPacketTooBig}
+		}
+		line = append(line, got...)
+		if err != bufio.ErrBufferFull {
+			return string(line), err
+		}
+	}
+}
+
 // a simple iot wire protocol that is text based.
 
 func (cc *textContact) WriteDownstream(packet packets.Interface) error {
 
+	packet = packets.StripInternal(packet) // see packets/options.go
+
 	u := HasError(packet)
 	if u != nil {
 		text := u.String()
@@ -169,12 +186,13 @@ func textConnection(tcpConn *net.TCPConn, ex *Executive) {
 			}
 		}
 		//fmt.Println("waiting for packet")
-		str, err := lineReader.ReadString('\n')
+		// twice the binary limit leaves room for the quoting
+		str, err := readLine(lineReader, packets.ServerDecoder.MaxTotal*2)
 		//fmt.Println("got line ", str)
 		if len(str) > 0 {
 			str = str[0 : len(str)-1]
 		}
-		if len(str) == 0 {
+		if len(str) == 0 && err == nil {
 			continue
 		}
 		if err != nil {
@@ -182,6 +200,7 @@ func textConnection(tcpConn *net.TCPConn, ex *Executive) {
 			if err.Error() != "EOF" {
 				fmt.Println("packets 2 read err", err)
 			}
+			disconnectDecodeError(cc, err)
 			cc.DoClose(err)
 			return
 		}
@@ -190,6 +209,7 @@ func textConnection(tcpConn *net.TCPConn, ex *Executive) {
 			//connLogThing.Collect("se err " + err.Error())
 			fmt.Println("packets 3 read err", err)
 			// should we write 'man' page and keep going?
+			disconnectDecodeError(cc, err)
 			cc.DoClose(err)
 			return
 		}
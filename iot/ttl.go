@@ -0,0 +1,125 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package iot
+
+import (
+	"strconv"
+
+	"github.com/awootton/knotfreeiot/packets"
+)
+
+// The topic ttl. A subscribe can have a "ttl" option, in seconds, and then that subscriber
+// expires that long after its subscribe or the last publish to the topic, whichever is later,
+// instead of when the topic does. The others on the topic don't change. The topic lasts the
+// usual 20 or 25 minutes, or the longest ttl, after the last subscribe or publish.
+// A publish can have one too. Then the topic lasts at least that long after the publish.
+// It can't make the topic shorter for the others.
+// The heartBeatCallBack drops the subscribers and the topics that are past it.
+//
+// The contact clamps it. Not less than topicTTLMin, not more than topicTTLMax, not past
+// when the token expires and not more than ttlPerSubscription for each of the token's subscriptions.
+//
+// At the guru the watchers are aides so only the topic gets the ttl. The aide unsubscribes
+// when its own subscribers are gone. The aide sends it again after a remap. See resubscribes
+
+const (
+	topicTTLMin        = 10
+	topicTTLMax        = 24 * 60 * 60
+	ttlPerSubscription = 60 * 60 // a small token can't keep a topic for a day.
+)
+
+// getTTL returns the "ttl" option.
+func getTTL(p *packets.PacketCommon) (uint32, bool) {
+	val, ok := p.GetOption("ttl")
+	if !ok {
+		return 0, false
+	}
+	ttl, err := strconv.ParseUint(string(val), 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(ttl), true
+}
+
+// clampTTL is at the contact, where we have the token.
+func clampTTL(ssi ContactInterface, p *packets.PacketCommon, now uint32) {
+	ttl, ok := getTTL(p)
+	if !ok {
+		p.DeleteOption("ttl")
+		return
+	}
+	max := uint32(topicTTLMax)
+	tok := ssi.GetToken()
+	if tok != nil && tok.ExpirationTime > now && tok.ExpirationTime-now < max {
+		max = tok.ExpirationTime - now
+	}
+	if tok != nil && tok.Subscriptions*ttlPerSubscription < float64(max) {
+		max = uint32(tok.Subscriptions * ttlPerSubscription)
+	}
+	if ttl > max {
+		ttl = max
+	}
+	if ttl < topicTTLMin {
+		ttl = topicTTLMin
+	}
+	p.SetOption("ttl", []byte(strconv.FormatUint(uint64(ttl), 10)))
+}
+
+// touch is for a subscribe or publish. def is the usual expiry.
+func (wt *WatchedTopic) touch(now uint32, def uint32) {
+	if wt.ttl > def {
+		def = wt.ttl
+	}
+	wt.Expires = now + def
+	wt.touched = now
+}
+
+// publishedTTL is for a publish with a ttl. After touch.
+func (wt *WatchedTopic) publishedTTL(p *packets.PacketCommon, now uint32) {
+	ttl, ok := getTTL(p)
+	if ok && now+ttl > wt.Expires {
+		wt.Expires = now + ttl
+	}
+}
+
+// subscribedTTL is for the watcher of a subscribe, new or again.
+func (wt *WatchedTopic) subscribedTTL(wi *watcherItem, p *packets.PacketCommon, now uint32) {
+	ttl, _ := getTTL(p)
+	wi.ttl = ttl
+	wi.since = now
+	if ttl > wt.ttl {
+		wt.ttl = ttl
+	}
+}
+
+// expired is true if the watcher had a ttl and it's past.
+func (wi *watcherItem) expired(wt *WatchedTopic, now uint32) bool {
+	if wi.ttl == 0 {
+		return false
+	}
+	last := wi.since
+	if wt.touched > last {
+		last = wt.touched
+	}
+	return last+wi.ttl < now
+}
+
+// setTTLOption is for the subscribes an aide sends again.
+func setTTLOption(wt *WatchedTopic, p *packets.PacketCommon) {
+	if wt.ttl != 0 {
+		p.SetOption("ttl", []byte(strconv.FormatUint(uint64(wt.ttl), 10)))
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package iot
+
+import (
+	"fmt"
+
+	"github.com/awootton/knotfreeiot/packets"
+)
+
+// The Users of a name. If a reserved name has Users then only they, and the Owner, can subscribe.
+// No Users means anyone. The owner changes the list with the "add user", "remove user"
+// and "list users" lookup commands.
+//
+// The contact puts the "pubk" from the token on the subscribe, after it takes out any the client sent.
+// Only the guru knows the Users so it's the guru that says no. It sends the suback down with an "error"
+// and the "pubk" and the aide takes the contacts with that pubk off the topic and sends them an error Send,
+// which disconnects them, like the billing errors. An aide with no guru says no itself.
+
+// userAllowed is true if the pubk can subscribe.
+func (wt *WatchedTopic) userAllowed(pubk string) bool {
+	if len(wt.Users) == 0 || wt.Owner == "" {
+		return true
+	}
+	if pubk == "" {
+		return false
+	}
+	if pubk == wt.Owner {
+		return true
+	}
+	return wt.hasUser(pubk)
+}
+
+func (wt *WatchedTopic) hasUser(pubk string) bool {
+	for _, u := range wt.Users {
+		if u == pubk {
+			return true
+		}
+	}
+	return false
+}
+
+func (wt *WatchedTopic) addUser(pubk string) {
+	if !wt.hasUser(pubk) {
+		wt.Users = append(wt.Users, pubk)
+	}
+}
+
+func (wt *WatchedTopic) removeUser(pubk string) {
+	for i, u := range wt.Users {
+		if u == pubk {
+			wt.Users = append(wt.Users[:i:i], wt.Users[i+1:]...)
+			return
+		}
+	}
+}
+
+// setPubkOption is for the contact. The pubk comes from the token and not from the client.
+func setPubkOption(ssi ContactInterface, p *packets.PacketCommon) {
+	p.DeleteOption("pubk")
+	tok := ssi.GetToken()
+	if tok != nil && tok.Pubk != "" {
+		p.SetOption("pubk", []byte(tok.Pubk))
+	}
+}
+
+// rejectSubscribe is at the guru. The subscribe doesn't happen and the aide gets told.
+func rejectSubscribe(me *LookupTableStruct, submsg *subscriptionMessage) {
+	subscribeRejected.Inc()
+	pubk, _ := submsg.p.GetOption("pubk")
+	fmt.Println(me.ex.Name, "subscribe rejected. not a user", string(pubk), submsg.p.Sig())
+	errmsg := []byte("subscribe rejected: not a user of this name")
+	if !me.isGuru {
+		queueDownstream(submsg.ss, rejectedSend(submsg.p.Address, errmsg))
+		return
+	}
+	suback := &packets.Subscribe{}
+	suback.Address = submsg.p.Address
+	packets.OptError.Set(suback, errmsg)
+	suback.SetOption("pubk", pubk)
+	queueDownstream(submsg.ss, suback)
+}
+
+// gotRejected is at the aide. The ones with the pubk get an error.
+func (me *LookupTableStruct) gotRejected(wt *WatchedTopic, p *packets.Subscribe) {
+	errmsg, _ := packets.OptError.Get(p)
+	pubk, _ := p.GetOption("pubk")
+	var rejected []HalfHash
+	it := wt.Iterator()
+	for it.Next() {
+		key, item := it.KeyValue()
+		tok := item.contactInterface.GetToken()
+		if tok == nil || tok.Pubk != string(pubk) {
+			continue
+		}
+		rejected = append(rejected, key)
+		queueDownstream(item.contactInterface, rejectedSend(p.Address, errmsg))
+	}
+	for _, key := range rejected {
+		wt.remove(key)
+	}
+}
+
+// rejectedSend is what the contact gets. The "error" disconnects it.
+func rejectedSend(address packets.AddressUnion, errmsg []byte) *packets.Send {
+	send := &packets.Send{}
+	send.Address = address
+	send.Source.FromString("knotfree")
+	send.Payload = errmsg
+	packets.OptError.Set(send, errmsg)
+	return send
+}
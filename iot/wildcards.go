@@ -0,0 +1,225 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package iot
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/awootton/knotfreeiot/packets"
+)
+
+// Wildcard subscriptions are mqtt style. Levels are separated by '/'.
+// '+' matches exactly one level and '#', which must be last, matches the rest.
+// eg "home/+/temp" and "home/#"
+//
+// The addresses get hashed as soon as they come in so we keep the utf8 name
+// in the "topic" option. A subscribe with a wildcard has the pattern in "topic"
+// and a publish to a name with a '/' in it has the name in "topic".
+// Names without a '/' are the usual private names and wildcards never see those.
+//
+// The wildcard subscription itself is a WatchedTopic like any other, keyed by the hash of the pattern,
+// and it lives in the bucket for that hash. The wildcardIndex is just so that a publish
+// can find which patterns it matches. Since a pattern doesn't map to any one guru
+// the aides push wildcard subscriptions up to *all* the gurus.
+//
+// A publish goes to the bucket of its name first and that bucket queues it to the patterns.
+// They all share a sentTo so a contact that has the name and a pattern, or two patterns, gets it once.
+// The guru sends an aide one copy and the aide does the same thing with it for its own contacts.
+// So the wildcard subscribers at the aide of the publisher get it when it comes back from the guru.
+//
+// The name's bucket does the checks, like owned.go, before it queues to the patterns, and the "topic"
+// has to be the name of the address.
+//
+// A pattern can't start with a wildcard, "#" and "+/x" are just names, and a name that has
+// Users doesn't go to the patterns at all. The guru marks those "nowild" for the aides. See users.go
+
+// wildcardIndex is from the pattern to the hash of the pattern.
+// The buckets all share it so it has a lock.
+type wildcardIndex struct {
+	mux      sync.RWMutex
+	patterns map[string]HashType
+}
+
+// IsWildcardTopic returns true if the utf8 name has a '+' or a '#' in it.
+func IsWildcardTopic(topic []byte) bool {
+	return packets.IsWildcardTopic(topic)
+}
+
+// IsHierarchicalTopic returns true if the name has a '/' and could match a wildcard.
+func IsHierarchicalTopic(topic []byte) bool {
+	for _, b := range topic {
+		if b == '/' {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchTopic returns true if the topic matches the pattern. Like mqtt. See packets/topics.go
+func MatchTopic(pattern string, topic string) bool {
+	return packets.MatchTopic(pattern, topic)
+}
+
+// checkWildcardTopic returns an error if the pattern is malformed.
+// '#' must be last and must be a whole level and so must '+'.
+// The first level has to be a name. A bare "#" would get everybody's publishes.
+func checkWildcardTopic(pattern string) error {
+	parts := strings.Split(pattern, "/")
+	for i, p := range parts {
+		if strings.ContainsAny(p, "+#") && len(p) != 1 {
+			return fmt.Errorf("wildcard must be a whole level %v", pattern)
+		}
+		if p == "#" && i != len(parts)-1 {
+			return fmt.Errorf("wildcard # must be last %v", pattern)
+		}
+	}
+	if parts[0] == "+" || parts[0] == "#" {
+		return fmt.Errorf("wildcard can't be the first level %v", pattern)
+	}
+	return nil
+}
+
+func (wi *wildcardIndex) add(pattern string, h HashType) {
+	wi.mux.Lock()
+	defer wi.mux.Unlock()
+	if wi.patterns == nil {
+		wi.patterns = make(map[string]HashType)
+	}
+	wi.patterns[pattern] = h
+}
+
+func (wi *wildcardIndex) remove(pattern string) {
+	wi.mux.Lock()
+	defer wi.mux.Unlock()
+	delete(wi.patterns, pattern)
+}
+
+func (wi *wildcardIndex) size() int {
+	wi.mux.RLock()
+	defer wi.mux.RUnlock()
+	return len(wi.patterns)
+}
+
+// matches returns the hashes of all the patterns that match topic.
+// It's a linear scan. todo: make a tree by level if there's ever a lot of these.
+func (wi *wildcardIndex) matches(topic string) []HashType {
+	wi.mux.RLock()
+	defer wi.mux.RUnlock()
+	var result []HashType
+	for pattern, h := range wi.patterns {
+		if MatchTopic(pattern, topic) {
+			result = append(result, h)
+		}
+	}
+	return result
+}
+
+// isWildcard is true if this topic is a wildcard subscription.
+func (wt *WatchedTopic) isWildcard() bool {
+	return len(wt.NameStr) > 0 && IsWildcardTopic([]byte(wt.NameStr))
+}
+
+// setTopicOption remembers the utf8 name in the "topic" option before the address is hashed.
+// Only wildcards and names that could match a wildcard get one.
+// A malformed pattern is just a name, like it always was.
+// At an aide whatever "topic" the client sent is gone first. It could be any name.
+func setTopicOption(p *packets.PacketCommon, address *packets.AddressUnion, isGuru bool) {
+	if !isGuru {
+		p.DeleteOption("topic")
+	}
+	if address.Type != packets.Utf8Address {
+		return
+	}
+	if IsWildcardTopic(address.Bytes) {
+		err := checkWildcardTopic(string(address.Bytes))
+		if err != nil {
+			fmt.Println("setTopicOption", err)
+			return
+		}
+	}
+	if IsWildcardTopic(address.Bytes) || IsHierarchicalTopic(address.Bytes) {
+		p.SetOption("topic", address.Bytes)
+	}
+}
+
+// isTopicOf is true if the address is the hash of the topic.
+func isTopicOf(topic []byte, address *packets.AddressUnion) bool {
+	a := packets.AddressUnion{Type: packets.Utf8Address, Bytes: topic}
+	a.EnsureAddressIsBinary()
+	return address.Type == packets.BinaryAddress && bytes.Equal(a.Bytes, address.Bytes)
+}
+
+// getWildcardPattern returns the pattern if the packet is a wildcard sub or unsub.
+func getWildcardPattern(p packets.Interface) (string, bool) {
+	topic, ok := p.GetOption("topic")
+	if !ok || !IsWildcardTopic(topic) {
+		return "", false
+	}
+	return string(topic), true
+}
+
+// wildcardPublishMessage is a publish that matched a wildcard subscription.
+// The topicHash is the hash of the pattern and not of the address.
+type wildcardPublishMessage struct {
+	baseMessage
+	f *fanOut
+}
+
+// sendWildcardPublishMessages queues the publish to the buckets of all the patterns it matches.
+// It's called from the bucket of the name, after that's done, so the patterns get what the exact
+// subscribers got. Returns true if there were any.
+func (me *LookupTableStruct) sendWildcardPublishMessages(f *fanOut) bool {
+
+	if me.wildcards.size() == 0 || isRetainRemap(f.p) || packets.OptNoWild.Has(f.p) {
+		return false
+	}
+	topic, ok := f.p.GetOption("topic")
+	if !ok || IsWildcardTopic(topic) {
+		return false // can't publish to a wildcard
+	}
+	if !isTopicOf(topic, &f.p.Address) {
+		fmt.Println("sendWildcardPublishMessages topic isn't the address", string(topic))
+		return false // or it would skip the checks of the real name. See owned.go
+	}
+	hashes := me.wildcards.matches(string(topic))
+	for _, h := range hashes {
+		msg := wildcardPublishMessage{}
+		msg.f = f
+		msg.topicHash = h
+		i := msg.topicHash.GetFractionalBits(me.theBucketsSizeLog2)
+		b := me.allTheSubscriptions[i]
+		if len(b.incoming) >= cap(b.incoming) {
+			fmt.Println("sendWildcardPublishMessages channel full")
+		}
+		b.incoming <- &msg
+	}
+	return len(hashes) > 0
+}
+
+// processWildcardPublish is the delivery part of processPublish for one pattern.
+// There's no PushUp and there's no billing, the bucket of the name did that.
+func processWildcardPublish(me *LookupTableStruct, bucket *subscribeBucket, pubmsg *wildcardPublishMessage) {
+
+	watchedTopic, ok := getWatcher(bucket, &pubmsg.topicHash)
+	if !ok {
+		return // it was unsubscribed since.
+	}
+	watchedTopic.touch(me.getTime(), 25*60) // see ttl.go
+	me.deliver(watchedTopic, pubmsg.f)
+}
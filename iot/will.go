@@ -0,0 +1,68 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package iot
+
+import (
+	"fmt"
+
+	"github.com/awootton/knotfreeiot/packets"
+)
+
+// Last will and testament. Any contact can leave a publish in its Connect that we send for it
+// if it goes away without a Disconnect. eg. the tcp dies, or it times out, or we kick it.
+//
+// In a native Connect the options are:
+// "will" is the topic
+// "willmsg" is the payload
+// "willretain" is "1" to make it a retained value. See retained.go
+// "willqos" is "1" or "2"
+//
+// mqtt has it in the connect packet already and it gets translated to these.
+
+// willFromConnect returns nil if there isn't a will.
+func willFromConnect(p *packets.Connect) *packets.Send {
+	topic, ok := p.GetOption("will")
+	if !ok || len(topic) == 0 {
+		return nil
+	}
+	w := &packets.Send{}
+	w.Address.FromBytes(topic)
+	w.Source.FromString("will")
+	w.Payload, _ = p.GetOption("willmsg")
+	retain, ok := p.GetOption("willretain")
+	if ok && string(retain) == "1" {
+		w.SetOption("retain", []byte("1"))
+	}
+	qos, ok := p.GetOption("willqos")
+	if ok && len(qos) == 1 && qos[0] >= '1' && qos[0] <= '2' {
+		w.SetOption("qos", qos)
+	}
+	return w
+}
+
+// publishWill is during DoClosingWork. The contact is closed already so it skips the
+// part of PushPacketUpFromBottom2 that wants it open and gets the rest like any publish.
+func (ss *ContactStruct) publishWill() {
+	w := ss.will.Swap(nil)
+	if w == nil || ss.token == nil {
+		return
+	}
+	fmt.Println("publishing will of", ss.GetKey().Sig(), w.Address.String())
+	err := pushPacketUp(ss, ss.config, w, false)
+	if err != nil {
+		fmt.Println("publishWill fail", err)
+	}
+}
@@ -133,9 +133,9 @@ func ServeGetTime(token string, c *ThingContext) { // use knotfree format
 				continue // to connect loop
 			}
 			connect := &packets.Connect{}
-			connect.SetOption("token", []byte(token))
+			packets.OptToken.Set(connect, token)
 			if c.LogMeVerbose {
-				connect.SetOption("debg", []byte("12345678"))
+				packets.OptDebug.Set(connect, "12345678")
 			}
 			err = connect.Write(conn)
 			if err != nil {
@@ -231,7 +231,7 @@ func Subscribe(c *ThingContext, conn net.Conn) error {
 	sub := &packets.Subscribe{}
 	sub.Address.FromString(c.Topic)
 	if c.LogMeVerbose {
-		sub.SetOption("debg", []byte("12345678"))
+		packets.OptDebug.Set(sub, "12345678")
 	}
 	err := sub.Write(conn)
 	if err != nil {
@@ -311,7 +311,7 @@ func digestPacket(p packets.Interface, c *ThingContext) (packets.Interface, erro
 
 	if strings.HasPrefix(message, "=") { // it is base64 encoded ie encrypted
 		emessage := message[1:]
-		nonc, ok := pub.GetOption("nonc")
+		nonc, ok := packets.OptNonce.Get(pub)
 		admn, ok2 := pub.GetOption("admn")
 		if nonc == nil || !ok || admn == nil || !ok2 {
 			hadError = "no nonce or no admn"
@@ -426,7 +426,7 @@ func digestPacket(p packets.Interface, c *ThingContext) (packets.Interface, erro
 			}
 		}
 	}
-	nonc, ok := pub.GetOption("nonc")
+	nonc, ok := packets.OptNonce.Get(pub)
 	if nonc == nil || !ok {
 		hadError = "Error: no nonce"
 	}
@@ -538,7 +538,7 @@ func PublishTestTopic(token string) { // use knotfree format
 				continue
 			}
 			connect := &packets.Connect{}
-			connect.SetOption("token", []byte(token))
+			packets.OptToken.Set(connect, token)
 			err = connect.Write(conn)
 			if err != nil {
 				println("testtopic Write C to server failed:", err.Error())
@@ -923,8 +923,8 @@ func GetIotResponse(server string, thing string, cmd string, devicepubk string,
 }
 
 func SpecialPrint(p *packets.PacketCommon, fn func()) {
-	val, ok := p.GetOption("debg")
-	if ok && (string(val) == "[12345678]" || string(val) == "12345678") {
+	val, ok := packets.OptDebug.Get(p)
+	if ok && (val == "[12345678]" || val == "12345678") {
 		fn()
 	}
 }
@@ -0,0 +1,105 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package packets
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"sync"
+)
+
+// Calls matches the replies to the calls waiting for them. It's the correlation of request/reply.
+// A call is a Send or a Lookup with the reply topic in the Source and a random key in both
+// the "sessionKey" and the "CorrelationData" options. The cluster's replies copy the "sessionKey"
+// and the mqtt 5 devices copy the CorrelationData (see iot/mqtt-protocol.go).
+//
+// iot.ServiceContact, iot.ServiceContactTcp and the client package use it. The zero value is ready.
+type Calls struct {
+	mux     sync.Mutex
+	pending map[string]chan Interface
+}
+
+// OptCorrelationData is the mqtt 5 CorrelationData.
+const OptCorrelationData = "CorrelationData"
+
+// Add stamps msg, a *Send or a *Lookup, with a new key and the reply topic.
+// The reply will go to replies. It should have room for one so Reply never blocks.
+// Call Remove with the key when done waiting.
+func (c *Calls) Add(msg Interface, replyTopic string, replies chan Interface) (string, error) {
+	var common *PacketCommon
+	var source *AddressUnion
+	switch v := msg.(type) {
+	case *Send:
+		common, source = &v.PacketCommon, &v.Source
+	case *Lookup:
+		common, source = &v.PacketCommon, &v.Source
+	default:
+		return "", errors.New("can't call with that packet type")
+	}
+	var tmp [18]byte
+	rand.Read(tmp[:])
+	key := base64.RawURLEncoding.EncodeToString(tmp[:])
+
+	OptSessionKey.Set(common, key)
+	common.SetOption(OptCorrelationData, []byte(key))
+	source.FromString(replyTopic)
+
+	c.mux.Lock()
+	if c.pending == nil {
+		c.pending = make(map[string]chan Interface)
+	}
+	c.pending[key] = replies
+	c.mux.Unlock()
+	return key, nil
+}
+
+// Remove forgets the call.
+func (c *Calls) Remove(key string) {
+	c.mux.Lock()
+	delete(c.pending, key)
+	c.mux.Unlock()
+}
+
+// Reply gives p to the call waiting for it. Only the first reply. False if nobody is waiting.
+func (c *Calls) Reply(p Interface) bool {
+	key, ok := OptSessionKey.Get(p)
+	if !ok {
+		got, has := p.GetOption(OptCorrelationData) // from mqtt
+		key, ok = string(got), has
+	}
+	if !ok {
+		return false
+	}
+	c.mux.Lock()
+	replies, ok := c.pending[key]
+	delete(c.pending, key)
+	c.mux.Unlock()
+	if ok {
+		replies <- p
+	}
+	return ok
+}
+
+// FailAll closes the replies of all the calls. eg. when the connection broke.
+func (c *Calls) FailAll() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for key, replies := range c.pending {
+		close(replies)
+		delete(c.pending, key)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package packets
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Capabilities. The client puts a "version" and a "caps" list in the Connect and the
+// server answers with a ConnectAck that has its "version", the "caps" it accepted and
+// its limits. A Connect without either is an old client and gets no ConnectAck.
+// The lists are comma separated. See iot/capabilities.go
+
+// ProtocolVersion is the version of the native protocol. Goes up when the packets change.
+const ProtocolVersion = 1
+
+// MaxPacketSize is the most ReadPacket will take. All the strings together.
+const MaxPacketSize = 8000000
+
+// MaxPayload is the biggest payload to put in one Send. It's the "maxpayload" in the ConnectAck.
+// A bigger one goes in fragments. See fragment.go
+const MaxPayload = 64 * 1024
+
+// The capabilities so far.
+const (
+	CapSeq     = "seq"     // the "seq" option on publishes. See seq.go
+	CapExpiry  = "expiry"  // the "expires" option on publishes. See expiry.go
+	CapHistory = "history" // the "since" option on subscribe.
+	CapRetain  = "retain"  // the "retain" option on publishes.
+)
+
+// The limits in a ConnectAck.
+const (
+	LimitMaxPayload = "maxpayload" // bytes
+	LimitKeepalive  = "keepalive"  // seconds. Send something, like a Ping, sooner than this.
+)
+
+// SetCapabilities says what the client can do. It sets the "version" too.
+func (p *Connect) SetCapabilities(caps ...string) {
+	p.SetOption("version", []byte(strconv.Itoa(ProtocolVersion)))
+	p.SetOption("caps", []byte(strings.Join(caps, ",")))
+}
+
+// GetCapabilities returns what the client can do. ok is false for an old client.
+func (p *Connect) GetCapabilities() (caps []string, ok bool) {
+	return getCapabilities(&p.PacketCommon)
+}
+
+// GetVersion is the protocol version of the client. 0 for an old client.
+func (p *Connect) GetVersion() int {
+	return getVersion(&p.PacketCommon)
+}
+
+// SetCapabilities is what the server accepted. It sets the "version" too.
+func (p *ConnectAck) SetCapabilities(caps ...string) {
+	p.SetOption("version", []byte(strconv.Itoa(ProtocolVersion)))
+	p.SetOption("caps", []byte(strings.Join(caps, ",")))
+}
+
+// GetCapabilities is what the server accepted.
+func (p *ConnectAck) GetCapabilities() (caps []string, ok bool) {
+	return getCapabilities(&p.PacketCommon)
+}
+
+// GetVersion is the protocol version of the server.
+func (p *ConnectAck) GetVersion() int {
+	return getVersion(&p.PacketCommon)
+}
+
+// SetLimit sets one of the limits, like LimitMaxPayload.
+func (p *ConnectAck) SetLimit(name string, val int) {
+	p.SetOption(name, []byte(strconv.Itoa(val)))
+}
+
+// GetLimit returns one of the limits.
+func (p *ConnectAck) GetLimit(name string) (int, bool) {
+	return getIntOption(&p.PacketCommon, name)
+}
+
+// Negotiate returns the ones that are in both lists, sorted.
+func Negotiate(offered []string, supported []string) []string {
+	accepted := []string{}
+	for _, o := range offered {
+		for _, s := range supported {
+			if o == s {
+				accepted = append(accepted, o)
+				break
+			}
+		}
+	}
+	sort.Strings(accepted)
+	return accepted
+}
+
+// HasCapability says if caps has the one.
+func HasCapability(caps []string, name string) bool {
+	for _, c := range caps {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+func getCapabilities(p *PacketCommon) ([]string, bool) {
+	got, ok := p.GetOption("caps")
+	if !ok {
+		return nil, p.getVersionOk()
+	}
+	caps := []string{}
+	for _, c := range strings.Split(string(got), ",") {
+		c = strings.TrimSpace(c)
+		if c != "" {
+			caps = append(caps, c)
+		}
+	}
+	return caps, true
+}
+
+func getVersion(p *PacketCommon) int {
+	got, ok := p.GetOption("version")
+	if !ok {
+		return 0
+	}
+	version, err := strconv.Atoi(string(got))
+	if err != nil {
+		return 0
+	}
+	return version
+}
+
+func (p *PacketCommon) getVersionOk() bool {
+	_, ok := p.GetOption("version")
+	return ok
+}
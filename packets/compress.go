@@ -0,0 +1,133 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package packets
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Payload compression. A Send with an "enc" option has a compressed payload. The value is
+// the name of the compression and it's also the capability. A client that asks for "deflate"
+// at Connect can get deflated payloads. The others get them decompressed by the aide on the way down.
+// The aides and gurus pass them along untouched. See iot/compress.go
+// The billing counts the bytes on the wire so compression is cheaper.
+
+// The compressions so far. They're capabilities too. See capabilities.go
+const (
+	CapDeflate = "deflate"
+	CapZstd    = "zstd"
+)
+
+// ErrUnknownEncoding is an "enc" we don't do.
+var ErrUnknownEncoding = errors.New("unknown payload encoding")
+
+// one of each, they're safe for concurrent use.
+var zstdEncoder, _ = zstd.NewWriter(nil)
+var zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(MaxPacketSize))
+
+// GetEncoding is the "enc" option. Empty if not compressed.
+func (p *Send) GetEncoding() string {
+	got, _ := p.GetOption("enc")
+	return string(got)
+}
+
+// Compress the payload with enc and set the "enc". If it doesn't get smaller it leaves it alone.
+// Already compressed is an error.
+func (p *Send) Compress(enc string) error {
+	if p.GetEncoding() != "" {
+		return errors.New("already compressed")
+	}
+	var compressed []byte
+	switch enc {
+	case CapDeflate:
+		var bb bytes.Buffer
+		w, _ := flate.NewWriter(&bb, flate.DefaultCompression)
+		w.Write(p.Payload)
+		err := w.Close()
+		if err != nil {
+			return err
+		}
+		compressed = bb.Bytes()
+	case CapZstd:
+		compressed = zstdEncoder.EncodeAll(p.Payload, nil)
+	default:
+		return ErrUnknownEncoding
+	}
+	if len(compressed) >= len(p.Payload) {
+		return nil
+	}
+	p.Payload = compressed
+	p.SetOption("enc", []byte(enc))
+	return nil
+}
+
+// CheckEncoding is for a Send from a client. The "enc" has to be one we do and the payload
+// has to decompress. A fragment is only a piece so just the name. It's checked when it's whole.
+func (p *Send) CheckEncoding() error {
+	enc := p.GetEncoding()
+	switch enc {
+	case "":
+		return nil
+	case CapDeflate, CapZstd:
+	default:
+		return ErrUnknownEncoding
+	}
+	if p.IsFragment() {
+		return nil
+	}
+	cp := &Send{}
+	cp.Payload = p.Payload
+	cp.SetOption("enc", []byte(enc))
+	return cp.Decompress()
+}
+
+// Decompress the payload and delete the "enc". Not compressed is fine.
+// Bigger than MaxPacketSize is an error.
+func (p *Send) Decompress() error {
+	enc := p.GetEncoding()
+	var payload []byte
+	switch enc {
+	case "":
+		return nil
+	case CapDeflate:
+		r := flate.NewReader(bytes.NewReader(p.Payload))
+		var bb bytes.Buffer
+		n, err := io.Copy(&bb, io.LimitReader(r, MaxPacketSize+1))
+		if err != nil {
+			return err
+		}
+		if n > MaxPacketSize {
+			return errors.New("decompressed payload too big")
+		}
+		payload = bb.Bytes()
+	case CapZstd:
+		var err error
+		payload, err = zstdDecoder.DecodeAll(p.Payload, nil)
+		if err != nil {
+			return err
+		}
+	default:
+		return ErrUnknownEncoding
+	}
+	p.Payload = payload
+	p.DeleteOption("enc")
+	return nil
+}
@@ -0,0 +1,245 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package packets
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The decoder doesn't trust the wire. The limits are checked before anything is allocated
+// and a big packet is only allocated as fast as its bytes arrive, so a header that lies costs nothing.
+// ReadPacket and friends use DefaultDecoder. It takes what the servers pass along.
+// A device that can't have that much uses DeviceDecoder.
+// A bad packet is a *DecodeError and anything else, like io.EOF, is the connection.
+// See iot/TCPUtil.go for how they get disconnected.
+
+// DecoderConfig is the limits.
+type DecoderConfig struct {
+	MaxArgs  int // strings in a packet. The wire can't do more than 127.
+	MaxTotal int // bytes of all the strings together.
+	MaxArg   int // bytes of one string.
+}
+
+// ServerDecoder is for the aides and the gurus. They pass along whatever the old clients send.
+var ServerDecoder = &DecoderConfig{
+	MaxArgs:  127,
+	MaxTotal: MaxPacketSize - 1,
+	MaxArg:   MaxPacketSize - 1,
+}
+
+// DefaultDecoder is what ReadPacket uses. It's the same as the servers because a client gets
+// what an old client published, all in one Send.
+var DefaultDecoder = ServerDecoder
+
+// DeviceDecoder is small, for the devices that ask for it. A bigger payload than MaxPayload
+// has to come in fragments. The rest is for the addresses and the options.
+var DeviceDecoder = &DecoderConfig{
+	MaxArgs:  127,
+	MaxTotal: MaxPayload + 16*1024,
+	MaxArg:   MaxPayload + 16*1024,
+}
+
+// allocAhead is how much readArrayOfByteArray allocates before the bytes arrive.
+const allocAhead = 64 * 1024
+
+// The kinds of DecodeError. Use errors.Is
+var (
+	ErrTooManyArgs    = errors.New("too many strings")
+	ErrTooFewArgs     = errors.New("too few strings")
+	ErrArgTooBig      = errors.New("string too long")
+	ErrPacketTooBig   = errors.New("packet too long for this reality")
+	ErrBadLength      = errors.New("bad length")
+	ErrUnknownCommand = errors.New("unknown command")
+	ErrMalformed      = errors.New("malformed packet")
+	ErrBadOption      = errors.New("bad option") // a well known option that isn't its kind. See options.go
+)
+
+// DecodeError is a packet we won't take.
+type DecodeError struct {
+	Kind   error  // one of the Err's above
+	Detail string // eg. the length that was too long
+}
+
+func (e *DecodeError) Error() string {
+	if e.Detail == "" {
+		return e.Kind.Error()
+	}
+	return e.Kind.Error() + ": " + e.Detail
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Kind
+}
+
+// Code is the reason code for the Disconnect.
+func (e *DecodeError) Code() ReasonCode {
+	switch e.Kind {
+	case ErrArgTooBig, ErrPacketTooBig:
+		return ReasonPacketTooLarge
+	}
+	return ReasonMalformed
+}
+
+func decodeError(kind error, detail ...interface{}) error {
+	de := &DecodeError{Kind: kind}
+	if len(detail) != 0 {
+		de.Detail = fmt.Sprint(detail...)
+	}
+	return de
+}
+
+// ReadPacket is ReadPacket with these limits.
+func (config *DecoderConfig) ReadPacket(reader io.Reader) (Interface, error) {
+
+	var uni Universal // not on the heap
+	err := config.readUniversal(reader, &uni)
+	if err != nil {
+		return nil, err
+	}
+	p, err := FillPacket(&uni)
+	if err != nil {
+		var de *DecodeError
+		if !errors.As(err, &de) {
+			err = decodeError(ErrMalformed, err.Error())
+		}
+		return nil, err
+	}
+	return p, nil
+}
+
+// ReadUniversal is ReadUniversal with these limits.
+func (config *DecoderConfig) ReadUniversal(reader io.Reader) (*Universal, error) {
+	str := &Universal{}
+	err := config.readUniversal(reader, str)
+	return str, err
+}
+
+func (config *DecoderConfig) readUniversal(reader io.Reader, str *Universal) error {
+
+	scratch := pool.Get().(*readScratch)
+	defer pool.Put(scratch)
+
+	_, err := io.ReadFull(reader, scratch.one[:]) // read the command type
+	if err != nil {
+		return err
+	}
+	str.Cmd = CommandType(scratch.one[0])
+
+	// read array of byte arrays
+	str.Args, err = config.readArrayOfByteArray(reader, scratch)
+	return err
+}
+
+// ReadArrayOfByteArray is ReadArrayOfByteArray with these limits.
+func (config *DecoderConfig) ReadArrayOfByteArray(reader io.Reader) ([][]byte, error) {
+	scratch := pool.Get().(*readScratch)
+	defer pool.Put(scratch)
+	return config.readArrayOfByteArray(reader, scratch)
+}
+
+func (config *DecoderConfig) readArrayOfByteArray(reader io.Reader, scratch *readScratch) ([][]byte, error) {
+
+	// read the lengths of the following args
+	_, err := io.ReadFull(reader, scratch.one[:])
+	if err != nil {
+		return nil, err
+	}
+	argsLen := int(scratch.one[0])
+	if argsLen&0x80 != 0 || argsLen > config.MaxArgs {
+		// in the future 0x80 would mean that another byte follows and the args
+		// count is even bigger but for now ... 0x7F is the max.
+		return nil, decodeError(ErrTooManyArgs, argsLen)
+	}
+
+	lengths := &scratch.lengths
+	total := 0
+	for i := 0; i < argsLen; i++ { // read the lengths of the following strings
+		aval, err := readVarLenInt(reader, scratch.one[:])
+		if err != nil {
+			return nil, err
+		}
+		if aval > config.MaxArg {
+			return nil, decodeError(ErrArgTooBig, aval)
+		}
+		lengths[i] = aval
+		total += aval
+		if total > config.MaxTotal {
+			return nil, decodeError(ErrPacketTooBig, total)
+		}
+	}
+
+	// now we can read the rest all at once. A big one grows as it comes.
+	var bytes []uint8 // the base array
+	if total <= allocAhead {
+		bytes = make([]uint8, total)
+		_, err = io.ReadFull(reader, bytes)
+	} else {
+		bytes, err = readGrowing(reader, total)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// now we can slice the args
+	position := 0
+	args := make([][]byte, argsLen) // array of slices
+	for i := 0; i < argsLen; i++ {
+		args[i] = bytes[position : position+lengths[i] : position+lengths[i]]
+		position += lengths[i]
+	}
+	return args, nil
+}
+
+// readGrowing reads total bytes without trusting that they'll come. It doubles as they do.
+func readGrowing(reader io.Reader, total int) ([]uint8, error) {
+	bytes := make([]uint8, 0, allocAhead)
+	for {
+		end := cap(bytes)
+		if end > total {
+			end = total
+		}
+		n, err := io.ReadFull(reader, bytes[len(bytes):end])
+		bytes = bytes[:len(bytes)+n]
+		if err != nil {
+			return nil, err
+		}
+		if len(bytes) == total {
+			return bytes, nil
+		}
+		bigger := make([]uint8, len(bytes), 2*cap(bytes))
+		copy(bigger, bytes)
+		bytes = bigger
+	}
+}
+
+// CheckArgs is the limits for packets that didn't come in binary, like the text ones.
+func (config *DecoderConfig) CheckArgs(args [][]byte) error {
+	if len(args) > config.MaxArgs {
+		return decodeError(ErrTooManyArgs, len(args))
+	}
+	total := 0
+	for _, arg := range args {
+		if len(arg) > config.MaxArg {
+			return decodeError(ErrArgTooBig, len(arg))
+		}
+		total += len(arg)
+	}
+	if total > config.MaxTotal {
+		return decodeError(ErrPacketTooBig, total)
+	}
+	return nil
+}
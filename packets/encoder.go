@@ -0,0 +1,124 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package packets
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// The packets write themselves straight into a pooled buffer and then do one Write.
+// No Universal gets made. The wire format is the same, see packets.go
+// See bench_test.go for the numbers.
+
+// encoder is a buffer from the pool.
+type encoder struct {
+	buf []byte
+}
+
+// wireArg is one of the args before the options. An address has a type byte in front.
+type wireArg struct {
+	prefix int // -1 is none
+	bytes  []byte
+}
+
+// bigger buffers than this don't go back in the pool.
+const maxPooledBuffer = 64 * 1024
+
+var encoderPool = sync.Pool{
+	New: func() interface{} {
+		return &encoder{buf: make([]byte, 0, 1024)}
+	},
+}
+
+func getEncoder() *encoder {
+	e := encoderPool.Get().(*encoder)
+	e.buf = e.buf[:0]
+	return e
+}
+
+func putEncoder(e *encoder) {
+	if cap(e.buf) > maxPooledBuffer {
+		return
+	}
+	encoderPool.Put(e)
+}
+
+func addressArg(address *AddressUnion) wireArg {
+	if address.Type == Utf8Address {
+		return wireArg{-1, address.Bytes} // the utf-8 types don't get the space. See ToBytes
+	}
+	return wireArg{int(address.Type), address.Bytes}
+}
+
+func (a *wireArg) len() int {
+	if a.prefix < 0 {
+		return len(a.bytes)
+	}
+	return len(a.bytes) + 1
+}
+
+// varLenInt is WriteVarLenInt into the buffer.
+func (e *encoder) varLenInt(val uint32) {
+	if val > 127 {
+		var tmp [5]byte
+		i := len(tmp) - 1
+		tmp[i] = byte(val & 0x7F)
+		val >>= 7
+		for val != 0 {
+			i--
+			tmp[i] = byte(val&0x7F) | 0x80
+			val >>= 7
+		}
+		e.buf = append(e.buf, tmp[i:]...)
+		return
+	}
+	e.buf = append(e.buf, byte(val))
+}
+
+// writePacket is the cmd, the count, the lengths and then the bytes.
+// The options are key then value in pairs.
+func writePacket(writer io.Writer, cmd CommandType, fixed []wireArg, options [][]byte) error {
+	if writer == nil {
+		return nil
+	}
+	count := len(fixed) + len(options)
+	if count >= 128 {
+		return errors.New("Too many args")
+	}
+	e := getEncoder()
+	defer putEncoder(e)
+
+	e.buf = append(e.buf, byte(cmd), byte(count))
+	for i := range fixed {
+		e.varLenInt(uint32(fixed[i].len()))
+	}
+	for _, arg := range options {
+		e.varLenInt(uint32(len(arg)))
+	}
+	for _, arg := range fixed {
+		if arg.prefix >= 0 {
+			e.buf = append(e.buf, byte(arg.prefix))
+		}
+		e.buf = append(e.buf, arg.bytes...)
+	}
+	for _, arg := range options {
+		e.buf = append(e.buf, arg...)
+	}
+	_, err := writer.Write(e.buf)
+	return err
+}
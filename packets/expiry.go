@@ -0,0 +1,48 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package packets
+
+import (
+	"strconv"
+)
+
+// Message expiry. The "expires" option is the unix seconds after which nobody should get
+// the message. It's a time and not an interval so it means the same thing at every hop.
+// See iot/expiry.go
+
+// SetExpires sets the "expires" option.
+func (p *Send) SetExpires(when uint32) {
+	p.SetOption("expires", []byte(strconv.FormatUint(uint64(when), 10)))
+}
+
+// GetExpires returns the "expires" option.
+func (p *Send) GetExpires() (uint32, bool) {
+	val, ok := p.GetOption("expires")
+	if !ok {
+		return 0, false
+	}
+	when, err := strconv.ParseUint(string(val), 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(when), true
+}
+
+// IsExpired is true if it has an "expires" and now is past it.
+func (p *Send) IsExpired(now uint32) bool {
+	when, ok := p.GetExpires()
+	return ok && now > when
+}
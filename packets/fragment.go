@@ -0,0 +1,302 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package packets
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Fragments. A payload too big for one Send, like a camera snapshot or a firmware image, goes as
+// several Sends with the same "frag" id, a "fragi" index and a "fragn" count. Every fragment has
+// the options of the original so they all get routed the same way. The shared subscriptions give all
+// the fragments with the same id to the same member. See iot/shared.go
+//
+// The cluster doesn't put them back together. The receiver does with a Reassembler. The client
+// does (see client/client.go) and so does the http subdomain gateway (see iot/sub-domain-server.go).
+// Compression is of the whole payload so decompress after reassembly.
+// Billing sees every fragment go by so it counts the full size.
+
+// FragmentSize is the most payload in one fragment. Under the 63k the small things can take.
+const FragmentSize = 60 * 1024
+
+// MaxMessageSize is the biggest payload a Reassembler will put back together.
+const MaxMessageSize = 64 * 1024 * 1024
+
+// ErrReassemblyFull is when the fragments waiting would be more than the Reassembler's MaxBytes.
+var ErrReassemblyFull = errors.New("too many fragments waiting")
+
+// IsFragment is true if it's a piece of a bigger Send.
+func (p *Send) IsFragment() bool {
+	_, ok := p.GetOption("frag")
+	return ok
+}
+
+// GetFragment returns the "frag", "fragi" and "fragn". ok is false if it's not a fragment or they're bad.
+func (p *Send) GetFragment() (id string, index int, count int, ok bool) {
+	got, ok := p.GetOption("frag")
+	if !ok || len(got) == 0 {
+		return "", 0, 0, false
+	}
+	i, ok := getIntOption(&p.PacketCommon, "fragi")
+	if !ok {
+		return "", 0, 0, false
+	}
+	n, ok := getIntOption(&p.PacketCommon, "fragn")
+	if !ok || i < 0 || n <= 0 || i >= n || n > MaxMessageSize/1024 {
+		return "", 0, 0, false
+	}
+	return string(got), i, n, true
+}
+
+// Fragment splits p into Sends with no more than size bytes of payload. Just p if it fits.
+// size <= 0 is FragmentSize.
+func (p *Send) Fragment(size int) []*Send {
+	if size <= 0 {
+		size = FragmentSize
+	}
+	if len(p.Payload) <= size {
+		return []*Send{p}
+	}
+	id := newFragmentID()
+	count := (len(p.Payload) + size - 1) / size
+	frags := make([]*Send, 0, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * size
+		if end > len(p.Payload) {
+			end = len(p.Payload)
+		}
+		frags = append(frags, p.fragment(p.Payload[i*size:end], id, i, count))
+	}
+	return frags
+}
+
+// FragmentReader is Fragment for a payload that's still coming, like an http body. The payload is
+// head and then length bytes from r. Each fragment goes to send as soon as it's read so only one
+// is in memory at a time. The Payload of p isn't used. size <= 0 is FragmentSize.
+func (p *Send) FragmentReader(head []byte, r io.Reader, length int64, size int, send func(frag *Send) error) error {
+	if size <= 0 {
+		size = FragmentSize
+	}
+	if length < 0 || int64(len(head))+length > MaxMessageSize {
+		return errors.New("bad length for fragments")
+	}
+	total := int64(len(head)) + length
+	body := io.MultiReader(bytes.NewReader(head), io.LimitReader(r, length))
+	if total <= int64(size) {
+		whole := &Send{}
+		whole.Address = p.Address
+		whole.Source = p.Source
+		whole.CopyOptions(&p.PacketCommon)
+		whole.Payload = make([]byte, total)
+		_, err := io.ReadFull(body, whole.Payload)
+		if err != nil {
+			return err
+		}
+		return send(whole)
+	}
+	id := newFragmentID()
+	count := int((total + int64(size) - 1) / int64(size))
+	for i := 0; i < count; i++ {
+		n := int64(size)
+		if rest := total - int64(i)*int64(size); rest < n {
+			n = rest
+		}
+		payload := make([]byte, n)
+		_, err := io.ReadFull(body, payload)
+		if err != nil {
+			return err
+		}
+		err = send(p.fragment(payload, id, i, count))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fragment is piece i of count.
+func (p *Send) fragment(payload []byte, id []byte, i int, count int) *Send {
+	frag := &Send{}
+	frag.Address = p.Address
+	frag.Source = p.Source
+	frag.Payload = payload
+	frag.CopyOptions(&p.PacketCommon)
+	frag.SetOption("frag", id)
+	frag.SetOption("fragi", []byte(strconv.Itoa(i)))
+	frag.SetOption("fragn", []byte(strconv.Itoa(count)))
+	return frag
+}
+
+func newFragmentID() []byte {
+	var tmp [12]byte
+	rand.Read(tmp[:])
+	return []byte(base64.RawURLEncoding.EncodeToString(tmp[:]))
+}
+
+// Reassembler puts the fragments back together. It's bounded, one per contact or client.
+// A message is the address, the source and the "frag" id together so two senders can't mix
+// their pieces, even with the same id. It's safe for concurrent use.
+type Reassembler struct {
+	MaxBytes   int           // of all the fragments waiting. Default MaxMessageSize.
+	MaxPending int           // messages in pieces at once. The oldest is dropped. Default 16.
+	MaxAge     time.Duration // a message with a missing piece is dropped after this. Default 1 min.
+
+	mux     sync.Mutex
+	pending map[string]*partial // by fragmentKey
+	bytes   int
+}
+
+type partial struct {
+	parts   [][]byte
+	have    int
+	size    int
+	started time.Time
+}
+
+// Add a Send. The whole Send comes back with the last fragment, otherwise nil.
+// A Send that isn't a fragment comes right back.
+func (r *Reassembler) Add(p *Send, now time.Time) (*Send, error) {
+
+	if !p.IsFragment() {
+		return p, nil
+	}
+	id, index, count, ok := p.GetFragment()
+	if !ok {
+		return nil, errors.New("bad fragment")
+	}
+	maxBytes := r.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = MaxMessageSize
+	}
+	maxPending := r.MaxPending
+	if maxPending <= 0 {
+		maxPending = 16
+	}
+	maxAge := r.MaxAge
+	if maxAge <= 0 {
+		maxAge = time.Minute
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.pending == nil {
+		r.pending = make(map[string]*partial)
+	}
+	for key, part := range r.pending {
+		if now.Sub(part.started) > maxAge {
+			r.drop(key)
+		}
+	}
+	key := fragmentKey(p, id)
+	part := r.pending[key]
+	if part == nil {
+		if len(r.pending) >= maxPending {
+			r.drop(r.oldest())
+		}
+		part = &partial{parts: make([][]byte, count), started: now}
+		r.pending[key] = part
+	}
+	if count != len(part.parts) {
+		r.drop(key)
+		return nil, errors.New("fragment count changed")
+	}
+	if part.parts[index] != nil {
+		return nil, nil // a duplicate
+	}
+	if r.bytes+len(p.Payload) > maxBytes || part.size+len(p.Payload) > MaxMessageSize {
+		r.drop(key)
+		return nil, ErrReassemblyFull
+	}
+	part.parts[index] = append([]byte{}, p.Payload...) // not nil, even if empty
+	part.have++
+	part.size += len(p.Payload)
+	r.bytes += len(p.Payload)
+	if part.have < count {
+		return nil, nil
+	}
+
+	whole := &Send{}
+	whole.Address = p.Address
+	whole.Source = p.Source
+	whole.CopyOptions(&p.PacketCommon)
+	whole.DeleteOption("frag")
+	whole.DeleteOption("fragi")
+	whole.DeleteOption("fragn")
+	whole.Payload = make([]byte, 0, part.size)
+	for _, got := range part.parts {
+		whole.Payload = append(whole.Payload, got...)
+	}
+	r.drop(key)
+	return whole, nil
+}
+
+// Pending is how many bytes are waiting.
+func (r *Reassembler) Pending() int {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return r.bytes
+}
+
+func (r *Reassembler) drop(key string) {
+	part := r.pending[key]
+	if part == nil {
+		return
+	}
+	r.bytes -= part.size
+	delete(r.pending, key)
+}
+
+// fragmentKey is the address, the source and the id. With the lengths so they can't run together.
+func fragmentKey(p *Send, id string) string {
+	key := make([]byte, 0, 64)
+	for _, a := range []*AddressUnion{&p.Address, &p.Source} {
+		key = append(key, byte(a.Type))
+		key = strconv.AppendInt(key, int64(len(a.Bytes)), 10)
+		key = append(key, ':')
+		key = append(key, a.Bytes...)
+	}
+	return string(append(key, id...))
+}
+
+func (r *Reassembler) oldest() string {
+	oldest := ""
+	var when time.Time
+	for key, part := range r.pending {
+		if oldest == "" || part.started.Before(when) {
+			oldest, when = key, part.started
+		}
+	}
+	return oldest
+}
+
+func getIntOption(p *PacketCommon, name string) (int, bool) {
+	got, ok := p.GetOption(name)
+	if !ok {
+		return 0, false
+	}
+	val, err := strconv.Atoi(string(got))
+	if err != nil {
+		return 0, false
+	}
+	return val, true
+}
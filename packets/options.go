@@ -0,0 +1,288 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package packets
+
+import (
+	"encoding/json"
+	"strconv"
+	"unicode/utf8"
+)
+
+// The well known options. The keys used to be strings all over iot and monitor_pod.
+// Each one has a kind and a value that isn't that kind is a DecodeError when it's read.
+// The Internal ones are for the servers and StripInternal takes them out before a
+// packet goes down to a device. See iot/TCPUtil.go
+// The aide takes them out of what comes up from a device too. See stripServerOptions in iot/contacts.go
+
+// OptionKind is what the value of an option has to be.
+type OptionKind byte
+
+const (
+	OptionBytes  OptionKind = iota // anything
+	OptionString                   // utf-8
+	OptionInt                      // decimal
+	OptionJSON                     // eg. a KnotFreeContactStats
+	OptionFlag                     // only being there matters
+)
+
+// OptionInfo is a well known option.
+type OptionInfo struct {
+	Key      string
+	Kind     OptionKind
+	Internal bool // never goes down to a device.
+}
+
+// OptionGetter is any packet.
+type OptionGetter interface {
+	GetOption(key string) ([]byte, bool)
+}
+
+// OptionSetter is any packet too, but a pointer.
+type OptionSetter interface {
+	SetOption(key string, val []byte)
+}
+
+var wellKnownOptions = map[string]OptionInfo{}
+
+// wellKnownKeys are the keys as bytes so SetOption doesn't alloc one every time.
+var wellKnownKeys = map[string][]byte{}
+
+func register(key string, kind OptionKind, internal bool) OptionInfo {
+	info := OptionInfo{key, kind, internal}
+	wellKnownOptions[key] = info
+	wellKnownKeys[key] = []byte(key)
+	return info
+}
+
+// optionKey is the key for SetOption. Nobody writes into a key.
+func optionKey(key string) []byte {
+	got, ok := wellKnownKeys[key]
+	if ok {
+		return got
+	}
+	return []byte(key)
+}
+
+// The registry.
+var (
+	OptToken       = StringOption{register("token", OptionString, true)}       // the JWT in a Connect
+	OptJWTID       = StringOption{register("jwtid", OptionString, true)}       // the token's id on subscribes. For billing.
+	OptStatsMax    = JSONOption{register("statsmax", OptionJSON, true)}        // the billing subscribe. The token's limits.
+	OptAddStats    = JSONOption{register("add-stats", OptionJSON, true)}       // a publish to the billing channel.
+	OptStatsDeltaT = IntOption{register("stats-deltat", OptionInt, true)}      // seconds, with add-stats.
+	OptPub2Self    = FlagOption{register("pub2self", OptionFlag, false)}       // a subscriber gets its own publishes.
+	OptSessionKey  = StringOption{register("sessionKey", OptionString, false)} // rpc replies copy it. See rpc
+	OptNonce       = BytesOption{register("nonc", OptionBytes, false)}         // a raw nonce
+	OptDebug       = StringOption{register("debg", OptionString, false)}       // "12345678" means print it.
+	OptError       = BytesOption{register("error", OptionBytes, false)}        // the contact is going to be disconnected.
+	OptCode        = IntOption{register("code", OptionInt, false)}             // a ReasonCode. See reasons.go
+	OptReason      = StringOption{register("reason", OptionString, false)}     // with code on a ConnectAck
+	OptNoWild      = FlagOption{register("nowild", OptionFlag, true)}          // the wildcard subscribers don't get it. See iot/wildcards.go
+	OptPubk        = BytesOption{register("pubk", OptionBytes, true)}          // from the token. A Lookup from a client keeps its own. See iot/users.go
+	OptFrom        = StringOption{register("from", OptionString, true)}        // the publisher, between the aide and the guru. See iot/seq.go
+	OptBack        = FlagOption{register("back", OptionFlag, true)}            // on a subscribe. The aide wants its own publishes back. See iot/seq.go
+	OptShare       = StringOption{register("share", OptionString, true)}       // the group. See iot/shared.go
+	OptShareFilter = StringOption{register("sharefilter", OptionString, true)} // the wildcard of the group.
+	OptSinceFor    = StringOption{register("sincefor", OptionString, true)}    // the contact that wants the history. A uint64. See iot/history.go
+	OptOwned       = StringOption{register("owned", OptionString, true)}       // the owner's pubk on a suback. See iot/owned.go
+)
+
+// "seqepoch" isn't one of them. A client with the seq cap gets it. See seq.go
+
+// LookupOption returns the well known option, if it is one.
+func LookupOption(key string) (OptionInfo, bool) {
+	info, ok := wellKnownOptions[key]
+	return info, ok
+}
+
+// IsInternalOption is true for the options the devices don't get.
+func IsInternalOption(key string) bool {
+	return wellKnownOptions[key].Internal
+}
+
+// Valid says if val is the right kind.
+func (o OptionInfo) Valid(val []byte) bool {
+	switch o.Kind {
+	case OptionString:
+		return utf8.Valid(val)
+	case OptionInt:
+		_, err := strconv.ParseInt(string(val), 10, 64)
+		return err == nil
+	case OptionJSON:
+		return json.Valid(val)
+	}
+	return true
+}
+
+// Has is true if p has it at all.
+func (o OptionInfo) Has(p OptionGetter) bool {
+	_, ok := p.GetOption(o.Key)
+	return ok
+}
+
+// BytesOption is an option that could be anything.
+type BytesOption struct{ OptionInfo }
+
+func (o BytesOption) Get(p OptionGetter) ([]byte, bool) {
+	return p.GetOption(o.Key)
+}
+
+func (o BytesOption) Set(p OptionSetter, val []byte) {
+	p.SetOption(o.Key, val)
+}
+
+// StringOption is a utf-8 option.
+type StringOption struct{ OptionInfo }
+
+func (o StringOption) Get(p OptionGetter) (string, bool) {
+	got, ok := p.GetOption(o.Key)
+	if !ok || !o.Valid(got) {
+		return "", false
+	}
+	return string(got), true
+}
+
+func (o StringOption) Set(p OptionSetter, val string) {
+	p.SetOption(o.Key, []byte(val))
+}
+
+// IntOption is a decimal option.
+type IntOption struct{ OptionInfo }
+
+func (o IntOption) Get(p OptionGetter) (int64, bool) {
+	got, ok := p.GetOption(o.Key)
+	if !ok {
+		return 0, false
+	}
+	val, err := strconv.ParseInt(string(got), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return val, true
+}
+
+func (o IntOption) Set(p OptionSetter, val int64) {
+	p.SetOption(o.Key, []byte(strconv.FormatInt(val, 10)))
+}
+
+// JSONOption is a struct in json.
+type JSONOption struct{ OptionInfo }
+
+// Get unmarshals into v. false if it's not there.
+func (o JSONOption) Get(p OptionGetter, v interface{}) (bool, error) {
+	got, ok := p.GetOption(o.Key)
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(got, v)
+}
+
+func (o JSONOption) Set(p OptionSetter, v interface{}) error {
+	got, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	p.SetOption(o.Key, got)
+	return nil
+}
+
+// FlagOption is there or it isn't.
+type FlagOption struct{ OptionInfo }
+
+func (o FlagOption) Is(p OptionGetter) bool {
+	return o.Has(p)
+}
+
+func (o FlagOption) Set(p OptionSetter) {
+	p.SetOption(o.Key, []byte("1"))
+}
+
+// validateOptions checks the well known ones. It doesn't alloc.
+func (p *PacketCommon) validateOptions() error {
+	for i := 0; i+1 < len(p.options); i += 2 {
+		info, ok := wellKnownOptions[string(p.options[i])]
+		if ok && !info.Valid(p.options[i+1]) {
+			return decodeError(ErrBadOption, info.Key)
+		}
+	}
+	return nil
+}
+
+func (p *PacketCommon) common() *PacketCommon {
+	return p
+}
+
+func (p *PacketCommon) hasInternal() bool {
+	for i := 0; i < len(p.options); i += 2 {
+		if wellKnownOptions[string(p.options[i])].Internal {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *PacketCommon) withoutInternal() [][]byte {
+	options := make([][]byte, 0, len(p.options))
+	for i := 0; i < len(p.options); i += 2 {
+		if !wellKnownOptions[string(p.options[i])].Internal {
+			options = append(options, p.options[i], p.options[i+1])
+		}
+	}
+	return options
+}
+
+// StripInternal is p without the Internal options. A copy if there were any.
+func StripInternal(p Interface) Interface {
+	c, ok := p.(interface{ common() *PacketCommon })
+	if !ok || !c.common().hasInternal() {
+		return p
+	}
+	switch v := p.(type) {
+	case *Send:
+		cp := *v
+		cp.options = v.withoutInternal()
+		return &cp
+	case *Subscribe:
+		cp := *v
+		cp.options = v.withoutInternal()
+		return &cp
+	case *Unsubscribe:
+		cp := *v
+		cp.options = v.withoutInternal()
+		return &cp
+	case *Lookup:
+		cp := *v
+		cp.options = v.withoutInternal()
+		return &cp
+	case *Connect:
+		cp := *v
+		cp.options = v.withoutInternal()
+		return &cp
+	case *Disconnect:
+		cp := *v
+		cp.options = v.withoutInternal()
+		return &cp
+	case *Ping:
+		cp := *v
+		cp.options = v.withoutInternal()
+		return &cp
+	case *ConnectAck:
+		cp := *v
+		cp.options = v.withoutInternal()
+		return &cp
+	}
+	return p
+}
@@ -7,7 +7,6 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"errors"
-	"fmt"
 	"strings"
 	"sync"
 	"unicode/utf8"
@@ -15,8 +14,6 @@ import (
 	"io"
 
 	"github.com/awootton/knotfreeiot/badjson"
-
-	"github.com/emirpasic/gods/trees/redblacktree"
 )
 
 /**
@@ -209,8 +206,9 @@ func (address *AddressUnion) EnsureAddressIsBinary() {
 // PacketCommon is stuff the packets all have, like options.
 type PacketCommon struct {
 	// for internal use only:
-	backingUniversal  *Universal         // might be nil, a write will fill it.
-	optionalKeyValues *redblacktree.Tree // might be nil if no options.
+	// key then value in pairs, sorted by key. Might be nil if no options.
+	// After a read it's the args straight off the wire so nothing gets decoded until asked.
+	options [][]byte
 	// There is a Get and a Put and a Size() for options below.
 }
 
@@ -232,6 +230,12 @@ type Ping struct {
 	PacketCommon
 }
 
+// ConnectAck is the server's answer to a Connect that had a "version" or "caps".
+// See capabilities.go
+type ConnectAck struct {
+	PacketCommon
+}
+
 // MessageCommon is
 type MessageCommon struct {
 	PacketCommon
@@ -324,7 +328,6 @@ func FillPacket(uni *Universal) (Interface, error) {
 		if err != nil {
 			return nil, err
 		}
-		p.backingUniversal = nil
 		return p, nil
 	case 'S': //
 		p := &Subscribe{}
@@ -332,7 +335,6 @@ func FillPacket(uni *Universal) (Interface, error) {
 		if err != nil {
 			return nil, err
 		}
-		p.backingUniversal = nil
 		return p, nil
 	case 'U': //
 		p := &Unsubscribe{}
@@ -340,7 +342,6 @@ func FillPacket(uni *Universal) (Interface, error) {
 		if err != nil {
 			return nil, err
 		}
-		p.backingUniversal = nil
 		return p, nil
 	case 'L': //
 		p := &Lookup{}
@@ -348,7 +349,6 @@ func FillPacket(uni *Universal) (Interface, error) {
 		if err != nil {
 			return nil, err
 		}
-		p.backingUniversal = nil
 		return p, nil
 	case 'C': //
 		p := &Connect{}
@@ -356,7 +356,6 @@ func FillPacket(uni *Universal) (Interface, error) {
 		if err != nil {
 			return nil, err
 		}
-		p.backingUniversal = nil
 		return p, nil
 	case 'D': //
 		p := &Disconnect{}
@@ -364,7 +363,6 @@ func FillPacket(uni *Universal) (Interface, error) {
 		if err != nil {
 			return nil, err
 		}
-		p.backingUniversal = nil
 		return p, nil
 	case 'H': // Ping aka Heartbeat, used?
 		p := &Ping{}
@@ -372,26 +370,36 @@ func FillPacket(uni *Universal) (Interface, error) {
 		if err != nil {
 			return nil, err
 		}
-		p.backingUniversal = nil
+		return p, nil
+	case 'A': // ConnectAck
+		p := &ConnectAck{}
+		err := p.Fill(uni)
+		if err != nil {
+			return nil, err
+		}
 		return p, nil
 	default:
-		return nil, errors.New("unknown command " + string(uni.Cmd))
+		return nil, decodeError(ErrUnknownCommand, string(uni.Cmd))
 	}
 }
 
 // ReadPacket attempts to obtain a valid Packet from the stream
+// A bad one is a *DecodeError. See decoder.go
 func ReadPacket(reader io.Reader) (Interface, error) {
-
-	uni, err := ReadUniversal(reader)
-	if err != nil {
-		return nil, err
-	}
-	p, err := FillPacket(uni)
-	return p, err
+	return DefaultDecoder.ReadPacket(reader)
 }
 
 // The args slice is key then value in pairs
-func (p *PacketCommon) unpackOptions(args [][]byte) {
+// When they're already sorted, like we write them, we just keep the args.
+// The well known ones have to be the right kind. See options.go
+func (p *PacketCommon) unpackOptions(args [][]byte) error {
+	p.options = nil
+	if optionsAreSorted(args) {
+		if len(args) != 0 {
+			p.options = args[:len(args):len(args)]
+		}
+		return p.validateOptions()
+	}
 	key := "none"
 	for i, arg := range args {
 		if i&1 == 1 { // on odd numbers
@@ -401,18 +409,26 @@ func (p *PacketCommon) unpackOptions(args [][]byte) {
 		}
 		key = string(arg)
 	}
+	return p.validateOptions()
 }
 
-func (p *PacketCommon) packOptions(args [][]byte) [][]byte {
-	if p.OptionSize() == 0 {
-		return args
+func optionsAreSorted(args [][]byte) bool {
+	if len(args)&1 == 1 {
+		return false
 	}
-	it := p.optionalKeyValues.Iterator()
-	for it.Next() {
-		args = append(args, []byte(it.Key().(string)))
-		args = append(args, it.Value().([]byte))
+	for i := 0; i < len(args); i += 2 {
+		if len(args[i]) == 0 {
+			return false
+		}
+		if i > 0 && string(args[i-2]) >= string(args[i]) {
+			return false
+		}
 	}
-	return args
+	return true
+}
+
+func (p *PacketCommon) packOptions(args [][]byte) [][]byte {
+	return append(args, p.options...)
 }
 
 // Fill implements the 2nd part of an unmarshal.
@@ -420,24 +436,22 @@ func (p *PacketCommon) packOptions(args [][]byte) [][]byte {
 func (p *Subscribe) Fill(str *Universal) error {
 
 	if len(str.Args) < 1 {
-		return errors.New("too few args for Subscribe")
+		return decodeError(ErrTooFewArgs, "for Subscribe")
 	}
 	p.Address.FromBytes(str.Args[0])
 
-	p.unpackOptions(str.Args[1:])
-	return nil
+	return p.unpackOptions(str.Args[1:])
 }
 
 // Fill implements the 2nd part of an unmarshal.
 func (p *Unsubscribe) Fill(str *Universal) error {
 
 	if len(str.Args) < 1 {
-		return errors.New("too few args for Unsubscribe")
+		return decodeError(ErrTooFewArgs, "for Unsubscribe")
 	}
 
 	p.Address.FromBytes(str.Args[0])
-	p.unpackOptions(str.Args[1:])
-	return nil
+	return p.unpackOptions(str.Args[1:])
 }
 
 // Fill implements the 2nd part of an unmarshal
@@ -448,46 +462,47 @@ func (p *Send) Fill(str *Universal) error {
 		// for _, a := range str.Args {
 		// 	fmt.Println("arg", a)
 		// }
-		return errors.New("too few args for Send")
+		return decodeError(ErrTooFewArgs, "for Send")
 	}
 	p.Address.FromBytes(str.Args[0])
 	p.Source.FromBytes(str.Args[1])
 	p.Payload = str.Args[2]
-	p.unpackOptions(str.Args[3:])
-	return nil
+	return p.unpackOptions(str.Args[3:])
 }
 
 // Fill implements the 2nd part of an unmarshal.
 func (p *Connect) Fill(str *Universal) error {
 
-	p.unpackOptions(str.Args[0:])
-	return nil
+	return p.unpackOptions(str.Args[0:])
 }
 
 // Fill implements the 2nd part of an unmarshal.
 func (p *Disconnect) Fill(str *Universal) error {
 
-	p.unpackOptions(str.Args[0:])
-	return nil
+	return p.unpackOptions(str.Args[0:])
 }
 
 // Fill implements the 2nd part of an unmarshal.
 func (p *Ping) Fill(str *Universal) error {
 
-	p.unpackOptions(str.Args[0:])
-	return nil
+	return p.unpackOptions(str.Args[0:])
+}
+
+// Fill implements the 2nd part of an unmarshal.
+func (p *ConnectAck) Fill(str *Universal) error {
+
+	return p.unpackOptions(str.Args[0:])
 }
 
 // Fill implements the 2nd part of an unmarshal.
 func (p *Lookup) Fill(str *Universal) error {
 
 	if len(str.Args) < 2 {
-		return errors.New("too few args for Lookup")
+		return decodeError(ErrTooFewArgs, "for Lookup")
 	}
 	p.Address.FromBytes(str.Args[0])
 	p.Source.FromBytes(str.Args[1])
-	p.unpackOptions(str.Args[2:])
-	return nil
+	return p.unpackOptions(str.Args[2:])
 }
 
 // UniversalToJSON outputs an array of strings.
@@ -548,58 +563,42 @@ func UniversalToJSON(str *Universal) ([]byte, error) {
 
 // ToJSON to output a bad json version
 func (p *Send) ToJSON() ([]byte, error) {
-	p.backingUniversal = nil
-	p.Write(nil) // force existance of backingUniversal
-	bytes, err := UniversalToJSON(p.backingUniversal)
-	return bytes, err
+	return UniversalToJSON(p.universal())
 }
 
 // ToJSON is not that efficient
 func (p *Subscribe) ToJSON() ([]byte, error) {
-	p.backingUniversal = nil
-	p.Write(nil) // force existance of backingUniversal
-	bytes, err := UniversalToJSON(p.backingUniversal)
-	return bytes, err
+	return UniversalToJSON(p.universal())
 }
 
 // ToJSON is something that wastes memory.
 func (p *Unsubscribe) ToJSON() ([]byte, error) {
-	p.backingUniversal = nil
-	p.Write(nil) // force existance of backingUniversal
-	bytes, err := UniversalToJSON(p.backingUniversal)
-	return bytes, err
+	return UniversalToJSON(p.universal())
 }
 
 // ToJSON is
 func (p *Connect) ToJSON() ([]byte, error) {
-	p.backingUniversal = nil
-	p.Write(nil) // force existance of backingUniversal
-	bytes, err := UniversalToJSON(p.backingUniversal)
-	return bytes, err
+	return UniversalToJSON(p.universal())
 }
 
 // ToJSON is all the same
 func (p *Disconnect) ToJSON() ([]byte, error) {
-	p.backingUniversal = nil
-	p.Write(nil) // force existance of backingUniversal
-	bytes, err := UniversalToJSON(p.backingUniversal)
-	return bytes, err
+	return UniversalToJSON(p.universal())
 }
 
 // ToJSON is all the same
 func (p *Ping) ToJSON() ([]byte, error) {
-	p.backingUniversal = nil
-	p.Write(nil) // force existance of backingUniversal
-	bytes, err := UniversalToJSON(p.backingUniversal)
-	return bytes, err
+	return UniversalToJSON(p.universal())
+}
+
+// ToJSON is all the same
+func (p *ConnectAck) ToJSON() ([]byte, error) {
+	return UniversalToJSON(p.universal())
 }
 
 // ToJSON is
 func (p *Lookup) ToJSON() ([]byte, error) {
-	p.backingUniversal = nil
-	p.Write(nil) // force existance of backingUniversal
-	bytes, err := UniversalToJSON(p.backingUniversal)
-	return bytes, err
+	return UniversalToJSON(p.universal())
 }
 
 func (str *Universal) String() string {
@@ -639,6 +638,11 @@ func (p *Ping) String() string {
 	return string(b)
 }
 
+func (p *ConnectAck) String() string {
+	b, _ := p.ToJSON()
+	return string(b)
+}
+
 func (p *Lookup) String() string {
 	b, _ := p.ToJSON()
 	return string(b)
@@ -674,215 +678,125 @@ func (p *Ping) Sig() string {
 	return "ping"
 }
 
+func (p *ConnectAck) Sig() string {
+	return "connack"
+}
+
 func (p *Lookup) Sig() string {
 	return "Lookup :" + p.Address.Sig() + " frm:" + p.Source.Sig()
 
 }
 
-// Write implements a marshal operation.
+// Write implements a marshal operation. See encoder.go
 func (p *Subscribe) Write(writer io.Writer) error {
-	if p.backingUniversal == nil {
-		str := new(Universal)
-		p.backingUniversal = str
-		str.Cmd = 'S' //
-		str.Args = make([][]byte, 0, 1+(p.OptionSize()*2))
-		str.Args = append(str.Args, p.Address.ToBytes())
-		str.Args = p.packOptions(str.Args)
-	}
-	err := p.backingUniversal.Write(writer)
-	return err
+	fixed := [...]wireArg{addressArg(&p.Address)}
+	return writePacket(writer, 'S', fixed[:], p.options)
 }
 
 // Write marshals to binary
 func (p *Unsubscribe) Write(writer io.Writer) error {
-	if p.backingUniversal == nil {
-		str := new(Universal)
-		p.backingUniversal = str
-		str.Cmd = 'U' //
-		str.Args = make([][]byte, 0, 1+(p.OptionSize()*2))
-		str.Args = append(str.Args, p.Address.ToBytes())
-		str.Args = p.packOptions(str.Args)
-	}
-	err := p.backingUniversal.Write(writer)
-	return err
+	fixed := [...]wireArg{addressArg(&p.Address)}
+	return writePacket(writer, 'U', fixed[:], p.options)
 }
 
-// Write forces backingUniversal
+// Write doesn't make a Universal. This is the hot one.
 func (p *Send) Write(writer io.Writer) error {
-	if p.backingUniversal == nil {
-		str := new(Universal)
-		p.backingUniversal = str
-		str.Cmd = 'P' // Publish
-		str.Args = make([][]byte, 0, 3+(p.OptionSize()*2))
-		str.Args = append(str.Args, p.Address.ToBytes())
-		str.Args = append(str.Args, p.Source.ToBytes())
-		str.Args = append(str.Args, p.Payload)
-		str.Args = p.packOptions(str.Args)
-	}
-	err := p.backingUniversal.Write(writer) // can have nulls in the addresses
-	return err
+	// can have nulls in the addresses
+	fixed := [...]wireArg{addressArg(&p.Address), addressArg(&p.Source), {-1, p.Payload}}
+	return writePacket(writer, 'P', fixed[:], p.options)
 }
 
 func (p *Connect) Write(writer io.Writer) error {
-	if p.backingUniversal == nil {
-		str := new(Universal)
-		p.backingUniversal = str
-		str.Cmd = 'C'
-		str.Args = make([][]byte, 0, 0+(p.OptionSize()*2))
-		str.Args = p.packOptions(str.Args)
-	}
-	err := p.backingUniversal.Write(writer)
-	return err
+	return writePacket(writer, 'C', nil, p.options)
 }
 
 func (p *Disconnect) Write(writer io.Writer) error {
-	if p.backingUniversal == nil {
-		str := new(Universal)
-		p.backingUniversal = str
-		str.Cmd = 'D'
-		str.Args = make([][]byte, 0, 0+(p.OptionSize()*2))
-		str.Args = p.packOptions(str.Args)
-	}
-	err := p.backingUniversal.Write(writer)
-	return err
+	return writePacket(writer, 'D', nil, p.options)
 }
 
 func (p *Ping) Write(writer io.Writer) error {
-	if p.backingUniversal == nil {
-		str := new(Universal)
-		p.backingUniversal = str
-		str.Cmd = 'H'
-		str.Args = make([][]byte, 0, 0+(p.OptionSize()*2))
-		str.Args = p.packOptions(str.Args)
-	}
-	err := p.backingUniversal.Write(writer)
-	return err
+	return writePacket(writer, 'H', nil, p.options)
+}
+
+func (p *ConnectAck) Write(writer io.Writer) error {
+	return writePacket(writer, 'A', nil, p.options)
 }
 
 func (p *Lookup) Write(writer io.Writer) error {
-	if p.backingUniversal == nil {
-		str := new(Universal)
-		p.backingUniversal = str
-		str.Cmd = 'L'
-		str.Args = make([][]byte, 0, 2+(p.OptionSize()*2))
-		str.Args = append(str.Args, p.Address.ToBytes())
-		str.Args = append(str.Args, p.Source.ToBytes())
-		str.Args = p.packOptions(str.Args)
-	}
-	err := p.backingUniversal.Write(writer)
-	return err
+	fixed := [...]wireArg{addressArg(&p.Address), addressArg(&p.Source)}
+	return writePacket(writer, 'L', fixed[:], p.options)
 }
 
-// ReadUniversal reads a Universal packet.
-func ReadUniversal(reader io.Reader) (*Universal, error) {
+// universal is for ToJSON. It's not fast.
+func (p *Subscribe) universal() *Universal {
+	args := make([][]byte, 0, 1+len(p.options))
+	args = append(args, p.Address.ToBytes())
+	return &Universal{'S', p.packOptions(args)}
+}
 
-	str := Universal{}
-	oneByte := []uint8{0}
-	n, err := reader.Read(oneByte) // read the command type
-	if err != nil {
-		return &str, err
-	}
-	str.Cmd = CommandType(oneByte[0])
+func (p *Unsubscribe) universal() *Universal {
+	args := make([][]byte, 0, 1+len(p.options))
+	args = append(args, p.Address.ToBytes())
+	return &Universal{'U', p.packOptions(args)}
+}
 
-	// read array of byte arrays
-	str.Args, err = ReadArrayOfByteArray(reader)
-	_ = n
-	// if err != nil {  this happens with a partial buffer.
-	// 	fmt.Println("ReadUniversal got error", err, "type:", rune(str.Cmd))
-	// }
-	return &str, err
+func (p *Send) universal() *Universal {
+	args := make([][]byte, 0, 3+len(p.options))
+	args = append(args, p.Address.ToBytes(), p.Source.ToBytes(), p.Payload)
+	return &Universal{'P', p.packOptions(args)}
+}
+
+func (p *Connect) universal() *Universal {
+	return &Universal{'C', p.packOptions(nil)}
+}
+
+func (p *Disconnect) universal() *Universal {
+	return &Universal{'D', p.packOptions(nil)}
+}
+
+func (p *Ping) universal() *Universal {
+	return &Universal{'H', p.packOptions(nil)}
+}
+
+func (p *ConnectAck) universal() *Universal {
+	return &Universal{'A', p.packOptions(nil)}
+}
+
+func (p *Lookup) universal() *Universal {
+	args := make([][]byte, 0, 2+len(p.options))
+	args = append(args, p.Address.ToBytes(), p.Source.ToBytes())
+	return &Universal{'L', p.packOptions(args)}
+}
+
+// ReadUniversal reads the command and the strings. See decoder.go
+func ReadUniversal(reader io.Reader) (*Universal, error) {
+	return DefaultDecoder.ReadUniversal(reader)
+}
+
+// This is a pool of the lengths of the strings, and a byte, which is something the read uses temporarily.
+// Awkward on an Arduino this will be.
+type readScratch struct {
+	lengths [128]int
+	one     [1]byte
 }
 
-// This is a pool of [128]int which is something the read uses to temporarily store
-// the lengths of the strings. Awkward on an Arduino this will be.
 var pool = sync.Pool{
 	// New creates an object when the pool has nothing available to return.
 	// New must return an interface{} to make it flexible. You have to cast
 	// your type after getting it.
 	New: func() interface{} {
-		// Pools often contain things like *bytes.Buffer, which are
-		// temporary and re-usable.
-		return new([128]int)
+		return new(readScratch)
 	},
 }
 
-// ReadArrayOfByteArray to read an array of byte arrays
+// ReadArrayOfByteArray to read an array of byte arrays. See decoder.go
 func ReadArrayOfByteArray(reader io.Reader) ([][]byte, error) {
-
-	oneByte := []uint8{0}
-	// read the lengths of the following args
-	n, err := reader.Read(oneByte)
-	if err != nil || n != 1 {
-		return nil, err
-	}
-	argsLen := uint8(oneByte[0])
-	if argsLen&0x80 != 0 {
-		// in the future this would mean that another byte follows and the args
-		// count is even bigger but for now ... 0x7F is the max.
-		return nil, errors.New("too many strings")
-	}
-
-	lengths := pool.Get().(*[128]int)
-	defer pool.Put(lengths)
-
-	total := 0
-	for i := uint8(0); i < argsLen; i++ { // read the lengths of the following strings
-		aval, err := ReadVarLenInt(reader)
-		if err != nil {
-			return nil, err
-		}
-		lengths[i] = aval
-		total += aval
-	}
-	// if total > (65536 - 256) { // was 1024*16 but now 65536 - 256 atw 3/2021
-	// 	return nil, errors.New("Packet too long for this reality")
-	// }
-
-	if total >= 8000000 { // atw 4/2021
-		// this can happen with a partial buffer
-		// fmt.Println("Packet too long error ", total)
-		// for i := 0; i < int(argsLen); i++ {
-		// 	fmt.Println("Packet strlen ", lengths[i])
-		// }
-		return nil, errors.New("packet too long for this reality")
-	}
-
-	// now we can read the rest all at once
-	bytes := make([]uint8, total) // alloc the base array
-	//n, err = reader.Read(bytes)   // read it. timeout?
-	n, err = io.ReadFull(reader, bytes)
-	if err != nil {
-		return nil, err
-	}
-	if n != total {
-		return nil, errors.New(fmt.Sprint("Too few bytes", n, total))
-	}
-	// now we can slice the args
-	position := 0
-	args := make([][]byte, argsLen) // array of slices
-	for i := 0; i < int(argsLen); i++ {
-		args[i] = bytes[position : position+lengths[i]]
-		position += lengths[i]
-	}
-	return args, nil
+	return DefaultDecoder.ReadArrayOfByteArray(reader)
 }
 
 // Write an Universal packet.
 func (str *Universal) Write(writer io.Writer) error {
-
-	if writer == nil {
-		return nil
-	}
-
-	oneByte := []uint8{0}
-	oneByte[0] = uint8(str.Cmd)
-	n, err := writer.Write(oneByte)
-	if err != nil {
-		return err
-	}
-	err = WriteArrayOfByteArray(str.Args, writer)
-	_ = n
-	return err // can haz binary data preceded by \0
+	return writePacket(writer, str.Cmd, nil, str.Args) // can haz binary data preceded by \0
 }
 
 // WriteArrayOfByteArray write count then lengths and then bytes
@@ -940,94 +854,104 @@ func WriteVarLenInt(uintvalue uint32, mask uint8, writer io.Writer) error {
 // ReadVarLenInt see comments above
 // Not meant for integers >= 2^28 big endian
 func ReadVarLenInt(reader io.Reader) (int, error) {
-	oneByte := []uint8{0}
-	_, err := reader.Read(oneByte)
-	if err != nil {
-		return 0, err
-	}
+	return readVarLenInt(reader, []uint8{0})
+}
+
+// readVarLenInt uses oneByte so it doesn't have to make one.
+func readVarLenInt(reader io.Reader, oneByte []byte) (int, error) {
 	aval := 0
-	remaining := 4
-	for remaining != 0 {
-		aval <<= 7
-		if oneByte[0] >= 128 {
-			aval |= int(oneByte[0]) & 0x7F
-			remaining--
-			_, err := reader.Read(oneByte)
-			if err != nil {
-				return 0, err
-			}
-		} else { // the common case
-			aval |= int(oneByte[0])
-			remaining = 0
-			break
+	for i := 0; i < 4; i++ {
+		_, err := io.ReadFull(reader, oneByte)
+		if err != nil {
+			return 0, err
+		}
+		aval = (aval << 7) | int(oneByte[0]&0x7F)
+		if oneByte[0] < 128 { // the common case
+			return aval, nil
 		}
 	}
-	return aval, nil
+	return 0, decodeError(ErrBadLength, "more than 4 bytes")
 }
 
 // OptionSize returns key count which is same as value count
 func (p *PacketCommon) OptionSize() int {
-	if p.optionalKeyValues == nil {
-		return 0
+	return len(p.options) / 2
+}
+
+// findOption is the index of the key, or where it would go, and if it's there.
+func (p *PacketCommon) findOption(key string) (int, bool) {
+	for i := 0; i < len(p.options); i += 2 {
+		k := string(p.options[i]) // doesn't alloc
+		if k == key {
+			return i, true
+		}
+		if k > key {
+			return i, false
+		}
 	}
-	return p.optionalKeyValues.Size()
+	return len(p.options), false
 }
 
 // GetOption returns the value,true to go with the key or nil,false
 func (p *PacketCommon) GetOption(key string) ([]byte, bool) {
-	if p.optionalKeyValues == nil {
-		return nil, false
-	}
-	val, ok := p.optionalKeyValues.Get(key)
+	i, ok := p.findOption(key)
 	if !ok {
-		val = []byte("")
+		return nil, false
 	}
-	return val.([]byte), ok
+	return p.options[i+1], true
 }
 
 // GetOptionKeys returns a slice of strings and a slice of byte slices. The keys and the valus are in the same order.
 func (p *PacketCommon) GetOptionKeys() ([]string, [][]byte) {
-	keys := make([]string, 0)
-	values := make([][]byte, 0)
-	if p.optionalKeyValues == nil {
-		return keys, values
-	}
-	it := p.optionalKeyValues.Iterator()
-	for it.Next() {
-		keys = append(keys, it.Key().(string))
-		values = append(values, it.Value().([]byte))
+	keys := make([]string, 0, len(p.options)/2)
+	values := make([][]byte, 0, len(p.options)/2)
+	for i := 0; i < len(p.options); i += 2 {
+		keys = append(keys, string(p.options[i]))
+		values = append(values, p.options[i+1])
 	}
 	return keys, values
 }
 
 // DeleteOption returns the value,true to go with the key or nil,false
 func (p *PacketCommon) DeleteOption(key string) {
-	if p.optionalKeyValues == nil {
+	i, ok := p.findOption(key)
+	if !ok {
 		return
 	}
-	p.optionalKeyValues.Remove(key)
-
+	// in place. A copy of a packet gets its own slice from CopyOptions.
+	n := len(p.options) - 2
+	copy(p.options[i:], p.options[i+2:])
+	p.options[n], p.options[n+1] = nil, nil
+	p.options = p.options[:n]
 }
 
 // SetOption adds the key,value
 func (p *PacketCommon) SetOption(key string, val []byte) {
-	if p.optionalKeyValues == nil {
-		p.optionalKeyValues = redblacktree.NewWithStringComparator()
+	i, ok := p.findOption(key)
+	if ok {
+		p.options[i+1] = val
+		return
+	}
+	// in place if there's room. See DeleteOption
+	if len(p.options)+2 > cap(p.options) {
+		options := make([][]byte, len(p.options), 2*len(p.options)+6)
+		copy(options, p.options)
+		p.options = options
 	}
-	p.optionalKeyValues.Put(key, val)
+	p.options = p.options[:len(p.options)+2]
+	copy(p.options[i+2:], p.options[i:])
+	p.options[i] = optionKey(key)
+	p.options[i+1] = val
 }
 
 func (p *PacketCommon) CopyOptions(source *PacketCommon) {
 
-	if p.optionalKeyValues == nil {
-		p.optionalKeyValues = redblacktree.NewWithStringComparator()
-	}
-	if source.optionalKeyValues == nil {
+	if len(p.options) == 0 {
+		p.options = append([][]byte(nil), source.options...)
 		return
 	}
-	it := source.optionalKeyValues.Iterator()
-	for it.Next() {
-		p.SetOption(it.Key().(string), it.Value().([]byte))
+	for i := 0; i < len(source.options); i += 2 {
+		p.SetOption(string(source.options[i]), source.options[i+1])
 	}
 }
 
@@ -0,0 +1,130 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package packets
+
+import (
+	"strconv"
+)
+
+// Reason codes. Why a connect failed, in the ConnectAck, or why we got disconnected,
+// in the Disconnect. They're in the "code" option as a decimal number and the numbers are
+// the mqtt 5 CONNACK ones so iot/mqtt-protocol.go can pass them straight through.
+// The ConnectAck has the words in "reason". Not "error", that would disconnect it on the way down.
+// The Disconnect has the words in "error" like always.
+
+// ReasonCode is the mqtt 5 reason code.
+type ReasonCode byte
+
+// The reason codes so far.
+const (
+	ReasonSuccess        ReasonCode = 0x00
+	ReasonUnspecified    ReasonCode = 0x80
+	ReasonMalformed      ReasonCode = 0x81 // the decoder didn't like it. See decoder.go
+	ReasonProtocolError  ReasonCode = 0x82 // eg. the first packet wasn't a Connect
+	ReasonBadToken       ReasonCode = 0x86 // mqtt's bad user name or password. Missing or didn't verify.
+	ReasonTokenExpired   ReasonCode = 0x87 // mqtt's not authorized
+	ReasonServerFull     ReasonCode = 0x89 // mqtt's server busy
+	ReasonBadIssuer      ReasonCode = 0x8C // mqtt's bad authentication method. We don't know who signed it.
+	ReasonPacketTooLarge ReasonCode = 0x95
+	ReasonOverLimit      ReasonCode = 0x97 // mqtt's quota exceeded
+)
+
+// The token limits in a successful ConnectAck. Same as the json of tokens.KnotFreeContactStats
+const (
+	LimitInput         = "in"  // bytes per sec
+	LimitOutput        = "out" // bytes per sec
+	LimitSubscriptions = "su"
+	LimitConnections   = "co"
+)
+
+func (code ReasonCode) String() string {
+	switch code {
+	case ReasonSuccess:
+		return "success"
+	case ReasonMalformed:
+		return "malformed packet"
+	case ReasonPacketTooLarge:
+		return "packet too large"
+	case ReasonProtocolError:
+		return "protocol error"
+	case ReasonBadToken:
+		return "bad token"
+	case ReasonTokenExpired:
+		return "token expired"
+	case ReasonServerFull:
+		return "server full"
+	case ReasonBadIssuer:
+		return "bad issuer"
+	case ReasonOverLimit:
+		return "over limit"
+	}
+	return "error"
+}
+
+// SetReason says how the connect went.
+func (p *ConnectAck) SetReason(code ReasonCode, reason string) {
+	OptCode.Set(p, int64(code))
+	if reason != "" {
+		OptReason.Set(p, reason)
+	}
+}
+
+// GetReason is ReasonSuccess if there's no code.
+func (p *ConnectAck) GetReason() (ReasonCode, string) {
+	reason, _ := OptReason.Get(p)
+	return getReasonCode(&p.PacketCommon), reason
+}
+
+// SetReason sets the "code" and the "error".
+func (p *Disconnect) SetReason(code ReasonCode, reason string) {
+	OptCode.Set(p, int64(code))
+	OptError.Set(p, []byte(reason))
+}
+
+// GetReason is ReasonSuccess if there's no code.
+func (p *Disconnect) GetReason() (ReasonCode, string) {
+	reason, _ := OptError.Get(p)
+	return getReasonCode(&p.PacketCommon), string(reason)
+}
+
+// SetLimitFloat is SetLimit for the token limits.
+func (p *ConnectAck) SetLimitFloat(name string, val float64) {
+	p.SetOption(name, []byte(strconv.FormatFloat(val, 'f', -1, 64)))
+}
+
+// GetLimitFloat is GetLimit for the token limits.
+func (p *ConnectAck) GetLimitFloat(name string) (float64, bool) {
+	got, ok := p.GetOption(name)
+	if !ok {
+		return 0, false
+	}
+	val, err := strconv.ParseFloat(string(got), 64)
+	if err != nil {
+		return 0, false
+	}
+	return val, true
+}
+
+func getReasonCode(p *PacketCommon) ReasonCode {
+	if !OptCode.Has(p) {
+		return ReasonSuccess
+	}
+	code, ok := OptCode.Get(p)
+	if !ok {
+		return ReasonUnspecified
+	}
+	return ReasonCode(code)
+}
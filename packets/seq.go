@@ -0,0 +1,86 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package packets
+
+import (
+	"strconv"
+)
+
+// Sequence numbers. The guru puts a "seq" option on every publish to a topic, 1, 2, 3 ...
+// A client can use a SeqTracker to see if it missed some. See iot/seq.go
+//
+// There's a "seqepoch" with it. It's when the guru started counting. A guru that forgot the
+// topic starts at 1 again with a new epoch.
+
+// GetSeq returns the "seq" option.
+func (p *Send) GetSeq() (uint64, bool) {
+	val, ok := p.GetOption("seq")
+	if !ok {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(string(val), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return seq, true
+}
+
+// GetSeqEpoch returns the "seqepoch" option. It's 0 if there isn't one.
+func (p *Send) GetSeqEpoch() uint64 {
+	val, ok := p.GetOption("seqepoch")
+	if !ok {
+		return 0
+	}
+	epoch, _ := strconv.ParseUint(string(val), 10, 64)
+	return epoch
+}
+
+// SeqTracker remembers the last seq of every topic.
+type SeqTracker struct {
+	last   map[string]uint64
+	epochs map[string]uint64
+}
+
+// Check returns how many were missed before p. old is true if p is a repeat or
+// out of order. The first one for a topic, or of a new epoch, never misses any.
+// Publishes without a seq are 0,false.
+func (t *SeqTracker) Check(p *Send) (missed uint64, old bool) {
+	seq, ok := p.GetSeq()
+	if !ok {
+		return 0, false
+	}
+	if t.last == nil {
+		t.last = make(map[string]uint64)
+		t.epochs = make(map[string]uint64)
+	}
+	address := p.Address
+	address.EnsureAddressIsBinary()
+	key := string(address.Bytes)
+	last, seen := t.last[key]
+	epoch := p.GetSeqEpoch()
+	if seen && epoch != t.epochs[key] {
+		seen = false // it started again. We can't know what we missed.
+	}
+	t.epochs[key] = epoch
+	if seen && seq <= last {
+		return 0, true
+	}
+	t.last[key] = seq
+	if !seen {
+		return 0, false
+	}
+	return seq - last - 1, false
+}
@@ -0,0 +1,87 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package packets
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"strconv"
+)
+
+// Signed publishes. The "sig" option is an ed25519 signature in base64, "sigtime"
+// is the unix seconds when it was signed and "signonce" is random so no two are the same.
+// The signature covers the hashed address, the time, the nonce and the payload.
+// The owned broadcast topics need these and don't take a nonce twice. See iot/owned.go
+
+// SignedBytes is what the signature is of.
+// The binary address then the time then a '#' then the nonce then a '#' then the payload.
+func (p *Send) SignedBytes(sigtime string, nonce string) []byte {
+	address := p.Address
+	address.EnsureAddressIsBinary()
+	buf := make([]byte, 0, len(address.Bytes)+len(sigtime)+len(nonce)+2+len(p.Payload))
+	buf = append(buf, address.Bytes...)
+	buf = append(buf, sigtime...)
+	buf = append(buf, '#')
+	buf = append(buf, nonce...)
+	buf = append(buf, '#')
+	buf = append(buf, p.Payload...)
+	return buf
+}
+
+// Sign sets the "sig", "sigtime" and "signonce" options. now is the unix seconds.
+// Don't change the address or the payload after this.
+func (p *Send) Sign(privateKey ed25519.PrivateKey, now uint32) {
+	var tmp [12]byte
+	rand.Read(tmp[:])
+	nonce := base64.RawURLEncoding.EncodeToString(tmp[:])
+	sigtime := strconv.FormatUint(uint64(now), 10)
+	sig := ed25519.Sign(privateKey, p.SignedBytes(sigtime, nonce))
+	p.SetOption("sigtime", []byte(sigtime))
+	p.SetOption("signonce", []byte(nonce))
+	p.SetOption("sig", []byte(base64.RawURLEncoding.EncodeToString(sig)))
+}
+
+// VerifySignature returns the "sigtime" and true if the "sig" is good for the public key.
+func (p *Send) VerifySignature(publicKey ed25519.PublicKey) (uint32, bool) {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return 0, false
+	}
+	sig64, ok := p.GetOption("sig")
+	if !ok {
+		return 0, false
+	}
+	sigtime, ok := p.GetOption("sigtime")
+	if !ok {
+		return 0, false
+	}
+	nonce, ok := p.GetOption("signonce")
+	if !ok {
+		return 0, false
+	}
+	when, err := strconv.ParseUint(string(sigtime), 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(string(sig64))
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return 0, false
+	}
+	if !ed25519.Verify(publicKey, p.SignedBytes(string(sigtime), string(nonce)), sig) {
+		return 0, false
+	}
+	return uint32(when), true
+}
@@ -0,0 +1,68 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package packets
+
+import "strings"
+
+// The mqtt style topic names. The server has them in iot/wildcards.go and iot/shared.go
+// and the clients need them too to know which subscription a publish is for.
+
+// IsWildcardTopic returns true if the utf8 name has a '+' or a '#' in it.
+func IsWildcardTopic(topic []byte) bool {
+	for _, b := range topic {
+		if b == '+' || b == '#' {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchTopic returns true if the topic matches the pattern. Like mqtt.
+// Topics starting with '$' don't match a pattern that starts with a wildcard.
+func MatchTopic(pattern string, topic string) bool {
+
+	if len(topic) > 0 && topic[0] == '$' {
+		if len(pattern) == 0 || pattern[0] == '+' || pattern[0] == '#' {
+			return false
+		}
+	}
+	pparts := strings.Split(pattern, "/")
+	tparts := strings.Split(topic, "/")
+	for i, p := range pparts {
+		if p == "#" {
+			return i == len(pparts)-1 // and also matches the parent level
+		}
+		if i >= len(tparts) {
+			return false
+		}
+		if p != "+" && p != tparts[i] {
+			return false
+		}
+	}
+	return len(pparts) == len(tparts)
+}
+
+// SplitSharedName returns the group and the topic of a "$share/group/topic" name.
+func SplitSharedName(name string) (string, string, bool) {
+	if !strings.HasPrefix(name, "$share/") {
+		return "", "", false
+	}
+	parts := strings.SplitN(name, "/", 3)
+	if len(parts) != 3 || parts[1] == "" || parts[2] == "" || strings.ContainsAny(parts[1], "+#*") {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
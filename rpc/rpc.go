@@ -0,0 +1,212 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package rpc is request/reply over the native packet protocol. Like iot.ServiceContactTcp but
+// public and not just for lookups. The connection is a client.Client and the calls are matched
+// to the replies by a packets.Calls, the same as in the ServiceContact.
+//
+// A call is a Send (or Lookup) with the client's reply topic in the Source and a random key in
+// both the "sessionKey" and the "CorrelationData" options. The cluster's own replies copy the
+// "sessionKey". The mqtt 5 contacts turn "CorrelationData" and the Source into the
+// CorrelationData and RespTopic properties and back again (see iot/mqtt-protocol.go) so an mqtt
+// device that answers the mqtt 5 way is a server too, and an mqtt device can call a Serve.
+//
+// The client reconnects by itself, resubscribes the reply topic and the Serve topics and
+// fails the calls that were waiting when the connection broke.
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/awootton/knotfreeiot/client"
+	"github.com/awootton/knotfreeiot/packets"
+)
+
+// Config is how to connect. Only Host and Token are required.
+type Config struct {
+	Host  string // eg. "knotfree.io:8384"
+	Token string
+
+	Timeout     time.Duration // for a call when the context doesn't have a deadline. Default 5 sec.
+	MaxInFlight int           // calls waiting for a reply at once. More will wait their turn. Default 64.
+	ReplyTopic  string        // where the replies come. Default is random.
+
+	Keepalive  time.Duration // See client.Config
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	Debug bool
+}
+
+// Handler answers a request that came to a Serve topic. The returned payload goes back to the caller.
+type Handler func(req *packets.Send) ([]byte, error)
+
+// Client makes calls and serves topics. It's safe for concurrent use.
+type Client struct {
+	*client.Client
+
+	inFlight chan bool
+}
+
+var (
+	// ErrTimeout is when there's no reply in time. The receiver is probably offline.
+	ErrTimeout = client.ErrTimeout
+	// ErrDisconnected is when the connection broke while waiting. The request may or may not have arrived.
+	ErrDisconnected = client.ErrDisconnected
+	// ErrClosed is after Close.
+	ErrClosed = client.ErrClosed
+)
+
+// Dial connects and waits for the reply topic subscription. After that it stays connected
+// until Close.
+func Dial(ctx context.Context, config Config) (*Client, error) {
+
+	if config.MaxInFlight <= 0 {
+		config.MaxInFlight = 64
+	}
+	cc, err := client.Dial(ctx, client.Config{
+		Host:       config.Host,
+		Token:      config.Token,
+		Timeout:    config.Timeout,
+		Keepalive:  config.Keepalive,
+		Backoff:    config.Backoff,
+		MaxBackoff: config.MaxBackoff,
+		ReplyTopic: config.ReplyTopic,
+		Debug:      config.Debug,
+	})
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{}
+	c.Client = cc
+	c.inFlight = make(chan bool, config.MaxInFlight)
+	return c, nil
+}
+
+// ReplyTopic is where the replies come.
+func (c *Client) ReplyTopic() string {
+	return c.Config().ReplyTopic
+}
+
+// Call sends msg, a *packets.Send or a *packets.Lookup, and waits for the reply.
+// The Source and the "sessionKey" and "CorrelationData" options of msg are overwritten.
+func (c *Client) Call(ctx context.Context, msg packets.Interface) (packets.Interface, error) {
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Config().Timeout)
+		defer cancel()
+	}
+
+	// wait for a turn
+	select {
+	case c.inFlight <- true:
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, ErrTimeout
+		}
+		return nil, ctx.Err()
+	}
+	defer func() { <-c.inFlight }()
+
+	return c.Client.Call(ctx, msg)
+}
+
+// Request sends the payload to the topic and returns the payload of the reply.
+func (c *Client) Request(ctx context.Context, topic string, payload []byte) ([]byte, error) {
+	msg := &packets.Send{}
+	msg.Address.FromString(topic)
+	msg.Payload = payload
+	reply, err := c.Call(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+	send, ok := reply.(*packets.Send)
+	if !ok {
+		return nil, fmt.Errorf("rpc got a %T for a reply", reply)
+	}
+	got, ok := send.GetOption("rpc-error")
+	if ok {
+		return send.Payload, errors.New(string(got))
+	}
+	return send.Payload, nil
+}
+
+// CallJSON is a typed Request. The request goes as json and the reply comes back as json.
+func CallJSON[Resp any](ctx context.Context, c *Client, topic string, req interface{}) (Resp, error) {
+	var resp Resp
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return resp, err
+	}
+	got, err := c.Request(ctx, topic, payload)
+	if err != nil {
+		return resp, err
+	}
+	err = json.Unmarshal(got, &resp)
+	return resp, err
+}
+
+// Serve subscribes to the topic and answers every Send that comes to it with a reply
+// to its Source. An error goes back as the "rpc-error" option. Not "error", that one disconnects the contact.
+func (c *Client) Serve(topic string, handler Handler) error {
+	return c.Subscribe(topic, func(req *packets.Send) {
+		go c.answer(req, handler)
+	})
+}
+
+// ServeJSON is a typed Serve.
+func ServeJSON[Req any, Resp any](c *Client, topic string, handler func(req Req) (Resp, error)) error {
+	return c.Serve(topic, func(p *packets.Send) ([]byte, error) {
+		var req Req
+		err := json.Unmarshal(p.Payload, &req)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := handler(req)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(resp)
+	})
+}
+
+// answer runs a handler and sends back the reply.
+func (c *Client) answer(req *packets.Send, handler Handler) {
+
+	payload, err := handler(req)
+
+	reply := &packets.Send{}
+	reply.Address = req.Source
+	reply.Source = req.Address
+	reply.Payload = payload
+	if err != nil {
+		reply.SetOption("rpc-error", []byte(err.Error()))
+	}
+	for _, key := range []string{packets.OptSessionKey.Key, packets.OptCorrelationData} {
+		got, ok := req.GetOption(key)
+		if ok {
+			reply.SetOption(key, got)
+		}
+	}
+	if len(reply.Address.Bytes) == 0 {
+		return // nowhere to send it
+	}
+	c.Send(reply)
+}
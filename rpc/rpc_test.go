@@ -0,0 +1,235 @@
+// Copyright 2019,2020,2021,2023 Alan Tracey Wootton
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rpc_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/awootton/knotfreeiot/iot"
+	"github.com/awootton/knotfreeiot/packets"
+	"github.com/awootton/knotfreeiot/rpc"
+	"github.com/awootton/knotfreeiot/tokens"
+)
+
+const starttime = uint32(1577840400) // Wednesday, January 1, 2020 1:00:00 AM
+
+type addRequest struct {
+	A, B int
+}
+
+type addReply struct {
+	Sum int
+}
+
+func TestRPC(t *testing.T) {
+
+	tokens.LoadPublicKeys()
+	getTime := func() uint32 {
+		return starttime
+	}
+	iot.MakeSimplestCluster(getTime, true, 1, "")
+	token, _ := tokens.GetImpromptuGiantTokenLocal("", "")
+	config := rpc.Config{Host: "localhost:8384", Token: token, Timeout: 2 * time.Second}
+
+	proxy := startProxy(t, config.Host)
+	config.Host = proxy.Addr().String()
+
+	ctx := context.Background()
+	server, err := rpc.Dial(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := rpc.Dial(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	release := make(chan bool)
+	server.Serve("rpc-upper", func(req *packets.Send) ([]byte, error) {
+		if string(req.Payload) == "wait" {
+			<-release
+		}
+		if len(req.Payload) == 0 {
+			return nil, errors.New("nothing to upper")
+		}
+		return []byte(strings.ToUpper(string(req.Payload))), nil
+	})
+	rpc.ServeJSON(server, "rpc-add", func(req addRequest) (addReply, error) {
+		return addReply{Sum: req.A + req.B}, nil
+	})
+	time.Sleep(100 * time.Millisecond) // for the subscribes
+
+	got, err := client.Request(ctx, "rpc-upper", []byte("hello"))
+	if err != nil || string(got) != "HELLO" {
+		t.Errorf("got %v %v, want HELLO", string(got), err)
+	}
+	_, err = client.Request(ctx, "rpc-upper", nil)
+	if err == nil || err.Error() != "nothing to upper" {
+		t.Errorf("got %v, want the handler's error", err)
+	}
+	sum, err := rpc.CallJSON[addReply](ctx, client, "rpc-add", addRequest{A: 2, B: 3})
+	if err != nil || sum.Sum != 5 {
+		t.Errorf("got %v %v, want 5", sum, err)
+	}
+
+	// nobody is there
+	short, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	_, err = client.Request(short, "rpc-nobody", []byte("hello"))
+	cancel()
+	if err != rpc.ErrTimeout {
+		t.Errorf("got %v, want timeout", err)
+	}
+
+	// cancel
+	cancelled, cancel := context.WithCancel(ctx)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	_, err = client.Request(cancelled, "rpc-nobody", []byte("hello"))
+	if err != context.Canceled {
+		t.Errorf("got %v, want canceled", err)
+	}
+
+	// one at a time
+	config.MaxInFlight = 1
+	single, err := rpc.Dial(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer single.Close()
+	first := make(chan error)
+	go func() {
+		_, err := single.Request(ctx, "rpc-upper", []byte("wait"))
+		first <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	short, cancel = context.WithTimeout(ctx, 200*time.Millisecond)
+	_, err = single.Request(short, "rpc-upper", []byte("second"))
+	cancel()
+	if err != rpc.ErrTimeout {
+		t.Errorf("got %v, want the second to time out waiting its turn", err)
+	}
+	close(release)
+	if err := <-first; err != nil {
+		t.Errorf("got %v for the first", err)
+	}
+
+	// an mqtt 5 device only knows CorrelationData
+	device := dialRaw(t, token, "rpc-mqtt-device")
+	defer device.Close()
+	go func() {
+		p, err := packets.ReadPacket(device)
+		if err != nil {
+			return
+		}
+		req := p.(*packets.Send)
+		corr, _ := req.GetOption("CorrelationData")
+		reply := &packets.Send{}
+		reply.Address = req.Source
+		reply.Payload = []byte("from the device")
+		reply.SetOption("CorrelationData", corr)
+		reply.Write(device)
+	}()
+	got, err = client.Request(ctx, "rpc-mqtt-device", []byte("hello"))
+	if err != nil || string(got) != "from the device" {
+		t.Errorf("got %v %v, want the device's reply", string(got), err)
+	}
+
+	// kill the connections. They come back and resubscribe.
+	proxy.breakAll()
+	for i := 0; i < 40; i++ {
+		got, err = client.Request(ctx, "rpc-upper", []byte("again"))
+		if err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil || string(got) != "AGAIN" {
+		t.Errorf("got %v %v after reconnect, want AGAIN", string(got), err)
+	}
+}
+
+type proxy struct {
+	net.Listener
+	mux   sync.Mutex
+	conns []net.Conn
+}
+
+// startProxy forwards to the host so we can break the connections.
+func startProxy(t *testing.T, host string) *proxy {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	px := &proxy{Listener: listener}
+	go func() {
+		for {
+			down, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			up, err := net.Dial("tcp", host)
+			if err != nil {
+				down.Close()
+				continue
+			}
+			px.mux.Lock()
+			px.conns = append(px.conns, down, up)
+			px.mux.Unlock()
+			go io.Copy(up, down)
+			go io.Copy(down, up)
+		}
+	}()
+	return px
+}
+
+func (px *proxy) breakAll() {
+	px.mux.Lock()
+	defer px.mux.Unlock()
+	for _, conn := range px.conns {
+		conn.Close()
+	}
+	px.conns = nil
+}
+
+// dialRaw is a native contact subscribed to the topic.
+func dialRaw(t *testing.T, token string, topic string) net.Conn {
+	conn, err := net.Dial("tcp", "localhost:8384")
+	if err != nil {
+		t.Fatal(err)
+	}
+	connect := &packets.Connect{}
+	connect.SetOption("token", []byte(token))
+	connect.Write(conn)
+	sub := &packets.Subscribe{}
+	sub.Address.FromString(topic)
+	sub.Write(conn)
+	_, err = packets.ReadPacket(conn) // the suback
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}